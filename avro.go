@@ -0,0 +1,399 @@
+package consumer
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Avro values produced with the Confluent serializers are prefixed with a zero magic byte and the big-endian
+// id of their schema in the Schema Registry
+const (
+	avroMagicByte    = 0
+	avroHeaderLength = 5
+)
+
+const schemaRegistryContentType = "application/vnd.schemaregistry.v1+json"
+
+var errNotAvro = errors.New("value is not in the Confluent Avro wire format")
+
+// maxAvroNullItems bounds the count of the arrays of nulls, the only items not taking any byte of the value
+const maxAvroNullItems = 1 << 16
+
+// schemaFetchError is returned when the schema of a value could not be fetched from the registry.
+// Unlike the malformed values, the value can be decoded once the registry is reachable again.
+type schemaFetchError struct {
+	id  int
+	err error
+}
+
+func (e *schemaFetchError) Error() string {
+	return fmt.Sprintf("error fetching schema %d: %v", e.id, e.err)
+}
+
+func (e *schemaFetchError) Unwrap() error {
+	return e.err
+}
+
+// schemaRegistry fetches the Avro schemas of the consumed values from a Confluent Schema Registry, caching them by id
+type schemaRegistry struct {
+	url    string
+	caller httpCaller
+	mu     sync.Mutex
+	cache  map[int]*avroType
+}
+
+func newSchemaRegistry(url string, client *http.Client, userAgent string) *schemaRegistry {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	if userAgent == "" {
+		userAgent = defaultUserAgent()
+	}
+	return &schemaRegistry{
+		url:    strings.TrimRight(url, "/"),
+		caller: httpClient{client: client, userAgent: userAgent},
+		cache:  make(map[int]*avroType),
+	}
+}
+
+// schema returns the schema with the given id, fetched from the registry the first time it is seen
+func (r *schemaRegistry) schema(id int) (*avroType, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if t, ok := r.cache[id]; ok {
+		return t, nil
+	}
+
+	data, err := r.caller.DoReq("GET", r.url+"/schemas/ids/"+strconv.Itoa(id), nil, map[string]string{"Accept": schemaRegistryContentType}, http.StatusOK)
+	if err != nil {
+		return nil, &schemaFetchError{id, err}
+	}
+	var resp struct {
+		Schema string `json:"schema"`
+	}
+	if err := json.Unmarshal(data, &resp); err != nil {
+		return nil, fmt.Errorf("error decoding schema %d: %w", id, err)
+	}
+	t, err := parseAvroSchema(resp.Schema)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing schema %d: %w", id, err)
+	}
+	r.cache[id] = t
+	return t, nil
+}
+
+// decode returns the JSON of the Avro record held by a Confluent wire format value
+func (r *schemaRegistry) decode(value []byte) ([]byte, error) {
+	if len(value) < avroHeaderLength || value[0] != avroMagicByte {
+		return nil, errNotAvro
+	}
+	t, err := r.schema(int(binary.BigEndian.Uint32(value[1:avroHeaderLength])))
+	if err != nil {
+		return nil, err
+	}
+
+	d := &avroDecoder{data: value[avroHeaderLength:]}
+	v, err := d.decode(t)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding Avro value: %w", err)
+	}
+	return json.Marshal(v)
+}
+
+// avroType is a node of a parsed Avro schema
+type avroType struct {
+	kind     string //primitive type name, or record, enum, array, map, union or fixed
+	name     string //full name of the named types
+	fields   []avroField
+	symbols  []string
+	items    *avroType //of arrays, and values of maps
+	branches []*avroType
+	size     int
+}
+
+type avroField struct {
+	name string
+	t    *avroType
+}
+
+var avroPrimitives = map[string]bool{
+	"null": true, "boolean": true, "int": true, "long": true, "float": true, "double": true, "bytes": true, "string": true,
+}
+
+// parseAvroSchema parses the JSON of an Avro schema
+func parseAvroSchema(schema string) (*avroType, error) {
+	var raw interface{}
+	if err := json.Unmarshal([]byte(schema), &raw); err != nil {
+		return nil, err
+	}
+	p := avroSchemaParser{named: make(map[string]*avroType)}
+	return p.parse(raw, "")
+}
+
+type avroSchemaParser struct {
+	//named types by full and short name, for the later references to them
+	named map[string]*avroType
+}
+
+func (p avroSchemaParser) parse(raw interface{}, namespace string) (*avroType, error) {
+	switch s := raw.(type) {
+	case string:
+		if avroPrimitives[s] {
+			return &avroType{kind: s}, nil
+		}
+		if t, ok := p.named[s]; ok {
+			return t, nil
+		}
+		if t, ok := p.named[fullName(s, namespace)]; ok {
+			return t, nil
+		}
+		return nil, fmt.Errorf("unknown type %q", s)
+	case []interface{}:
+		union := &avroType{kind: "union"}
+		for _, b := range s {
+			t, err := p.parse(b, namespace)
+			if err != nil {
+				return nil, err
+			}
+			union.branches = append(union.branches, t)
+		}
+		return union, nil
+	case map[string]interface{}:
+		return p.parseComplex(s, namespace)
+	}
+	return nil, fmt.Errorf("invalid schema %v", raw)
+}
+
+func (p avroSchemaParser) parseComplex(s map[string]interface{}, namespace string) (*avroType, error) {
+	kind, _ := s["type"].(string)
+	switch kind {
+	case "record", "error", "enum", "fixed":
+		name, _ := s["name"].(string)
+		if name == "" {
+			return nil, fmt.Errorf("%s without a name", kind)
+		}
+		if ns, ok := s["namespace"].(string); ok && !strings.Contains(name, ".") {
+			namespace = ns
+		}
+		t := &avroType{kind: kind, name: fullName(name, namespace)}
+		if kind == "error" {
+			t.kind = "record"
+		}
+		if i := strings.LastIndex(t.name, "."); i != -1 {
+			namespace = t.name[:i]
+		}
+		//registered before the fields are parsed for the recursive records
+		p.named[t.name] = t
+		p.named[t.name[strings.LastIndex(t.name, ".")+1:]] = t
+		return t, p.parseNamed(t, s, namespace)
+	case "array":
+		items, err := p.parse(s["items"], namespace)
+		return &avroType{kind: kind, items: items}, err
+	case "map":
+		values, err := p.parse(s["values"], namespace)
+		return &avroType{kind: kind, items: values}, err
+	}
+	//a primitive type or reference, possibly with attributes such as logicalType
+	return p.parse(s["type"], namespace)
+}
+
+func (p avroSchemaParser) parseNamed(t *avroType, s map[string]interface{}, namespace string) error {
+	switch t.kind {
+	case "record":
+		fields, _ := s["fields"].([]interface{})
+		for _, f := range fields {
+			field, _ := f.(map[string]interface{})
+			name, _ := field["name"].(string)
+			ft, err := p.parse(field["type"], namespace)
+			if err != nil {
+				return fmt.Errorf("field %s of %s: %w", name, t.name, err)
+			}
+			t.fields = append(t.fields, avroField{name, ft})
+		}
+	case "enum":
+		symbols, _ := s["symbols"].([]interface{})
+		for _, sym := range symbols {
+			name, _ := sym.(string)
+			t.symbols = append(t.symbols, name)
+		}
+	case "fixed":
+		size, _ := s["size"].(float64)
+		t.size = int(size)
+	}
+	return nil
+}
+
+func fullName(name, namespace string) string {
+	if namespace == "" || strings.Contains(name, ".") {
+		return name
+	}
+	return namespace + "." + name
+}
+
+// avroDecoder reads values in the Avro binary encoding.
+// Records are decoded into maps, bytes and fixed into byte slices, and unions into the value of their branch.
+type avroDecoder struct {
+	data []byte
+	pos  int
+}
+
+var errAvroTruncated = errors.New("truncated value")
+
+var avroString = &avroType{kind: "string"}
+
+func (d *avroDecoder) decode(t *avroType) (interface{}, error) {
+	switch t.kind {
+	case "null":
+		return nil, nil
+	case "boolean":
+		b, err := d.read(1)
+		if err != nil {
+			return nil, err
+		}
+		return b[0] != 0, nil
+	case "int", "long":
+		return d.long()
+	case "float":
+		b, err := d.read(4)
+		if err != nil {
+			return nil, err
+		}
+		return math.Float32frombits(binary.LittleEndian.Uint32(b)), nil
+	case "double":
+		b, err := d.read(8)
+		if err != nil {
+			return nil, err
+		}
+		return math.Float64frombits(binary.LittleEndian.Uint64(b)), nil
+	case "bytes", "string":
+		n, err := d.long()
+		if err != nil {
+			return nil, err
+		}
+		//checked before the conversion for a corrupt length not to wrap around on 32-bit platforms
+		if n < 0 || n > int64(len(d.data)-d.pos) {
+			return nil, errAvroTruncated
+		}
+		b, err := d.read(int(n))
+		if err != nil {
+			return nil, err
+		}
+		if t.kind == "string" {
+			return string(b), nil
+		}
+		return append([]byte(nil), b...), nil
+	case "fixed":
+		b, err := d.read(t.size)
+		return append([]byte(nil), b...), err
+	case "enum":
+		i, err := d.long()
+		if err != nil {
+			return nil, err
+		}
+		if i < 0 || int(i) >= len(t.symbols) {
+			return nil, fmt.Errorf("enum index %d out of range for %s", i, t.name)
+		}
+		return t.symbols[i], nil
+	case "union":
+		i, err := d.long()
+		if err != nil {
+			return nil, err
+		}
+		if i < 0 || int(i) >= len(t.branches) {
+			return nil, fmt.Errorf("union index %d out of range", i)
+		}
+		return d.decode(t.branches[i])
+	case "record":
+		record := make(map[string]interface{}, len(t.fields))
+		for _, f := range t.fields {
+			v, err := d.decode(f.t)
+			if err != nil {
+				return nil, err
+			}
+			record[f.name] = v
+		}
+		return record, nil
+	case "array":
+		items := []interface{}{}
+		err := d.blocks(t.items, func() error {
+			v, err := d.decode(t.items)
+			items = append(items, v)
+			return err
+		})
+		return items, err
+	case "map":
+		values := make(map[string]interface{})
+		err := d.blocks(avroString, func() error {
+			k, err := d.decode(avroString)
+			if err != nil {
+				return err
+			}
+			v, err := d.decode(t.items)
+			values[k.(string)] = v
+			return err
+		})
+		return values, err
+	}
+	return nil, fmt.Errorf("unsupported type %q", t.kind)
+}
+
+// blocks reads the blocks of an array or map, calling item for each of their items.
+// The counts are checked against the bytes left, as each item but a null takes at least one, for a corrupt count to fail
+// rather than have the items appended until memory runs out.
+func (d *avroDecoder) blocks(t *avroType, item func() error) error {
+	for {
+		n, err := d.long()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return nil
+		}
+		if n < 0 {
+			//a negative count is followed by the size of the block in bytes
+			n = -n
+			if _, err := d.long(); err != nil {
+				return err
+			}
+		}
+		maxItems := int64(len(d.data) - d.pos)
+		if t.kind == "null" {
+			maxItems = maxAvroNullItems
+		}
+		if n < 0 || n > maxItems {
+			return fmt.Errorf("block count %d out of range", n)
+		}
+		for ; n > 0; n-- {
+			if err := item(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// long reads a zigzag encoded variable-length integer
+func (d *avroDecoder) long() (int64, error) {
+	v, n := binary.Uvarint(d.data[d.pos:])
+	if n <= 0 {
+		return 0, errAvroTruncated
+	}
+	d.pos += n
+	return int64(v>>1) ^ -int64(v&1), nil
+}
+
+// read returns the next n bytes, comparing n with the bytes left for a huge n not to overflow the bound
+func (d *avroDecoder) read(n int) ([]byte, error) {
+	if n < 0 || n > len(d.data)-d.pos {
+		return nil, errAvroTruncated
+	}
+	b := d.data[d.pos : d.pos+n]
+	d.pos += n
+	return b, nil
+}
@@ -0,0 +1,285 @@
+package consumer
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	log "github.com/Financial-Times/go-logger/v2"
+	"github.com/sirupsen/logrus"
+	logTest "github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+)
+
+const testAvroSchema = `{
+	"type": "record", "name": "Article", "namespace": "com.ft.content",
+	"fields": [
+		{"name": "uuid", "type": "string"},
+		{"name": "revision", "type": "int"},
+		{"name": "score", "type": "double"},
+		{"name": "published", "type": "boolean"},
+		{"name": "tags", "type": {"type": "array", "items": "string"}},
+		{"name": "counts", "type": {"type": "map", "values": "long"}},
+		{"name": "status", "type": {"type": "enum", "name": "Status", "symbols": ["DRAFT", "PUBLISHED"]}},
+		{"name": "byline", "type": ["null", "string"]},
+		{"name": "author", "type": {"type": "record", "name": "Author", "fields": [{"name": "name", "type": "string"}]}},
+		{"name": "editor", "type": ["null", "Author"]},
+		{"name": "timestamp", "type": {"type": "long", "logicalType": "timestamp-millis"}}
+	]
+}`
+
+// avroEncoder writes the Avro binary encoding of the test values
+type avroEncoder struct {
+	data []byte
+}
+
+func (e *avroEncoder) long(v int64) *avroEncoder {
+	buf := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutUvarint(buf, uint64((v<<1)^(v>>63)))
+	e.data = append(e.data, buf[:n]...)
+	return e
+}
+
+func (e *avroEncoder) string(s string) *avroEncoder {
+	e.long(int64(len(s)))
+	e.data = append(e.data, s...)
+	return e
+}
+
+func (e *avroEncoder) double(f float64) *avroEncoder {
+	buf := make([]byte, 8)
+	binary.LittleEndian.PutUint64(buf, math.Float64bits(f))
+	e.data = append(e.data, buf...)
+	return e
+}
+
+func (e *avroEncoder) boolean(b bool) *avroEncoder {
+	if b {
+		e.data = append(e.data, 1)
+	} else {
+		e.data = append(e.data, 0)
+	}
+	return e
+}
+
+// wireFormat prefixes the encoded value with the magic byte and the schema id
+func (e *avroEncoder) wireFormat(schemaID uint32) []byte {
+	header := make([]byte, avroHeaderLength)
+	binary.BigEndian.PutUint32(header[1:], schemaID)
+	return append(header, e.data...)
+}
+
+func testAvroArticle() []byte {
+	e := &avroEncoder{}
+	e.string("e7a3b814-59ee-459e-8f60-517f3e80ed99").long(3).double(0.5).boolean(true)
+	//tags, in a block with its size
+	e.long(-2).long(10).string("brexit").string("uk").long(0)
+	e.long(1).string("views").long(1200).long(0)
+	e.long(1)
+	e.long(1).string("Jane Doe")
+	e.string("John Doe")
+	e.long(0)
+	e.long(1602676800000)
+	return e.wireFormat(7)
+}
+
+const testAvroArticleJSON = `{
+	"uuid": "e7a3b814-59ee-459e-8f60-517f3e80ed99",
+	"revision": 3,
+	"score": 0.5,
+	"published": true,
+	"tags": ["brexit", "uk"],
+	"counts": {"views": 1200},
+	"status": "PUBLISHED",
+	"byline": "Jane Doe",
+	"author": {"name": "John Doe"},
+	"editor": null,
+	"timestamp": 1602676800000
+}`
+
+func setupSchemaRegistry(t *testing.T, fetches *int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(fetches, 1)
+		if req.URL.Path != "/schemas/ids/7" {
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"error_code":40403,"message":"Schema not found"}`))
+			return
+		}
+		assert.Equal(t, schemaRegistryContentType, req.Header.Get("Accept"))
+		resp, _ := json.Marshal(map[string]string{"schema": testAvroSchema})
+		_, _ = w.Write(resp)
+	}))
+}
+
+func TestSchemaRegistryDecode(t *testing.T) {
+	var fetches int32
+	registry := setupSchemaRegistry(t, &fetches)
+	defer registry.Close()
+
+	r := newSchemaRegistry(registry.URL+"/", &http.Client{}, "")
+	for i := 0; i < 2; i++ {
+		body, err := r.decode(testAvroArticle())
+		assert.NoError(t, err)
+		assert.JSONEq(t, testAvroArticleJSON, string(body))
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&fetches), "the schema should be fetched once")
+
+	_, err := r.decode([]byte("FTMSG/1.0\n\nbody"))
+	assert.Equal(t, errNotAvro, err)
+
+	_, err = r.decode((&avroEncoder{}).string("x").wireFormat(8))
+	assert.Error(t, err, "an unknown schema should fail")
+
+	truncated := testAvroArticle()
+	_, err = r.decode(truncated[:len(truncated)-3])
+	assert.Error(t, err)
+}
+
+func TestAvroDecoderRejectsCorruptBlockCounts(t *testing.T) {
+	for _, schema := range []string{
+		`{"type": "array", "items": "string"}`,
+		`{"type": "array", "items": "null"}`,
+		`{"type": "map", "values": "long"}`,
+	} {
+		s, err := parseAvroSchema(schema)
+		assert.NoError(t, err)
+		for _, count := range []int64{math.MaxInt64 / 2, -math.MaxInt64 / 2} {
+			d := &avroDecoder{data: (&avroEncoder{}).long(count).long(4).string("x").data}
+			_, err = d.decode(s)
+			assert.Error(t, err, "%s with a block count of %d", schema, count)
+		}
+	}
+
+	s, _ := parseAvroSchema(`{"type": "array", "items": "null"}`)
+	d := &avroDecoder{data: (&avroEncoder{}).long(3).long(0).data}
+	items, err := d.decode(s)
+	assert.NoError(t, err)
+	assert.Equal(t, []interface{}{nil, nil, nil}, items, "nulls take no byte of the value")
+}
+
+func TestAvroDecoderRejectsCorruptLengths(t *testing.T) {
+	s, err := parseAvroSchema(`{"type": "record", "name": "r", "fields": [{"name": "n", "type": "int"}, {"name": "s", "type": "string"}]}`)
+	assert.NoError(t, err)
+	for _, length := range []int64{math.MaxInt64, math.MaxInt64 - 5, -1} {
+		d := &avroDecoder{data: (&avroEncoder{}).long(1).long(length).string("x").data}
+		_, err = d.decode(s)
+		assert.Equal(t, errAvroTruncated, err, "a string length of %d", length)
+	}
+}
+
+func TestSchemaFetchErrorIsNotMalformed(t *testing.T) {
+	registry := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer registry.Close()
+
+	_, err := newSchemaRegistry(registry.URL, &http.Client{}, "").decode(testAvroArticle())
+	var ferr *schemaFetchError
+	assert.True(t, errors.As(err, &ferr), "%v", err)
+	assert.Equal(t, 7, ferr.id)
+}
+
+func TestSchemaRegistryUserAgent(t *testing.T) {
+	var userAgent string
+	registry := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		userAgent = req.Header.Get("User-Agent")
+		_, _ = w.Write([]byte(`{"schema": "\"string\""}`))
+	}))
+	defer registry.Close()
+
+	r := newSchemaRegistry(registry.URL, &http.Client{}, "annotations-writer/1.2.0")
+	_, err := r.decode((&avroEncoder{}).string("x").wireFormat(1))
+	assert.NoError(t, err)
+	assert.Equal(t, "annotations-writer/1.2.0", userAgent)
+}
+
+func TestParseAvroSchemaErrors(t *testing.T) {
+	for _, schema := range []string{
+		`"uuid"`,
+		`{"type": "record", "fields": []}`,
+		`{"type": "record", "name": "A", "fields": [{"name": "b", "type": "B"}]}`,
+		`not json`,
+	} {
+		_, err := parseAvroSchema(schema)
+		assert.Error(t, err, schema)
+	}
+
+	recursive, err := parseAvroSchema(`{"type": "record", "name": "Node", "fields": [{"name": "next", "type": ["null", "Node"]}]}`)
+	assert.NoError(t, err)
+	assert.Equal(t, recursive, recursive.fields[0].t.branches[1], "a record should be able to refer to itself")
+}
+
+func TestConsumeFailsWithoutCommitWhenSchemaCannotBeFetched(t *testing.T) {
+	var fetches int32
+	up := setupSchemaRegistry(t, &fetches)
+	defer up.Close()
+	var unavailable int32 = 1
+	registry := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if atomic.LoadInt32(&unavailable) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		http.Redirect(w, req, up.URL+req.URL.Path, http.StatusTemporaryRedirect)
+	}))
+	defer registry.Close()
+
+	var bodies []string
+	c := newConsumerInstance(QueueConfig{AvroSchemaRegistryURL: registry.URL, DedupWindow: 10}, func(m Message) {
+		bodies = append(bodies, m.Body)
+	}, &http.Client{}, log.NewUPPLogger("Test", "FATAL"))
+	queue := &partitionCommitQueueCaller{batchQueueCaller: batchQueueCaller{data: []byte(fmt.Sprintf(`[{"value":"%s","partition":0,"offset":1}]`,
+		base64.StdEncoding.EncodeToString(testAvroArticle())))}}
+	c.queue = queue
+
+	_, err := c.consume()
+	var ferr *schemaFetchError
+	assert.True(t, errors.As(err, &ferr), "%v", err)
+	assert.Empty(t, bodies)
+	assert.Equal(t, 0, queue.fullCommits, "the batch should not be committed")
+	assert.Nil(t, c.consumer, "the consumer instance should be torn down for the batch to be redelivered")
+
+	atomic.StoreInt32(&unavailable, 0)
+	msgs, err := c.consume()
+	assert.NoError(t, err)
+	assert.Len(t, msgs, 1, "the redelivered message should not be skipped as a duplicate")
+	assert.Len(t, bodies, 1)
+	assert.Equal(t, 1, queue.fullCommits)
+}
+
+func TestConsumeDecodesAvroValues(t *testing.T) {
+	var fetches int32
+	registry := setupSchemaRegistry(t, &fetches)
+	defer registry.Close()
+
+	logger := log.NewUPPLogger("Test", "ERROR")
+	logger.Out = ioutil.Discard
+	hook := logTest.NewLocal(logger.Logger)
+
+	var bodies []string
+	c := newConsumerInstance(QueueConfig{AvroSchemaRegistryURL: registry.URL, AutoCommitEnable: true}, func(m Message) {
+		assert.Nil(t, m.Headers)
+		bodies = append(bodies, m.Body)
+	}, &http.Client{}, logger)
+	c.consumer = consInstTest
+	c.queue = batchQueueCaller{data: []byte(fmt.Sprintf(`[{"value":"%s","partition":0,"offset":1},{"value":"%s","partition":0,"offset":2}]`,
+		base64.StdEncoding.EncodeToString(testAvroArticle()), base64.StdEncoding.EncodeToString([]byte("FTMSG/1.0\n\nbody"))))}
+
+	msgs, err := c.consume()
+	assert.NoError(t, err)
+	assert.Len(t, msgs, 1, "the value not in the Avro wire format should be skipped")
+	assert.Len(t, bodies, 1)
+	assert.JSONEq(t, testAvroArticleJSON, bodies[0])
+
+	entries := hook.AllEntries()
+	assert.Len(t, entries, 1)
+	assert.Equal(t, logrus.ErrorLevel, entries[0].Level)
+	assert.Equal(t, 2, entries[0].Data["offset"])
+}
@@ -0,0 +1,101 @@
+package consumer
+
+import (
+	"errors"
+	"time"
+)
+
+const defaultCircuitBreakerCooldown = time.Minute
+
+// ErrCircuitOpen is returned for the polls skipped while the circuit breaker is open
+var ErrCircuitOpen = errors.New("circuit breaker open, proxy calls skipped")
+
+// CircuitBreakerState is the state of the circuit breaker of a stream, see QueueConfig.CircuitBreakerThreshold
+type CircuitBreakerState int
+
+const (
+	// CircuitClosed is the normal state, the proxy is polled
+	CircuitClosed CircuitBreakerState = iota
+	// CircuitOpen skips the proxy calls until the cooldown has elapsed
+	CircuitOpen
+	// CircuitHalfOpen lets a single poll through to test whether the proxy has recovered
+	CircuitHalfOpen
+)
+
+func (s CircuitBreakerState) String() string {
+	switch s {
+	case CircuitClosed:
+		return "closed"
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half-open"
+	}
+	return "unknown"
+}
+
+// circuitBreaker opens after threshold consecutive failed polls, skipping the polls for cooldown,
+// then half-opens to let a poll through. The circuit closes again if it succeeds and reopens otherwise.
+type circuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+	onChange  func(state CircuitBreakerState)
+	state     CircuitBreakerState
+	failures  int
+	openedAt  time.Time
+}
+
+// newCircuitBreaker returns the breaker configured by CircuitBreakerThreshold, nil when it is disabled
+func newCircuitBreaker(config QueueConfig) *circuitBreaker {
+	if config.CircuitBreakerThreshold <= 0 {
+		return nil
+	}
+	cooldown := defaultCircuitBreakerCooldown
+	if config.CircuitBreakerCooldown > 0 {
+		cooldown = config.CircuitBreakerCooldown
+	}
+	return &circuitBreaker{
+		threshold: config.CircuitBreakerThreshold,
+		cooldown:  cooldown,
+		onChange:  config.OnCircuitBreakerStateChange,
+	}
+}
+
+// allow reports whether a poll can go through, half-opening the circuit once the cooldown has elapsed.
+// The remaining cooldown is returned when it cannot.
+func (b *circuitBreaker) allow(now time.Time) (bool, time.Duration) {
+	if b.state != CircuitOpen {
+		return true, 0
+	}
+	if remaining := b.openedAt.Add(b.cooldown).Sub(now); remaining > 0 {
+		return false, remaining
+	}
+	b.setState(CircuitHalfOpen)
+	return true, 0
+}
+
+func (b *circuitBreaker) success() {
+	b.failures = 0
+	b.setState(CircuitClosed)
+}
+
+// failure records a failed poll and reports whether it opened the circuit
+func (b *circuitBreaker) failure(now time.Time) bool {
+	b.failures++
+	if b.state != CircuitHalfOpen && b.failures < b.threshold {
+		return false
+	}
+	b.openedAt = now
+	b.setState(CircuitOpen)
+	return true
+}
+
+func (b *circuitBreaker) setState(state CircuitBreakerState) {
+	if b.state == state {
+		return
+	}
+	b.state = state
+	if b.onChange != nil {
+		b.onChange(state)
+	}
+}
@@ -0,0 +1,25 @@
+package consumer
+
+import "time"
+
+// clock abstracts the time functions used for backoffs, retries and timers so that tests can control them
+type clock interface {
+	Now() time.Time
+	Sleep(d time.Duration)
+	After(d time.Duration) <-chan time.Time
+}
+
+// realClock is the clock backed by the time package
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) Sleep(d time.Duration)                  { time.Sleep(d) }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// clockOrDefault returns c, or the real clock when none was set
+func clockOrDefault(c clock) clock {
+	if c == nil {
+		return realClock{}
+	}
+	return c
+}
@@ -1,9 +1,12 @@
 package consumer
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"net/http"
 	"sync"
+	"time"
 
 	log "github.com/Financial-Times/go-logger/v2"
 )
@@ -24,55 +27,128 @@ type MessageConsumer interface {
 	ConnectivityCheck() (string, error)
 }
 
-// NewConsumer returns a new instance of a Consumer
-func NewConsumer(config QueueConfig, handler func(m Message), client *http.Client, logger *log.UPPLogger) MessageConsumer {
-	streamCount := 1
-	if config.StreamCount > 0 {
-		streamCount = config.StreamCount
-	}
-	instanceHandlers := make([]instanceHandler, streamCount)
-	for i := 0; i < streamCount; i++ {
-		instanceHandlers[i] = newConsumerInstance(config, handler, client, logger)
-	}
+var (
+	_ MessageConsumer = (*Consumer)(nil)
+	_ MessageConsumer = (*inMemoryConsumer)(nil)
+)
 
-	return &Consumer{streamCount, instanceHandlers}
+// NewConsumer returns a new instance of a Consumer.
+// The options, see NewConsumerWithOptions, are accepted by every constructor, WithHTTPClient and WithLogger taking precedence over client and logger.
+func NewConsumer(config QueueConfig, handler func(m Message), client *http.Client, logger *log.UPPLogger, opts ...Option) MessageConsumer {
+	return newConsumer(config, func() messageProcessor {
+		return splitMessageProcessor{handler}
+	}, client, logger, opts)
 }
 
 // NewBatchedConsumer returns a Consumer to manage batches of messages
-func NewBatchedConsumer(config QueueConfig, handler func(m []Message), client *http.Client, logger *log.UPPLogger) MessageConsumer {
-	streamCount := 1
-	if config.StreamCount > 0 {
-		streamCount = config.StreamCount
-	}
+func NewBatchedConsumer(config QueueConfig, handler func(m []Message), client *http.Client, logger *log.UPPLogger, opts ...Option) MessageConsumer {
+	return newConsumer(config, func() messageProcessor {
+		return batchedMessageProcessor{handler}
+	}, client, logger, opts)
+}
 
-	instanceHandlers := make([]instanceHandler, streamCount)
-	for i := 0; i < streamCount; i++ {
-		instanceHandlers[i] = newBatchedConsumerInstance(config, handler, client, logger)
-	}
+// NewStreamingConsumer returns a Consumer handing messages to the handler with their body exposed as an io.Reader
+func NewStreamingConsumer(config QueueConfig, handler func(m StreamMessage), client *http.Client, logger *log.UPPLogger, opts ...Option) MessageConsumer {
+	return newConsumer(config, func() messageProcessor {
+		return streamingMessageProcessor{handler, config.RawBody}
+	}, client, logger, opts)
+}
 
-	return &Consumer{streamCount, instanceHandlers}
+// NewErrorAwareConsumer returns a Consumer whose handler reports the messages it failed to process.
+// Failures are logged and, with QueueConfig.CommitProcessedOffsets, left uncommitted to be redelivered.
+func NewErrorAwareConsumer(config QueueConfig, handler func(m Message) error, client *http.Client, logger *log.UPPLogger, opts ...Option) MessageConsumer {
+	return NewContextConsumer(config, func(_ context.Context, m Message) error { return handler(m) }, client, logger, opts...)
+}
+
+// NewBatchedErrorAwareConsumer returns a Consumer handing batches of messages to a handler that reports how far
+// it processed them: the first commitUpTo messages of the batch are processed, the others are treated as
+// failures of the NewErrorAwareConsumer, with err as their error. A commitUpTo of len(msgs) or more processes
+// the whole batch, err being ignored then, and 0 or less none of it.
+// The batch is committed up to the first unprocessed message of each partition and the rest is redelivered,
+// QueueConfig.CommitProcessedOffsets being set whatever its value. It requires the v2 API and AutoCommitEnable to be false.
+func NewBatchedErrorAwareConsumer(config QueueConfig, handler func(msgs []Message) (commitUpTo int, err error), client *http.Client, logger *log.UPPLogger, opts ...Option) MessageConsumer {
+	return newConsumer(config, func() messageProcessor {
+		return batchedErrorAwareMessageProcessor{handler, &failedMessages{}}
+	}, client, logger, opts)
+}
+
+// NewContextConsumer returns an error aware Consumer, see NewErrorAwareConsumer, whose handler is given a context.
+// The context is cancelled when the consumer is stopped, or when the context given to RunN or WaitForMessages is done,
+// so that long running handlers can give up and report the cancellation as their error.
+func NewContextConsumer(config QueueConfig, handler func(ctx context.Context, m Message) error, client *http.Client, logger *log.UPPLogger, opts ...Option) MessageConsumer {
+	return newConsumer(config, func() messageProcessor {
+		return errorAwareMessageProcessor{handler, &failedMessages{}}
+	}, client, logger, opts)
 }
 
 // NewAgeingConsumer returns a new instance of a Consumer with an AgeingClient
-func NewAgeingConsumer(config QueueConfig, handler func(m Message), client *AgeingClient) MessageConsumer {
+func NewAgeingConsumer(config QueueConfig, handler func(m Message), client *AgeingClient, opts ...Option) MessageConsumer {
+	c := NewConsumer(config, handler, client.HTTPClient, client.Logger, opts...)
+	client.StartAgeingProcess()
+	return c
+}
+
+// newConsumer returns a Consumer of StreamCount streams, each handing the messages to its own processor from newProcessor.
+// The streams share the default client and logger when none is given.
+func newConsumer(config QueueConfig, newProcessor func() messageProcessor, client *http.Client, logger *log.UPPLogger, opts []Option) *Consumer {
+	o := options{client: client, logger: logger}
+	for _, opt := range opts {
+		opt(&o)
+	}
 	streamCount := 1
 	if config.StreamCount > 0 {
 		streamCount = config.StreamCount
 	}
+	if o.client == nil {
+		o.client = newHTTPClient(config, streamCount)
+	}
+	if o.logger == nil {
+		o.logger = discardLogger()
+	}
+
 	instanceHandlers := make([]instanceHandler, streamCount)
 	for i := 0; i < streamCount; i++ {
-		instanceHandlers[i] = newConsumerInstance(config, handler, client.HTTPClient, client.Logger)
+		instance := newInstance(streamConfig(config, streamCount, i), newProcessor(), o.client, o.logger)
+		instance.onError = o.errorHandler
+		instance.metrics = o.metrics
+		instance.backoff = o.backoff
+		instanceHandlers[i] = instance
 	}
-	client.StartAgeingProcess()
-
 	return &Consumer{streamCount, instanceHandlers}
 }
 
+// streamConfig returns the config of the i-th stream.
+// Instance names and group instance ids have to be unique within the group,
+// so the stream number is appended to InstanceName and GroupInstanceID when there are several streams.
+func streamConfig(config QueueConfig, streamCount, i int) QueueConfig {
+	if config.InstanceName != "" && streamCount > 1 {
+		config.InstanceName = fmt.Sprintf("%s-%d", config.InstanceName, i+1)
+	}
+	if config.GroupInstanceID != "" && streamCount > 1 {
+		config.GroupInstanceID = fmt.Sprintf("%s-%d", config.GroupInstanceID, i+1)
+	}
+	return config
+}
+
 type instanceHandler interface {
 	consumeWhileActive()
+	consumeN(ctx context.Context, maxPolls int) error
+	waitForMessages(ctx context.Context) ([]Message, error)
+	commitOffsets(offsets map[int]int64) error
+	pause()
+	resume()
+	totalBytesConsumed() int64
+	poll() ([]Message, error)
+	pollDriven() ([]Message, error)
+	close() error
+	closeDriven() error
+	requestReconnect() error
 	initiateShutdown()
-	shutdown()
+	stop(ctx context.Context) error
+	shutdown() error
 	checkConnectivity() error
+	lastPollHadMessages() bool
+	assign(partitions []int) error
 }
 
 // Consumer provides methods to consume messages from a kafka proxy
@@ -81,8 +157,12 @@ type Consumer struct {
 	instanceHandlers []instanceHandler
 }
 
+// ErrAlreadyRunning is returned by RunN, WaitForMessages, Poll and Close when the streams are already polled by Start or another call
+var ErrAlreadyRunning = errors.New("consumer already running")
+
 //Start is a method that triggers the consumption of messages from the queue
 //Start is a blocking methode, it will return only when Stop() is called. If you don't want to block start it in a different goroutine.
+// A stream is only polled by one loop at a time, so calling Start while the consumer is running returns right away.
 func (c *Consumer) Start() {
 	var wg sync.WaitGroup
 	wg.Add(c.streamCount)
@@ -95,13 +175,264 @@ func (c *Consumer) Start() {
 	wg.Wait()
 }
 
+// RunN polls the queue at most maxPolls times per stream, or until ctx is done, and returns once
+// every consumer instance has been torn down. Offsets are committed after each poll as in Start.
+// It returns ctx.Err() if the context expired before the polls were completed.
+func (c *Consumer) RunN(ctx context.Context, maxPolls int) error {
+	errs := make(chan error, len(c.instanceHandlers))
+	for _, ih := range c.instanceHandlers {
+		go func(ih instanceHandler) {
+			errs <- ih.consumeN(ctx, maxPolls)
+		}(ih)
+	}
+
+	var err error
+	for range c.instanceHandlers {
+		if e := <-errs; e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// WaitForMessages polls the queue until messages are available on one of the streams, or until ctx is done,
+// and returns once every consumer instance has been torn down. The messages are handed to the handler and
+// committed as in Start before being returned, e.g. for a request/response bridge to pick up the reply.
+// An empty slice is returned along with ctx.Err() if ctx is done before any message arrived.
+func (c *Consumer) WaitForMessages(ctx context.Context) ([]Message, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		msgs []Message
+		err  error
+	}
+	results := make(chan result, len(c.instanceHandlers))
+	for _, ih := range c.instanceHandlers {
+		go func(ih instanceHandler) {
+			msgs, err := ih.waitForMessages(ctx)
+			results <- result{msgs, err}
+		}(ih)
+	}
+
+	msgs := []Message{}
+	var err error
+	for range c.instanceHandlers {
+		r := <-results
+		if len(r.msgs) > 0 {
+			//the other streams don't need to wait any longer
+			cancel()
+			msgs = append(msgs, r.msgs...)
+		} else if r.err != nil && err == nil {
+			err = r.err
+		}
+	}
+	if len(msgs) > 0 {
+		return msgs, nil
+	}
+	return msgs, err
+}
+
+// ErrNoMessages is returned by the polls that succeeded without consuming any message.
+// The poll loop backs off after them as after the failed polls, though they are not reported as errors.
+var ErrNoMessages = errors.New("no messages consumed")
+
+// Poll runs a single poll of every stream, for integrations driving the polling themselves, e.g. from a scheduler.
+// Each stream creates and subscribes its consumer instance if needed, then consumes a batch, hands it to the
+// handler and commits it. The messages of every stream are returned, along with the error of the first failed
+// stream if any. ErrNoMessages is returned when every stream succeeded without consuming anything.
+// Poll cannot be mixed with Start, RunN or WaitForMessages: the streams they are running return ErrAlreadyRunning,
+// as does a stream already polled by another call, and they do not start while Poll is running.
+// Once done the consumer instances have to be torn down with Close.
+func (c *Consumer) Poll() ([]Message, error) {
+	type result struct {
+		msgs []Message
+		err  error
+	}
+	results := make(chan result, len(c.instanceHandlers))
+	for _, ih := range c.instanceHandlers {
+		go func(ih instanceHandler) {
+			msgs, err := ih.pollDriven()
+			results <- result{msgs, err}
+		}(ih)
+	}
+
+	var msgs []Message
+	var err error
+	for range c.instanceHandlers {
+		r := <-results
+		msgs = append(msgs, r.msgs...)
+		if r.err != nil && r.err != ErrNoMessages && err == nil {
+			err = r.err
+		}
+	}
+	if err == nil && len(msgs) == 0 {
+		return nil, ErrNoMessages
+	}
+	return msgs, err
+}
+
+// Reconnect tears down the consumer instance of every stream and creates and subscribes a new one, e.g. once
+// a rebalance is known to have happened, without stopping the consumer. The pending offsets are committed first.
+// A running consumer reconnects between two polls. A stream polling, e.g. when Reconnect is called from a handler
+// or a callback such as the error handler, reconnects once the poll is over, Reconnect not waiting for it and the
+// failure being logged only.
+// The error of the first stream that failed to reconnect is returned, it will create a new instance on its next poll.
+func (c *Consumer) Reconnect() error {
+	var err error
+	for _, ih := range c.instanceHandlers {
+		if e := ih.requestReconnect(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// Close commits the pending offsets and tears down the consumer instances of a consumer driven with Poll.
+// The streams run by Start, RunN or WaitForMessages, or being polled, are left alone and ErrAlreadyRunning is returned.
+func (c *Consumer) Close() error {
+	var err error
+	for _, ih := range c.instanceHandlers {
+		if e := ih.closeDriven(); e == ErrAlreadyRunning {
+			err = e
+		}
+	}
+	return err
+}
+
+// ErrNotConsuming is returned by CommitOffset when none of the streams has a consumer instance to commit with
+var ErrNotConsuming = errors.New("no consumer instance to commit with, the consumer is not consuming")
+
+// CommitOffset commits the offset of the last processed message of the partition for the consumer group,
+// independently of the consume loop, e.g. to checkpoint once a downstream system has acknowledged a message.
+// The commit is issued by the first stream with a consumer instance, as any member of the group can commit
+// the offsets of the topic. It is only supported by the v2 API.
+//
+// The consume loop still commits the position of its consumer instance after every batch, or the proxy
+// does periodically with AutoCommitEnable. Either overwrites the offset committed here as soon as the
+// partition is consumed further, so an explicit commit only lasts while the partition has no new messages.
+func (c *Consumer) CommitOffset(partition int, offset int64) error {
+	err := ErrNotConsuming
+	for _, ih := range c.instanceHandlers {
+		if err = ih.commitOffsets(map[int]int64{partition: offset}); err != ErrNotConsuming {
+			return err
+		}
+	}
+	return err
+}
+
+// ErrNoOffsets is returned by CommitOffsets when it is given no offset to commit
+var ErrNoOffsets = errors.New("no offsets to commit")
+
+// CommitOffsets commits the offset of the last processed message of each partition in a single request,
+// e.g. the highest contiguous offset of the partitions of messages processed out of order.
+// It is issued like CommitOffset, by the first stream with a consumer instance, and is only supported by the v2 API.
+func (c *Consumer) CommitOffsets(offsets map[int]int64) error {
+	if len(offsets) == 0 {
+		return ErrNoOffsets
+	}
+	err := ErrNotConsuming
+	for _, ih := range c.instanceHandlers {
+		if err = ih.commitOffsets(offsets); err != ErrNotConsuming {
+			return err
+		}
+	}
+	return err
+}
+
+// Pause halts the polling of every stream once the batches being processed are done, e.g. while a downstream
+// dependency is unhealthy, without tearing down the consumer. The consumer instances are kept alive with
+// KeepAliveInterval while paused, otherwise the proxy may expire them and new ones are created on Resume.
+// It is safe to call from the handler and has no effect on a paused consumer.
+func (c *Consumer) Pause() {
+	for _, ih := range c.instanceHandlers {
+		ih.pause()
+	}
+}
+
+// Resume restarts the polling of a paused consumer
+func (c *Consumer) Resume() {
+	for _, ih := range c.instanceHandlers {
+		ih.resume()
+	}
+}
+
+// BytesConsumed returns the total size of the messages consumed by every stream, as decoded from the proxy
+// responses and decompressed, e.g. to size the network and the downstream buffers. It is safe to call while consuming.
+func (c *Consumer) BytesConsumed() int64 {
+	var total int64
+	for _, ih := range c.instanceHandlers {
+		total += ih.totalBytesConsumed()
+	}
+	return total
+}
+
 //Stop is a methode to stop the consumer
+// It does not block and can be called several times, before or after the consumer has stopped. A stopped consumer cannot be started again.
 func (c *Consumer) Stop() {
 	for _, ih := range c.instanceHandlers {
 		ih.initiateShutdown()
 	}
 }
 
+// StopConsuming stops the consumer like Stop, then waits for every stream to have torn down its consumer instance,
+// for at most timeout, e.g. for an orderly exit of the program. It returns the error of the first delete request
+// that failed, or context.DeadlineExceeded if the streams have not stopped in time.
+// The streams that are not running return right away.
+func (c *Consumer) StopConsuming(timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	errs := make(chan error, len(c.instanceHandlers))
+	for _, ih := range c.instanceHandlers {
+		go func(ih instanceHandler) {
+			errs <- ih.stop(ctx)
+		}(ih)
+	}
+
+	var err error
+	for range c.instanceHandlers {
+		if e := <-errs; e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// AssignPartitions has the consumer read the given partitions of the topic directly instead of subscribing
+// to it, e.g. to replay or inspect specific partitions. The consumer instances then take no part in the
+// rebalances of the consumer group: they are not assigned any other partition, and the subscribed members
+// of the group are not aware of them, so the same partitions may be consumed twice if both are used at once.
+// The partitions are spread over the streams, so there have to be at least as many as streams.
+// It has to be called before the consumer is started, ErrAlreadyRunning is returned otherwise.
+// It is only supported by the v2 API.
+func (c *Consumer) AssignPartitions(partitions []int) error {
+	if len(partitions) < len(c.instanceHandlers) {
+		return fmt.Errorf("cannot assign %d partitions to %d streams", len(partitions), len(c.instanceHandlers))
+	}
+	assigned := make([][]int, len(c.instanceHandlers))
+	for i, p := range partitions {
+		assigned[i%len(assigned)] = append(assigned[i%len(assigned)], p)
+	}
+	for i, ih := range c.instanceHandlers {
+		if err := ih.assign(assigned[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LastPollHadMessages reports whether the last poll of any of the streams returned messages.
+// It is safe to call while the consumer is running, e.g. to adapt an external polling schedule.
+func (c *Consumer) LastPollHadMessages() bool {
+	for _, ih := range c.instanceHandlers {
+		if ih.lastPollHadMessages() {
+			return true
+		}
+	}
+	return false
+}
+
 //ConnectivityCheck returns the connection status with the kafka proxy
 func (c *Consumer) ConnectivityCheck() (string, error) {
 	errMsg := ""
@@ -116,3 +447,75 @@ func (c *Consumer) ConnectivityCheck() (string, error) {
 
 	return "Error connecting to consumer proxies", errors.New(errMsg)
 }
+
+const defaultConnectivityRetryInterval = 500 * time.Millisecond
+
+// CachedConnectivityCheck wraps a connectivity check, e.g. ConnectivityCheck or HealthCheck().Checker, for health
+// endpoints called frequently not to hammer the proxy: the last result is served for ttl before the check is run
+// again. A failed check is retried up to retries times, half a second apart, before the failure is reported and cached.
+// The returned function is safe for concurrent use, concurrent calls waiting for the check in progress.
+func CachedConnectivityCheck(check func() (string, error), ttl time.Duration, retries int) func() (string, error) {
+	return newCachedCheck(check, ttl, retries, nil).run
+}
+
+type cachedCheck struct {
+	sync.Mutex
+	check   func() (string, error)
+	ttl     time.Duration
+	retries int
+	clock   clock
+	//last result and when it expires
+	msg       string
+	err       error
+	expiresAt time.Time
+}
+
+func newCachedCheck(check func() (string, error), ttl time.Duration, retries int, c clock) *cachedCheck {
+	return &cachedCheck{check: check, ttl: ttl, retries: retries, clock: clockOrDefault(c)}
+}
+
+func (c *cachedCheck) run() (string, error) {
+	c.Lock()
+	defer c.Unlock()
+	if !c.expiresAt.IsZero() && c.clock.Now().Before(c.expiresAt) {
+		return c.msg, c.err
+	}
+
+	c.msg, c.err = c.check()
+	for attempt := 0; c.err != nil && attempt < c.retries; attempt++ {
+		c.clock.Sleep(defaultConnectivityRetryInterval)
+		c.msg, c.err = c.check()
+	}
+	c.expiresAt = c.clock.Now().Add(c.ttl)
+	return c.msg, c.err
+}
+
+// HealthCheck has the fields of an FT health check, e.g. of a fthealth.Check served on __health
+type HealthCheck struct {
+	ID               string
+	Name             string
+	Severity         uint8
+	BusinessImpact   string
+	TechnicalSummary string
+	PanicGuide       string
+	Checker          func() (string, error)
+}
+
+// HealthCheck returns the health check of the connectivity to the kafka proxy, checked with ConnectivityCheck.
+// The PanicGuide of the service is left for the caller to set.
+func (c *Consumer) HealthCheck() HealthCheck {
+	topic := ""
+	if len(c.instanceHandlers) > 0 {
+		if ci, ok := c.instanceHandlers[0].(*consumerInstance); ok {
+			topic = ci.config.Topic
+		}
+	}
+	return HealthCheck{
+		ID:               topic + "-consumer-connectivity",
+		Name:             "Consumer connectivity to the kafka proxy for the " + topic + " topic",
+		Severity:         2,
+		BusinessImpact:   "Messages of the " + topic + " topic cannot be consumed, so the content they carry will not be processed",
+		TechnicalSummary: "The kafka-rest-proxy cannot be reached or did not list the topics, check that it is up and that the configured addresses are correct",
+		Checker:          c.ConnectivityCheck,
+	}
+}
@@ -1,9 +1,13 @@
 package consumer
 
 import (
+	"context"
+	"errors"
 	"net/http"
 	"net/http/httptest"
+	"os"
 	"testing"
+	"time"
 
 	logger "github.com/Financial-Times/go-logger/v2"
 	"github.com/stretchr/testify/assert"
@@ -78,3 +82,128 @@ func TestConnectivityCheckNoKafka(t *testing.T) {
 	assert.Error(t, err, "It should return an error")
 	assert.Equal(t, "Error connecting to consumer proxies", msg, `The check message should be "Error connecting to consumer proxies"`)
 }
+
+func TestTopicExists(t *testing.T) {
+	proxy := setupMockKafka(t, 200, mockedTopics)
+	defer proxy.Close()
+
+	for topic, expected := range map[string]bool{"methode-articles": true, "methode-artciles": false} {
+		q := newKafkaRESTClient(QueueConfig{Addrs: []string{proxy.URL}, Topic: topic, AuthorizationKey: "my-first-auth-key"}, &http.Client{})
+		exists, err := q.topicExists()
+		assert.NoError(t, err)
+		assert.Equal(t, expected, exists, topic)
+	}
+}
+
+func TestTopicExistsFailsWhenTopicsCannotBeListed(t *testing.T) {
+	proxy := setupMockKafka(t, http.StatusForbidden, "")
+	defer proxy.Close()
+
+	q := newKafkaRESTClient(QueueConfig{Addrs: []string{proxy.URL}, Topic: "methode-articles", AuthorizationKey: "my-first-auth-key"}, &http.Client{})
+	_, err := q.topicExists()
+	assert.Error(t, err)
+}
+
+func TestRunNFailsFastWhenTopicDoesNotExist(t *testing.T) {
+	proxy := setupMockKafka(t, 200, mockedTopics)
+	defer proxy.Close()
+
+	config := consumerConfigMock
+	config.Addrs = []string{proxy.URL}
+	config.Topic = "methode-artciles"
+	config.VerifyTopicExists = true
+	c := NewConsumer(config, func(m Message) {}, &http.Client{}, logger.NewUPPLogger("Test", "FATAL")).(*Consumer)
+
+	// the mocked proxy fails the test on any request other than the topic listing
+	err := c.RunN(context.Background(), 3)
+	assert.True(t, errors.Is(err, ErrTopicNotFound), "got %v", err)
+}
+
+func TestRunUntilSignalReturnsWhenTopicDoesNotExist(t *testing.T) {
+	proxy := setupMockKafka(t, 200, mockedTopics)
+	defer proxy.Close()
+
+	config := consumerConfigMock
+	config.Addrs = []string{proxy.URL}
+	config.Topic = "methode-artciles"
+	config.VerifyTopicExists = true
+	c := NewConsumer(config, func(m Message) {}, &http.Client{}, logger.NewUPPLogger("Test", "FATAL"))
+
+	done := make(chan struct{})
+	go func() {
+		RunUntilSignal(c, os.Interrupt)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("RunUntilSignal should return once the consumer stopped by itself")
+	}
+}
+
+func TestHealthCheck(t *testing.T) {
+	proxy := setupMockKafka(t, 200, mockedTopics)
+	defer proxy.Close()
+
+	config := consumerConfigMock
+	config.Addrs = []string{proxy.URL}
+	c := NewConsumer(config, func(m Message) {}, &http.Client{}, logger.NewUPPLogger("Test", "FATAL")).(*Consumer)
+
+	check := c.HealthCheck()
+	assert.Equal(t, "methode-articles-consumer-connectivity", check.ID)
+	assert.Equal(t, uint8(2), check.Severity)
+	assert.Contains(t, check.Name, "methode-articles")
+	assert.Contains(t, check.BusinessImpact, "methode-articles")
+	assert.NotEmpty(t, check.TechnicalSummary)
+	assert.Empty(t, check.PanicGuide, "the panic guide is set by the service")
+
+	msg, err := check.Checker()
+	assert.NoError(t, err)
+	assert.Equal(t, "Connectivity to consumer proxies is OK.", msg)
+
+	proxy.Close()
+	_, err = check.Checker()
+	assert.Error(t, err)
+}
+
+func TestCachedConnectivityCheck(t *testing.T) {
+	clk := &fakeClock{now: time.Now()}
+	calls := 0
+	var failures int
+	check := newCachedCheck(func() (string, error) {
+		calls++
+		if failures > 0 {
+			failures--
+			return "Error connecting to consumer proxies", errors.New("connection refused")
+		}
+		return "Connectivity to consumer proxies is OK.", nil
+	}, time.Minute, 2, clk)
+
+	msg, err := check.run()
+	assert.NoError(t, err)
+	assert.Equal(t, "Connectivity to consumer proxies is OK.", msg)
+	clk.now = clk.now.Add(59 * time.Second)
+	_, err = check.run()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, calls, "the result should be cached within the TTL")
+
+	failures = 1
+	clk.now = clk.now.Add(time.Second)
+	_, err = check.run()
+	assert.NoError(t, err, "a transient failure should be retried")
+	assert.Equal(t, 3, calls, "the check should be run again once the TTL has expired")
+	assert.Equal(t, []time.Duration{defaultConnectivityRetryInterval}, clk.waits())
+
+	failures = 5
+	clk.now = clk.now.Add(time.Minute)
+	msg, err = check.run()
+	assert.Error(t, err)
+	assert.Equal(t, "Error connecting to consumer proxies", msg)
+	assert.Equal(t, 6, calls, "the check should be retried twice before reporting unhealthy")
+
+	failures = 0
+	clk.now = clk.now.Add(30 * time.Second)
+	_, err = check.run()
+	assert.Error(t, err, "the failure should be cached too")
+	assert.Equal(t, 6, calls)
+}
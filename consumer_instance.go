@@ -1,16 +1,29 @@
 package consumer
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
 	"net/http"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	log "github.com/Financial-Times/go-logger/v2"
 )
 
 const (
-	defaultBackoffPeriod = 8
-	defaultOffsetReset   = "latest"
+	defaultBackoffPeriod          = 8
+	defaultOffsetReset            = "latest"
+	defaultProcessorChannelBuffer = 128
+	defaultReconnectWarnWindow    = 5 * time.Minute
+	defaultAsyncCommitInterval    = 5 * time.Second
 )
 
 var offsetResetOptions = map[string]bool{
@@ -19,52 +32,129 @@ var offsetResetOptions = map[string]bool{
 	"latest":   true,
 }
 
+var apiVersionOptions = map[string]bool{
+	apiVersionV1: true,
+	apiVersionV2: true,
+}
+
 // newConsumerInstance returns a new instance of consumerInstance
 func newConsumerInstance(config QueueConfig, handler func(m Message), client *http.Client, logger *log.UPPLogger) *consumerInstance {
-	offset := defaultOffsetReset
-	if offsetResetOptions[config.Offset] {
-		offset = config.Offset
+	return newInstance(config, splitMessageProcessor{handler}, client, logger)
+}
+
+// newBatchedConsumerInstance returns a new instance of a QueueConsumer that handles batches of messages
+func newBatchedConsumerInstance(config QueueConfig, handler func(m []Message), client *http.Client, logger *log.UPPLogger) *consumerInstance {
+	return newInstance(config, batchedMessageProcessor{handler}, client, logger)
+}
+
+// newBatchedErrorAwareConsumerInstance returns a new instance of consumerInstance handling batches of messages
+// and keeping track of the messages the handler left uncommitted
+func newBatchedErrorAwareConsumerInstance(config QueueConfig, handler func(msgs []Message) (commitUpTo int, err error), client *http.Client, logger *log.UPPLogger) *consumerInstance {
+	return newInstance(config, batchedErrorAwareMessageProcessor{handler, &failedMessages{}}, client, logger)
+}
+
+// newStreamingConsumerInstance returns a new instance of consumerInstance handling StreamMessages
+func newStreamingConsumerInstance(config QueueConfig, handler func(m StreamMessage), client *http.Client, logger *log.UPPLogger) *consumerInstance {
+	return newInstance(config, streamingMessageProcessor{handler, config.RawBody}, client, logger)
+}
+
+// newErrorAwareConsumerInstance returns a new instance of consumerInstance keeping track of the messages the handler failed on
+func newErrorAwareConsumerInstance(config QueueConfig, handler func(m Message) error, client *http.Client, logger *log.UPPLogger) *consumerInstance {
+	return newContextConsumerInstance(config, func(_ context.Context, m Message) error { return handler(m) }, client, logger)
+}
+
+// newContextConsumerInstance returns a new error aware consumerInstance whose handler is given the context of the consumption
+func newContextConsumerInstance(config QueueConfig, handler func(ctx context.Context, m Message) error, client *http.Client, logger *log.UPPLogger) *consumerInstance {
+	return newInstance(config, errorAwareMessageProcessor{handler, &failedMessages{}}, client, logger)
+}
+
+// newInstance returns a consumerInstance handing the messages to the processor.
+// CommitProcessedOffsets is always set for a batched error aware processor, for the messages after commitUpTo
+// not to be committed with the rest of the batch.
+func newInstance(config QueueConfig, processor messageProcessor, client *http.Client, logger *log.UPPLogger) *consumerInstance {
+	_, batchedErrorAware := processor.(batchedErrorAwareMessageProcessor)
+	if batchedErrorAware {
+		config.CommitProcessedOffsets = true
+	}
+	var dedup *offsetCache
+	if config.DedupWindow > 0 {
+		dedup = newOffsetCache(config.DedupWindow)
 	}
-	queue := &kafkaRESTClient{
-		addrs:            config.Addrs,
-		group:            config.Group,
-		topic:            config.Topic,
-		offset:           offset,
-		autoCommitEnable: config.AutoCommitEnable,
-		caller:           httpClient{config.Queue, config.AuthorizationKey, client},
+	if logger == nil {
+		logger = discardLogger()
 	}
-	return &consumerInstance{
+	var registry *schemaRegistry
+	if config.AvroSchemaRegistryURL != "" {
+		registry = newSchemaRegistry(config.AvroSchemaRegistryURL, client, config.UserAgent)
+	}
+	c := &consumerInstance{
 		config:       config,
-		queue:        queue,
+		queue:        newKafkaRESTClient(config, client),
 		consumer:     nil,
 		shutdownChan: make(chan bool, 1),
-		processor:    splitMessageProcessor{handler},
+		processor:    processor,
 		logger:       logger,
+		dedup:        dedup,
+		breaker:      newCircuitBreaker(config),
+		registry:     registry,
+	}
+	if batchedErrorAware && config.AutoCommitEnable {
+		c.logEntry().Error("AutoCommitEnable is set, the messages a batched error aware handler leaves unprocessed are committed by the proxy and not redelivered")
 	}
+	return c
 }
 
-// newBatchedConsumerInstance returns a new instance of a QueueConsumer that handles batches of messages
-func newBatchedConsumerInstance(config QueueConfig, handler func(m []Message), client *http.Client, logger *log.UPPLogger) *consumerInstance {
+// discardLogger is used by the consumers created without a logger
+func discardLogger() *log.UPPLogger {
+	logger := log.NewUPPLogger("message-queue-gonsumer", "FATAL")
+	logger.Out = ioutil.Discard
+	return logger
+}
+
+func newKafkaRESTClient(config QueueConfig, client *http.Client) *kafkaRESTClient {
 	offset := defaultOffsetReset
 	if offsetResetOptions[config.Offset] {
 		offset = config.Offset
 	}
-	queue := &kafkaRESTClient{
-		addrs:            config.Addrs,
-		group:            config.Group,
-		topic:            config.Topic,
-		offset:           offset,
-		autoCommitEnable: config.AutoCommitEnable,
-		caller:           httpClient{config.Queue, config.AuthorizationKey, client},
+	apiVersion := defaultAPIVersion
+	if apiVersionOptions[config.APIVersion] {
+		apiVersion = config.APIVersion
 	}
-
-	return &consumerInstance{
-		config:       config,
-		queue:        queue,
-		consumer:     nil,
-		shutdownChan: make(chan bool, 1),
-		processor:    batchedMessageProcessor{handler},
-		logger:       logger,
+	commitRetryInterval := defaultCommitRetryInterval
+	if config.CommitRetryInterval > 0 {
+		commitRetryInterval = config.CommitRetryInterval
+	}
+	userAgent := config.UserAgent
+	if userAgent == "" {
+		userAgent = defaultUserAgent()
+	}
+	destroyRetries := defaultDestroyRetries
+	if config.DestroyRetries > 0 {
+		destroyRetries = config.DestroyRetries
+	}
+	return &kafkaRESTClient{
+		addrs:                config.Addrs,
+		basePath:             normalizeBasePath(config.BasePath),
+		group:                config.Group,
+		topic:                config.Topic,
+		offset:               offset,
+		apiVersion:           apiVersion,
+		autoCommitEnable:     config.AutoCommitEnable,
+		caller:               httpClient{config.Queue, config.AuthorizationKey, client, userAgent, config.TokenProvider, nil},
+		commitRetries:        config.CommitRetries,
+		commitRetryInterval:  commitRetryInterval,
+		requestTimeout:       config.RequestTimeout,
+		sessionTimeout:       config.SessionTimeout,
+		instanceName:         config.InstanceName,
+		groupInstanceID:      config.GroupInstanceID,
+		fetchMaxBytes:        config.FetchMaxBytes,
+		maxPollRecords:       config.MaxPollRecords,
+		consumeMaxBytes:      config.ConsumeMaxBytes,
+		consumeTimeoutMs:     config.ConsumeTimeoutMs,
+		proxyConsumerConfig:  config.ProxyConsumerConfig,
+		destroyRetries:       destroyRetries,
+		destroyRetryInterval: defaultDestroyRetryInterval,
+		contentTypes:         config.ContentTypes,
 	}
 }
 
@@ -72,91 +162,961 @@ type queueCaller interface {
 	createConsumerInstance() (consumerInstanceURI, error)
 	destroyConsumerInstance(c consumerInstanceURI) error
 	subscribeConsumerInstance(c consumerInstanceURI) error
+	assignPartitions(c consumerInstanceURI, partitions []int) error
+	seekOffsets(c consumerInstanceURI, offsets map[int]int64) error
 	destroyConsumerInstanceSubscription(c consumerInstanceURI) error
-	consumeMessages(c consumerInstanceURI) ([]byte, error)
+	consumeMessages(c consumerInstanceURI) (io.ReadCloser, error)
 	commitOffsets(c consumerInstanceURI) error
+	commitPartitionOffsets(c consumerInstanceURI, offsets map[int]int64) error
+	keepAlive(c consumerInstanceURI) error
+	topicExists() (bool, error)
 	checkConnectivity() error
 }
 
+// idleConnectionsCloser is implemented by queue callers holding on to HTTP connections
+type idleConnectionsCloser interface {
+	closeIdleConnections()
+}
+
 type messageProcessor interface {
-	consume(messages ...Message)
+	consume(ctx context.Context, messages ...Message)
 }
 
 //consumerInstance is the default implementation of the QueueConsumer interface.
 //NOTE: consumerInstance is not thread-safe!
 type consumerInstance struct {
-	config       QueueConfig
-	queue        queueCaller
-	consumer     *consumerInstanceURI
+	//decoded bytes of the consumed messages, accessed atomically.
+	//It comes first to be 64-bit aligned on 32-bit platforms.
+	bytesConsumed int64
+	config        QueueConfig
+	queue         queueCaller
+	consumer      *consumerInstanceURI
+	//guards the writes of consumer, which is only read by other goroutines, see commitOffset
+	consumerMu   sync.Mutex
 	shutdownChan chan bool
+	shutdownOnce sync.Once
 	processor    messageProcessor
 	logger       *log.UPPLogger
+	//consecutive consumer instance recreations, see recordReconnect
+	reconnects    int
+	lastCreatedAt time.Time
+	//recently consumed partitions and offsets, nil unless DedupWindow is set
+	dedup *offsetCache
+	//set once the topic has been checked for VerifyTopicExists
+	topicVerified bool
+	//error that stops consumption altogether, e.g. ErrTopicNotFound
+	fatalErr error
+	//wait requested by the proxy after a 429 response, used for the next backoff
+	retryAfter time.Duration
+	//1 if the last poll returned messages, accessed atomically
+	lastPollHadMsgs int32
+	//used for the backoffs and timers, the real clock when nil
+	clock clock
+	//messages processed but not committed yet with AsyncCommit, and when they are due to be
+	pendingCommit   []Message
+	pendingCommitAt time.Time
+	//failed delivery attempts of the messages to redeliver, see deadLetter
+	deliveryAttempts map[partitionOffset]int
+	//skips the polls while the proxy keeps failing, nil unless CircuitBreakerThreshold is set
+	breaker *circuitBreaker
+	//set by the options given to the constructor
+	onError func(err error)
+	metrics Metrics
+	backoff time.Duration
+	//context of the handlers, cancelled on shutdown or once the context of the consume loop is done
+	handlerMu      sync.Mutex
+	handlerCtx     context.Context
+	cancelHandlers context.CancelFunc
+	//caps the dispatch rate with MaxMessagesPerSecond, created on first use
+	limiter *rateLimiter
+	//decodes the Avro values, nil unless AvroSchemaRegistryURL is set
+	registry *schemaRegistry
+	//partitions assigned to the consumer instance instead of subscribing it, see assign
+	partitions []int
+	//reconnect requests served by the poll loop, and closed once the running loop ends, nil when it is not running
+	loopMu            sync.Mutex
+	reconnectRequests chan chan error
+	loopDone          chan struct{}
+	//set while the loop goroutine polls or reconnects, the reconnects requested meanwhile, e.g. by a handler, being deferred
+	polling          bool
+	reconnectPending bool
+	//set while Poll or Close drive the consumer instance, the loops not starting meanwhile
+	driven bool
+	//error the consumer instance was torn down with by the last loop
+	closeErr error
+	//non-nil while consumption is paused, closed on resume
+	pauseMu  sync.Mutex
+	resumeCh chan struct{}
 }
 
 func (c *consumerInstance) consumeWhileActive() {
-	for {
+	_ = c.consumeN(context.Background(), 0)
+}
+
+// consumeN polls at most maxPolls times, or until ctx is done or a shutdown is initiated,
+// then tears down the consumer instance. A maxPolls of 0 or less only stops on ctx or shutdown.
+// The backoff between polls is interrupted by either, so that no goroutine outlives the call.
+func (c *consumerInstance) consumeN(ctx context.Context, maxPolls int) error {
+	_, err := c.pollLoop(ctx, maxPolls, false)
+	return err
+}
+
+// waitForMessages polls like consumeN until a poll returns messages, and returns them
+func (c *consumerInstance) waitForMessages(ctx context.Context) ([]Message, error) {
+	return c.pollLoop(ctx, 0, true)
+}
+
+// pollLoop is the loop of consumeN, also stopping at the first poll returning messages when untilMessages is set
+func (c *consumerInstance) pollLoop(ctx context.Context, maxPolls int, untilMessages bool) ([]Message, error) {
+	stopLoop, err := c.startLoop()
+	if err != nil {
+		return nil, err
+	}
+	//closed before the loop is flagged as stopped, for a concurrent reconnect not to race with it
+	defer func() { stopLoop(c.close()) }()
+	stopHandlers := c.startHandlerContext(ctx)
+	defer stopHandlers()
+	if !c.firstPollImmediate() {
+		if stop, err := c.backOff(ctx, c.backoffPeriod()); stop {
+			return nil, err
+		}
+	}
+	for polls := 0; maxPolls <= 0 || polls < maxPolls; polls++ {
 		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
 		case <-c.shutdownChan:
-			c.shutdown()
-			return
+			return nil, nil
+		case reply := <-c.reconnectRequests:
+			c.serveReconnect(reply)
 		default:
-			c.consumeAndHandleMessages()
+		}
+		if stop, err := c.waitWhilePaused(ctx); stop {
+			return nil, err
+		}
+
+		msgs, err := c.poll()
+		if c.fatalErr != nil {
+			return nil, c.fatalErr
+		}
+		if untilMessages && len(msgs) > 0 {
+			return msgs, nil
+		}
+		//back off after the failed and the empty polls
+		if err == nil || polls+1 == maxPolls || c.longPolled(err) {
+			continue
+		}
+		if stop, err := c.backOff(ctx, c.nextBackoff()); stop {
+			return nil, err
+		}
+	}
+	return nil, nil
+}
+
+// backOff waits before the next poll, interrupted by ctx and shutdown, in which case it returns true
+// and the error the loop should stop with. The reconnects requested meanwhile are handled.
+func (c *consumerInstance) backOff(ctx context.Context, wait time.Duration) (stop bool, err error) {
+	select {
+	case <-ctx.Done():
+		return true, ctx.Err()
+	case <-c.shutdownChan:
+		return true, nil
+	case reply := <-c.reconnectRequests:
+		c.serveReconnect(reply)
+	case <-clockOrDefault(c.clock).After(wait):
+	}
+	return false, nil
+}
+
+// firstPollImmediate reports whether the loop polls as soon as it starts, see QueueConfig.FirstPollImmediate
+func (c *consumerInstance) firstPollImmediate() bool {
+	return c.config.FirstPollImmediate == nil || *c.config.FirstPollImmediate
+}
+
+// startHandlerContext derives the context given to the handlers from ctx, until the returned function is called
+func (c *consumerInstance) startHandlerContext(ctx context.Context) (stop func()) {
+	handlerCtx, cancel := context.WithCancel(ctx)
+	c.handlerMu.Lock()
+	defer c.handlerMu.Unlock()
+	c.handlerCtx, c.cancelHandlers = handlerCtx, cancel
+	return func() {
+		c.handlerMu.Lock()
+		defer c.handlerMu.Unlock()
+		cancel()
+		c.handlerCtx, c.cancelHandlers = nil, nil
+	}
+}
+
+// handlerContext returns the context given to the handlers, the background context outside of the consume loop
+func (c *consumerInstance) handlerContext() context.Context {
+	c.handlerMu.Lock()
+	defer c.handlerMu.Unlock()
+	if c.handlerCtx == nil {
+		return context.Background()
+	}
+	return c.handlerCtx
+}
+
+// waitWhilePaused blocks while consumption is paused, keeping the consumer instance alive with KeepAliveInterval.
+// It reports whether the loop has to stop, as ctx is done or a shutdown was initiated in the meantime.
+func (c *consumerInstance) waitWhilePaused(ctx context.Context) (stop bool, err error) {
+	c.pauseMu.Lock()
+	resumed := c.resumeCh
+	c.pauseMu.Unlock()
+	if resumed == nil {
+		return false, nil
+	}
+
+	c.logEntry().Info("Consumption paused")
+	stopKeepAlive := c.startKeepAlive()
+	defer func() { stopKeepAlive() }()
+	for {
+		select {
+		case <-ctx.Done():
+			return true, ctx.Err()
+		case <-c.shutdownChan:
+			return true, nil
+		case reply := <-c.reconnectRequests:
+			stopKeepAlive()
+			c.serveReconnect(reply)
+			stopKeepAlive = c.startKeepAlive()
+		case <-resumed:
+			c.logEntry().Info("Consumption resumed")
+			return false, nil
 		}
 	}
 }
 
-func (c *consumerInstance) consumeAndHandleMessages() {
+func (c *consumerInstance) pause() {
+	c.pauseMu.Lock()
+	defer c.pauseMu.Unlock()
+	if c.resumeCh == nil {
+		c.resumeCh = make(chan struct{})
+	}
+}
+
+func (c *consumerInstance) resume() {
+	c.pauseMu.Lock()
+	defer c.pauseMu.Unlock()
+	if c.resumeCh != nil {
+		close(c.resumeCh)
+		c.resumeCh = nil
+	}
+}
+
+// poll consumes, processes and commits a single batch.
+// It returns the messages of the batch and a nil error, or ErrNoMessages when the poll succeeded without
+// consuming anything, ErrCircuitOpen when it was skipped by the circuit breaker, or the error it failed with.
+// Both nil are only returned after recovering from a panic of the handler.
+// The reconnects requested meanwhile, e.g. by a handler or a callback, are done once the whole poll is over.
+func (c *consumerInstance) poll() (msgs []Message, err error) {
+	c.withDeferredReconnects(func() { msgs, err = c.pollOnce() })
+	return msgs, err
+}
+
+func (c *consumerInstance) pollOnce() (msgs []Message, err error) {
 	defer func() {
 		if r := recover(); r != nil {
 			err, ok := r.(error)
 			if !ok {
-				c.logger.WithError(err).Error("Recovered from panic")
+				c.logEntry().WithError(err).Error("Recovered from panic")
 			}
 		}
 	}()
+
+	start := clockOrDefault(c.clock).Now()
+	if c.breaker != nil {
+		if ok, remaining := c.breaker.allow(start); !ok {
+			c.retryAfter = remaining
+			c.logEntry().WithField("remaining", remaining.String()).Debug("Circuit breaker open, skipping poll")
+			return nil, ErrCircuitOpen
+		}
+	}
+	msgs, err = c.consume()
+	c.recordPollOutcome(err)
+	if c.metrics != nil {
+		c.metrics.Poll(len(msgs), clockOrDefault(c.clock).Now().Sub(start), err)
+	}
+	if err != nil && c.onError != nil {
+		c.onError(err)
+	}
+	var hadMessages int32
+	if len(msgs) > 0 {
+		hadMessages = 1
+	}
+	atomic.StoreInt32(&c.lastPollHadMsgs, hadMessages)
+	if err == nil && len(msgs) == 0 {
+		return nil, ErrNoMessages
+	}
+	return msgs, err
+}
+
+// longPolled reports whether the poll came back empty after the proxy held it for ConsumeTimeoutMs,
+// in which case the next poll is issued right away as the proxy has already waited for records
+func (c *consumerInstance) longPolled(err error) bool {
+	return c.config.ConsumeTimeoutMs > 0 && errors.Is(err, ErrNoMessages)
+}
+
+// recordStage reports the time elapsed since start to the metrics, if they implement StageMetrics
+func (c *consumerInstance) recordStage(stage PollStage, start time.Time) {
+	if m, ok := c.metrics.(StageMetrics); ok {
+		m.Stage(stage, clockOrDefault(c.clock).Now().Sub(start))
+	}
+}
+
+// recordPollOutcome feeds the circuit breaker, the polls rate limited by the proxy counting neither as a success nor a failure.
+// The next poll waits for the whole cooldown once the circuit opens.
+func (c *consumerInstance) recordPollOutcome(err error) {
+	if c.breaker == nil || errors.Is(err, ErrRateLimited) {
+		return
+	}
+	if err == nil {
+		if c.breaker.state == CircuitHalfOpen {
+			c.logEntry().Info("Proxy recovered, closing the circuit breaker")
+		}
+		c.breaker.success()
+		return
+	}
+	if c.breaker.failure(clockOrDefault(c.clock).Now()) {
+		c.retryAfter = c.breaker.cooldown
+		c.logEntry().WithError(err).WithField("failures", c.breaker.failures).WithField("cooldown", c.breaker.cooldown.String()).
+			Warn("Opening the circuit breaker, skipping proxy calls for the cooldown")
+	}
+}
+
+// rateLimited reports whether err is a 429 response from the proxy. The consumer instance is kept in that case
+// as recreating it would only add load to the proxy, and the next backoff honours the requested Retry-After.
+// A failed seek is not, as the instance has to be recreated for the messages past its position to be redelivered.
+func (c *consumerInstance) rateLimited(err error) bool {
+	var rerr *rateLimitError
+	var serr *seekError
+	if errors.As(err, &serr) || !errors.As(err, &rerr) {
+		return false
+	}
+
+	c.retryAfter = rerr.retryAfter
+	if c.retryAfter <= 0 {
+		c.retryAfter = c.backoffPeriod()
+	}
+	c.logEntry().WithError(err).WithField("retryAfter", c.retryAfter.String()).Warn("Rate limited by the proxy, backing off")
+	return true
+}
+
+// nextBackoff returns the wait before the next poll, the Retry-After of a rate limited request taking precedence
+func (c *consumerInstance) nextBackoff() time.Duration {
+	if c.retryAfter > 0 {
+		wait := c.retryAfter
+		c.retryAfter = 0
+		return wait
+	}
+	return c.backoffPeriod()
+}
+
+func (c *consumerInstance) backoffPeriod() time.Duration {
+	if c.backoff > 0 {
+		return c.backoff
+	}
 	backoffPeriod := defaultBackoffPeriod
 	if c.config.BackoffPeriod > 0 {
 		backoffPeriod = c.config.BackoffPeriod
 	}
-
-	msgs, err := c.consume()
-	if err != nil || len(msgs) == 0 {
-		time.Sleep(time.Duration(backoffPeriod) * time.Second)
-	}
+	return time.Duration(backoffPeriod) * time.Second
 }
 
+// consume creates and subscribes a consumer instance if needed, then consumes, processes and commits a batch.
+// It returns the messages of the batch, none after an empty poll, or the error of the failing step once
+// the consumer instance has been torn down, the instance being kept when the proxy rate limited the request.
 func (c *consumerInstance) consume() ([]Message, error) {
 	q := c.queue
 	if c.consumer == nil {
-		cInst, err := q.createConsumerInstance()
-		if err != nil {
-			c.logger.WithError(err).Error("Error creating consumer instance")
+		if err := c.connect(); err != nil {
 			return nil, err
 		}
-		c.consumer = &cInst
+	}
 
-		err = q.subscribeConsumerInstance(*c.consumer)
+	start := clockOrDefault(c.clock).Now()
+	res, err := q.consumeMessages(*c.consumer)
+	c.recordStage(StageConsume, start)
+	if err == nil && c.config.DebugRawResponses && c.config.OnRawResponse != nil {
+		res, err = c.rawResponse(res)
+	}
+	if c.config.DebugRawResponses {
+		res, err = c.debugResponse(res, err)
+	}
+	if err != nil {
+		if c.rateLimited(err) {
+			return nil, err
+		}
+		c.logEntry().WithError(err).Error("Error consuming messages")
+
+		c.shutdown()
+		return nil, err
+	}
+	var skip func(partition, offset int) bool
+	var recorded []partitionOffset
+	if c.dedup != nil {
+		skip = func(partition, offset int) bool {
+			if c.dedup.seen(partition, offset) {
+				return true
+			}
+			recorded = append(recorded, partitionOffset{partition, offset})
+			return false
+		}
+	}
+	start = clockOrDefault(c.clock).Now()
+	msgs, err := parseResponseSkipping(res, c.config, c.logger, skip)
+	res.Close()
+	if err == nil && c.registry != nil {
+		msgs, err = c.decodeAvro(msgs)
+	}
+	c.recordStage(StageParse, start)
+	if err != nil {
+		//the batch is redelivered to the next consumer instance, the records parsed must not be skipped as duplicates then
+		for _, po := range recorded {
+			c.dedup.forget(po.partition, po.offset)
+		}
+		c.logRawResponse(res)
+		c.logEntry().WithError(err).Error("Error parsing messages")
+
+		c.shutdown()
+		return nil, err
+	}
+	c.logRawResponse(res)
+	c.checkBatchSize(len(msgs))
+	c.recordBytesConsumed(msgs)
+
+	start = clockOrDefault(c.clock).Now()
+	c.processWithKeepAlive(c.validate(msgs))
+	c.recordStage(StageProcess, start)
+	failed := c.takeFailures(msgs)
+
+	if !c.config.AutoCommitEnable {
+		start = clockOrDefault(c.clock).Now()
+		err = c.commit(msgs, failed)
+		c.recordStage(StageCommit, start)
 		if err != nil {
-			c.logger.WithError(err).Error("Error subscribing consumer instance to topic")
+			if c.rateLimited(err) {
+				return nil, err
+			}
+			c.logEntry().WithError(err).WithField("offsets", batchOffsets(msgs)).Error("Error committing offsets")
 
 			c.shutdown()
 			return nil, err
 		}
 	}
 
-	res, err := q.consumeMessages(*c.consumer)
+	return msgs, nil
+}
+
+// processWithKeepAlive processes the messages, keeping the consumer instance alive with KeepAliveInterval
+// until they are processed or a handler panics
+func (c *consumerInstance) processWithKeepAlive(msgs []Message) {
+	stopKeepAlive := c.startKeepAlive()
+	defer stopKeepAlive()
+	c.processMessages(c.handlerContext(), msgs)
+}
+
+// connect creates a consumer instance and subscribes it to the topic, or assigns it its partitions,
+// seeking it to SeekOffsets if set
+func (c *consumerInstance) connect() error {
+	if err := c.verifyTopic(); err != nil {
+		return err
+	}
+
+	q := c.queue
+	start := clockOrDefault(c.clock).Now()
+	cInst, err := q.createConsumerInstance()
+	c.recordStage(StageCreate, start)
 	if err != nil {
-		c.logger.WithError(err).Error("Error consuming messages")
+		c.logEntry().WithError(err).Error("Error creating consumer instance")
+		return err
+	}
+	c.setConsumer(&cInst)
+	c.recordReconnect()
 
-		c.shutdown()
-		return nil, err
+	start = clockOrDefault(c.clock).Now()
+	if len(c.partitions) > 0 {
+		err = q.assignPartitions(*c.consumer, c.partitions)
+	} else {
+		err = q.subscribeConsumerInstance(*c.consumer)
 	}
-	msgs, err := parseResponse(res, c.logger)
+	c.recordStage(StageSubscribe, start)
 	if err != nil {
-		c.logger.WithError(err).Error("Error parsing messages")
+		c.logEntry().WithError(err).Error("Error subscribing consumer instance to topic")
 
 		c.shutdown()
-		return nil, err
+		return err
+	}
+
+	if len(c.config.SeekOffsets) > 0 {
+		err = q.seekOffsets(*c.consumer, c.config.SeekOffsets)
+		if err != nil {
+			c.logEntry().WithError(err).Error("Error seeking consumer instance to configured offsets")
+
+			c.shutdown()
+			return err
+		}
+	}
+
+	if c.config.OnSubscribe != nil {
+		c.config.OnSubscribe(c.consumer.BaseURI)
+	}
+	return nil
+}
+
+// reconnect replaces the consumer instance with a new one, committing the pending offsets first
+func (c *consumerInstance) reconnect() error {
+	c.logEntry().Info("Reconnecting the consumer instance")
+	c.flushCommit()
+	c.shutdown()
+	return c.connect()
+}
+
+// serveReconnect reconnects for a Reconnect call received by the poll loop and replies with the result
+func (c *consumerInstance) serveReconnect(reply chan<- error) {
+	var err error
+	c.withDeferredReconnects(func() { err = c.reconnect() })
+	reply <- err
+}
+
+// requestReconnect has the poll loop reconnect the consumer instance between two polls and waits for the result.
+// The consumer instance is reconnected right away when the loop is not running.
+// While a poll or a reconnect is running the reconnect is deferred until it is over and nil is returned,
+// as waiting for it would deadlock when requested by a handler or a callback.
+func (c *consumerInstance) requestReconnect() error {
+	c.loopMu.Lock()
+	if c.polling {
+		defer c.loopMu.Unlock()
+		c.reconnectPending = true
+		return nil
+	}
+	if c.loopDone == nil {
+		defer c.loopMu.Unlock()
+		return c.reconnect()
+	}
+	requests, done := c.reconnectRequests, c.loopDone
+	c.loopMu.Unlock()
+
+	reply := make(chan error, 1)
+	select {
+	case requests <- reply:
+		return <-reply
+	case <-done:
+		return c.requestReconnect()
+	}
+}
+
+// withDeferredReconnects runs f on the loop goroutine, deferring the reconnects requested meanwhile as the loop
+// cannot serve them, e.g. from OnSubscribe or an error handler. It then reconnects until none was requested anymore.
+func (c *consumerInstance) withDeferredReconnects(f func()) {
+	requested := c.deferReconnects()
+	defer func() { requested() }()
+	f()
+	for requested() {
+		requested = c.deferReconnects()
+		//the failures are logged, the next poll creating a new instance
+		_ = c.reconnect()
+	}
+}
+
+// deferReconnects defers the reconnects requested until the returned function is called,
+// which reports whether one was requested meanwhile. Calling it again returns false.
+func (c *consumerInstance) deferReconnects() (requested func() bool) {
+	c.loopMu.Lock()
+	defer c.loopMu.Unlock()
+	c.polling = true
+	return func() bool {
+		c.loopMu.Lock()
+		defer c.loopMu.Unlock()
+		pending := c.polling && c.reconnectPending
+		c.polling, c.reconnectPending = false, false
+		return pending
+	}
+}
+
+// assign has the consumer instances created from now on assigned the partitions instead of subscribed to the topic.
+// ErrAlreadyRunning is returned if a poll loop is running.
+func (c *consumerInstance) assign(partitions []int) error {
+	c.loopMu.Lock()
+	defer c.loopMu.Unlock()
+	if c.loopDone != nil {
+		return ErrAlreadyRunning
+	}
+	c.partitions = partitions
+	return nil
+}
+
+// startLoop records that the poll loop is running until the returned function is called
+// with the error the consumer instance was torn down with.
+// The consumer instance is not safe for concurrent use, so ErrAlreadyRunning is returned if a loop is already running.
+func (c *consumerInstance) startLoop() (stop func(closeErr error), err error) {
+	c.loopMu.Lock()
+	defer c.loopMu.Unlock()
+	if c.loopDone != nil || c.driven {
+		return nil, ErrAlreadyRunning
+	}
+	if c.reconnectRequests == nil {
+		c.reconnectRequests = make(chan chan error)
+	}
+	done := make(chan struct{})
+	c.loopDone = done
+	return func(closeErr error) {
+		c.loopMu.Lock()
+		defer c.loopMu.Unlock()
+		c.loopDone = nil
+		c.closeErr = closeErr
+		close(done)
+	}, nil
+}
+
+// stop initiates the shutdown and waits for the poll loop to have torn down the consumer instance,
+// returning the teardown error, or for ctx to be done. It returns right away if no loop is running.
+func (c *consumerInstance) stop(ctx context.Context) error {
+	c.initiateShutdown()
+	c.loopMu.Lock()
+	done := c.loopDone
+	c.loopMu.Unlock()
+	if done == nil {
+		return nil
+	}
+
+	select {
+	case <-done:
+		c.loopMu.Lock()
+		defer c.loopMu.Unlock()
+		return c.closeErr
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+const maxDebugResponse = 4096
+
+// debugResponse logs the response of a failed consume request, and records the beginning of
+// a successful one as it is parsed for logRawResponse
+func (c *consumerInstance) debugResponse(res io.ReadCloser, err error) (io.ReadCloser, error) {
+	if err != nil {
+		var perr *ProxyError
+		if errors.As(err, &perr) {
+			c.logEntry().WithField("status", perr.StatusCode).WithField("response", perr.Body).Debug("Raw proxy response")
+		}
+		return res, err
+	}
+	return &recordingReadCloser{ReadCloser: res}, nil
+}
+
+// rawResponse reads the whole consume response and hands it to OnRawResponse,
+// returning a reader over the same bytes for them to be parsed
+func (c *consumerInstance) rawResponse(res io.ReadCloser) (io.ReadCloser, error) {
+	data, err := ioutil.ReadAll(res)
+	res.Close()
+	if err != nil {
+		return nil, fmt.Errorf("error reading response: %w", err)
+	}
+	c.config.OnRawResponse(data)
+	return ioutil.NopCloser(bytes.NewReader(data)), nil
+}
+
+// logRawResponse logs the recorded beginning of the consume response when DebugRawResponses is set
+func (c *consumerInstance) logRawResponse(res io.ReadCloser) {
+	if r, ok := res.(*recordingReadCloser); ok {
+		c.logEntry().WithField("status", http.StatusOK).WithField("response", string(r.data)).Debug("Raw proxy response")
+	}
+}
+
+// recordingReadCloser keeps the first maxDebugResponse bytes read
+type recordingReadCloser struct {
+	io.ReadCloser
+	data []byte
+}
+
+func (r *recordingReadCloser) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if room := maxDebugResponse - len(r.data); room > 0 {
+		if room > n {
+			room = n
+		}
+		r.data = append(r.data, p[:room]...)
+	}
+	return n, err
+}
+
+// verifyTopic checks once that the topic exists when VerifyTopicExists is set.
+// A missing topic is a fatal error, whereas a proxy that cannot list topics only skips the check.
+func (c *consumerInstance) verifyTopic() error {
+	if !c.config.VerifyTopicExists || c.topicVerified {
+		return nil
+	}
+
+	exists, err := c.queue.topicExists()
+	if err != nil {
+		c.logEntry().WithError(err).Warn("Could not verify that the topic exists, continuing without the check")
+		c.topicVerified = true
+		return nil
+	}
+	if !exists {
+		c.fatalErr = fmt.Errorf("%w: %s", ErrTopicNotFound, c.config.Topic)
+		c.logEntry().WithError(c.fatalErr).Error("Topic does not exist, stopping the consumer")
+		return c.fatalErr
+	}
+
+	c.topicVerified = true
+	return nil
+}
+
+// validate returns the messages passing ValidateMessage, to be handed to the handler.
+// The others are passed to DeadLetter and committed along with the rest of the batch.
+func (c *consumerInstance) validate(msgs []Message) []Message {
+	if c.config.ValidateMessage == nil {
+		return msgs
+	}
+
+	var valid []Message
+	for _, m := range msgs {
+		if err := c.config.ValidateMessage(m); err != nil {
+			c.logEntry().WithError(err).WithField("partition", m.Partition).WithField("offset", m.Offset).Warn("Message failed validation, skipping it")
+			if c.config.DeadLetter != nil {
+				c.config.DeadLetter(m, err)
+			}
+			continue
+		}
+		valid = append(valid, m)
+	}
+	return valid
+}
+
+// takeFailures returns the messages the handler of an error aware consumer failed on in the last batch,
+// leaving out the ones handed to DeadLetter
+func (c *consumerInstance) takeFailures(msgs []Message) []Message {
+	var failures *failedMessages
+	switch p := c.processor.(type) {
+	case errorAwareMessageProcessor:
+		failures = p.failures
+	case batchedErrorAwareMessageProcessor:
+		failures = p.failures
+	default:
+		return nil
+	}
+
+	failed, errs := failures.take()
+	for i, m := range failed {
+		c.logEntry().WithError(errs[i]).WithField("partition", m.Partition).WithField("offset", m.Offset).Warn("Handler failed to process message")
+	}
+	if !c.config.CommitProcessedOffsets || c.config.MaxDeliveryAttempts <= 0 {
+		return failed
+	}
+	return c.deadLetter(msgs, failed, errs)
+}
+
+// deadLetter counts the failed delivery attempts of each message and hands the messages
+// that reached MaxDeliveryAttempts to DeadLetter, so that they are committed instead of redelivered.
+// The counts are kept in memory, a restarted consumer redelivers the messages MaxDeliveryAttempts times again.
+func (c *consumerInstance) deadLetter(msgs, failed []Message, errs []error) []Message {
+	if c.deliveryAttempts == nil {
+		c.deliveryAttempts = make(map[partitionOffset]int)
+	}
+	failedAttempts := make(map[partitionOffset]int, len(failed))
+	for _, m := range failed {
+		key := partitionOffset{m.Partition, m.Offset}
+		failedAttempts[key] = c.deliveryAttempts[key] + 1
+	}
+	//messages processed successfully are not tracked any longer
+	for _, m := range msgs {
+		delete(c.deliveryAttempts, partitionOffset{m.Partition, m.Offset})
+	}
+
+	var redelivered []Message
+	for i, m := range failed {
+		key := partitionOffset{m.Partition, m.Offset}
+		attempts := failedAttempts[key]
+		if attempts < c.config.MaxDeliveryAttempts {
+			c.deliveryAttempts[key] = attempts
+			redelivered = append(redelivered, m)
+			continue
+		}
+
+		c.logEntry().WithError(errs[i]).WithField("partition", m.Partition).WithField("offset", m.Offset).
+			WithField("attempts", attempts).Error("Message failed too many times, skipping it")
+		if c.config.DeadLetter != nil {
+			c.config.DeadLetter(m, errs[i])
+		}
+	}
+	return redelivered
+}
+
+// commit commits the offsets of the batch, or with AsyncCommit adds them to the pending ones and
+// only commits those once AsyncCommitInterval has elapsed since the first of them was consumed.
+// The commits are coalesced in the consume loop rather than issued in the background, as the proxy
+// commits the position of the consumer instance, which must not move while a commit is in flight.
+// A batch with failures to redeliver under CommitProcessedOffsets is always committed right away.
+func (c *consumerInstance) commit(msgs, failed []Message) error {
+	if !c.config.AsyncCommit {
+		return c.commitNow(msgs, failed)
+	}
+
+	msgs = append(c.pendingCommit, msgs...)
+	c.pendingCommit = nil
+	if !c.config.CommitProcessedOffsets || len(failed) == 0 {
+		if len(msgs) == 0 {
+			return nil
+		}
+		now := clockOrDefault(c.clock).Now()
+		if c.pendingCommitAt.IsZero() {
+			c.pendingCommitAt = now.Add(c.asyncCommitInterval())
+		}
+		if now.Before(c.pendingCommitAt) {
+			c.pendingCommit = msgs
+			return nil
+		}
+	}
+	c.pendingCommitAt = time.Time{}
+	return c.commitNow(msgs, failed)
+}
+
+func (c *consumerInstance) asyncCommitInterval() time.Duration {
+	if c.config.AsyncCommitInterval > 0 {
+		return c.config.AsyncCommitInterval
+	}
+	return defaultAsyncCommitInterval
+}
+
+// flushCommit commits the offsets still pending with AsyncCommit
+func (c *consumerInstance) flushCommit() {
+	if len(c.pendingCommit) == 0 || c.consumer == nil {
+		return
+	}
+
+	msgs := c.pendingCommit
+	c.pendingCommit, c.pendingCommitAt = nil, time.Time{}
+	if err := c.commitNow(msgs, nil); err != nil {
+		c.logEntry().WithError(err).WithField("offsets", batchOffsets(msgs)).Error("Error committing pending offsets")
+	}
+}
+
+// commitNow commits the offsets of the batch, calling the BeforeCommit, AfterCommit and OnCommit hooks around it.
+// Everything consumed is committed unless CommitProcessedOffsets is set and some messages failed,
+// see processedOffsets for what is committed then.
+func (c *consumerInstance) commitNow(msgs, failed []Message) error {
+	committed := msgs
+	commit := func() error { return c.queue.commitOffsets(*c.consumer) }
+	if c.config.CommitProcessedOffsets && len(failed) > 0 {
+		var commitOffsets, seekOffsets map[int]int64
+		committed, commitOffsets, seekOffsets = processedOffsets(msgs, failed)
+		commit = func() error {
+			if len(commitOffsets) > 0 {
+				if err := c.queue.commitPartitionOffsets(*c.consumer, commitOffsets); err != nil {
+					return err
+				}
+			}
+			c.forgetRedelivered(msgs, seekOffsets)
+			if err := c.queue.seekOffsets(*c.consumer, seekOffsets); err != nil {
+				return &seekError{err}
+			}
+			return nil
+		}
+	}
+
+	offsets := messageOffsets(committed)
+	if c.config.BeforeCommit != nil {
+		c.config.BeforeCommit(offsets...)
+	}
+	if err := commit(); err != nil {
+		return err
+	}
+	if c.config.AfterCommit != nil {
+		c.config.AfterCommit(offsets...)
+	}
+	c.onCommit(lastOffsets(committed))
+	return nil
+}
+
+// seekError is returned when the consumer instance could not be seeked back to the failed messages
+type seekError struct {
+	err error
+}
+
+func (e *seekError) Error() string {
+	return "error seeking to the failed messages: " + e.err.Error()
+}
+
+func (e *seekError) Unwrap() error {
+	return e.err
+}
+
+// forgetRedelivered removes the messages the seek redelivers from the DedupWindow,
+// for the failed message and the ones after it not to be skipped as duplicates
+func (c *consumerInstance) forgetRedelivered(msgs []Message, seekOffsets map[int]int64) {
+	if c.dedup == nil {
+		return
+	}
+	for _, m := range msgs {
+		if o, ok := seekOffsets[m.Partition]; ok && int64(m.Offset) >= o {
+			c.dedup.forget(m.Partition, m.Offset)
+		}
+	}
+}
+
+// onCommit calls OnCommit with the committed offsets, if any
+func (c *consumerInstance) onCommit(offsets map[int]int64) {
+	if c.config.OnCommit != nil && len(offsets) > 0 {
+		c.config.OnCommit(offsets)
+	}
+}
+
+// lastOffsets returns the offset of the last message of each partition
+func lastOffsets(msgs []Message) map[int]int64 {
+	offsets := make(map[int]int64)
+	for _, m := range msgs {
+		if o, ok := offsets[m.Partition]; !ok || int64(m.Offset) > o {
+			offsets[m.Partition] = int64(m.Offset)
+		}
+	}
+	return offsets
+}
+
+// processedOffsets works out what can be committed when some messages of the batch failed.
+// A partition is only committed up to the message preceding its first failure, the offsets of a
+// partition being contiguous within a batch, and partitions without failures are committed in full.
+// The consumer instance then has to seek each partition with failures back to its first failed offset
+// for the failed message, and the ones after it, to be redelivered.
+func processedOffsets(msgs, failed []Message) (committed []Message, commitOffsets, seekOffsets map[int]int64) {
+	seekOffsets = make(map[int]int64)
+	for _, m := range failed {
+		if o, ok := seekOffsets[m.Partition]; !ok || int64(m.Offset) < o {
+			seekOffsets[m.Partition] = int64(m.Offset)
+		}
+	}
+
+	commitOffsets = make(map[int]int64)
+	for _, m := range msgs {
+		if firstFailed, ok := seekOffsets[m.Partition]; ok && int64(m.Offset) >= firstFailed {
+			continue
+		}
+		committed = append(committed, m)
+		if o, ok := commitOffsets[m.Partition]; !ok || int64(m.Offset) > o {
+			commitOffsets[m.Partition] = int64(m.Offset)
+		}
+	}
+	return committed, commitOffsets, seekOffsets
+}
+
+// messageOffsets returns the offsets of the messages, in the order they were consumed
+func messageOffsets(msgs []Message) []int {
+	offsets := make([]int, len(msgs))
+	for i, m := range msgs {
+		offsets[i] = m.Offset
+	}
+	return offsets
+}
+
+// processMessages hands the messages to the processor, fanning them out to NoOfProcessors goroutines in concurrent mode.
+// With MaxMessagesPerSecond the dispatch of each message waits for the rate limiter, batches waiting for as many
+// tokens as they have messages.
+func (c *consumerInstance) processMessages(ctx context.Context, msgs []Message) {
+	limiter := c.rateLimiter()
+	if batched(c.processor) && limiter != nil {
+		limiter.wait(ctx, len(msgs))
+		limiter = nil
 	}
 
 	if c.config.ConcurrentProcessing {
@@ -165,22 +1125,39 @@ func (c *consumerInstance) consume() ([]Message, error) {
 			processors = c.config.NoOfProcessors
 		}
 		rwWg := sync.WaitGroup{}
-		ch := make(chan Message, 128)
+		chs, route := c.processorChannels(processors)
+		//a slot is taken for each dispatched message and released once it is processed
+		var inFlight chan struct{}
+		if c.config.MaxInFlight > 0 {
+			inFlight = make(chan struct{}, c.config.MaxInFlight)
+		}
 
 		rwWg.Add(1)
 		go func() {
 			for _, msg := range msgs {
-				ch <- msg
+				if inFlight != nil {
+					inFlight <- struct{}{}
+				}
+				if limiter != nil {
+					limiter.wait(ctx, 1)
+				}
+				chs[route(msg)] <- msg
+			}
+			for _, ch := range chs {
+				close(ch)
 			}
-			close(ch)
 			rwWg.Done()
 		}()
 
 		for i := 0; i < processors; i++ {
 			rwWg.Add(1)
+			ch := chs[i%len(chs)]
 			go func() {
 				for m := range ch {
-					c.processor.consume(m)
+					c.handle(ctx, m)
+					if inFlight != nil {
+						<-inFlight
+					}
 				}
 
 				rwWg.Done()
@@ -188,40 +1165,354 @@ func (c *consumerInstance) consume() ([]Message, error) {
 		}
 		rwWg.Wait()
 
+	} else if limiter != nil {
+		for _, msg := range msgs {
+			limiter.wait(ctx, 1)
+			c.handle(ctx, msg)
+		}
 	} else {
-		c.processor.consume(msgs...)
+		c.handle(ctx, msgs...)
 	}
+}
 
-	if !c.config.AutoCommitEnable {
-		err = q.commitOffsets(*c.consumer)
-		if err != nil {
-			c.logger.WithError(err).Error("Error committing offsets")
+// handle hands the messages to the processor, one by one when SlowHandlerThreshold is set
+// so that the handlers taking longer than it are timed and logged
+func (c *consumerInstance) handle(ctx context.Context, msgs ...Message) {
+	threshold := c.config.SlowHandlerThreshold
+	if threshold <= 0 {
+		c.processor.consume(ctx, msgs...)
+		return
+	}
 
-			c.shutdown()
+	clk := clockOrDefault(c.clock)
+	if batched(c.processor) {
+		start := clk.Now()
+		c.processor.consume(ctx, msgs...)
+		if d := clk.Now().Sub(start); d > threshold {
+			c.logEntry().WithField("batchSize", len(msgs)).WithField("offsets", batchOffsets(msgs)).
+				WithField("duration", d.String()).Warn("Slow handler, the batch took longer than the threshold to process")
+		}
+		return
+	}
+	for _, msg := range msgs {
+		start := clk.Now()
+		c.processor.consume(ctx, msg)
+		if d := clk.Now().Sub(start); d > threshold {
+			c.logEntry().WithTransactionID(msg.TransactionID()).WithField("partition", msg.Partition).WithField("offset", msg.Offset).
+				WithField("duration", d.String()).Warn("Slow handler, the message took longer than the threshold to process")
+		}
+	}
+}
+
+// decodeAvro sets the body of the messages to the JSON of their Avro value.
+// The malformed values are logged and skipped, like the messages failing to parse. A schema that cannot be fetched from
+// the registry fails the whole batch instead, for it not to be committed and to be redelivered once the registry is back.
+func (c *consumerInstance) decodeAvro(msgs []Message) ([]Message, error) {
+	decoded := make([]Message, 0, len(msgs))
+	for _, m := range msgs {
+		if m.IsTombstone {
+			decoded = append(decoded, m)
+			continue
+		}
+		body, err := c.registry.decode(m.Raw)
+		var ferr *schemaFetchError
+		if errors.As(err, &ferr) {
 			return nil, err
 		}
+		if err != nil {
+			c.logEntry().WithError(err).WithField("partition", m.Partition).WithField("offset", m.Offset).Error("Error decoding Avro message, skipping it")
+			continue
+		}
+		m.Body = string(body)
+		decoded = append(decoded, m)
 	}
+	return decoded, nil
+}
 
-	return msgs, nil
+// batched reports whether the processor hands whole batches to the handler
+func batched(p messageProcessor) bool {
+	switch p.(type) {
+	case batchedMessageProcessor, batchedErrorAwareMessageProcessor:
+		return true
+	}
+	return false
+}
+
+func (c *consumerInstance) rateLimiter() *rateLimiter {
+	if c.limiter == nil && c.config.MaxMessagesPerSecond > 0 {
+		c.limiter = newRateLimiter(c.config.MaxMessagesPerSecond, c.clock)
+	}
+	return c.limiter
+}
+
+// startKeepAlive pings the consumer instance every KeepAliveInterval until the returned function is called.
+// It is only run while messages are processed, when the consume loop itself makes no proxy calls,
+// and the returned function waits for any in-flight ping to complete.
+func (c *consumerInstance) startKeepAlive() (stop func()) {
+	if c.config.KeepAliveInterval <= 0 || c.consumer == nil {
+		return func() {}
+	}
+
+	instance := *c.consumer
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	clk := clockOrDefault(c.clock)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			case <-clk.After(c.config.KeepAliveInterval):
+				if err := c.queue.keepAlive(instance); err != nil {
+					c.logEntry().WithError(err).Warn("Error keeping consumer instance alive")
+				}
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		wg.Wait()
+	}
+}
+
+// batchOffsets returns the offset range of each partition of the batch for the log entries, e.g. 0:10-12,1:20
+func batchOffsets(msgs []Message) string {
+	type offsetRange struct{ first, last int }
+	ranges := make(map[int]*offsetRange)
+	var partitions []int
+	for _, m := range msgs {
+		r, ok := ranges[m.Partition]
+		if !ok {
+			ranges[m.Partition] = &offsetRange{m.Offset, m.Offset}
+			partitions = append(partitions, m.Partition)
+			continue
+		}
+		if m.Offset < r.first {
+			r.first = m.Offset
+		}
+		if m.Offset > r.last {
+			r.last = m.Offset
+		}
+	}
+	sort.Ints(partitions)
+
+	parts := make([]string, len(partitions))
+	for i, p := range partitions {
+		r := ranges[p]
+		parts[i] = fmt.Sprintf("%d:%d", p, r.first)
+		if r.last != r.first {
+			parts[i] += fmt.Sprintf("-%d", r.last)
+		}
+	}
+	return strings.Join(parts, ",")
+}
+
+// logEntry returns a log entry populated with the topic and group the consumer instance reads from
+func (c *consumerInstance) logEntry() *log.LogEntry {
+	return c.logger.WithField("topic", c.config.Topic).WithField("group", c.config.Group)
+}
+
+// recordReconnect tracks how many times in a row the consumer instance has been recreated
+// and warns once ReconnectWarnThreshold is crossed. An instance that survived longer than
+// ReconnectWarnWindow is considered a sustained success and resets the count.
+func (c *consumerInstance) recordReconnect() {
+	now := clockOrDefault(c.clock).Now()
+	defer func() { c.lastCreatedAt = now }()
+
+	if c.lastCreatedAt.IsZero() {
+		return
+	}
+
+	window := defaultReconnectWarnWindow
+	if c.config.ReconnectWarnWindow > 0 {
+		window = c.config.ReconnectWarnWindow
+	}
+	if now.Sub(c.lastCreatedAt) > window {
+		c.reconnects = 0
+	}
+	c.reconnects++
+
+	if c.config.ReconnectWarnThreshold > 0 && c.reconnects > c.config.ReconnectWarnThreshold {
+		c.logEntry().WithField("reconnects", c.reconnects).
+			WithField("window", window.String()).
+			Warnf("Consumer instance recreated %d times in a row, the proxy may be unhealthy", c.reconnects)
+	}
+}
+
+// checkBatchSize warns when a poll returned more than LargeBatchThreshold messages.
+// The proxy does not report the lag, but a batch of this size means the consumer is at least that far behind.
+func (c *consumerInstance) checkBatchSize(size int) {
+	if c.config.LargeBatchThreshold <= 0 || size <= c.config.LargeBatchThreshold {
+		return
+	}
+
+	c.logEntry().WithField("batchSize", size).
+		WithField("threshold", c.config.LargeBatchThreshold).
+		Warnf("Consumed a batch of %d messages, the consumer may be falling behind", size)
+	if c.config.OnLargeBatch != nil {
+		c.config.OnLargeBatch(size)
+	}
+}
+
+// newProcessorChannel returns the channel used to fan out messages to the concurrent processors
+func (c *consumerInstance) newProcessorChannel() chan Message {
+	buffer := defaultProcessorChannelBuffer
+	if c.config.ProcessorChannelBuffer > 0 {
+		buffer = c.config.ProcessorChannelBuffer
+	}
+	return make(chan Message, buffer)
+}
+
+// processorChannels returns the channels feeding the concurrent processors and the index of the channel each message
+// is dispatched to: a single one shared by the processors, or one per processor routed by WorkerKeyFunc when it is set
+func (c *consumerInstance) processorChannels(processors int) ([]chan Message, func(m Message) int) {
+	if c.config.WorkerKeyFunc == nil {
+		return []chan Message{c.newProcessorChannel()}, func(m Message) int { return 0 }
+	}
+
+	chs := make([]chan Message, processors)
+	for i := range chs {
+		chs[i] = c.newProcessorChannel()
+	}
+	return chs, func(m Message) int {
+		h := fnv.New32a()
+		h.Write([]byte(c.config.WorkerKeyFunc(m)))
+		return int(h.Sum32() % uint32(processors))
+	}
 }
 
-func (c *consumerInstance) shutdown() {
+// shutdown tears down the consumer instance, returning the error of the first delete that failed
+func (c *consumerInstance) shutdown() (err error) {
 	if c.consumer != nil {
-		err := c.queue.destroyConsumerInstanceSubscription(*c.consumer)
-		if err != nil {
-			c.logger.WithError(err).Error("Error deleting consumer instance subscription")
+		if serr := c.queue.destroyConsumerInstanceSubscription(*c.consumer); serr != nil {
+			c.logEntry().WithError(serr).Error("Error deleting consumer instance subscription")
+			err = serr
 		}
-		err = c.queue.destroyConsumerInstance(*c.consumer)
-		if err != nil {
-			c.logger.WithError(err).Error("Error deleting consumer instance")
+		if derr := c.queue.destroyConsumerInstance(*c.consumer); derr != nil {
+			c.logEntry().WithError(derr).Error("Error deleting consumer instance")
+			if err == nil {
+				err = derr
+			}
 		}
 
-		c.consumer = nil
+		if c.config.OnUnsubscribe != nil {
+			c.config.OnUnsubscribe(c.consumer.BaseURI)
+		}
+		c.setConsumer(nil)
+	}
+	//a new consumer instance gets the uncommitted messages redelivered
+	c.pendingCommit, c.pendingCommitAt = nil, time.Time{}
+	return err
+}
+
+// setClock has the instance, its queue and their HTTP client use clk instead of the real clock
+func (c *consumerInstance) setClock(clk clock) {
+	c.clock = clk
+	if q, ok := c.queue.(*kafkaRESTClient); ok {
+		q.setClock(clk)
+	}
+}
+
+func (c *consumerInstance) setConsumer(consumer *consumerInstanceURI) {
+	c.consumerMu.Lock()
+	defer c.consumerMu.Unlock()
+	c.consumer = consumer
+}
+
+// commitOffsets commits the offsets of the partitions with the current consumer instance, see Consumer.CommitOffset
+func (c *consumerInstance) commitOffsets(offsets map[int]int64) error {
+	c.consumerMu.Lock()
+	consumer := c.consumer
+	c.consumerMu.Unlock()
+	if consumer == nil {
+		return ErrNotConsuming
+	}
+	if err := c.queue.commitPartitionOffsets(*consumer, offsets); err != nil {
+		return err
 	}
+	c.onCommit(offsets)
+	return nil
 }
 
+// pollDriven is poll for a consumer driven with Poll, see drive
+func (c *consumerInstance) pollDriven() (msgs []Message, err error) {
+	if derr := c.drive(func() { msgs, err = c.poll() }); derr != nil {
+		return nil, derr
+	}
+	return msgs, err
+}
+
+// closeDriven is close for a consumer driven with Poll, see drive
+func (c *consumerInstance) closeDriven() (err error) {
+	if derr := c.drive(func() { err = c.close() }); derr != nil {
+		return derr
+	}
+	return err
+}
+
+// drive runs f outside of a poll loop, ErrAlreadyRunning being returned instead while a loop or another f is running.
+// The loops do not start until f returns.
+func (c *consumerInstance) drive(f func()) error {
+	c.loopMu.Lock()
+	if c.loopDone != nil || c.driven {
+		c.loopMu.Unlock()
+		return ErrAlreadyRunning
+	}
+	c.driven = true
+	c.loopMu.Unlock()
+	defer func() {
+		c.loopMu.Lock()
+		defer c.loopMu.Unlock()
+		c.driven = false
+	}()
+
+	f()
+	return nil
+}
+
+// close flushes the pending commits, tears down the consumer instance
+// and closes the idle proxy connections once consumption has stopped
+func (c *consumerInstance) close() error {
+	c.flushCommit()
+	err := c.shutdown()
+	if closer, ok := c.queue.(idleConnectionsCloser); ok {
+		closer.closeIdleConnections()
+	}
+	return err
+}
+
+func (c *consumerInstance) recordBytesConsumed(msgs []Message) {
+	var n int64
+	for _, m := range msgs {
+		n += int64(len(m.Raw))
+	}
+	atomic.AddInt64(&c.bytesConsumed, n)
+}
+
+func (c *consumerInstance) totalBytesConsumed() int64 {
+	return atomic.LoadInt64(&c.bytesConsumed)
+}
+
+func (c *consumerInstance) lastPollHadMessages() bool {
+	return atomic.LoadInt32(&c.lastPollHadMsgs) == 1
+}
+
+// initiateShutdown stops the consume loop, cancelling the context of the handlers still running.
+// shutdownChan is closed once rather than sent to, so that the calls never block whether a loop is running or not,
+// and a loop started after the shutdown stops right away.
 func (c *consumerInstance) initiateShutdown() {
-	c.shutdownChan <- true
+	c.handlerMu.Lock()
+	if c.cancelHandlers != nil {
+		c.cancelHandlers()
+	}
+	c.handlerMu.Unlock()
+
+	if c.shutdownChan != nil {
+		c.shutdownOnce.Do(func() { close(c.shutdownChan) })
+	}
 }
 
 func (c *consumerInstance) checkConnectivity() error {
@@ -1,12 +1,27 @@
 package consumer
 
 import (
+	"bytes"
+	"context"
+	"encoding/base64"
 	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/signal"
 	"reflect"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	log "github.com/Financial-Times/go-logger/v2"
+	"github.com/sirupsen/logrus"
+	logTest "github.com/sirupsen/logrus/hooks/test"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -65,45 +80,2329 @@ func TestBatchConsumer(t *testing.T) {
 	assert.Equal(t, msgsTest, msgs)
 }
 
+func TestStreamingConsumer(t *testing.T) {
+	var bodies []string
+	c := &consumerInstance{
+		config: QueueConfig{},
+		queue:  defaultTestQueueCaller{},
+		processor: streamingMessageProcessor{func(m StreamMessage) {
+			data, err := ioutil.ReadAll(m.Body)
+			assert.NoError(t, err)
+			bodies = append(bodies, string(data))
+		}, false},
+		logger: log.NewUPPLogger("Test", "FATAL"),
+	}
+
+	_, err := c.consume()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"body", "[]"}, bodies)
+}
+
+func TestConsumeSkipsDuplicateOffsets(t *testing.T) {
+	var bodies []string
+	c := newInstance(QueueConfig{DedupWindow: 10}, splitMessageProcessor{func(m Message) {
+		bodies = append(bodies, m.Body)
+	}}, nil, log.NewUPPLogger("Test", "FATAL"))
+	c.queue = batchQueueCaller{data: []byte(`[
+		{"value":"RlRNU0cvMS4wCgpib2R5Cg==","partition":0,"offset":0},
+		{"value":"RlRNU0cvMS4wCgpib2R5Cg==","partition":0,"offset":0},
+		{"value":"TWVzc2FnZS1JZDogMDAwMC0xMTExLTAwMDAtYWJjZAoKW10K","partition":1,"offset":0}
+	]`)}
+
+	for i := 0; i < 2; i++ {
+		_, err := c.consume()
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, []string{"body", "[]"}, bodies, "redelivered messages should only be handled once")
+}
+
+func TestConsumeParseErrorKeepsRecordsForRedelivery(t *testing.T) {
+	var offsets []int
+	c := newInstance(QueueConfig{DedupWindow: 10}, splitMessageProcessor{func(m Message) {
+		offsets = append(offsets, m.Offset)
+	}}, nil, log.NewUPPLogger("Test", "FATAL"))
+	c.queue = batchQueueCaller{data: []byte(`[
+		{"value":"RlRNU0cvMS4wCgpib2R5Cg==","partition":0,"offset":1},
+		{"value":"RlRNU0cvMS4wCgpib2R5Cg==","partition":0,"offset":`)}
+	_, err := c.consume()
+	assert.Error(t, err)
+
+	c.queue = batchQueueCaller{data: []byte(`[
+		{"value":"RlRNU0cvMS4wCgpib2R5Cg==","partition":0,"offset":1},
+		{"value":"RlRNU0cvMS4wCgpib2R5Cg==","partition":0,"offset":2}
+	]`)}
+	_, err = c.consume()
+	assert.NoError(t, err)
+	assert.Equal(t, []int{1, 2}, offsets, "the records parsed before the error should be handled once redelivered")
+}
+
+func TestConsumeWithoutDedupWindowHandlesDuplicates(t *testing.T) {
+	count := 0
+	c := newInstance(QueueConfig{}, splitMessageProcessor{func(m Message) { count++ }}, nil, log.NewUPPLogger("Test", "FATAL"))
+	c.queue = defaultTestQueueCaller{}
+
+	for i := 0; i < 2; i++ {
+		_, err := c.consume()
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, 4, count)
+}
+
+func TestPollResults(t *testing.T) {
+	var errs []error
+	c := &consumerInstance{
+		config:       QueueConfig{},
+		queue:        &pollCountingQueueCaller{empty: true},
+		shutdownChan: make(chan bool, 1),
+		processor:    splitMessageProcessor{func(m Message) {}},
+		logger:       log.NewUPPLogger("Test", "FATAL"),
+		onError:      func(err error) { errs = append(errs, err) },
+	}
+
+	msgs, err := c.poll()
+	assert.Nil(t, msgs)
+	assert.Equal(t, ErrNoMessages, err, "an empty poll should return ErrNoMessages")
+	assert.Empty(t, errs, "an empty poll should not be reported as an error")
+
+	c.queue = &pollCountingQueueCaller{}
+	msgs, err = c.poll()
+	assert.NoError(t, err)
+	assert.Len(t, msgs, 2)
+
+	c.queue = consumeMsgErrorQueueCaller{}
+	msgs, err = c.poll()
+	assert.Nil(t, msgs)
+	assert.Error(t, err)
+	assert.NotEqual(t, ErrNoMessages, err)
+	assert.Equal(t, []error{err}, errs)
+}
+
+func TestManualPolls(t *testing.T) {
+	var handled int32
+	c := NewConsumer(QueueConfig{StreamCount: 2}, func(m Message) { atomic.AddInt32(&handled, 1) }, nil, nil).(*Consumer)
+	queues := []*pollCountingQueueCaller{{}, {}}
+	for i, ih := range c.instanceHandlers {
+		ih.(*consumerInstance).queue = queues[i]
+	}
+
+	for i := 0; i < 3; i++ {
+		msgs, err := c.Poll()
+		assert.NoError(t, err)
+		assert.Len(t, msgs, 4, "each stream should consume a batch of 2 messages")
+	}
+	assert.Equal(t, int32(12), atomic.LoadInt32(&handled))
+	for _, queue := range queues {
+		assert.Equal(t, int32(3), atomic.LoadInt32(&queue.polls))
+		assert.Equal(t, int32(3), atomic.LoadInt32(&queue.commits))
+		assert.Equal(t, int32(0), atomic.LoadInt32(&queue.destroyed), "the consumer instance should be kept between polls")
+	}
+
+	queues[0].empty = true
+	msgs, err := c.Poll()
+	assert.NoError(t, err)
+	assert.Len(t, msgs, 2)
+
+	queues[1].empty = true
+	msgs, err = c.Poll()
+	assert.Nil(t, msgs)
+	assert.Equal(t, ErrNoMessages, err)
+
+	c.instanceHandlers[1].(*consumerInstance).queue = consumeMsgErrorQueueCaller{}
+	_, err = c.Poll()
+	assert.Error(t, err)
+	assert.NotEqual(t, ErrNoMessages, err, "the error of a failed stream should be returned")
+
+	c.Close()
+	assert.Equal(t, int32(1), atomic.LoadInt32(&queues[0].destroyed))
+}
+
+func TestReconnect(t *testing.T) {
+	queue := &reconnectingQueueCaller{}
+	var subscribed []string
+	c := NewConsumer(QueueConfig{OnSubscribe: func(uri string) { subscribed = append(subscribed, uri) }}, func(m Message) {}, nil, nil).(*Consumer)
+	instance := c.instanceHandlers[0].(*consumerInstance)
+	instance.queue = queue
+
+	_, err := c.Poll()
+	assert.NoError(t, err)
+	assert.NoError(t, c.Reconnect())
+	assert.Equal(t, "/consumers/group/instances/instance-2", instance.consumer.BaseURI, "a new consumer instance should be created")
+	assert.Equal(t, []string{"/consumers/group/instances/instance-1"}, queue.destroyedURIs)
+	assert.Equal(t, []string{"/consumers/group/instances/instance-1", "/consumers/group/instances/instance-2"}, subscribed)
+	c.Close()
+}
+
+func TestReconnectFromHandler(t *testing.T) {
+	queue := &reconnectingQueueCaller{}
+	reconnected := make(chan error, 1)
+	var c *Consumer
+	var once sync.Once
+	c = &Consumer{1, []instanceHandler{&consumerInstance{
+		config:       QueueConfig{BackoffPeriod: 3600},
+		queue:        queue,
+		shutdownChan: make(chan bool, 1),
+		processor: splitMessageProcessor{func(m Message) {
+			once.Do(func() { reconnected <- c.Reconnect() })
+		}},
+		logger: log.NewUPPLogger("Test", "FATAL"),
+	}}}
+
+	done := make(chan struct{})
+	go func() {
+		c.Start()
+		close(done)
+	}()
+
+	select {
+	case err := <-reconnected:
+		assert.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("Reconnect called from a handler should not block")
+	}
+	c.Stop()
+	<-done
+	assert.Equal(t, []string{"/consumers/group/instances/instance-1", "/consumers/group/instances/instance-2"}, queue.destroyed(), "the stream should reconnect once the messages are processed")
+}
+
+func TestReconnectFromErrorHandler(t *testing.T) {
+	reconnected := make(chan error, 1)
+	var c *Consumer
+	var once sync.Once
+	c = &Consumer{1, []instanceHandler{&consumerInstance{
+		config:       QueueConfig{BackoffPeriod: 3600},
+		queue:        consumeMsgErrorQueueCaller{},
+		shutdownChan: make(chan bool, 1),
+		processor:    splitMessageProcessor{func(m Message) {}},
+		logger:       log.NewUPPLogger("Test", "FATAL"),
+		onError: func(err error) {
+			once.Do(func() { reconnected <- c.Reconnect() })
+		},
+	}}}
+
+	done := make(chan struct{})
+	go func() {
+		c.Start()
+		close(done)
+	}()
+
+	select {
+	case err := <-reconnected:
+		assert.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("Reconnect called from the error handler should not block")
+	}
+	stopped := make(chan struct{})
+	go func() {
+		c.Stop()
+		<-done
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("the stream should not be blocked by the reconnect")
+	}
+}
+
+func TestReconnectFromOnSubscribe(t *testing.T) {
+	queue := &reconnectingQueueCaller{}
+	queue.empty = true
+	subscribed := make(chan struct{})
+	reconnected := make(chan error, 1)
+	var c *Consumer
+	var subscribes int32
+	c = &Consumer{1, []instanceHandler{&consumerInstance{
+		config: QueueConfig{BackoffPeriod: 3600, OnSubscribe: func(string) {
+			//the second subscribe is requested by the test, the third from OnSubscribe while the loop serves it
+			switch atomic.AddInt32(&subscribes, 1) {
+			case 1:
+				close(subscribed)
+			case 2:
+				reconnected <- c.Reconnect()
+			}
+		}},
+		queue:        queue,
+		shutdownChan: make(chan bool, 1),
+		processor:    splitMessageProcessor{func(m Message) {}},
+		logger:       log.NewUPPLogger("Test", "FATAL"),
+	}}}
+
+	done := make(chan struct{})
+	go func() {
+		c.Start()
+		close(done)
+	}()
+	<-subscribed
+
+	result := make(chan error, 1)
+	go func() { result <- c.Reconnect() }()
+	for _, ch := range []chan error{reconnected, result} {
+		select {
+		case err := <-ch:
+			assert.NoError(t, err)
+		case <-time.After(time.Second):
+			t.Fatal("Reconnect called from OnSubscribe should not block")
+		}
+	}
+	c.Stop()
+	<-done
+	assert.Equal(t, int32(3), atomic.LoadInt32(&subscribes), "the deferred reconnect should be done once the first is over")
+}
+
+func TestReconnectWhileRunning(t *testing.T) {
+	queue := &reconnectingQueueCaller{}
+	queue.empty = true
+	polled := make(chan struct{})
+	var once sync.Once
+	c := &Consumer{1, []instanceHandler{&consumerInstance{
+		config:       QueueConfig{BackoffPeriod: 3600, OnSubscribe: func(string) { once.Do(func() { close(polled) }) }},
+		queue:        queue,
+		shutdownChan: make(chan bool, 1),
+		processor:    splitMessageProcessor{func(m Message) {}},
+		logger:       log.NewUPPLogger("Test", "FATAL"),
+	}}}
+
+	done := make(chan struct{})
+	go func() {
+		c.Start()
+		close(done)
+	}()
+	<-polled
+
+	assert.NoError(t, c.Reconnect(), "the loop should reconnect during its backoff")
+	assert.Equal(t, []string{"/consumers/group/instances/instance-1"}, queue.destroyed())
+	c.Stop()
+	<-done
+	assert.Equal(t, []string{"/consumers/group/instances/instance-1", "/consumers/group/instances/instance-2"}, queue.destroyed())
+}
+
 func TestConsumeAndHandleMessagesRecoversFromPanic(t *testing.T) {
 	c := consumerInstance{config: QueueConfig{BackoffPeriod: 1}, queue: consumeMsgPanicQueueCaller{}, processor: splitMessageProcessor{func(m Message) {}}}
-	c.consumeAndHandleMessages()
+	c.poll()
+}
+
+func TestConsumeWhileActiveTerminates(t *testing.T) {
+	sdChan := make(chan bool)
+	c := consumerInstance{config: QueueConfig{}, queue: defaultTestQueueCaller{}, shutdownChan: sdChan, processor: splitMessageProcessor{func(m Message) {}}}
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		c.consumeWhileActive()
+		wg.Done()
+	}()
+	sdChan <- true
+	wg.Wait()
+}
+
+func TestRunNStopsAfterMaxPolls(t *testing.T) {
+	queue := &pollCountingQueueCaller{}
+	c := &Consumer{1, []instanceHandler{&consumerInstance{
+		config:       QueueConfig{},
+		queue:        queue,
+		shutdownChan: make(chan bool, 1),
+		processor:    splitMessageProcessor{func(m Message) {}},
+		logger:       log.NewUPPLogger("Test", "FATAL"),
+	}}}
+
+	err := c.RunN(context.Background(), 3)
+	assert.NoError(t, err)
+	assert.Equal(t, int32(3), atomic.LoadInt32(&queue.polls))
+	assert.Equal(t, int32(3), atomic.LoadInt32(&queue.commits))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&queue.destroyed), "the consumer instance should be destroyed on exit")
+}
+
+func TestBytesConsumed(t *testing.T) {
+	c := NewConsumer(QueueConfig{StreamCount: 2}, func(m Message) {}, nil, nil).(*Consumer)
+	for _, ih := range c.instanceHandlers {
+		ih.(*consumerInstance).queue = &pollCountingQueueCaller{}
+	}
+
+	assert.Equal(t, int64(0), c.BytesConsumed())
+	assert.NoError(t, c.RunN(context.Background(), 3))
+	//each poll consumes a 16 and a 36 byte message
+	assert.Equal(t, int64(2*3*(16+36)), c.BytesConsumed())
+}
+
+func TestRunNStopsWhenContextExpires(t *testing.T) {
+	queue := &pollCountingQueueCaller{}
+	c := &Consumer{1, []instanceHandler{&consumerInstance{
+		config:       QueueConfig{BackoffPeriod: 60},
+		queue:        queue,
+		shutdownChan: make(chan bool, 1),
+		processor:    splitMessageProcessor{func(m Message) {}},
+		logger:       log.NewUPPLogger("Test", "FATAL"),
+	}}}
+	queue.empty = true
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err := c.RunN(ctx, 0)
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&queue.polls), "the backoff should be interrupted by the context")
+	assert.Equal(t, int32(1), atomic.LoadInt32(&queue.destroyed))
+}
+
+func TestWaitForMessagesReturnsTheFirstMessages(t *testing.T) {
+	queue := &pollCountingQueueCaller{emptyPolls: 2}
+	var handled int32
+	clk := &fakeClock{}
+	c := &Consumer{1, []instanceHandler{&consumerInstance{
+		config:       QueueConfig{BackoffPeriod: 60},
+		queue:        queue,
+		shutdownChan: make(chan bool, 1),
+		processor:    splitMessageProcessor{func(m Message) { atomic.AddInt32(&handled, 1) }},
+		logger:       log.NewUPPLogger("Test", "FATAL"),
+		clock:        clk,
+	}}}
+
+	msgs, err := c.WaitForMessages(context.Background())
+	assert.NoError(t, err)
+	assert.Len(t, msgs, 2)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&handled))
+	assert.Equal(t, int32(3), atomic.LoadInt32(&queue.polls), "it should stop polling once messages arrived")
+	assert.Equal(t, int32(1), atomic.LoadInt32(&queue.destroyed))
+	assert.Len(t, clk.waits(), 2)
+}
+
+func TestFirstPollIsImmediate(t *testing.T) {
+	queue := &pollCountingQueueCaller{}
+	c := &Consumer{1, []instanceHandler{&consumerInstance{
+		config:       QueueConfig{BackoffPeriod: 60},
+		queue:        queue,
+		shutdownChan: make(chan bool, 1),
+		processor:    splitMessageProcessor{func(m Message) {}},
+		logger:       log.NewUPPLogger("Test", "FATAL"),
+	}}}
+
+	start := time.Now()
+	_, err := c.WaitForMessages(context.Background())
+	assert.NoError(t, err)
+	assert.True(t, time.Since(start) < time.Second, "the first poll should not wait for the backoff, took %v", time.Since(start))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&queue.polls))
+}
+
+func TestFirstPollBacksOffWhenNotImmediate(t *testing.T) {
+	queue := &pollCountingQueueCaller{}
+	clk := &fakeClock{}
+	immediate := false
+	c := &Consumer{1, []instanceHandler{&consumerInstance{
+		config:       QueueConfig{BackoffPeriod: 60, FirstPollImmediate: &immediate},
+		queue:        queue,
+		shutdownChan: make(chan bool, 1),
+		processor:    splitMessageProcessor{func(m Message) {}},
+		logger:       log.NewUPPLogger("Test", "FATAL"),
+		clock:        clk,
+	}}}
+
+	_, err := c.WaitForMessages(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, []time.Duration{60 * time.Second}, clk.waits())
+	assert.Equal(t, int32(1), atomic.LoadInt32(&queue.polls))
+}
+
+func TestWaitForMessagesStopsWhenContextExpires(t *testing.T) {
+	queue := &pollCountingQueueCaller{empty: true}
+	c := &Consumer{2, []instanceHandler{
+		&consumerInstance{
+			config:       QueueConfig{BackoffPeriod: 60},
+			queue:        queue,
+			shutdownChan: make(chan bool, 1),
+			processor:    splitMessageProcessor{func(m Message) {}},
+			logger:       log.NewUPPLogger("Test", "FATAL"),
+		},
+		&consumerInstance{
+			config:       QueueConfig{BackoffPeriod: 60},
+			queue:        queue,
+			shutdownChan: make(chan bool, 1),
+			processor:    splitMessageProcessor{func(m Message) {}},
+			logger:       log.NewUPPLogger("Test", "FATAL"),
+		},
+	}}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	msgs, err := c.WaitForMessages(ctx)
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.NotNil(t, msgs)
+	assert.Empty(t, msgs)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&queue.destroyed), "every consumer instance should be destroyed")
+}
+
+func TestConsumeWhileActiveStopsWhenTopicDoesNotExist(t *testing.T) {
+	queue := &topicCheckingQueueCaller{}
+	c := &consumerInstance{
+		config:       QueueConfig{Topic: "methode-artciles", VerifyTopicExists: true, BackoffPeriod: 60},
+		queue:        queue,
+		shutdownChan: make(chan bool, 1),
+		processor:    splitMessageProcessor{func(m Message) {}},
+		logger:       log.NewUPPLogger("Test", "FATAL"),
+	}
+
+	done := make(chan struct{})
+	go func() {
+		c.consumeWhileActive()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("consumer did not stop")
+	}
+
+	assert.True(t, errors.Is(c.fatalErr, ErrTopicNotFound))
+	assert.Equal(t, int32(0), atomic.LoadInt32(&queue.created), "no consumer instance should be created")
+}
+
+func TestVerifyTopicExistsSkippedWhenTopicsCannotBeListed(t *testing.T) {
+	queue := &topicCheckingQueueCaller{listErr: errors.New("unexpected response status 403. Expected: 200")}
+	c := &consumerInstance{
+		config:    QueueConfig{VerifyTopicExists: true},
+		queue:     queue,
+		processor: splitMessageProcessor{func(m Message) {}},
+		logger:    log.NewUPPLogger("Test", "FATAL"),
+	}
+
+	_, err := c.consume()
+	assert.NoError(t, err)
+	assert.NoError(t, c.fatalErr)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&queue.created))
+}
+
+func TestStreamConfigInstanceName(t *testing.T) {
+	config := QueueConfig{InstanceName: "annotations-writer"}
+	assert.Equal(t, "annotations-writer", streamConfig(config, 1, 0).InstanceName)
+	assert.Equal(t, "annotations-writer-1", streamConfig(config, 2, 0).InstanceName)
+	assert.Equal(t, "annotations-writer-2", streamConfig(config, 2, 1).InstanceName)
+	assert.Equal(t, "", streamConfig(QueueConfig{}, 2, 1).InstanceName)
+}
+
+func TestStreamConfigGroupInstanceID(t *testing.T) {
+	config := QueueConfig{GroupInstanceID: "replica-0"}
+	assert.Equal(t, "replica-0", streamConfig(config, 1, 0).GroupInstanceID)
+	assert.Equal(t, "replica-0-1", streamConfig(config, 2, 0).GroupInstanceID)
+	assert.Equal(t, "replica-0-2", streamConfig(config, 2, 1).GroupInstanceID)
+}
+
+func TestConsumeBacksOffWithoutTeardownWhenRateLimited(t *testing.T) {
+	queue := &rateLimitedQueueCaller{retryAfter: 3 * time.Second}
+	c := &consumerInstance{
+		config:    QueueConfig{BackoffPeriod: 1},
+		queue:     queue,
+		processor: splitMessageProcessor{func(m Message) {}},
+		logger:    log.NewUPPLogger("Test", "FATAL"),
+	}
+
+	_, err := c.consume()
+	assert.True(t, errors.Is(err, ErrRateLimited))
+	assert.Equal(t, consInstTest, c.consumer, "the consumer instance should be kept")
+	assert.Equal(t, int32(0), atomic.LoadInt32(&queue.destroyed))
+	assert.Equal(t, 3*time.Second, c.nextBackoff(), "the Retry-After should be honoured")
+	assert.Equal(t, time.Second, c.nextBackoff(), "the Retry-After should only apply to the next backoff")
+
+	queue.retryAfter = 0
+	_, _ = c.consume()
+	assert.Equal(t, time.Second, c.nextBackoff(), "the backoff period should be used without Retry-After")
+}
+
+func TestLastPollHadMessages(t *testing.T) {
+	queue := &pollCountingQueueCaller{}
+	instance := &consumerInstance{
+		config:    QueueConfig{},
+		queue:     queue,
+		processor: splitMessageProcessor{func(m Message) {}},
+		logger:    log.NewUPPLogger("Test", "FATAL"),
+	}
+	c := &Consumer{1, []instanceHandler{instance}}
+	assert.False(t, c.LastPollHadMessages())
+
+	instance.poll()
+	assert.True(t, c.LastPollHadMessages())
+
+	queue.empty = true
+	instance.poll()
+	assert.False(t, c.LastPollHadMessages())
+
+	queue.empty = false
+	instance.poll()
+	assert.True(t, c.LastPollHadMessages())
+}
+
+func TestConsumeNBacksOffAfterFailedPolls(t *testing.T) {
+	clk := &fakeClock{}
+	c := &consumerInstance{
+		config:       QueueConfig{BackoffPeriod: 5},
+		queue:        consumeMsgErrorQueueCaller{},
+		shutdownChan: make(chan bool, 1),
+		processor:    splitMessageProcessor{func(m Message) {}},
+		logger:       log.NewUPPLogger("Test", "FATAL"),
+		clock:        clk,
+	}
+
+	assert.NoError(t, c.consumeN(context.Background(), 3))
+	assert.Equal(t, []time.Duration{5 * time.Second, 5 * time.Second}, clk.waits(), "there should be no backoff after the last poll")
+}
+
+func TestConsumeNDoesNotBackOffAfterPollsWithMessages(t *testing.T) {
+	clk := &fakeClock{}
+	queue := &pollCountingQueueCaller{}
+	c := &consumerInstance{
+		config:       QueueConfig{BackoffPeriod: 5},
+		queue:        queue,
+		shutdownChan: make(chan bool, 1),
+		processor:    splitMessageProcessor{func(m Message) {}},
+		logger:       log.NewUPPLogger("Test", "FATAL"),
+		clock:        clk,
+	}
+
+	assert.NoError(t, c.consumeN(context.Background(), 3))
+	assert.Equal(t, int32(3), atomic.LoadInt32(&queue.polls))
+	assert.Empty(t, clk.waits(), "a consumer catching up should poll again right away")
+}
+
+func TestConsumeNDoesNotBackOffAfterLongPolls(t *testing.T) {
+	for _, timeout := range []int{0, 30000} {
+		clk := &fakeClock{}
+		c := &consumerInstance{
+			config:       QueueConfig{BackoffPeriod: 5, ConsumeTimeoutMs: timeout},
+			queue:        &pollCountingQueueCaller{empty: true},
+			shutdownChan: make(chan bool, 1),
+			processor:    splitMessageProcessor{func(m Message) {}},
+			logger:       log.NewUPPLogger("Test", "FATAL"),
+			clock:        clk,
+		}
+
+		assert.NoError(t, c.consumeN(context.Background(), 3))
+		if timeout == 0 {
+			assert.Equal(t, []time.Duration{5 * time.Second, 5 * time.Second}, clk.waits(), "empty polls should be backed off")
+		} else {
+			assert.Empty(t, clk.waits(), "the proxy should have already waited for records")
+		}
+	}
+}
+
+func TestCircuitBreakerStates(t *testing.T) {
+	clk := &fakeClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	var states []CircuitBreakerState
+	config := QueueConfig{
+		CircuitBreakerThreshold:     2,
+		CircuitBreakerCooldown:      time.Minute,
+		OnCircuitBreakerStateChange: func(state CircuitBreakerState) { states = append(states, state) },
+	}
+	c := &consumerInstance{
+		config:       config,
+		queue:        consumeMsgErrorQueueCaller{},
+		shutdownChan: make(chan bool, 1),
+		processor:    splitMessageProcessor{func(m Message) {}},
+		logger:       log.NewUPPLogger("Test", "FATAL"),
+		clock:        clk,
+		breaker:      newCircuitBreaker(config),
+	}
+
+	c.poll()
+	assert.Empty(t, states, "the circuit should stay closed below the threshold")
+	c.poll()
+	assert.Equal(t, []CircuitBreakerState{CircuitOpen}, states)
+	assert.Equal(t, time.Minute, c.nextBackoff(), "the next poll should wait for the cooldown")
+
+	queue := &pollCountingQueueCaller{}
+	c.queue = queue
+	clk.now = clk.now.Add(20 * time.Second)
+	_, err := c.poll()
+	assert.Equal(t, ErrCircuitOpen, err)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&queue.polls), "the proxy should not be called while the circuit is open")
+	assert.Equal(t, 40*time.Second, c.nextBackoff())
+
+	clk.now = clk.now.Add(40 * time.Second)
+	c.poll()
+	assert.Equal(t, int32(1), atomic.LoadInt32(&queue.polls))
+	assert.Equal(t, []CircuitBreakerState{CircuitOpen, CircuitHalfOpen, CircuitClosed}, states)
+
+	c.queue = consumeMsgErrorQueueCaller{}
+	c.poll()
+	c.poll()
+	clk.now = clk.now.Add(time.Minute)
+	c.poll()
+	assert.Equal(t, []CircuitBreakerState{CircuitOpen, CircuitHalfOpen, CircuitClosed, CircuitOpen, CircuitHalfOpen, CircuitOpen}, states,
+		"a failed poll should reopen a half-open circuit")
+}
+
+func TestCircuitBreakerIgnoresRateLimiting(t *testing.T) {
+	b := newCircuitBreaker(QueueConfig{CircuitBreakerThreshold: 1})
+	c := &consumerInstance{logger: log.NewUPPLogger("Test", "FATAL"), breaker: b}
+
+	c.recordPollOutcome(&rateLimitError{})
+	assert.Equal(t, CircuitClosed, b.state)
+	assert.Equal(t, defaultCircuitBreakerCooldown, b.cooldown)
+	c.recordPollOutcome(errors.New("proxy down"))
+	assert.Equal(t, CircuitOpen, b.state)
+}
+
+func TestCircuitBreakerDisabledByDefault(t *testing.T) {
+	assert.Nil(t, newCircuitBreaker(QueueConfig{}))
+}
+
+func TestReconnectWindowUsesClock(t *testing.T) {
+	clk := &fakeClock{now: time.Date(2015, 10, 21, 7, 28, 0, 0, time.UTC)}
+	c := &consumerInstance{
+		config: QueueConfig{ReconnectWarnWindow: time.Minute},
+		logger: log.NewUPPLogger("Test", "FATAL"),
+		clock:  clk,
+	}
+
+	c.recordReconnect()
+	clk.now = clk.now.Add(30 * time.Second)
+	c.recordReconnect()
+	assert.Equal(t, 1, c.reconnects)
+
+	clk.now = clk.now.Add(2 * time.Minute)
+	c.recordReconnect()
+	assert.Equal(t, 1, c.reconnects, "the count should be reset after a sustained success")
+}
+
+func TestConsumerWithNilLogger(t *testing.T) {
+	for _, queue := range []queueCaller{defaultTestQueueCaller{}, consumeMsgErrorQueueCaller{}, consumeMsgPanicQueueCaller{}} {
+		c := newConsumerInstance(QueueConfig{}, func(m Message) {}, nil, nil)
+		c.queue = queue
+
+		assert.NotPanics(t, func() { c.poll() })
+		assert.NotNil(t, c.logger)
+	}
+
+	c := NewErrorAwareConsumer(QueueConfig{StreamCount: 2}, func(m Message) error { return nil }, nil, nil).(*Consumer)
+	for _, ih := range c.instanceHandlers {
+		assert.NotNil(t, ih.(*consumerInstance).logger)
+	}
+}
+
+func TestStartStop(t *testing.T) {
+	consumers := make([]instanceHandler, 2)
+	for i := 0; i < 2; i++ {
+		consumers[i] = &consumerInstance{config: QueueConfig{}, queue: defaultTestQueueCaller{}, shutdownChan: make(chan bool), processor: splitMessageProcessor{func(m Message) {}}}
+	}
+	c := Consumer{2, consumers}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+
+	go func() {
+		c.Start()
+		wg.Done()
+	}()
+	c.Stop()
+	wg.Wait()
+}
+
+func TestConsumeSeeksToConfiguredOffsetsAfterSubscribing(t *testing.T) {
+	queue := &seekRecordingQueueCaller{}
+	seekOffsets := map[int]int64{0: 42, 1: 7}
+	consumer := &consumerInstance{
+		config:    QueueConfig{SeekOffsets: seekOffsets},
+		queue:     queue,
+		processor: splitMessageProcessor{func(m Message) {}},
+		logger:    log.NewUPPLogger("Test", "FATAL"),
+	}
+
+	_, err := consumer.consume()
+	assert.NoError(t, err)
+	assert.Equal(t, []map[int]int64{seekOffsets}, queue.seeks)
+
+	_, err = consumer.consume()
+	assert.NoError(t, err)
+	assert.Len(t, queue.seeks, 1, "seek should only be issued when the consumer instance is created")
+}
+
+func TestAssignPartitionsInsteadOfSubscribing(t *testing.T) {
+	queues := []*assignRecordingQueueCaller{{}, {}}
+	var handlers []instanceHandler
+	for _, q := range queues {
+		handlers = append(handlers, &consumerInstance{
+			queue:     q,
+			processor: splitMessageProcessor{func(m Message) {}},
+			logger:    log.NewUPPLogger("Test", "FATAL"),
+		})
+	}
+	c := &Consumer{2, handlers}
+
+	assert.Error(t, c.AssignPartitions([]int{0}), "every stream should get a partition")
+	assert.NoError(t, c.AssignPartitions([]int{0, 1, 2}))
+
+	for _, ih := range handlers {
+		_, err := ih.(*consumerInstance).consume()
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, [][]int{{0, 2}}, queues[0].assigned)
+	assert.Equal(t, [][]int{{1}}, queues[1].assigned)
+	assert.Equal(t, 0, queues[0].subscribes+queues[1].subscribes, "assigned instances should not subscribe")
+
+	_, err := c.instanceHandlers[0].(*consumerInstance).consume()
+	assert.NoError(t, err)
+	assert.Len(t, queues[0].assigned, 1, "the partitions should only be assigned when the consumer instance is created")
+
+	stop, err := c.instanceHandlers[0].(*consumerInstance).startLoop()
+	assert.NoError(t, err)
+	assert.Equal(t, ErrAlreadyRunning, c.AssignPartitions([]int{0, 1}))
+	stop(nil)
+}
+
+func TestSubscriptionCallbacks(t *testing.T) {
+	var subscribed, unsubscribed []string
+	consumer := &consumerInstance{
+		config: QueueConfig{
+			OnSubscribe:   func(instanceURI string) { subscribed = append(subscribed, instanceURI) },
+			OnUnsubscribe: func(instanceURI string) { unsubscribed = append(unsubscribed, instanceURI) },
+		},
+		queue:     defaultTestQueueCaller{},
+		processor: splitMessageProcessor{func(m Message) {}},
+		logger:    log.NewUPPLogger("Test", "FATAL"),
+	}
+
+	_, err := consumer.consume()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{consInstTest.BaseURI}, subscribed)
+	assert.Empty(t, unsubscribed)
+
+	_, err = consumer.consume()
+	assert.NoError(t, err)
+	assert.Len(t, subscribed, 1, "OnSubscribe should only fire when a new instance is subscribed")
+
+	consumer.shutdown()
+	assert.Equal(t, []string{consInstTest.BaseURI}, unsubscribed)
+
+	consumer.shutdown()
+	assert.Len(t, unsubscribed, 1, "OnUnsubscribe should not fire without an active instance")
+}
+
+func TestOnUnsubscribeCalledWhenConsumeFails(t *testing.T) {
+	var subscribed, unsubscribed []string
+	consumer := &consumerInstance{
+		config: QueueConfig{
+			OnSubscribe:   func(instanceURI string) { subscribed = append(subscribed, instanceURI) },
+			OnUnsubscribe: func(instanceURI string) { unsubscribed = append(unsubscribed, instanceURI) },
+		},
+		queue:     consumeMsgErrorQueueCaller{},
+		processor: splitMessageProcessor{func(m Message) {}},
+		logger:    log.NewUPPLogger("Test", "FATAL"),
+	}
+
+	_, err := consumer.consume()
+	assert.Error(t, err)
+	assert.Equal(t, []string{consInstTest.BaseURI}, subscribed)
+	assert.Equal(t, []string{consInstTest.BaseURI}, unsubscribed)
+}
+
+func TestCommitHooks(t *testing.T) {
+	var calls []string
+	var before, after []int
+	c := &consumerInstance{
+		config: QueueConfig{
+			BeforeCommit: func(offsets ...int) {
+				calls = append(calls, "before")
+				before = offsets
+			},
+			AfterCommit: func(offsets ...int) {
+				calls = append(calls, "after")
+				after = offsets
+			},
+		},
+		queue:     defaultTestQueueCaller{},
+		processor: splitMessageProcessor{func(m Message) { calls = append(calls, "handle") }},
+		logger:    log.NewUPPLogger("Test", "FATAL"),
+	}
+
+	_, err := c.consume()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"handle", "handle", "before", "after"}, calls)
+	assert.Equal(t, []int{0, 1}, before)
+	assert.Equal(t, []int{0, 1}, after)
+}
+
+func TestOnCommitReceivesOffsetsPerPartition(t *testing.T) {
+	queue := &partitionCommitQueueCaller{batchQueueCaller: batchQueueCaller{data: partitionedTestResponse(
+		[]int{0, 0, 1, 1, 2}, []int{10, 11, 20, 21, 30},
+	)}}
+	var commits []map[int]int64
+	failing := int64(21)
+	c := newErrorAwareConsumerInstance(QueueConfig{
+		CommitProcessedOffsets: true,
+		OnCommit:               func(offsets map[int]int64) { commits = append(commits, offsets) },
+	}, func(m Message) error {
+		if int64(m.Offset) == failing {
+			return errors.New("processing failed")
+		}
+		return nil
+	}, nil, log.NewUPPLogger("Test", "FATAL"))
+	c.queue = queue
+
+	_, err := c.consume()
+	assert.NoError(t, err)
+	assert.Equal(t, []map[int]int64{{0: 11, 1: 20, 2: 30}}, commits, "partition 1 should only be committed up to its failed message")
+
+	failing = -1
+	_, err = c.consume()
+	assert.NoError(t, err)
+	assert.Equal(t, map[int]int64{0: 11, 1: 21, 2: 30}, commits[1])
+
+	assert.NoError(t, c.commitOffsets(map[int]int64{3: 40}))
+	assert.Equal(t, map[int]int64{3: 40}, commits[2], "explicit commits should be reported too")
+}
+
+func TestAfterCommitNotCalledWhenCommitFails(t *testing.T) {
+	var before, after bool
+	c := &consumerInstance{
+		config: QueueConfig{
+			BeforeCommit: func(offsets ...int) { before = true },
+			AfterCommit:  func(offsets ...int) { after = true },
+		},
+		queue: &kafkaRESTClient{
+			addrs:  []string{"http://kafka-proxy-1.prod.ft.com"},
+			caller: &failingCommitHTTPCaller{commitFailures: 1},
+		},
+		consumer:  consInstTest,
+		processor: splitMessageProcessor{func(m Message) {}},
+		logger:    log.NewUPPLogger("Test", "FATAL"),
+	}
+
+	_, err := c.consume()
+	assert.Error(t, err)
+	assert.True(t, before)
+	assert.False(t, after)
+}
+
+func TestCommitHooksNotCalledWithAutoCommit(t *testing.T) {
+	called := false
+	c := &consumerInstance{
+		config: QueueConfig{
+			AutoCommitEnable: true,
+			BeforeCommit:     func(offsets ...int) { called = true },
+			AfterCommit:      func(offsets ...int) { called = true },
+		},
+		queue:     defaultTestQueueCaller{},
+		processor: splitMessageProcessor{func(m Message) {}},
+		logger:    log.NewUPPLogger("Test", "FATAL"),
+	}
+
+	_, err := c.consume()
+	assert.NoError(t, err)
+	assert.False(t, called)
+}
+
+func TestAsyncCommitCoalescesBatches(t *testing.T) {
+	clk := &fakeClock{now: time.Date(2015, 10, 21, 7, 28, 0, 0, time.UTC)}
+	queue := &partitionCommitQueueCaller{batchQueueCaller: batchQueueCaller{data: partitionedTestResponse([]int{0, 0}, []int{10, 11})}}
+	var committed [][]int
+	c := newConsumerInstance(QueueConfig{
+		AsyncCommit:         true,
+		AsyncCommitInterval: 10 * time.Second,
+		AfterCommit:         func(offsets ...int) { committed = append(committed, offsets) },
+	}, func(m Message) {}, nil, log.NewUPPLogger("Test", "FATAL"))
+	c.queue = queue
+	c.clock = clk
+
+	_, err := c.consume()
+	assert.NoError(t, err)
+	clk.now = clk.now.Add(5 * time.Second)
+	queue.data = partitionedTestResponse([]int{0}, []int{12})
+	_, err = c.consume()
+	assert.NoError(t, err)
+	assert.Equal(t, 0, queue.fullCommits, "nothing should be committed within the interval")
+
+	clk.now = clk.now.Add(5 * time.Second)
+	queue.data = []byte("[]")
+	_, err = c.consume()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, queue.fullCommits)
+	assert.Equal(t, [][]int{{10, 11, 12}}, committed)
+
+	_, err = c.consume()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, queue.fullCommits, "empty polls should not be committed")
+}
+
+func TestAsyncCommitFlushesPendingOffsetsOnShutdown(t *testing.T) {
+	queue := &partitionCommitQueueCaller{batchQueueCaller: batchQueueCaller{data: partitionedTestResponse([]int{0, 1}, []int{10, 20})}}
+	var committed []int
+	c := newConsumerInstance(QueueConfig{
+		AsyncCommit: true,
+		AfterCommit: func(offsets ...int) { committed = offsets },
+	}, func(m Message) {}, nil, log.NewUPPLogger("Test", "FATAL"))
+	c.queue = queue
+
+	assert.NoError(t, c.consumeN(context.Background(), 1))
+	assert.Equal(t, 1, queue.fullCommits)
+	assert.Equal(t, []int{10, 20}, committed)
+	assert.Nil(t, c.consumer)
+}
+
+func TestAsyncCommitCommitsFailedBatchRightAway(t *testing.T) {
+	clk := &fakeClock{now: time.Date(2015, 10, 21, 7, 28, 0, 0, time.UTC)}
+	queue := &partitionCommitQueueCaller{batchQueueCaller: batchQueueCaller{data: partitionedTestResponse([]int{0, 1}, []int{10, 20})}}
+	c := newErrorAwareConsumerInstance(QueueConfig{
+		AsyncCommit:            true,
+		CommitProcessedOffsets: true,
+	}, func(m Message) error {
+		if m.Offset == 11 {
+			return errors.New("processing failed")
+		}
+		return nil
+	}, nil, log.NewUPPLogger("Test", "FATAL"))
+	c.queue = queue
+	c.clock = clk
+
+	_, err := c.consume()
+	assert.NoError(t, err)
+	queue.data = partitionedTestResponse([]int{0, 0}, []int{11, 12})
+	_, err = c.consume()
+	assert.NoError(t, err)
+	assert.Equal(t, []map[int]int64{{0: 10, 1: 20}}, queue.commits, "the pending offsets should be committed with the failed batch")
+	assert.Equal(t, []map[int]int64{{0: 11}}, queue.seeks)
+	assert.Empty(t, c.pendingCommit)
+}
+
+func TestProcessedOffsets(t *testing.T) {
+	msgs := []Message{
+		{Partition: 0, Offset: 10}, {Partition: 1, Offset: 20}, {Partition: 0, Offset: 11},
+		{Partition: 1, Offset: 21}, {Partition: 0, Offset: 12}, {Partition: 2, Offset: 30},
+	}
+	failed := []Message{{Partition: 0, Offset: 12}, {Partition: 0, Offset: 11}, {Partition: 2, Offset: 30}}
+
+	committed, commitOffsets, seekOffsets := processedOffsets(msgs, failed)
+	assert.Equal(t, []Message{{Partition: 0, Offset: 10}, {Partition: 1, Offset: 20}, {Partition: 1, Offset: 21}}, committed)
+	assert.Equal(t, map[int]int64{0: 10, 1: 21}, commitOffsets, "partition 2 has nothing to commit")
+	assert.Equal(t, map[int]int64{0: 11, 2: 30}, seekOffsets)
+}
+
+func TestErrorAwareConsumerCommitsProcessedPartitions(t *testing.T) {
+	queue := &partitionCommitQueueCaller{batchQueueCaller: batchQueueCaller{data: partitionedTestResponse(
+		[]int{0, 0, 0, 1, 1}, []int{10, 11, 12, 20, 21},
+	)}}
+	var committed []int
+	failures := 1
+	c := newErrorAwareConsumerInstance(QueueConfig{
+		CommitProcessedOffsets: true,
+		ConcurrentProcessing:   true,
+		NoOfProcessors:         2,
+		AfterCommit:            func(offsets ...int) { committed = offsets },
+	}, func(m Message) error {
+		if m.Partition == 0 && m.Offset == 11 && failures > 0 {
+			failures--
+			return errors.New("processing failed")
+		}
+		return nil
+	}, nil, log.NewUPPLogger("Test", "FATAL"))
+	c.queue = queue
+
+	_, err := c.consume()
+	assert.NoError(t, err)
+	assert.Equal(t, []map[int]int64{{0: 10, 1: 21}}, queue.commits)
+	assert.Equal(t, []map[int]int64{{0: 11}}, queue.seeks, "partition 0 should be redelivered from the failed message")
+	assert.Equal(t, 0, queue.fullCommits)
+	assert.Equal(t, []int{10, 20, 21}, committed)
+
+	queue.data = partitionedTestResponse([]int{0, 0, 1}, []int{11, 12, 22})
+	_, err = c.consume()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, queue.fullCommits, "everything should be committed once no message fails")
+	assert.Len(t, queue.commits, 1)
+}
+
+func TestErrorAwareConsumerRedeliversFailedMessagesWithDedupWindow(t *testing.T) {
+	queue := &partitionCommitQueueCaller{batchQueueCaller: batchQueueCaller{data: partitionedTestResponse([]int{0, 0, 0}, []int{10, 11, 12})}}
+	var handled []int
+	failures := 1
+	c := newErrorAwareConsumerInstance(QueueConfig{
+		CommitProcessedOffsets: true,
+		DedupWindow:            10,
+	}, func(m Message) error {
+		handled = append(handled, m.Offset)
+		if m.Offset == 11 && failures > 0 {
+			failures--
+			return errors.New("processing failed")
+		}
+		return nil
+	}, nil, log.NewUPPLogger("Test", "FATAL"))
+	c.queue = queue
+
+	_, err := c.consume()
+	assert.NoError(t, err)
+	assert.Equal(t, []map[int]int64{{0: 11}}, queue.seeks)
+
+	queue.data = partitionedTestResponse([]int{0, 0}, []int{11, 12})
+	msgs, err := c.consume()
+	assert.NoError(t, err)
+	assert.Len(t, msgs, 2, "the messages from the seeked offset should not be skipped as duplicates")
+	assert.Equal(t, []int{10, 11, 12, 11, 12}, handled)
+	assert.Equal(t, 1, queue.fullCommits)
+
+	_, err = c.consume()
+	assert.NoError(t, err)
+	assert.Equal(t, []int{10, 11, 12, 11, 12}, handled, "the redelivered messages should be deduplicated again once processed")
+}
+
+func TestErrorAwareConsumerRecreatesInstanceWhenSeekIsRateLimited(t *testing.T) {
+	queue := &partitionCommitQueueCaller{
+		batchQueueCaller: batchQueueCaller{data: partitionedTestResponse([]int{0, 0}, []int{10, 11})},
+		seekErr:          &rateLimitError{retryAfter: time.Second},
+	}
+	c := newErrorAwareConsumerInstance(QueueConfig{CommitProcessedOffsets: true}, func(m Message) error {
+		if m.Offset == 11 {
+			return errors.New("processing failed")
+		}
+		return nil
+	}, nil, log.NewUPPLogger("Test", "FATAL"))
+	c.queue = queue
+
+	_, err := c.consume()
+	assert.True(t, errors.Is(err, ErrRateLimited), "the seek error should be returned")
+	assert.Equal(t, []map[int]int64{{0: 11}}, queue.seeks)
+	assert.Nil(t, c.consumer, "the consumer instance should be recreated for the failed message to be redelivered")
+}
+
+func TestErrorAwareConsumerDeadLettersPoisonMessage(t *testing.T) {
+	queue := &partitionCommitQueueCaller{batchQueueCaller: batchQueueCaller{data: partitionedTestResponse([]int{0, 0, 1}, []int{10, 11, 20})}}
+	var deadLettered []Message
+	var deadLetterErr error
+	c := newErrorAwareConsumerInstance(QueueConfig{
+		CommitProcessedOffsets: true,
+		MaxDeliveryAttempts:    3,
+		DeadLetter: func(m Message, err error) {
+			deadLettered = append(deadLettered, m)
+			deadLetterErr = err
+		},
+	}, func(m Message) error {
+		if m.Partition == 0 && m.Offset == 10 {
+			return errors.New("poison message")
+		}
+		return nil
+	}, nil, log.NewUPPLogger("Test", "FATAL"))
+	c.queue = queue
+
+	for i := 0; i < 2; i++ {
+		_, err := c.consume()
+		assert.NoError(t, err)
+		queue.data = partitionedTestResponse([]int{0, 0}, []int{10, 11})
+	}
+	assert.Empty(t, deadLettered)
+	assert.Equal(t, []map[int]int64{{0: 10}, {0: 10}}, queue.seeks, "the message should be redelivered until the last attempt")
+
+	_, err := c.consume()
+	assert.NoError(t, err)
+	assert.Len(t, deadLettered, 1)
+	assert.Equal(t, 10, deadLettered[0].Offset)
+	assert.EqualError(t, deadLetterErr, "poison message")
+	assert.Equal(t, 1, queue.fullCommits, "the offset should advance past the dead lettered message")
+	assert.Len(t, queue.seeks, 2)
+	assert.Empty(t, c.deliveryAttempts)
+}
+
+func TestErrorAwareConsumerDeadLettersPoisonMessageWithDedupWindow(t *testing.T) {
+	queue := &partitionCommitQueueCaller{batchQueueCaller: batchQueueCaller{data: partitionedTestResponse([]int{0, 0}, []int{10, 11})}}
+	var deadLettered []Message
+	attempts := 0
+	c := newErrorAwareConsumerInstance(QueueConfig{
+		CommitProcessedOffsets: true,
+		MaxDeliveryAttempts:    3,
+		DedupWindow:            10,
+		DeadLetter:             func(m Message, err error) { deadLettered = append(deadLettered, m) },
+	}, func(m Message) error {
+		if m.Offset == 10 {
+			attempts++
+			return errors.New("poison message")
+		}
+		return nil
+	}, nil, log.NewUPPLogger("Test", "FATAL"))
+	c.queue = queue
+
+	for i := 0; i < 3; i++ {
+		_, err := c.consume()
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, 3, attempts, "the redelivered message should not be skipped as a duplicate")
+	assert.Len(t, deadLettered, 1)
+	assert.Equal(t, 10, deadLettered[0].Offset)
+	assert.Equal(t, 1, queue.fullCommits)
+	assert.Len(t, queue.seeks, 2)
+
+	_, err := c.consume()
+	assert.NoError(t, err)
+	assert.Equal(t, 3, attempts, "the dead lettered message should be deduplicated once committed")
+}
+
+func TestValidateMessageDeadLettersInvalidMessages(t *testing.T) {
+	value := func(msg string) string { return base64.StdEncoding.EncodeToString([]byte(msg)) }
+	data := fmt.Sprintf(`[{"value":"%s","partition":0,"offset":10},{"value":"%s","partition":0,"offset":11},{"value":"%s","partition":1,"offset":20}]`,
+		value("FTMSG/1.0\r\nX-Request-Id: tid_1\r\n\r\nbody"),
+		value("FTMSG/1.0\r\nContent-Type: application/json\r\n\r\nbody"),
+		value("FTMSG/1.0\r\nX-Request-Id: tid_3\r\n\r\nbody"))
+	queue := &partitionCommitQueueCaller{batchQueueCaller: batchQueueCaller{data: []byte(data)}}
+	var handled, deadLettered []int
+	var deadLetterErr error
+	c := newConsumerInstance(QueueConfig{
+		ValidateMessage: func(m Message) error {
+			if _, found := m.Header("X-Request-Id"); !found {
+				return errors.New("missing X-Request-Id header")
+			}
+			return nil
+		},
+		DeadLetter: func(m Message, err error) {
+			deadLettered = append(deadLettered, m.Offset)
+			deadLetterErr = err
+		},
+	}, func(m Message) { handled = append(handled, m.Offset) }, nil, log.NewUPPLogger("Test", "FATAL"))
+	c.queue = queue
+
+	msgs, err := c.consume()
+	assert.NoError(t, err)
+	assert.Len(t, msgs, 3, "the invalid message should still be consumed")
+	assert.Equal(t, []int{10, 20}, handled)
+	assert.Equal(t, []int{11}, deadLettered)
+	assert.EqualError(t, deadLetterErr, "missing X-Request-Id header")
+	assert.Equal(t, 1, queue.fullCommits, "the invalid message should be committed with the batch")
+}
+
+func TestBatchedErrorAwareConsumerCommitsUpTo(t *testing.T) {
+	var tests = []struct {
+		name        string
+		commitUpTo  int
+		err         error
+		fullCommits int
+		commits     []map[int]int64
+		seeks       []map[int]int64
+	}{
+		{"full", 3, nil, 1, nil, nil},
+		{"full with more than the batch", 10, errors.New("ignored"), 1, nil, nil},
+		{"partial", 1, nil, 0, []map[int]int64{{0: 10}}, []map[int]int64{{0: 11, 1: 20}}},
+		{"partial across partitions", 2, errors.New("downstream unavailable"), 0, []map[int]int64{{0: 11}}, []map[int]int64{{1: 20}}},
+		{"zero", 0, errors.New("downstream unavailable"), 0, nil, []map[int]int64{{0: 10, 1: 20}}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			queue := &partitionCommitQueueCaller{batchQueueCaller: batchQueueCaller{data: partitionedTestResponse([]int{0, 0, 1}, []int{10, 11, 20})}}
+			var batches [][]Message
+			c := NewBatchedErrorAwareConsumer(QueueConfig{}, func(msgs []Message) (int, error) {
+				batches = append(batches, msgs)
+				return test.commitUpTo, test.err
+			}, nil, nil).(*Consumer)
+			instance := c.instanceHandlers[0].(*consumerInstance)
+			instance.queue = queue
+
+			_, err := instance.consume()
+			assert.NoError(t, err)
+			assert.Len(t, batches, 1)
+			assert.Len(t, batches[0], 3, "the handler should be given the whole batch")
+			assert.Equal(t, test.fullCommits, queue.fullCommits)
+			assert.Equal(t, test.commits, queue.commits)
+			assert.Equal(t, test.seeks, queue.seeks)
+		})
+	}
+}
+
+func TestBatchedErrorAwareConsumerLogsAutoCommit(t *testing.T) {
+	logger := log.NewUPPLogger("Test", "ERROR")
+	logger.Out = ioutil.Discard
+	hook := logTest.NewLocal(logger.Logger)
+
+	c := newBatchedErrorAwareConsumerInstance(QueueConfig{}, func(msgs []Message) (int, error) { return len(msgs), nil }, nil, logger)
+	assert.True(t, c.config.CommitProcessedOffsets)
+	assert.Empty(t, hook.AllEntries())
+
+	newBatchedErrorAwareConsumerInstance(QueueConfig{AutoCommitEnable: true}, func(msgs []Message) (int, error) { return len(msgs), nil }, nil, logger)
+	assert.Len(t, hook.AllEntries(), 1)
+	assert.Equal(t, logrus.ErrorLevel, hook.LastEntry().Level)
+}
+
+func TestBatchedErrorAwareConsumerRedeliversUnprocessedMessages(t *testing.T) {
+	queue := &partitionCommitQueueCaller{batchQueueCaller: batchQueueCaller{data: partitionedTestResponse([]int{0, 0, 0}, []int{10, 11, 12})}}
+	var batches [][]int
+	c := newBatchedErrorAwareConsumerInstance(QueueConfig{CommitProcessedOffsets: true}, func(msgs []Message) (int, error) {
+		batches = append(batches, messageOffsets(msgs))
+		if len(msgs) == 3 {
+			return 2, errors.New("downstream unavailable")
+		}
+		return len(msgs), nil
+	}, nil, log.NewUPPLogger("Test", "FATAL"))
+	c.queue = queue
+
+	_, err := c.consume()
+	assert.NoError(t, err)
+	assert.Equal(t, []map[int]int64{{0: 11}}, queue.commits, "only the first two messages should be committed")
+	assert.Equal(t, []map[int]int64{{0: 12}}, queue.seeks)
+
+	queue.data = partitionedTestResponse([]int{0}, []int{12})
+	_, err = c.consume()
+	assert.NoError(t, err)
+	assert.Equal(t, [][]int{{10, 11, 12}, {12}}, batches, "the third message should be redelivered")
+	assert.Equal(t, 1, queue.fullCommits)
+}
+
+func TestErrorAwareConsumerForgetsAttemptsOfProcessedMessages(t *testing.T) {
+	queue := &partitionCommitQueueCaller{batchQueueCaller: batchQueueCaller{data: partitionedTestResponse([]int{0}, []int{10})}}
+	failures := 2
+	deadLettered := false
+	c := newErrorAwareConsumerInstance(QueueConfig{
+		CommitProcessedOffsets: true,
+		MaxDeliveryAttempts:    3,
+		DeadLetter:             func(m Message, err error) { deadLettered = true },
+	}, func(m Message) error {
+		if failures > 0 {
+			failures--
+			return errors.New("temporary failure")
+		}
+		return nil
+	}, nil, log.NewUPPLogger("Test", "FATAL"))
+	c.queue = queue
+
+	for i := 0; i < 3; i++ {
+		_, err := c.consume()
+		assert.NoError(t, err)
+	}
+	assert.False(t, deadLettered)
+	assert.Empty(t, c.deliveryAttempts)
+	assert.Equal(t, 1, queue.fullCommits)
+}
+
+func TestErrorAwareConsumerCommitsEverythingByDefault(t *testing.T) {
+	queue := &partitionCommitQueueCaller{batchQueueCaller: batchQueueCaller{data: msgsTestByteA}}
+	c := newErrorAwareConsumerInstance(QueueConfig{}, func(m Message) error {
+		return errors.New("processing failed")
+	}, nil, log.NewUPPLogger("Test", "FATAL"))
+	c.queue = queue
+
+	_, err := c.consume()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, queue.fullCommits)
+	assert.Empty(t, queue.commits)
+	assert.Empty(t, queue.seeks)
+}
+
+func TestContextConsumerCancelsHandlerOnShutdown(t *testing.T) {
+	queue := &partitionCommitQueueCaller{batchQueueCaller: batchQueueCaller{data: partitionedTestResponse([]int{0}, []int{10})}}
+	started := make(chan struct{})
+	var deadLetterErr error
+	c := NewContextConsumer(QueueConfig{
+		CommitProcessedOffsets: true,
+		MaxDeliveryAttempts:    1,
+		DeadLetter:             func(m Message, err error) { deadLetterErr = err },
+	}, func(ctx context.Context, m Message) error {
+		close(started)
+		<-ctx.Done()
+		return ctx.Err()
+	}, nil, nil).(*Consumer)
+	c.instanceHandlers[0].(*consumerInstance).queue = queue
+
+	done := make(chan struct{})
+	go func() {
+		c.Start()
+		close(done)
+	}()
+	<-started
+	c.Stop()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("the handler context should be cancelled on shutdown")
+	}
+	assert.Equal(t, context.Canceled, deadLetterErr, "the handler error should be handled as with NewErrorAwareConsumer")
+}
+
+func TestContextConsumerCancelsHandlerWhenRunNContextIsDone(t *testing.T) {
+	var handlerErr error
+	c := NewContextConsumer(QueueConfig{}, func(ctx context.Context, m Message) error {
+		<-ctx.Done()
+		handlerErr = ctx.Err()
+		return handlerErr
+	}, nil, nil).(*Consumer)
+	c.instanceHandlers[0].(*consumerInstance).queue = &pollCountingQueueCaller{}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err := c.RunN(ctx, 0)
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.Equal(t, context.DeadlineExceeded, handlerErr)
+}
+
+func TestCommitOffset(t *testing.T) {
+	c := NewConsumer(QueueConfig{Topic: "methode-articles", StreamCount: 2}, func(m Message) {}, nil, nil).(*Consumer)
+	caller := &recordingHTTPCaller{}
+	for _, ih := range c.instanceHandlers {
+		ih.(*consumerInstance).queue.(*kafkaRESTClient).caller = caller
+	}
+
+	assert.Equal(t, ErrNotConsuming, c.CommitOffset(3, 42))
+	assert.Empty(t, caller.reqs)
+
+	instance := c.instanceHandlers[1].(*consumerInstance)
+	instance.queue.(*kafkaRESTClient).addrs = []string{"http://kafka-proxy-1.prod.ft.com"}
+	instance.setConsumer(&testConsumer)
+
+	assert.NoError(t, c.CommitOffset(3, 42))
+	assert.Len(t, caller.reqs, 1)
+	assert.Equal(t, "POST", caller.reqs[0].method)
+	assert.Equal(t, "http://kafka-proxy-1.prod.ft.com/consumers/group1/instances/rest-consumer-1-45864/offsets", caller.reqs[0].addr)
+	assert.JSONEq(t, `{"offsets": [{"topic": "methode-articles", "partition": 3, "offset": 42}]}`, caller.reqs[0].body)
+}
+
+func TestCommitOffsets(t *testing.T) {
+	c := NewConsumer(QueueConfig{Topic: "methode-articles", StreamCount: 2}, func(m Message) {}, nil, nil).(*Consumer)
+	caller := &recordingHTTPCaller{}
+	for _, ih := range c.instanceHandlers {
+		ih.(*consumerInstance).queue.(*kafkaRESTClient).caller = caller
+	}
+
+	assert.Equal(t, ErrNoOffsets, c.CommitOffsets(nil))
+	assert.Equal(t, ErrNoOffsets, c.CommitOffsets(map[int]int64{}))
+	assert.Equal(t, ErrNotConsuming, c.CommitOffsets(map[int]int64{0: 10}))
+	assert.Empty(t, caller.reqs)
+
+	instance := c.instanceHandlers[0].(*consumerInstance)
+	instance.queue.(*kafkaRESTClient).addrs = []string{"http://kafka-proxy-1.prod.ft.com"}
+	instance.setConsumer(&testConsumer)
+
+	assert.NoError(t, c.CommitOffsets(map[int]int64{2: 7, 0: 10, 1: 3}))
+	assert.Len(t, caller.reqs, 1, "the offsets should be committed in a single request")
+	assert.Equal(t, "POST", caller.reqs[0].method)
+	assert.Equal(t, "http://kafka-proxy-1.prod.ft.com/consumers/group1/instances/rest-consumer-1-45864/offsets", caller.reqs[0].addr)
+	assert.JSONEq(t, `{"offsets": [
+		{"topic": "methode-articles", "partition": 0, "offset": 10},
+		{"topic": "methode-articles", "partition": 1, "offset": 3},
+		{"topic": "methode-articles", "partition": 2, "offset": 7}
+	]}`, caller.reqs[0].body)
+}
+
+// run with -race: the explicit commits build their URL from the active address the reconnects rotate
+func TestCommitOffsetsDuringReconnect(t *testing.T) {
+	c := NewConsumer(QueueConfig{Addrs: []string{"http://kafka-proxy-1.prod.ft.com", "http://kafka-proxy-2.prod.ft.com"}, Topic: "methode-articles"},
+		func(m Message) {}, nil, nil).(*Consumer)
+	instance := c.instanceHandlers[0].(*consumerInstance)
+	instance.queue.(*kafkaRESTClient).caller = testHTTPCaller{}
+	instance.setConsumer(&testConsumer)
+
+	started, done := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(done)
+		close(started)
+		for i := 0; i < 500; i++ {
+			//there is no consumer instance to commit with in between the teardown and the new instance
+			if err := c.CommitOffset(0, int64(i)); err != ErrNotConsuming {
+				assert.NoError(t, err)
+			}
+			if err := c.CommitOffsets(map[int]int64{0: int64(i), 1: int64(i)}); err != ErrNotConsuming {
+				assert.NoError(t, err)
+			}
+		}
+	}()
+	<-started
+	for i := 0; i < 500; i++ {
+		assert.NoError(t, c.Reconnect())
+	}
+	<-done
+}
+
+func TestConsumeRetriesFailedCommitWithoutShutdown(t *testing.T) {
+	caller := &failingCommitHTTPCaller{commitFailures: 2}
+	consumer := &consumerInstance{
+		config: QueueConfig{},
+		queue: &kafkaRESTClient{
+			addrs:               []string{"http://kafka-proxy-1.prod.ft.com"},
+			caller:              caller,
+			commitRetries:       2,
+			commitRetryInterval: time.Millisecond,
+		},
+		consumer:  consInstTest,
+		processor: splitMessageProcessor{func(m Message) {}},
+		logger:    log.NewUPPLogger("Test", "FATAL"),
+	}
+
+	msgs, err := consumer.consume()
+	assert.NoError(t, err)
+	assert.Equal(t, msgsTest, msgs)
+	assert.Equal(t, 3, caller.commits)
+	assert.Equal(t, 0, caller.deletes, "the consumer instance should not be destroyed")
+	assert.Equal(t, consInstTest, consumer.consumer)
+}
+
+func TestConsumeShutsDownAfterCommitRetriesAreExhausted(t *testing.T) {
+	caller := &failingCommitHTTPCaller{commitFailures: 3}
+	consumer := &consumerInstance{
+		config: QueueConfig{},
+		queue: &kafkaRESTClient{
+			addrs:               []string{"http://kafka-proxy-1.prod.ft.com"},
+			caller:              caller,
+			commitRetries:       2,
+			commitRetryInterval: time.Millisecond,
+		},
+		consumer:  consInstTest,
+		processor: splitMessageProcessor{func(m Message) {}},
+		logger:    log.NewUPPLogger("Test", "FATAL"),
+	}
+
+	_, err := consumer.consume()
+	assert.Error(t, err)
+	assert.Equal(t, 3, caller.commits)
+	assert.Equal(t, 2, caller.deletes, "the consumer instance subscription and instance should be destroyed")
+	assert.Nil(t, consumer.consumer)
+}
+
+func TestProcessorChannelBuffer(t *testing.T) {
+	c := consumerInstance{config: QueueConfig{}}
+	assert.Equal(t, defaultProcessorChannelBuffer, cap(c.newProcessorChannel()))
+
+	c = consumerInstance{config: QueueConfig{ProcessorChannelBuffer: 16}}
+	assert.Equal(t, 16, cap(c.newProcessorChannel()))
+}
+
+func TestMaxInFlightLimitsConcurrentHandlers(t *testing.T) {
+	offsets := make([]int, 50)
+	for i := range offsets {
+		offsets[i] = i
+	}
+	var running, maxRunning, processed int32
+	c := &consumerInstance{
+		config:   QueueConfig{ConcurrentProcessing: true, NoOfProcessors: 10, MaxInFlight: 3, AutoCommitEnable: true},
+		queue:    batchQueueCaller{data: partitionedTestResponse(make([]int, len(offsets)), offsets)},
+		consumer: consInstTest,
+		processor: splitMessageProcessor{func(m Message) {
+			n := atomic.AddInt32(&running, 1)
+			for {
+				max := atomic.LoadInt32(&maxRunning)
+				if n <= max || atomic.CompareAndSwapInt32(&maxRunning, max, n) {
+					break
+				}
+			}
+			time.Sleep(time.Millisecond)
+			atomic.AddInt32(&running, -1)
+			atomic.AddInt32(&processed, 1)
+		}},
+		logger: log.NewUPPLogger("Test", "FATAL"),
+	}
+
+	_, err := c.consume()
+	assert.NoError(t, err)
+	assert.Equal(t, int32(50), processed)
+	assert.True(t, maxRunning <= 3, "%d handlers ran concurrently", maxRunning)
+}
+
+func TestWorkerKeyFuncRoutesKeysToTheSameProcessor(t *testing.T) {
+	keys := []string{"a", "b", "c"}
+	var msgs []Message
+	for i := 0; i < 60; i++ {
+		msgs = append(msgs, Message{Headers: map[string]string{"Key": keys[i%len(keys)]}, Offset: i})
+	}
+
+	var mu sync.Mutex
+	processed := make(map[string][]int)
+	running := make(map[string]int)
+	c := &consumerInstance{
+		config: QueueConfig{
+			ConcurrentProcessing: true,
+			NoOfProcessors:       10,
+			WorkerKeyFunc:        func(m Message) string { return m.Headers["Key"] },
+		},
+		processor: splitMessageProcessor{func(m Message) {
+			key := m.Headers["Key"]
+			mu.Lock()
+			running[key]++
+			assert.Equal(t, 1, running[key], "messages with key %s processed concurrently", key)
+			mu.Unlock()
+			time.Sleep(100 * time.Microsecond)
+			mu.Lock()
+			running[key]--
+			processed[key] = append(processed[key], m.Offset)
+			mu.Unlock()
+		}},
+		logger: log.NewUPPLogger("Test", "FATAL"),
+	}
+	c.processMessages(context.Background(), msgs)
+
+	for i, key := range keys {
+		var expected []int
+		for offset := i; offset < len(msgs); offset += len(keys) {
+			expected = append(expected, offset)
+		}
+		assert.Equal(t, expected, processed[key], "messages with key %s should be processed in order", key)
+	}
+
+	chs, route := c.processorChannels(10)
+	assert.Len(t, chs, 10)
+	assert.Equal(t, route(msgs[0]), route(msgs[3]), "the same key should be routed to the same processor")
+
+	c.config.WorkerKeyFunc = nil
+	chs, route = c.processorChannels(10)
+	assert.Len(t, chs, 1, "the processors should share a channel without WorkerKeyFunc")
+	assert.Equal(t, 0, route(msgs[1]))
+}
+
+func BenchmarkConcurrentProcessingChannelBuffer(b *testing.B) {
+	var resp []string
+	for i := 0; i < 1000; i++ {
+		resp = append(resp, fmt.Sprintf(`{"value":"RlRNU0cvMS4wCgpib2R5Cg==","partition":0,"offset":%d}`, i))
+	}
+	queue := batchQueueCaller{data: []byte("[" + strings.Join(resp, ",") + "]")}
+
+	for _, buffer := range []int{1, 128, 1024} {
+		b.Run(fmt.Sprintf("buffer-%d", buffer), func(b *testing.B) {
+			c := &consumerInstance{
+				config:    QueueConfig{ConcurrentProcessing: true, NoOfProcessors: 10, ProcessorChannelBuffer: buffer, AutoCommitEnable: true},
+				queue:     queue,
+				consumer:  consInstTest,
+				processor: splitMessageProcessor{func(m Message) { time.Sleep(time.Microsecond) }},
+				logger:    log.NewUPPLogger("Test", "FATAL"),
+			}
+			for i := 0; i < b.N; i++ {
+				_, _ = c.consume()
+			}
+		})
+	}
+}
+
+func TestMaxMessagesPerSecondCapsProcessingRate(t *testing.T) {
+	msgs := make([]Message, 21)
+	//the first message goes right away, each of the others 10ms after the previous one
+	var expected []time.Duration
+	for i := 1; i < len(msgs); i++ {
+		expected = append(expected, time.Duration(i)*10*time.Millisecond)
+	}
+	for _, concurrent := range []bool{false, true} {
+		var processed int32
+		clk := &fakeClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+		c := newInMemoryConsumer(QueueConfig{MaxMessagesPerSecond: 100, ConcurrentProcessing: concurrent, NoOfProcessors: 4}, msgs, splitMessageProcessor{func(m Message) {
+			atomic.AddInt32(&processed, 1)
+		}})
+		c.instance.clock = clk
+
+		c.Start()
+
+		assert.Equal(t, int32(21), atomic.LoadInt32(&processed), "no message should be dropped")
+		waits := clk.waits()
+		sort.Slice(waits, func(i, j int) bool { return waits[i] < waits[j] })
+		assert.Equal(t, expected, waits, "concurrent %v: 21 messages at 100/s should be spread over 200ms", concurrent)
+	}
+}
+
+func TestMaxMessagesPerSecondWithBatches(t *testing.T) {
+	clk := &fakeClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	var batches int
+	c := &consumerInstance{
+		config:    QueueConfig{MaxMessagesPerSecond: 10},
+		processor: batchedMessageProcessor{func(m []Message) { batches++ }},
+		logger:    log.NewUPPLogger("Test", "FATAL"),
+		clock:     clk,
+	}
+
+	c.processMessages(context.Background(), make([]Message, 3))
+	c.processMessages(context.Background(), make([]Message, 2))
+	assert.Equal(t, 2, batches)
+	assert.Equal(t, []time.Duration{300 * time.Millisecond}, clk.waits(), "the next batch should wait for the messages of the previous one")
+}
+
+func TestCommitErrorLoggedWithBatchOffsets(t *testing.T) {
+	logger := log.NewUPPLogger("Test", "ERROR")
+	logger.Out = ioutil.Discard
+	hook := logTest.NewLocal(logger.Logger)
+
+	c := &consumerInstance{
+		queue:     &failingCommitQueueCaller{batchQueueCaller: batchQueueCaller{data: partitionedTestResponse([]int{1, 0, 0, 0}, []int{20, 10, 11, 12})}},
+		processor: splitMessageProcessor{func(m Message) {}},
+		logger:    logger,
+	}
+	_, err := c.consume()
+	assert.Error(t, err)
+
+	var entry *logrus.Entry
+	for _, e := range hook.AllEntries() {
+		if e.Message == "Error committing offsets" {
+			entry = e
+		}
+	}
+	if assert.NotNil(t, entry) {
+		assert.Equal(t, "0:10-12,1:20", entry.Data["offsets"])
+	}
+}
+
+func TestBatchOffsets(t *testing.T) {
+	assert.Equal(t, "", batchOffsets(nil))
+	assert.Equal(t, "3:7", batchOffsets([]Message{{Partition: 3, Offset: 7}}))
+	assert.Equal(t, "0:10-12,2:5-6", batchOffsets([]Message{{Partition: 2, Offset: 6}, {Partition: 0, Offset: 10}, {Partition: 2, Offset: 5}, {Partition: 0, Offset: 12}}))
+}
+
+func TestReconnectWarningAboveThreshold(t *testing.T) {
+	logger := log.NewUPPLogger("Test", "WARN")
+	logger.Out = ioutil.Discard
+	hook := logTest.NewLocal(logger.Logger)
+
+	c := &consumerInstance{
+		config:    QueueConfig{ReconnectWarnThreshold: 2},
+		queue:     consumeMsgErrorQueueCaller{},
+		processor: splitMessageProcessor{func(m Message) {}},
+		logger:    logger,
+	}
+
+	for i := 0; i < 3; i++ {
+		_, _ = c.consume()
+	}
+	assert.Equal(t, 2, c.reconnects)
+	assert.Empty(t, reconnectWarnings(hook))
+
+	_, _ = c.consume()
+	assert.Equal(t, 3, c.reconnects)
+	warnings := reconnectWarnings(hook)
+	assert.Len(t, warnings, 1)
+	assert.Equal(t, 3, warnings[0].Data["reconnects"])
+
+	_, _ = c.consume()
+	warnings = reconnectWarnings(hook)
+	assert.Len(t, warnings, 2)
+	assert.Equal(t, 4, warnings[1].Data["reconnects"], "the warning should escalate with the reconnect count")
+}
+
+func TestReconnectCountResetsAfterSustainedSuccess(t *testing.T) {
+	c := &consumerInstance{
+		config:        QueueConfig{ReconnectWarnThreshold: 1, ReconnectWarnWindow: time.Minute},
+		logger:        log.NewUPPLogger("Test", "FATAL"),
+		reconnects:    5,
+		lastCreatedAt: time.Now().Add(-2 * time.Minute),
+	}
+
+	c.recordReconnect()
+	assert.Equal(t, 1, c.reconnects)
+}
+
+func TestLargeBatchWarningAboveThreshold(t *testing.T) {
+	var tests = []struct {
+		threshold        int
+		expectedWarnings int
+	}{
+		{0, 0},
+		{1, 1},
+		{2, 0},
+		{3, 0},
+	}
+
+	for _, test := range tests {
+		logger := log.NewUPPLogger("Test", "WARN")
+		logger.Out = ioutil.Discard
+		hook := logTest.NewLocal(logger.Logger)
+
+		var sizes []int
+		c := &consumerInstance{
+			config: QueueConfig{
+				LargeBatchThreshold: test.threshold,
+				OnLargeBatch:        func(size int) { sizes = append(sizes, size) },
+			},
+			queue:     defaultTestQueueCaller{},
+			processor: splitMessageProcessor{func(m Message) {}},
+			logger:    logger,
+		}
+		_, err := c.consume()
+		assert.NoError(t, err)
+
+		var warnings []logrus.Entry
+		for _, e := range hook.AllEntries() {
+			if e.Level == logrus.WarnLevel && e.Data["batchSize"] != nil {
+				warnings = append(warnings, *e)
+			}
+		}
+		assert.Len(t, warnings, test.expectedWarnings, "threshold %d", test.threshold)
+		assert.Len(t, sizes, test.expectedWarnings, "threshold %d", test.threshold)
+		if test.expectedWarnings > 0 {
+			assert.Equal(t, 2, warnings[0].Data["batchSize"])
+			assert.Equal(t, []int{2}, sizes)
+		}
+	}
+}
+
+func TestSlowHandlerWarning(t *testing.T) {
+	logger := log.NewUPPLogger("Test", "WARN")
+	logger.Out = ioutil.Discard
+	hook := logTest.NewLocal(logger.Logger)
+
+	clk := &fakeClock{now: time.Now()}
+	msgs := []Message{
+		{Headers: map[string]string{"X-Request-Id": "tid_fast"}, Partition: 0, Offset: 1},
+		{Headers: map[string]string{"X-Request-Id": "tid_slow"}, Partition: 1, Offset: 2},
+	}
+	c := &consumerInstance{
+		config: QueueConfig{SlowHandlerThreshold: time.Second},
+		processor: splitMessageProcessor{func(m Message) {
+			if m.Offset == 2 {
+				clk.now = clk.now.Add(2 * time.Second)
+			}
+		}},
+		logger: logger,
+		clock:  clk,
+	}
+	c.processMessages(context.Background(), msgs)
+
+	entries := hook.AllEntries()
+	assert.Len(t, entries, 1, "only the slow message should be logged")
+	assert.Equal(t, logrus.WarnLevel, entries[0].Level)
+	assert.Equal(t, "tid_slow", entries[0].Data["transaction_id"])
+	assert.Equal(t, 1, entries[0].Data["partition"])
+	assert.Equal(t, 2, entries[0].Data["offset"])
+	assert.Equal(t, "2s", entries[0].Data["duration"])
+
+	hook.Reset()
+	c.processor = batchedMessageProcessor{func(m []Message) { clk.now = clk.now.Add(3 * time.Second) }}
+	c.processMessages(context.Background(), msgs)
+	entries = hook.AllEntries()
+	assert.Len(t, entries, 1)
+	assert.Equal(t, 2, entries[0].Data["batchSize"])
+	assert.Equal(t, "0:1,1:2", entries[0].Data["offsets"])
+	assert.Equal(t, "3s", entries[0].Data["duration"])
+
+	hook.Reset()
+	c.config.SlowHandlerThreshold = 0
+	c.processMessages(context.Background(), msgs)
+	assert.Empty(t, hook.AllEntries(), "no warning should be logged without a threshold")
+}
+
+func TestDebugRawResponses(t *testing.T) {
+	offsets := make([]int, 100)
+	for i := range offsets {
+		offsets[i] = i
+	}
+	data := partitionedTestResponse(make([]int, len(offsets)), offsets)
+	assert.True(t, len(data) > maxDebugResponse)
+
+	for _, enabled := range []bool{false, true} {
+		logger := log.NewUPPLogger("Test", "DEBUG")
+		logger.Out = ioutil.Discard
+		hook := logTest.NewLocal(logger.Logger)
+
+		c := &consumerInstance{
+			config:    QueueConfig{DebugRawResponses: enabled, AutoCommitEnable: true},
+			queue:     batchQueueCaller{data: data},
+			consumer:  consInstTest,
+			processor: splitMessageProcessor{func(m Message) {}},
+			logger:    logger,
+		}
+		msgs, err := c.consume()
+		assert.NoError(t, err)
+		assert.Len(t, msgs, 100, "recording the response should not affect parsing")
+
+		var responses []logrus.Entry
+		for _, e := range hook.AllEntries() {
+			if e.Data["response"] != nil {
+				responses = append(responses, *e)
+			}
+		}
+		if !enabled {
+			assert.Empty(t, responses, "raw responses should not be logged by default")
+			continue
+		}
+		assert.Len(t, responses, 1)
+		assert.Equal(t, logrus.DebugLevel, responses[0].Level)
+		assert.Equal(t, http.StatusOK, responses[0].Data["status"])
+		assert.Equal(t, string(data[:maxDebugResponse]), responses[0].Data["response"], "the response should be truncated")
+	}
+}
+
+func TestOnRawResponse(t *testing.T) {
+	data := partitionedTestResponse([]int{0, 1}, []int{10, 20})
+	for _, enabled := range []bool{false, true} {
+		var raw [][]byte
+		c := &consumerInstance{
+			config: QueueConfig{
+				DebugRawResponses: enabled,
+				AutoCommitEnable:  true,
+				OnRawResponse:     func(data []byte) { raw = append(raw, data) },
+			},
+			queue:     batchQueueCaller{data: data},
+			consumer:  consInstTest,
+			processor: splitMessageProcessor{func(m Message) {}},
+			logger:    log.NewUPPLogger("Test", "FATAL"),
+		}
+		msgs, err := c.consume()
+		assert.NoError(t, err)
+		assert.Len(t, msgs, 2, "the response should still be parsed")
+
+		if !enabled {
+			assert.Empty(t, raw, "the hook should only be called when DebugRawResponses is set")
+			continue
+		}
+		assert.Equal(t, [][]byte{data}, raw)
+	}
+}
+
+func TestDebugRawResponsesOfFailedConsume(t *testing.T) {
+	logger := log.NewUPPLogger("Test", "DEBUG")
+	logger.Out = ioutil.Discard
+	hook := logTest.NewLocal(logger.Logger)
+
+	c := &consumerInstance{
+		config: QueueConfig{DebugRawResponses: true},
+		queue: &kafkaRESTClient{
+			addrs:  []string{"http://kafka-proxy-1.prod.ft.com"},
+			caller: &failingCreateHTTPCaller{status: http.StatusBadGateway},
+		},
+		consumer:  consInstTest,
+		processor: splitMessageProcessor{func(m Message) {}},
+		logger:    logger,
+	}
+	_, err := c.consume()
+	assert.Error(t, err)
+
+	var found bool
+	for _, e := range hook.AllEntries() {
+		if e.Message == "Raw proxy response" {
+			found = true
+			assert.Equal(t, http.StatusBadGateway, e.Data["status"])
+		}
+	}
+	assert.True(t, found)
+}
+
+func TestLogEntriesHaveTopicAndGroup(t *testing.T) {
+	logger := log.NewUPPLogger("Test", "ERROR")
+	logger.Out = ioutil.Discard
+	hook := logTest.NewLocal(logger.Logger)
+
+	c := &consumerInstance{
+		config:    QueueConfig{Topic: "methode-articles", Group: "mcpm-group"},
+		queue:     consumeMsgErrorQueueCaller{},
+		processor: splitMessageProcessor{func(m Message) {}},
+		logger:    logger,
+	}
+	_, _ = c.consume()
+
+	assert.NotEmpty(t, hook.AllEntries())
+	for _, e := range hook.AllEntries() {
+		assert.Equal(t, "methode-articles", e.Data["topic"], e.Message)
+		assert.Equal(t, "mcpm-group", e.Data["group"], e.Message)
+	}
+}
+
+func TestInMemoryConsumer(t *testing.T) {
+	var tests = []struct {
+		name   string
+		config QueueConfig
+	}{
+		{name: "sequential", config: QueueConfig{}},
+		{name: "concurrent", config: QueueConfig{ConcurrentProcessing: true, NoOfProcessors: 4}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var mu sync.Mutex
+			var received []Message
+			c := NewInMemoryConsumer(test.config, msgsTest, func(m Message) {
+				mu.Lock()
+				defer mu.Unlock()
+				received = append(received, m)
+			})
+
+			c.Start()
+			c.Stop()
+
+			assert.Len(t, received, len(msgsTest))
+			for _, m := range msgsTest {
+				assert.Contains(t, received, m)
+			}
+			if !test.config.ConcurrentProcessing {
+				assert.Equal(t, msgsTest, received, "messages should be handled in order")
+			}
+		})
+	}
+}
+
+func TestInMemoryBatchedConsumer(t *testing.T) {
+	var batches [][]Message
+	c := NewInMemoryBatchedConsumer(QueueConfig{}, msgsTest, func(m []Message) {
+		batches = append(batches, m)
+	})
+
+	c.Start()
+
+	assert.Equal(t, [][]Message{msgsTest}, batches)
+	msg, err := c.ConnectivityCheck()
+	assert.NoError(t, err)
+	assert.NotEmpty(t, msg)
+}
+
+func TestKeepAliveWhileProcessing(t *testing.T) {
+	queue := &keepAliveCountingQueueCaller{}
+	clk := newManualClock()
+	release := make(chan struct{})
+	c := &consumerInstance{
+		config:   QueueConfig{KeepAliveInterval: time.Minute},
+		queue:    queue,
+		consumer: consInstTest,
+		processor: batchedMessageProcessor{func(m []Message) {
+			<-release
+		}},
+		logger: log.NewUPPLogger("Test", "FATAL"),
+		clock:  clk,
+	}
+
+	result := make(chan error, 1)
+	go func() {
+		_, err := c.consume()
+		result <- err
+	}()
+
+	timer := clk.next(t, time.Minute)
+	for i := 1; i <= 2; i++ {
+		timer <- time.Time{}
+		//the next keep-alive is only scheduled once the ping is done
+		timer = clk.next(t, time.Minute)
+		assert.Equal(t, int32(i), atomic.LoadInt32(&queue.pings), "the consumer instance should be pinged while processing")
+	}
+
+	close(release)
+	assert.NoError(t, <-result)
+	timer <- time.Time{}
+	assert.Equal(t, int32(2), atomic.LoadInt32(&queue.pings), "keep-alive should stop once processing is done")
 }
 
-func TestConsumeWhileActiveTerminates(t *testing.T) {
-	sdChan := make(chan bool)
-	c := consumerInstance{config: QueueConfig{}, queue: defaultTestQueueCaller{}, shutdownChan: sdChan, processor: splitMessageProcessor{func(m Message) {}}}
-	var wg sync.WaitGroup
-	wg.Add(1)
+func TestPauseAndResume(t *testing.T) {
+	queue := &pollCountingQueueCaller{empty: true}
+	clk := newManualClock()
+	c := &Consumer{1, []instanceHandler{&consumerInstance{
+		//the keep-alive of the paused instance tells the test the loop is waiting
+		config:       QueueConfig{KeepAliveInterval: time.Minute},
+		queue:        queue,
+		consumer:     consInstTest,
+		shutdownChan: make(chan bool, 1),
+		processor:    splitMessageProcessor{func(m Message) {}},
+		logger:       log.NewUPPLogger("Test", "FATAL"),
+		backoff:      time.Second,
+		clock:        clk,
+	}}}
+
+	c.Pause()
+	done := make(chan struct{})
 	go func() {
-		c.consumeWhileActive()
-		wg.Done()
+		c.Start()
+		close(done)
 	}()
-	sdChan <- true
-	wg.Wait()
+	clk.next(t, time.Minute)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&queue.polls), "a paused consumer should not poll")
+
+	c.Resume()
+	backoff := clk.next(t, time.Second)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&queue.polls), "a resumed consumer should poll again")
+
+	c.Pause()
+	backoff <- time.Time{}
+	clk.next(t, time.Minute)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&queue.polls), "the consumer should not poll again once paused")
+	assert.Equal(t, int32(0), atomic.LoadInt32(&queue.destroyed), "the consumer instance should be kept while paused")
+
+	c.Stop()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("a paused consumer should stop")
+	}
 }
 
-func TestStartStop(t *testing.T) {
-	consumers := make([]instanceHandler, 2)
-	for i := 0; i < 2; i++ {
-		consumers[i] = &consumerInstance{config: QueueConfig{}, queue: defaultTestQueueCaller{}, shutdownChan: make(chan bool), processor: splitMessageProcessor{func(m Message) {}}}
+func TestPauseKeepsConsumerInstanceAlive(t *testing.T) {
+	queue := &keepAliveCountingQueueCaller{}
+	clk := newManualClock()
+	c := &consumerInstance{
+		config:       QueueConfig{KeepAliveInterval: time.Minute},
+		queue:        queue,
+		consumer:     consInstTest,
+		shutdownChan: make(chan bool, 1),
+		processor:    splitMessageProcessor{func(m Message) {}},
+		logger:       log.NewUPPLogger("Test", "FATAL"),
+		clock:        clk,
 	}
-	c := Consumer{2, consumers}
+	c.pause()
 
-	var wg sync.WaitGroup
-	wg.Add(1)
+	ctx, cancel := context.WithCancel(context.Background())
+	result := make(chan error)
+	go func() { result <- c.consumeN(ctx, 0) }()
+	timer := clk.next(t, time.Minute)
+	for i := 1; i <= 2; i++ {
+		timer <- time.Time{}
+		//the next keep-alive is only scheduled once the ping is done
+		timer = clk.next(t, time.Minute)
+		assert.Equal(t, int32(i), atomic.LoadInt32(&queue.pings), "the consumer instance should be pinged while paused")
+	}
+	cancel()
+	assert.Equal(t, context.Canceled, <-result)
+}
+
+func TestKeepAliveStopsWhenHandlerPanics(t *testing.T) {
+	queue := &keepAliveCountingQueueCaller{}
+	clk := newManualClock()
+	c := &consumerInstance{
+		config:   QueueConfig{KeepAliveInterval: time.Minute},
+		queue:    queue,
+		consumer: consInstTest,
+		processor: batchedMessageProcessor{func(m []Message) {
+			panic("handler failed")
+		}},
+		logger: log.NewUPPLogger("Test", "FATAL"),
+		clock:  clk,
+	}
+
+	assert.Panics(t, func() { _, _ = c.consume() })
+	//the keep-alive has returned by then, so firing its timer neither pings nor schedules the next keep-alive
+	clk.next(t, time.Minute) <- time.Time{}
+	select {
+	case <-clk.timers:
+		t.Fatal("the keep-alive should stop once the handler panicked")
+	case <-time.After(50 * time.Millisecond):
+	}
+	assert.Equal(t, int32(0), atomic.LoadInt32(&queue.pings))
+}
+
+func TestNoKeepAliveByDefault(t *testing.T) {
+	queue := &keepAliveCountingQueueCaller{}
+	clk := newManualClock()
+	c := &consumerInstance{
+		config:    QueueConfig{},
+		queue:     queue,
+		consumer:  consInstTest,
+		processor: batchedMessageProcessor{func(m []Message) {}},
+		logger:    log.NewUPPLogger("Test", "FATAL"),
+		clock:     clk,
+	}
+
+	_, err := c.consume()
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(clk.timers), "no keep-alive should be scheduled")
+	assert.Equal(t, int32(0), atomic.LoadInt32(&queue.pings))
+}
 
+func reconnectWarnings(hook *logTest.Hook) []logrus.Entry {
+	var warnings []logrus.Entry
+	for _, e := range hook.AllEntries() {
+		if e.Level == logrus.WarnLevel && e.Data["reconnects"] != nil {
+			warnings = append(warnings, *e)
+		}
+	}
+	return warnings
+}
+
+func TestStartTwiceRunsASingleLoop(t *testing.T) {
+	queue := &shutdownRecordingQueueCaller{}
+	subscribed := make(chan struct{})
+	var once sync.Once
+	c := &Consumer{1, []instanceHandler{&consumerInstance{
+		config:       QueueConfig{BackoffPeriod: 1, OnSubscribe: func(string) { once.Do(func() { close(subscribed) }) }},
+		queue:        queue,
+		shutdownChan: make(chan bool, 1),
+		processor:    splitMessageProcessor{func(m Message) {}},
+		logger:       log.NewUPPLogger("Test", "FATAL"),
+	}}}
+
+	done := make(chan struct{})
 	go func() {
 		c.Start()
-		wg.Done()
+		close(done)
+	}()
+	<-subscribed
+
+	second := make(chan struct{})
+	go func() {
+		c.Start()
+		close(second)
 	}()
+	select {
+	case <-second:
+	case <-time.After(time.Second):
+		t.Fatal("the second Start should return right away")
+	}
+	assert.Equal(t, ErrAlreadyRunning, c.RunN(context.Background(), 1))
+	_, err := c.WaitForMessages(context.Background())
+	assert.Equal(t, ErrAlreadyRunning, err)
+	_, err = c.Poll()
+	assert.Equal(t, ErrAlreadyRunning, err)
+	assert.Equal(t, ErrAlreadyRunning, c.Close())
+
 	c.Stop()
-	wg.Wait()
+	c.Stop()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("consumer did not shut down")
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&queue.destroyed), "the consumer instance should only be torn down once")
+}
+
+func TestInitiateShutdownAfterLoopStopped(t *testing.T) {
+	queue := &pollCountingQueueCaller{}
+	c := &consumerInstance{
+		queue:        queue,
+		shutdownChan: make(chan bool, 1),
+		processor:    splitMessageProcessor{func(m Message) {}},
+		logger:       log.NewUPPLogger("Test", "FATAL"),
+	}
+	assert.NoError(t, c.consumeN(context.Background(), 1))
+
+	stopped := make(chan struct{})
+	go func() {
+		c.initiateShutdown()
+		c.initiateShutdown()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("initiateShutdown should not block once the loop has stopped")
+	}
+
+	assert.NoError(t, c.consumeN(context.Background(), 1))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&queue.polls), "a loop started after the shutdown should stop right away")
+}
+
+func TestStopConsumingWaitsForTeardown(t *testing.T) {
+	var tests = []struct {
+		name    string
+		err     error
+		timeout time.Duration
+		release bool
+	}{
+		{"teardown completed", nil, 5 * time.Second, true},
+		{"teardown failed", errors.New("delete failed"), 5 * time.Second, true},
+		{"timeout", nil, 50 * time.Millisecond, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			queue := &slowDestroyQueueCaller{release: make(chan struct{}), err: test.err}
+			subscribed := make(chan struct{})
+			var once sync.Once
+			c := &Consumer{1, []instanceHandler{&consumerInstance{
+				config:       QueueConfig{BackoffPeriod: 1, OnSubscribe: func(string) { once.Do(func() { close(subscribed) }) }},
+				queue:        queue,
+				shutdownChan: make(chan bool, 1),
+				processor:    splitMessageProcessor{func(m Message) {}},
+				logger:       log.NewUPPLogger("Test", "FATAL"),
+			}}}
+			done := make(chan struct{})
+			go func() {
+				c.Start()
+				close(done)
+			}()
+			<-subscribed
+
+			if test.release {
+				go func() {
+					time.Sleep(20 * time.Millisecond)
+					close(queue.release)
+				}()
+			} else {
+				defer close(queue.release)
+			}
+			err := c.StopConsuming(test.timeout)
+
+			if !test.release {
+				assert.Equal(t, context.DeadlineExceeded, err)
+				assert.Equal(t, int32(0), atomic.LoadInt32(&queue.destroyed))
+				return
+			}
+			assert.Equal(t, test.err, err)
+			assert.Equal(t, int32(1), atomic.LoadInt32(&queue.destroyed), "StopConsuming should return once the consumer instance is deleted")
+			<-done
+		})
+	}
+}
+
+func TestStopConsumingWhenNotRunning(t *testing.T) {
+	c := NewConsumer(QueueConfig{StreamCount: 2}, func(m Message) {}, nil, nil).(*Consumer)
+	assert.NoError(t, c.StopConsuming(time.Second))
+}
+
+func TestPollPreventsLoopsFromStarting(t *testing.T) {
+	handling, release := make(chan struct{}), make(chan struct{})
+	var once sync.Once
+	c := &Consumer{1, []instanceHandler{&consumerInstance{
+		config:       QueueConfig{},
+		queue:        defaultTestQueueCaller{},
+		shutdownChan: make(chan bool, 1),
+		processor: splitMessageProcessor{func(m Message) {
+			once.Do(func() {
+				close(handling)
+				<-release
+			})
+		}},
+		logger: log.NewUPPLogger("Test", "FATAL"),
+	}}}
+
+	polled := make(chan error, 1)
+	go func() {
+		_, err := c.Poll()
+		polled <- err
+	}()
+	<-handling
+
+	assert.Equal(t, ErrAlreadyRunning, c.RunN(context.Background(), 1))
+	_, err := c.Poll()
+	assert.Equal(t, ErrAlreadyRunning, err)
+	assert.Equal(t, ErrAlreadyRunning, c.Close())
+	close(release)
+	assert.NoError(t, <-polled)
+	assert.NoError(t, c.Close())
+}
+
+func TestStopTwiceDoesNotBlock(t *testing.T) {
+	c := NewConsumer(QueueConfig{StreamCount: 2}, func(m Message) {}, nil, nil)
+
+	stopped := make(chan struct{})
+	go func() {
+		c.Stop()
+		c.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("the second Stop should not block on the pending shutdown")
+	}
+}
+
+func TestRunUntilSignal(t *testing.T) {
+	// keep the signal from terminating the test binary if it arrives before RunUntilSignal subscribes to it
+	guard := make(chan os.Signal, 1)
+	signal.Notify(guard, os.Interrupt)
+	defer signal.Stop(guard)
+
+	queue := &shutdownRecordingQueueCaller{}
+	subscribed := make(chan struct{})
+	var once sync.Once
+	c := &Consumer{1, []instanceHandler{&consumerInstance{
+		config:       QueueConfig{BackoffPeriod: 1, OnSubscribe: func(string) { once.Do(func() { close(subscribed) }) }},
+		queue:        queue,
+		shutdownChan: make(chan bool, 1),
+		processor:    splitMessageProcessor{func(m Message) {}},
+		logger:       log.NewUPPLogger("Test", "FATAL"),
+	}}}
+
+	done := make(chan struct{})
+	go func() {
+		RunUntilSignal(c, os.Interrupt)
+		close(done)
+	}()
+	//a signal arriving before the first poll stops the consumer without creating a consumer instance
+	<-subscribed
+
+	p, err := os.FindProcess(os.Getpid())
+	assert.NoError(t, err)
+	deadline := time.After(10 * time.Second)
+	for {
+		assert.NoError(t, p.Signal(os.Interrupt))
+		select {
+		case <-done:
+			assert.Equal(t, int32(1), atomic.LoadInt32(&queue.destroyed), "the consumer instance should be destroyed on shutdown")
+			return
+		case <-deadline:
+			t.Fatal("consumer did not shut down")
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
 }
 
 var consInstTest = &consumerInstanceURI{"/queue/consumergroup/instance-d"}
 var msgsTestByteA = []byte(`[{"value":"RlRNU0cvMS4wCgpib2R5Cg==","partition":0,"offset":0},{"value":"TWVzc2FnZS1JZDogMDAwMC0xMTExLTAwMDAtYWJjZAoKW10K","partition":0,"offset":1}]`)
-var msgsTest = []Message{{nil, "body"}, {map[string]string{"Message-Id": "0000-1111-0000-abcd"}, "[]"}}
+var msgsTest = []Message{
+	{Body: "body", Raw: []byte("FTMSG/1.0\n\nbody\n")},
+	{Headers: map[string]string{"Message-Id": "0000-1111-0000-abcd"}, Body: "[]", Raw: []byte("Message-Id: 0000-1111-0000-abcd\n\n[]\n"), Offset: 1},
+}
 
 //test queueCaller implementations
 
@@ -129,6 +2428,20 @@ func (qc defaultTestQueueCaller) subscribeConsumerInstance(cInst consumerInstanc
 	return nil
 }
 
+func (qc defaultTestQueueCaller) assignPartitions(cInst consumerInstanceURI, partitions []int) error {
+	if len(cInst.BaseURI) == 0 {
+		return errors.New("consumer instance is nil")
+	}
+	return nil
+}
+
+func (qc defaultTestQueueCaller) seekOffsets(cInst consumerInstanceURI, offsets map[int]int64) error {
+	if len(cInst.BaseURI) == 0 {
+		return errors.New("consumer instance is nil")
+	}
+	return nil
+}
+
 func (qc defaultTestQueueCaller) destroyConsumerInstanceSubscription(cInst consumerInstanceURI) error {
 	if len(cInst.BaseURI) == 0 {
 		return errors.New("consumer instance is nil")
@@ -136,11 +2449,11 @@ func (qc defaultTestQueueCaller) destroyConsumerInstanceSubscription(cInst consu
 	return nil
 }
 
-func (qc defaultTestQueueCaller) consumeMessages(cInst consumerInstanceURI) ([]byte, error) {
+func (qc defaultTestQueueCaller) consumeMessages(cInst consumerInstanceURI) (io.ReadCloser, error) {
 	if len(cInst.BaseURI) == 0 {
 		return nil, errors.New("consumer instance is nil")
 	}
-	return msgsTestByteA, nil
+	return ioutil.NopCloser(bytes.NewReader(msgsTestByteA)), nil
 }
 
 func (qc defaultTestQueueCaller) commitOffsets(cInst consumerInstanceURI) error {
@@ -150,6 +2463,18 @@ func (qc defaultTestQueueCaller) commitOffsets(cInst consumerInstanceURI) error
 	return nil
 }
 
+func (qc defaultTestQueueCaller) commitPartitionOffsets(cInst consumerInstanceURI, offsets map[int]int64) error {
+	return nil
+}
+
+func (qc defaultTestQueueCaller) keepAlive(cInst consumerInstanceURI) error {
+	return nil
+}
+
+func (qc defaultTestQueueCaller) topicExists() (bool, error) {
+	return true, nil
+}
+
 func (qc defaultTestQueueCaller) checkConnectivity() error {
 	return nil
 }
@@ -171,11 +2496,19 @@ func (qc consumeMsgErrorQueueCaller) subscribeConsumerInstance(cInst consumerIns
 	return nil
 }
 
+func (qc consumeMsgErrorQueueCaller) assignPartitions(cInst consumerInstanceURI, partitions []int) error {
+	return nil
+}
+
+func (qc consumeMsgErrorQueueCaller) seekOffsets(cInst consumerInstanceURI, offsets map[int]int64) error {
+	return nil
+}
+
 func (qc consumeMsgErrorQueueCaller) destroyConsumerInstanceSubscription(cInst consumerInstanceURI) error {
 	return errors.New("error while destroying subscription")
 }
 
-func (qc consumeMsgErrorQueueCaller) consumeMessages(cInst consumerInstanceURI) ([]byte, error) {
+func (qc consumeMsgErrorQueueCaller) consumeMessages(cInst consumerInstanceURI) (io.ReadCloser, error) {
 	return nil, errors.New("error while consuming")
 }
 
@@ -183,6 +2516,18 @@ func (qc consumeMsgErrorQueueCaller) commitOffsets(cInst consumerInstanceURI) er
 	return errors.New("error while committing offsets")
 }
 
+func (qc consumeMsgErrorQueueCaller) commitPartitionOffsets(cInst consumerInstanceURI, offsets map[int]int64) error {
+	return nil
+}
+
+func (qc consumeMsgErrorQueueCaller) keepAlive(cInst consumerInstanceURI) error {
+	return nil
+}
+
+func (qc consumeMsgErrorQueueCaller) topicExists() (bool, error) {
+	return true, nil
+}
+
 func (qc consumeMsgErrorQueueCaller) checkConnectivity() error {
 	return errors.New("connectivity error")
 }
@@ -203,11 +2548,19 @@ func (qc consumeMsgPanicQueueCaller) subscribeConsumerInstance(cInst consumerIns
 	return nil
 }
 
+func (qc consumeMsgPanicQueueCaller) assignPartitions(cInst consumerInstanceURI, partitions []int) error {
+	return nil
+}
+
+func (qc consumeMsgPanicQueueCaller) seekOffsets(cInst consumerInstanceURI, offsets map[int]int64) error {
+	return nil
+}
+
 func (qc consumeMsgPanicQueueCaller) destroyConsumerInstanceSubscription(cInst consumerInstanceURI) error {
 	return errors.New("error while destroying subscription")
 }
 
-func (qc consumeMsgPanicQueueCaller) consumeMessages(cInst consumerInstanceURI) ([]byte, error) {
+func (qc consumeMsgPanicQueueCaller) consumeMessages(cInst consumerInstanceURI) (io.ReadCloser, error) {
 	return nil, errors.New("error while consuming")
 }
 
@@ -215,6 +2568,323 @@ func (qc consumeMsgPanicQueueCaller) commitOffsets(cInst consumerInstanceURI) er
 	return errors.New("error while committing offsets")
 }
 
+func (qc consumeMsgPanicQueueCaller) commitPartitionOffsets(cInst consumerInstanceURI, offsets map[int]int64) error {
+	return nil
+}
+
+func (qc consumeMsgPanicQueueCaller) keepAlive(cInst consumerInstanceURI) error {
+	return nil
+}
+
+func (qc consumeMsgPanicQueueCaller) topicExists() (bool, error) {
+	return true, nil
+}
+
 func (qc consumeMsgPanicQueueCaller) checkConnectivity() error {
 	return errors.New("connectivity error")
 }
+
+// records the seek requests issued for the consumer instance
+type seekRecordingQueueCaller struct {
+	defaultTestQueueCaller
+	seeks []map[int]int64
+}
+
+func (qc *seekRecordingQueueCaller) seekOffsets(cInst consumerInstanceURI, offsets map[int]int64) error {
+	qc.seeks = append(qc.seeks, offsets)
+	return qc.defaultTestQueueCaller.seekOffsets(cInst, offsets)
+}
+
+// records the partition assignments and subscriptions of the consumer instance
+type assignRecordingQueueCaller struct {
+	defaultTestQueueCaller
+	assigned   [][]int
+	subscribes int
+}
+
+func (qc *assignRecordingQueueCaller) assignPartitions(cInst consumerInstanceURI, partitions []int) error {
+	qc.assigned = append(qc.assigned, partitions)
+	return qc.defaultTestQueueCaller.assignPartitions(cInst, partitions)
+}
+
+func (qc *assignRecordingQueueCaller) subscribeConsumerInstance(cInst consumerInstanceURI) error {
+	qc.subscribes++
+	return qc.defaultTestQueueCaller.subscribeConsumerInstance(cInst)
+}
+
+// fails the first commitFailures offset commits with a 503
+type failingCommitHTTPCaller struct {
+	commitFailures int
+	commits        int
+	deletes        int
+}
+
+func (c *failingCommitHTTPCaller) DoReq(method, addr string, body io.Reader, headers map[string]string, expectedStatus int) ([]byte, error) {
+	switch {
+	case method == "DELETE":
+		c.deletes++
+	case strings.HasSuffix(addr, "/offsets"):
+		c.commits++
+		if c.commits <= c.commitFailures {
+			return nil, fmt.Errorf("unexpected response status %d. Expected: %d", http.StatusServiceUnavailable, expectedStatus)
+		}
+	case strings.HasSuffix(addr, "/records"):
+		return msgsTestByteA, nil
+	}
+	return nil, nil
+}
+
+// returns the given response on every consume
+type batchQueueCaller struct {
+	defaultTestQueueCaller
+	data []byte
+}
+
+func (qc batchQueueCaller) consumeMessages(cInst consumerInstanceURI) (io.ReadCloser, error) {
+	return ioutil.NopCloser(bytes.NewReader(qc.data)), nil
+}
+
+func (c *failingCommitHTTPCaller) DoStreamReq(method, addr string, body io.Reader, headers map[string]string, expectedStatus int) (io.ReadCloser, error) {
+	data, err := c.DoReq(method, addr, body, headers, expectedStatus)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(bytes.NewReader(data)), nil
+}
+
+// counts the keep-alive pings
+type keepAliveCountingQueueCaller struct {
+	defaultTestQueueCaller
+	pings int32
+}
+
+func (qc *keepAliveCountingQueueCaller) keepAlive(cInst consumerInstanceURI) error {
+	atomic.AddInt32(&qc.pings, 1)
+	return nil
+}
+
+// creates a new consumer instance URI every time and records the destroyed ones
+type reconnectingQueueCaller struct {
+	defaultTestQueueCaller
+	sync.Mutex
+	empty         bool
+	creates       int
+	destroyedURIs []string
+}
+
+func (qc *reconnectingQueueCaller) createConsumerInstance() (consumerInstanceURI, error) {
+	qc.Lock()
+	defer qc.Unlock()
+	qc.creates++
+	return consumerInstanceURI{fmt.Sprintf("/consumers/group/instances/instance-%d", qc.creates)}, nil
+}
+
+func (qc *reconnectingQueueCaller) destroyConsumerInstance(cInst consumerInstanceURI) error {
+	qc.Lock()
+	defer qc.Unlock()
+	qc.destroyedURIs = append(qc.destroyedURIs, cInst.BaseURI)
+	return nil
+}
+
+func (qc *reconnectingQueueCaller) destroyed() []string {
+	qc.Lock()
+	defer qc.Unlock()
+	return append([]string(nil), qc.destroyedURIs...)
+}
+
+func (qc *reconnectingQueueCaller) consumeMessages(cInst consumerInstanceURI) (io.ReadCloser, error) {
+	if qc.empty {
+		return ioutil.NopCloser(strings.NewReader("[]")), nil
+	}
+	return qc.defaultTestQueueCaller.consumeMessages(cInst)
+}
+
+// counts the destroyed consumer instances
+type shutdownRecordingQueueCaller struct {
+	defaultTestQueueCaller
+	destroyed int32
+}
+
+func (qc *shutdownRecordingQueueCaller) destroyConsumerInstance(cInst consumerInstanceURI) error {
+	atomic.AddInt32(&qc.destroyed, 1)
+	return qc.defaultTestQueueCaller.destroyConsumerInstance(cInst)
+}
+
+// deletes the consumer instance once release is closed, failing with err
+type slowDestroyQueueCaller struct {
+	shutdownRecordingQueueCaller
+	release chan struct{}
+	err     error
+}
+
+func (qc *slowDestroyQueueCaller) destroyConsumerInstance(cInst consumerInstanceURI) error {
+	<-qc.release
+	_ = qc.shutdownRecordingQueueCaller.destroyConsumerInstance(cInst)
+	return qc.err
+}
+
+// counts the polls, commits and destroyed consumer instances
+type pollCountingQueueCaller struct {
+	shutdownRecordingQueueCaller
+	empty      bool
+	emptyPolls int32 //number of empty polls before the messages are returned
+	polls      int32
+	commits    int32
+}
+
+func (qc *pollCountingQueueCaller) consumeMessages(cInst consumerInstanceURI) (io.ReadCloser, error) {
+	polls := atomic.AddInt32(&qc.polls, 1)
+	if qc.empty || polls <= qc.emptyPolls {
+		return ioutil.NopCloser(strings.NewReader("[]")), nil
+	}
+	return qc.shutdownRecordingQueueCaller.consumeMessages(cInst)
+}
+
+func (qc *pollCountingQueueCaller) commitOffsets(cInst consumerInstanceURI) error {
+	atomic.AddInt32(&qc.commits, 1)
+	return nil
+}
+
+// reports the topic as missing unless listing the topics fails
+type topicCheckingQueueCaller struct {
+	defaultTestQueueCaller
+	listErr error
+	created int32
+}
+
+func (qc *topicCheckingQueueCaller) topicExists() (bool, error) {
+	return false, qc.listErr
+}
+
+func (qc *topicCheckingQueueCaller) createConsumerInstance() (consumerInstanceURI, error) {
+	atomic.AddInt32(&qc.created, 1)
+	return qc.defaultTestQueueCaller.createConsumerInstance()
+}
+
+// rejects every consume with a 429
+type rateLimitedQueueCaller struct {
+	shutdownRecordingQueueCaller
+	retryAfter time.Duration
+}
+
+func (qc *rateLimitedQueueCaller) consumeMessages(cInst consumerInstanceURI) (io.ReadCloser, error) {
+	return nil, &rateLimitError{retryAfter: qc.retryAfter}
+}
+
+// fails every commit
+type failingCommitQueueCaller struct {
+	batchQueueCaller
+}
+
+func (qc *failingCommitQueueCaller) commitOffsets(cInst consumerInstanceURI) error {
+	return errors.New("commit failed")
+}
+
+// records the partition commits and seeks
+type partitionCommitQueueCaller struct {
+	batchQueueCaller
+	commits     []map[int]int64
+	seeks       []map[int]int64
+	seekErr     error
+	fullCommits int
+}
+
+func (qc *partitionCommitQueueCaller) consumeMessages(cInst consumerInstanceURI) (io.ReadCloser, error) {
+	return qc.batchQueueCaller.consumeMessages(cInst)
+}
+
+func (qc *partitionCommitQueueCaller) commitOffsets(cInst consumerInstanceURI) error {
+	qc.fullCommits++
+	return nil
+}
+
+func (qc *partitionCommitQueueCaller) commitPartitionOffsets(cInst consumerInstanceURI, offsets map[int]int64) error {
+	qc.commits = append(qc.commits, offsets)
+	return nil
+}
+
+func (qc *partitionCommitQueueCaller) seekOffsets(cInst consumerInstanceURI, offsets map[int]int64) error {
+	qc.seeks = append(qc.seeks, offsets)
+	return qc.seekErr
+}
+
+// returns a proxy response with a record at each of the given partitions and offsets
+func partitionedTestResponse(partitions, offsets []int) []byte {
+	value := base64.StdEncoding.EncodeToString([]byte("FTMSG/1.0\n\nbody"))
+	records := make([]string, len(partitions))
+	for i := range partitions {
+		records[i] = fmt.Sprintf(`{"value":"%s","partition":%d,"offset":%d}`, value, partitions[i], offsets[i])
+	}
+	return []byte("[" + strings.Join(records, ",") + "]")
+}
+
+// hands the timers to the test, which fires them when it sees fit
+type manualClock struct {
+	fakeClock
+	timers chan manualTimer
+}
+
+type manualTimer struct {
+	d  time.Duration
+	ch chan time.Time
+}
+
+func newManualClock() *manualClock {
+	return &manualClock{timers: make(chan manualTimer, 16)}
+}
+
+func (c *manualClock) After(d time.Duration) <-chan time.Time {
+	ch := make(chan time.Time, 1)
+	c.timers <- manualTimer{d, ch}
+	return ch
+}
+
+// next returns the next timer of duration d started, skipping the others, and fails the test if none is within a second
+func (c *manualClock) next(t *testing.T, d time.Duration) chan<- time.Time {
+	deadline := time.After(time.Second)
+	for {
+		select {
+		case timer := <-c.timers:
+			if timer.d == d {
+				return timer.ch
+			}
+		case <-deadline:
+			t.Fatalf("no %v timer was started", d)
+			return nil
+		}
+	}
+}
+
+// records the waits and returns immediately
+type fakeClock struct {
+	sync.Mutex
+	now time.Time
+	ds  []time.Duration
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func (c *fakeClock) Sleep(d time.Duration) {
+	c.record(d)
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.record(d)
+	ch := make(chan time.Time, 1)
+	ch <- c.now.Add(d)
+	return ch
+}
+
+func (c *fakeClock) record(d time.Duration) {
+	c.Lock()
+	defer c.Unlock()
+	c.ds = append(c.ds, d)
+}
+
+func (c *fakeClock) waits() []time.Duration {
+	c.Lock()
+	defer c.Unlock()
+	return c.ds
+}
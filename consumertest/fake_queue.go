@@ -0,0 +1,135 @@
+// Package consumertest provides test doubles for code built on top of the consumer package.
+package consumertest
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+)
+
+// FakeQueue is an in-process fake of the kafka-rest-proxy v2 API.
+// Point QueueConfig.Addrs at FakeQueue.URL() to drive a consumer without a live proxy.
+//
+// Enqueued responses are returned, in order, one per consume request. Once the
+// queue is drained the fake returns empty batches.
+type FakeQueue struct {
+	server *httptest.Server
+
+	mu         sync.Mutex
+	responses  [][]byte
+	nextOffset int
+	instances  int
+	commits    int
+	destroyed  []string
+}
+
+// NewFakeQueue starts a new FakeQueue. Close it when done.
+func NewFakeQueue() *FakeQueue {
+	q := &FakeQueue{}
+	q.server = httptest.NewServer(http.HandlerFunc(q.serveHTTP))
+	return q
+}
+
+// URL returns the address of the fake proxy
+func (q *FakeQueue) URL() string {
+	return q.server.URL
+}
+
+// Close shuts the fake proxy down
+func (q *FakeQueue) Close() {
+	q.server.Close()
+}
+
+// EnqueueResponse adds a raw consume response body, e.g. `[{"value":"...","partition":0,"offset":1}]`
+func (q *FakeQueue) EnqueueResponse(body []byte) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.responses = append(q.responses, body)
+}
+
+// EnqueueMessages adds a consume response containing the given FT messages,
+// each one being the full message including the version line and headers.
+func (q *FakeQueue) EnqueueMessages(msgs ...string) {
+	type record struct {
+		Value     string `json:"value"`
+		Partition int    `json:"partition"`
+		Offset    int    `json:"offset"`
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	records := make([]record, len(msgs))
+	for i, m := range msgs {
+		records[i] = record{Value: base64.StdEncoding.EncodeToString([]byte(m)), Offset: q.nextOffset}
+		q.nextOffset++
+	}
+	body, _ := json.Marshal(records)
+	q.responses = append(q.responses, body)
+}
+
+// Commits returns the number of offset commits received
+func (q *FakeQueue) Commits() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.commits
+}
+
+// Destroyed returns the names of the consumer instances that have been deleted
+func (q *FakeQueue) Destroyed() []string {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return append([]string(nil), q.destroyed...)
+}
+
+func (q *FakeQueue) serveHTTP(w http.ResponseWriter, req *http.Request) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	// /consumers/{group}[/instances/{instance}[/{resource}]]
+	parts := strings.Split(strings.Trim(req.URL.Path, "/"), "/")
+	switch {
+	case len(parts) == 1 && parts[0] == "topics" && req.Method == http.MethodGet:
+		_, _ = w.Write([]byte("[]"))
+	case len(parts) == 2 && parts[0] == "consumers" && req.Method == http.MethodPost:
+		q.instances++
+		name := fmt.Sprintf("fake-consumer-%d", q.instances)
+		_ = json.NewEncoder(w).Encode(map[string]string{
+			"instance_id": name,
+			"base_uri":    q.server.URL + "/consumers/" + parts[1] + "/instances/" + name,
+		})
+	case len(parts) == 4 && parts[2] == "instances" && req.Method == http.MethodDelete:
+		q.destroyed = append(q.destroyed, parts[3])
+		w.WriteHeader(http.StatusNoContent)
+	case len(parts) == 5 && parts[2] == "instances":
+		q.serveInstanceResource(w, req, parts[4])
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		_, _ = w.Write([]byte(`{"error_code":40400,"message":"HTTP 404 Not Found"}`))
+	}
+}
+
+func (q *FakeQueue) serveInstanceResource(w http.ResponseWriter, req *http.Request, resource string) {
+	switch {
+	case resource == "records" && req.Method == http.MethodGet:
+		if len(q.responses) == 0 {
+			_, _ = w.Write([]byte("[]"))
+			return
+		}
+		body := q.responses[0]
+		q.responses = q.responses[1:]
+		_, _ = w.Write(body)
+	case resource == "assignments" && req.Method == http.MethodGet:
+		_, _ = w.Write([]byte(`{"partitions":[]}`))
+	case resource == "offsets" && req.Method == http.MethodPost:
+		q.commits++
+	case resource == "subscription" || resource == "positions":
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
@@ -0,0 +1,104 @@
+package consumertest_test
+
+import (
+	"fmt"
+	"net/http"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	log "github.com/Financial-Times/go-logger/v2"
+	consumer "github.com/Financial-Times/message-queue-gonsumer"
+	"github.com/Financial-Times/message-queue-gonsumer/consumertest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFakeQueueDrivesConsumer(t *testing.T) {
+	queue := consumertest.NewFakeQueue()
+	defer queue.Close()
+	queue.EnqueueMessages("FTMSG/1.0\r\nMessage-Id: 0000-1111-0000-abcd\r\n\r\n{\"uuid\":\"1\"}")
+
+	received := make(chan consumer.Message, 1)
+	c := consumer.NewConsumer(consumer.QueueConfig{
+		Addrs:         []string{queue.URL()},
+		Group:         "group",
+		Topic:         "topic",
+		BackoffPeriod: 1,
+	}, func(m consumer.Message) { received <- m }, &http.Client{}, log.NewUPPLogger("Test", "FATAL"))
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		c.Start()
+		wg.Done()
+	}()
+
+	select {
+	case m := <-received:
+		assert.Equal(t, "0000-1111-0000-abcd", m.Headers["Message-Id"])
+		assert.Equal(t, `{"uuid":"1"}`, m.Body)
+	case <-time.After(5 * time.Second):
+		t.Fatal("message was not consumed")
+	}
+
+	c.Stop()
+	wg.Wait()
+
+	assert.True(t, queue.Commits() > 0)
+	assert.Equal(t, []string{"fake-consumer-1"}, queue.Destroyed())
+}
+
+func TestStartStopDoesNotLeakGoroutines(t *testing.T) {
+	queue := consumertest.NewFakeQueue()
+	defer queue.Close()
+	client := &http.Client{Transport: &http.Transport{}}
+	before := runtime.NumGoroutine()
+
+	for i := 0; i < 100; i++ {
+		subscribed := make(chan struct{})
+		c := consumer.NewConsumer(consumer.QueueConfig{
+			Addrs:       []string{queue.URL()},
+			Group:       "group",
+			Topic:       "topic",
+			OnSubscribe: func(string) { close(subscribed) },
+		}, func(m consumer.Message) {}, client, log.NewUPPLogger("Test", "FATAL"))
+
+		done := make(chan struct{})
+		go func() {
+			c.Start()
+			close(done)
+		}()
+		<-subscribed
+		c.Stop()
+		<-done
+	}
+	assert.Len(t, queue.Destroyed(), 100)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.True(t, runtime.NumGoroutine() <= before, "%d goroutines before, %d after", before, runtime.NumGoroutine())
+}
+
+func ExampleFakeQueue() {
+	queue := consumertest.NewFakeQueue()
+	defer queue.Close()
+	queue.EnqueueMessages("FTMSG/1.0\r\nX-Request-Id: tid_test\r\n\r\nhello")
+
+	done := make(chan struct{})
+	c := consumer.NewConsumer(consumer.QueueConfig{
+		Addrs: []string{queue.URL()},
+		Group: "group",
+		Topic: "topic",
+	}, func(m consumer.Message) {
+		fmt.Println(m.Headers["X-Request-Id"], m.Body)
+		close(done)
+	}, &http.Client{}, log.NewUPPLogger("Example", "FATAL"))
+
+	go c.Start()
+	<-done
+	c.Stop()
+	// Output: tid_test hello
+}
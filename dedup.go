@@ -0,0 +1,49 @@
+package consumer
+
+import "container/list"
+
+type partitionOffset struct {
+	partition int
+	offset    int
+}
+
+// offsetCache remembers the last size partition+offset pairs seen, evicting the least recently seen first
+type offsetCache struct {
+	size    int
+	order   *list.List
+	entries map[partitionOffset]*list.Element
+}
+
+func newOffsetCache(size int) *offsetCache {
+	return &offsetCache{
+		size:    size,
+		order:   list.New(),
+		entries: make(map[partitionOffset]*list.Element, size),
+	}
+}
+
+// seen reports whether the partition and offset were already seen, and records them otherwise
+func (c *offsetCache) seen(partition, offset int) bool {
+	key := partitionOffset{partition, offset}
+	if e, ok := c.entries[key]; ok {
+		c.order.MoveToFront(e)
+		return true
+	}
+
+	c.entries[key] = c.order.PushFront(key)
+	if c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(partitionOffset))
+	}
+	return false
+}
+
+// forget removes the partition and offset, for a message redelivered on purpose not to be skipped
+func (c *offsetCache) forget(partition, offset int) {
+	key := partitionOffset{partition, offset}
+	if e, ok := c.entries[key]; ok {
+		c.order.Remove(e)
+		delete(c.entries, key)
+	}
+}
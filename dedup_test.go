@@ -0,0 +1,29 @@
+package consumer
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOffsetCacheEvictsLeastRecentlySeen(t *testing.T) {
+	c := newOffsetCache(2)
+
+	assert.False(t, c.seen(0, 1))
+	assert.False(t, c.seen(1, 1), "offsets are tracked per partition")
+	assert.True(t, c.seen(0, 1))
+
+	assert.False(t, c.seen(0, 2))
+	assert.False(t, c.seen(1, 1), "partition 1 offset 1 should have been evicted")
+	assert.True(t, c.seen(0, 2))
+}
+
+func TestOffsetCacheForget(t *testing.T) {
+	c := newOffsetCache(2)
+
+	assert.False(t, c.seen(0, 1))
+	c.forget(0, 1)
+	c.forget(0, 2)
+	assert.False(t, c.seen(0, 1), "a forgotten offset should not be a duplicate")
+	assert.True(t, c.seen(0, 1))
+}
@@ -5,5 +5,6 @@ go 1.13
 require (
 	github.com/Financial-Times/go-logger/v2 v2.0.1
 	github.com/davecgh/go-spew v1.1.1 // indirect
+	github.com/sirupsen/logrus v1.0.5
 	github.com/stretchr/testify v1.1.5-0.20170130113145-4d4bfba8f1d1
 )
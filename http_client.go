@@ -1,20 +1,178 @@
 package consumer
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
+	"runtime/debug"
+	"strconv"
+	"time"
 )
 
+// ErrRateLimited is matched by the errors returned when the proxy responds with 429 Too Many Requests
+var ErrRateLimited = errors.New("rate limited by proxy")
+
+// rateLimitError carries the wait requested by the Retry-After header of a 429 response, 0 if there was none.
+// It wraps the ProxyError of the response, like the other failed requests.
+type rateLimitError struct {
+	retryAfter time.Duration
+	proxyErr   *ProxyError
+}
+
+func (e *rateLimitError) Error() string {
+	msg := fmt.Sprintf("%v, retry after %v", ErrRateLimited, e.retryAfter)
+	if e.proxyErr != nil && e.proxyErr.Operation != "" {
+		msg = e.proxyErr.Operation + ": " + msg
+	}
+	return msg
+}
+
+func (e *rateLimitError) Is(target error) bool {
+	return target == ErrRateLimited
+}
+
+func (e *rateLimitError) Unwrap() error {
+	if e.proxyErr == nil {
+		return nil
+	}
+	return e.proxyErr
+}
+
+// parseRetryAfter returns the wait requested by a Retry-After header, given either in seconds or as an HTTP date
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(value); err == nil && t.After(now) {
+		return t.Sub(now)
+	}
+	return 0
+}
+
+// ProxyError is returned for an unexpected response status of the kafka-rest-proxy.
+// ErrorCode and Message are set when the response is a proxy error object, e.g. {"error_code":40401,"message":"Consumer instance not found."}
+type ProxyError struct {
+	StatusCode int    `json:"-"` //HTTP status of the response, 0 if the error object came with a successful response
+	ErrorCode  int    `json:"error_code"`
+	Message    string `json:"message"`
+	Operation  string `json:"-"` //queue operation that failed, e.g. consume or commit, empty if unknown
+	Body       string `json:"-"` //beginning of the response body
+	expected   int
+}
+
+func (e *ProxyError) Error() string {
+	msg := fmt.Sprintf("proxy error %d (status %d): %s", e.ErrorCode, e.StatusCode, e.Message)
+	if e.ErrorCode == 0 {
+		msg = fmt.Sprintf("unexpected response status %d. Expected: %d", e.StatusCode, e.expected)
+	}
+	if e.Operation != "" {
+		msg = e.Operation + ": " + msg
+	}
+	return msg
+}
+
+// parseProxyError returns the proxy error object contained in data, or nil if data is not an error object
+func parseProxyError(status int, data []byte) *ProxyError {
+	perr := &ProxyError{}
+	if err := json.Unmarshal(data, perr); err != nil || perr.ErrorCode == 0 {
+		return nil
+	}
+	perr.StatusCode = status
+	perr.Body = responseSnippet(data)
+	return perr
+}
+
+// responseSnippet returns the beginning of a response body, as included in errors
+func responseSnippet(data []byte) string {
+	if len(data) > maxResponseSnippet {
+		data = data[:maxResponseSnippet]
+	}
+	return string(data)
+}
+
+// withOperation records the failed queue operation on a proxy error
+func withOperation(operation string, err error) error {
+	var perr *ProxyError
+	if errors.As(err, &perr) && perr.Operation == "" {
+		perr.Operation = operation
+	}
+	return err
+}
+
+// responseStatus returns the HTTP status of a failed request, or 0 if the error is not a response error
+func responseStatus(err error) int {
+	var perr *ProxyError
+	if errors.As(err, &perr) {
+		return perr.StatusCode
+	}
+	return 0
+}
+
+const modulePath = "github.com/Financial-Times/message-queue-gonsumer"
+
+// defaultUserAgent identifies the library, with its version when it is known from the build info
+func defaultUserAgent() string {
+	version := "devel"
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, dep := range info.Deps {
+			if dep.Path == modulePath {
+				version = dep.Version
+			}
+		}
+	}
+	return "message-queue-gonsumer/" + version
+}
+
+const defaultIdleConnTimeout = 90 * time.Second
+
+// newHTTPClient returns the client used when none is given to the constructors.
+// Each stream long-polls the proxy on its own connection, with another one for the keep-alive pings
+// and commits, so enough idle connections are kept per proxy for them all to be reused between polls.
+// The client has no timeout as a poll may be held by the proxy until messages arrive.
+func newHTTPClient(config QueueConfig, streamCount int) *http.Client {
+	maxIdleConnsPerHost := 2 * streamCount
+	if config.MaxIdleConnsPerHost > 0 {
+		maxIdleConnsPerHost = config.MaxIdleConnsPerHost
+	}
+	idleConnTimeout := defaultIdleConnTimeout
+	if config.IdleConnTimeout > 0 {
+		idleConnTimeout = config.IdleConnTimeout
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConnsPerHost = maxIdleConnsPerHost
+	transport.IdleConnTimeout = idleConnTimeout
+	return &http.Client{Transport: transport}
+}
+
 // Implementation of the httpCaller interface
 type httpClient struct {
 	hostHeader       string
 	authorizationKey string
 	client           *http.Client
+	userAgent        string
+	//returns the Authorization header of each request instead of authorizationKey when set
+	tokenProvider func() (string, error)
+	//used for the Retry-After dates, the real clock when nil
+	clock clock
 }
 
 func (c httpClient) DoReq(method, url string, body io.Reader, headers map[string]string, expectedStatus int) ([]byte, error) {
+	respBody, err := c.DoStreamReq(method, url, body, headers, expectedStatus)
+	if err != nil {
+		return nil, err
+	}
+	defer respBody.Close()
+
+	return ioutil.ReadAll(respBody)
+}
+
+// DoStreamReq executes the request and returns the response body without reading it.
+// The caller is responsible for closing the returned body.
+func (c httpClient) DoStreamReq(method, url string, body io.Reader, headers map[string]string, expectedStatus int) (io.ReadCloser, error) {
 	req, err := http.NewRequest(method, url, body)
 	if err != nil {
 		return nil, fmt.Errorf("error creating request: %w", err)
@@ -27,32 +185,61 @@ func (c httpClient) DoReq(method, url string, body io.Reader, headers map[string
 		req.Host = c.hostHeader
 	}
 
-	if len(c.authorizationKey) > 0 {
+	if c.tokenProvider != nil {
+		token, err := c.tokenProvider()
+		if err != nil {
+			return nil, fmt.Errorf("error getting authorization token from the token provider: %w", err)
+		}
+		req.Header.Set("Authorization", token)
+	} else if len(c.authorizationKey) > 0 {
 		req.Header.Add("Authorization", c.authorizationKey)
 	}
+	if len(c.userAgent) > 0 {
+		req.Header.Set("User-Agent", c.userAgent)
+	}
 
 	resp, err := c.client.Do(req)
 	if err != nil {
 		return nil, fmt.Errorf("error executing request: %w", err)
 	}
 
-	defer func() {
-		_, _ = io.Copy(ioutil.Discard, resp.Body)
-		resp.Body.Close()
-		if resp.StatusCode >= 500 {
-			// This might be a problem with the server instance, which may have been taken out
-			// of the DNS pool, but because we might still have a tcp connection open, we'll
-			// never re-do the DNS lookup and get a connection to a working server.  So when we
-			// get 5xx, close idle connections to force the next requests to re-connect.
-			if t, ok := c.client.Transport.(*http.Transport); ok {
-				t.CloseIdleConnections()
-			}
+	if resp.StatusCode != expectedStatus {
+		defer c.closeResponse(resp)
+
+		data, _ := ioutil.ReadAll(resp.Body)
+		perr := parseProxyError(resp.StatusCode, data)
+		if perr == nil {
+			perr = &ProxyError{StatusCode: resp.StatusCode, Body: responseSnippet(data), expected: expectedStatus}
+		}
+		if resp.StatusCode == http.StatusTooManyRequests {
+			return nil, &rateLimitError{parseRetryAfter(resp.Header.Get("Retry-After"), clockOrDefault(c.clock).Now()), perr}
 		}
-	}()
+		return nil, perr
+	}
 
-	if resp.StatusCode != expectedStatus {
-		return nil, fmt.Errorf("unexpected response status %d. Expected: %d", resp.StatusCode, expectedStatus)
+	return drainingReadCloser{resp.Body}, nil
+}
+
+func (c httpClient) closeResponse(resp *http.Response) {
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode >= 500 {
+		// This might be a problem with the server instance, which may have been taken out
+		// of the DNS pool, but because we might still have a tcp connection open, we'll
+		// never re-do the DNS lookup and get a connection to a working server.  So when we
+		// get 5xx, close idle connections to force the next requests to re-connect.
+		if t, ok := c.client.Transport.(*http.Transport); ok {
+			t.CloseIdleConnections()
+		}
 	}
+}
+
+// drainingReadCloser drains the remaining body on Close so that the connection can be reused
+type drainingReadCloser struct {
+	io.ReadCloser
+}
 
-	return ioutil.ReadAll(resp.Body)
+func (d drainingReadCloser) Close() error {
+	_, _ = io.Copy(ioutil.Discard, d.ReadCloser)
+	return d.ReadCloser.Close()
 }
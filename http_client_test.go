@@ -0,0 +1,524 @@
+package consumer
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDoReqReturnsProxyErrorOnErrorObject(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+		_, _ = w.Write([]byte(`{"error_code":40401,"message":"Topic not found."}`))
+	}))
+	defer server.Close()
+
+	c := httpClient{client: &http.Client{}}
+	_, err := c.DoReq("GET", server.URL, nil, nil, http.StatusOK)
+
+	var perr *ProxyError
+	if !errors.As(err, &perr) {
+		t.Fatalf("Expected ProxyError. Actual: [%v]", err)
+	}
+	assert.Equal(t, http.StatusNotFound, perr.StatusCode)
+	assert.Equal(t, 40401, perr.ErrorCode)
+	assert.Equal(t, "Topic not found.", perr.Message)
+}
+
+func TestQueueOperationsDecodeProxyErrorBodies(t *testing.T) {
+	var tests = []struct {
+		name      string
+		status    int
+		body      string
+		call      func(q *kafkaRESTClient) error
+		errorCode int
+		message   string
+		expected  string
+	}{
+		{
+			name:   "instance gone",
+			status: http.StatusNotFound,
+			body:   `{"error_code":40403,"message":"Consumer instance not found."}`,
+			call: func(q *kafkaRESTClient) error {
+				_, err := q.consumeMessages(testConsumer)
+				return err
+			},
+			errorCode: 40403,
+			message:   "Consumer instance not found.",
+			expected:  "consume: proxy error 40403 (status 404): Consumer instance not found.",
+		},
+		{
+			name:      "rebalance in progress",
+			status:    http.StatusConflict,
+			body:      `{"error_code":40901,"message":"Commit cannot be completed since the group has already rebalanced"}`,
+			call:      func(q *kafkaRESTClient) error { return q.commitOffsets(testConsumer) },
+			errorCode: 40901,
+			message:   "Commit cannot be completed since the group has already rebalanced",
+			expected:  "commit: proxy error 40901 (status 409): Commit cannot be completed since the group has already rebalanced",
+		},
+		{
+			name:      "instance already exists",
+			status:    http.StatusConflict,
+			body:      `{"error_code":40902,"message":"Consumer with specified consumer ID already exists in the specified consumer group."}`,
+			call:      func(q *kafkaRESTClient) error { _, err := q.createConsumerInstance(); return err },
+			errorCode: 40902,
+			message:   "Consumer with specified consumer ID already exists in the specified consumer group.",
+			expected:  "create: proxy error 40902 (status 409): Consumer with specified consumer ID already exists in the specified consumer group.",
+		},
+	}
+
+	for _, test := range tests {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			w.WriteHeader(test.status)
+			_, _ = w.Write([]byte(test.body))
+		}))
+
+		q := newKafkaRESTClient(QueueConfig{Addrs: []string{server.URL}, Group: "group1", Topic: "topic"}, &http.Client{})
+		err := test.call(q)
+		server.Close()
+
+		var perr *ProxyError
+		if !errors.As(err, &perr) {
+			t.Fatalf("%s: expected ProxyError. Actual: [%v]", test.name, err)
+		}
+		assert.Equal(t, test.status, perr.StatusCode, test.name)
+		assert.Equal(t, test.errorCode, perr.ErrorCode, test.name)
+		assert.Equal(t, test.message, perr.Message, test.name)
+		assert.EqualError(t, err, test.expected, test.name)
+	}
+}
+
+func TestDoReqReturnsStatusErrorOnNonJSONBody(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+		_, _ = w.Write([]byte(`<html><body>Bad Gateway</body></html>`))
+	}))
+	defer server.Close()
+
+	c := httpClient{client: &http.Client{}}
+	_, err := c.DoReq("GET", server.URL, nil, nil, http.StatusOK)
+
+	assert.EqualError(t, err, "unexpected response status 502. Expected: 200")
+
+	var perr *ProxyError
+	if !errors.As(err, &perr) {
+		t.Fatalf("Expected ProxyError. Actual: [%v]", err)
+	}
+	assert.Equal(t, http.StatusBadGateway, perr.StatusCode)
+	assert.Equal(t, 0, perr.ErrorCode)
+	assert.Equal(t, "<html><body>Bad Gateway</body></html>", perr.Body)
+}
+
+func TestQueueOperationErrorsCarryTheResponseStatus(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch {
+		case strings.HasSuffix(req.URL.Path, "/records"):
+			w.WriteHeader(http.StatusUnauthorized)
+			_, _ = w.Write([]byte(strings.Repeat("x", 1000)))
+		case strings.HasSuffix(req.URL.Path, "/offsets"):
+			w.WriteHeader(http.StatusServiceUnavailable)
+			_, _ = w.Write([]byte(`{"error_code":50301,"message":"Kafka unavailable."}`))
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer server.Close()
+
+	q := &kafkaRESTClient{
+		addrs:  []string{server.URL},
+		group:  "group1",
+		caller: httpClient{client: &http.Client{}},
+	}
+
+	_, err := q.consumeMessages(testConsumer)
+	var perr *ProxyError
+	if !errors.As(err, &perr) {
+		t.Fatalf("Expected ProxyError. Actual: [%v]", err)
+	}
+	assert.Equal(t, http.StatusUnauthorized, perr.StatusCode)
+	assert.Equal(t, "consume", perr.Operation)
+	assert.Len(t, perr.Body, maxResponseSnippet)
+	assert.EqualError(t, err, "consume: unexpected response status 401. Expected: 200")
+
+	err = q.commitOffsets(testConsumer)
+	if !errors.As(err, &perr) {
+		t.Fatalf("Expected ProxyError. Actual: [%v]", err)
+	}
+	assert.Equal(t, http.StatusServiceUnavailable, perr.StatusCode)
+	assert.Equal(t, 50301, perr.ErrorCode)
+	assert.Equal(t, "commit", perr.Operation)
+	assert.EqualError(t, err, "commit: proxy error 50301 (status 503): Kafka unavailable.")
+
+	_, err = q.createConsumerInstance()
+	if !errors.As(err, &perr) {
+		t.Fatalf("Expected ProxyError. Actual: [%v]", err)
+	}
+	assert.Equal(t, http.StatusInternalServerError, perr.StatusCode)
+	assert.Equal(t, "create", perr.Operation)
+}
+
+func TestDoStreamReqReturnsResponseBody(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		_, _ = w.Write([]byte(`[]`))
+	}))
+	defer server.Close()
+
+	c := httpClient{client: &http.Client{}}
+	body, err := c.DoStreamReq("GET", server.URL, nil, nil, http.StatusOK)
+	assert.NoError(t, err)
+
+	data, err := ioutil.ReadAll(body)
+	assert.NoError(t, err)
+	assert.Equal(t, "[]", string(data))
+	assert.NoError(t, body.Close())
+}
+
+func TestDoReqReturnsRateLimitErrorOn429(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Retry-After", "7")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer server.Close()
+
+	c := httpClient{client: &http.Client{}}
+	_, err := c.DoReq("GET", server.URL, nil, nil, http.StatusOK)
+
+	assert.True(t, errors.Is(err, ErrRateLimited), "expected ErrRateLimited, got %v", err)
+	var rerr *rateLimitError
+	if !errors.As(err, &rerr) {
+		t.Fatalf("Expected rateLimitError. Actual: [%v]", err)
+	}
+	assert.Equal(t, 7*time.Second, rerr.retryAfter)
+}
+
+func TestRateLimitErrorIsAProxyError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusTooManyRequests)
+		_, _ = w.Write([]byte(`{"error_code":42901,"message":"Request rate limit exceeded"}`))
+	}))
+	defer server.Close()
+
+	q := &kafkaRESTClient{addrs: []string{server.URL}, caller: httpClient{client: &http.Client{}}}
+	_, err := q.consumeMessages(testConsumer)
+
+	assert.True(t, errors.Is(err, ErrRateLimited), "expected ErrRateLimited, got %v", err)
+	var perr *ProxyError
+	if !errors.As(err, &perr) {
+		t.Fatalf("Expected ProxyError. Actual: [%v]", err)
+	}
+	assert.Equal(t, http.StatusTooManyRequests, perr.StatusCode)
+	assert.Equal(t, 42901, perr.ErrorCode)
+	assert.Equal(t, "consume", perr.Operation)
+	assert.Equal(t, `{"error_code":42901,"message":"Request rate limit exceeded"}`, perr.Body)
+	assert.True(t, strings.HasPrefix(err.Error(), "consume: "), err.Error())
+}
+
+func TestRateLimitRetryAfterDateUsesTheConsumerClock(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Retry-After", "Wed, 21 Oct 2015 07:28:30 GMT")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer server.Close()
+
+	c := newConsumerInstance(QueueConfig{Addrs: []string{server.URL}}, func(m Message) {}, &http.Client{}, nil)
+	c.setClock(&fakeClock{now: time.Date(2015, 10, 21, 7, 28, 0, 0, time.UTC)})
+	c.setConsumer(&testConsumer)
+
+	_, err := c.consume()
+	assert.True(t, errors.Is(err, ErrRateLimited), "expected ErrRateLimited, got %v", err)
+	assert.Equal(t, 30*time.Second, c.nextBackoff())
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2015, 10, 21, 7, 28, 0, 0, time.UTC)
+	var tests = []struct {
+		value    string
+		expected time.Duration
+	}{
+		{"120", 2 * time.Minute},
+		{"Wed, 21 Oct 2015 07:28:30 GMT", 30 * time.Second},
+		{"Wed, 21 Oct 2015 07:27:00 GMT", 0},
+		{"", 0},
+		{"soon", 0},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.expected, parseRetryAfter(test.value, now), test.value)
+	}
+}
+
+func TestUserAgentIsSetOnProxyRequests(t *testing.T) {
+	userAgents := make(map[string]string)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		userAgents[req.Method+" "+req.URL.Path] = req.Header.Get("User-Agent")
+		switch {
+		case req.Method == "DELETE":
+			w.WriteHeader(http.StatusNoContent)
+		case req.URL.Path == "/consumers/group1":
+			_, _ = w.Write([]byte(`{"base_uri": "http://` + req.Host + `/consumers/group1/instances/1"}`))
+		case req.Method == "GET":
+			_, _ = w.Write([]byte(`[]`))
+		default:
+			_, _ = w.Write([]byte(`{}`))
+		}
+	}))
+	defer server.Close()
+
+	q := newKafkaRESTClient(QueueConfig{Addrs: []string{server.URL}, Group: "group1", Topic: "topic", UserAgent: "annotations-writer/1.2.0"}, &http.Client{})
+	c, err := q.createConsumerInstance()
+	assert.NoError(t, err)
+	body, err := q.consumeMessages(c)
+	assert.NoError(t, err)
+	body.Close()
+	assert.NoError(t, q.commitOffsets(c))
+	assert.NoError(t, q.destroyConsumerInstance(c))
+
+	assert.Equal(t, map[string]string{
+		"POST /consumers/group1":                     "annotations-writer/1.2.0",
+		"GET /consumers/group1/instances/1/records":  "annotations-writer/1.2.0",
+		"POST /consumers/group1/instances/1/offsets": "annotations-writer/1.2.0",
+		"DELETE /consumers/group1/instances/1":       "annotations-writer/1.2.0",
+	}, userAgents)
+}
+
+func TestDefaultUserAgent(t *testing.T) {
+	q := newKafkaRESTClient(QueueConfig{Addrs: []string{"http://kafka-proxy-1.prod.ft.com"}}, &http.Client{})
+	assert.True(t, strings.HasPrefix(q.caller.(httpClient).userAgent, "message-queue-gonsumer/"))
+}
+
+func TestNewHTTPClientTransport(t *testing.T) {
+	transport := newHTTPClient(QueueConfig{}, 3).Transport.(*http.Transport)
+	assert.Equal(t, 6, transport.MaxIdleConnsPerHost)
+	assert.Equal(t, defaultIdleConnTimeout, transport.IdleConnTimeout)
+
+	transport = newHTTPClient(QueueConfig{MaxIdleConnsPerHost: 10, IdleConnTimeout: time.Minute}, 3).Transport.(*http.Transport)
+	assert.Equal(t, 10, transport.MaxIdleConnsPerHost)
+	assert.Equal(t, time.Minute, transport.IdleConnTimeout)
+}
+
+func TestConstructorsShareADefaultClientBetweenStreams(t *testing.T) {
+	c := NewConsumer(QueueConfig{StreamCount: 2}, func(m Message) {}, nil, nil).(*Consumer)
+
+	var clients []*http.Client
+	for _, ih := range c.instanceHandlers {
+		caller := ih.(*consumerInstance).queue.(*kafkaRESTClient).caller.(httpClient)
+		clients = append(clients, caller.client)
+	}
+	assert.NotNil(t, clients[0])
+	assert.Equal(t, clients[0], clients[1])
+}
+
+func TestDefaultClientReusesConnectionsAcrossPolls(t *testing.T) {
+	var conns int32
+	var server *httptest.Server
+	server = httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch {
+		case req.Method == "POST" && req.URL.Path == "/consumers/group1":
+			_, _ = w.Write([]byte(`{"base_uri": "` + server.URL + `/consumers/group1/instances/i1"}`))
+		case strings.HasSuffix(req.URL.Path, "/records"):
+			_, _ = w.Write([]byte(`[{"value":"RlRNU0cvMS4wCgpib2R5Cg==","partition":0,"offset":1}]`))
+		case strings.HasSuffix(req.URL.Path, "/offsets"):
+			w.WriteHeader(http.StatusOK)
+		default:
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	server.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&conns, 1)
+		}
+	}
+	server.Start()
+	defer server.Close()
+
+	config := QueueConfig{Addrs: []string{server.URL}, Group: "group1", Topic: "topic"}
+	polls := 0
+	c := newConsumerInstance(config, func(m Message) { polls++ }, newHTTPClient(config, 1), nil)
+
+	assert.NoError(t, c.consumeN(context.Background(), 10))
+	assert.Equal(t, 10, polls)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&conns), "the polls, commits and deletes should share a single connection")
+}
+
+// counts the requests going through the supplied client
+type countingTransport struct {
+	http.RoundTripper
+	requests int32
+}
+
+func (t *countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	atomic.AddInt32(&t.requests, 1)
+	return t.RoundTripper.RoundTrip(req)
+}
+
+func TestSuppliedClientReusesConnectionsAcrossResponses(t *testing.T) {
+	var conns, consumes int32
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		//every other consume fails with an error object, the successful ones return a large body
+		if atomic.AddInt32(&consumes, 1)%2 == 0 {
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"error_code":40403,"message":"Consumer instance not found."}`))
+			return
+		}
+		_, _ = w.Write([]byte("[" + strings.Repeat(`{"value":"RlRNU0cvMS4wCgpib2R5Cg==","partition":0,"offset":1},`, 1000) + `{}]`))
+	}))
+	server.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&conns, 1)
+		}
+	}
+	server.Start()
+	defer server.Close()
+
+	transport := &countingTransport{RoundTripper: http.DefaultTransport.(*http.Transport).Clone()}
+	q := newKafkaRESTClient(QueueConfig{Addrs: []string{server.URL}, Group: "group1"}, &http.Client{Transport: transport})
+	instance := consumerInstanceURI{BaseURI: server.URL + "/consumers/group1/instances/i1"}
+
+	for i := 0; i < 20; i++ {
+		res, err := q.consumeMessages(instance)
+		if i%2 == 1 {
+			assert.Error(t, err)
+			continue
+		}
+		assert.NoError(t, err)
+		//only the beginning of the body is read, as when parsing fails
+		_, _ = res.Read(make([]byte, 16))
+		assert.NoError(t, res.Close())
+	}
+	assert.Equal(t, int32(20), atomic.LoadInt32(&transport.requests), "the requests should go through the supplied client")
+	assert.Equal(t, int32(1), atomic.LoadInt32(&conns), "the responses should be drained for the connection to be reused")
+}
+
+// records whether the bodies of the responses are closed
+type bodyTrackingTransport struct {
+	http.RoundTripper
+	sync.Mutex
+	bodies []*trackedBody
+}
+
+type trackedBody struct {
+	io.ReadCloser
+	closed int32
+}
+
+func (b *trackedBody) Close() error {
+	atomic.AddInt32(&b.closed, 1)
+	return b.ReadCloser.Close()
+}
+
+func (t *bodyTrackingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.RoundTripper.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	body := &trackedBody{ReadCloser: resp.Body}
+	resp.Body = body
+	t.Lock()
+	t.bodies = append(t.bodies, body)
+	t.Unlock()
+	return resp, nil
+}
+
+func (t *bodyTrackingTransport) unclosed() int {
+	t.Lock()
+	defer t.Unlock()
+	n := 0
+	for _, b := range t.bodies {
+		if atomic.LoadInt32(&b.closed) == 0 {
+			n++
+		}
+	}
+	return n
+}
+
+func TestErrorResponsesAreClosed(t *testing.T) {
+	var conns int32
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+		_, _ = w.Write([]byte(`{"error_code":40403,"message":"` + strings.Repeat("Consumer instance not found. ", 1000) + `"}`))
+	}))
+	server.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&conns, 1)
+		}
+	}
+	server.Start()
+	defer server.Close()
+
+	transport := &bodyTrackingTransport{RoundTripper: http.DefaultTransport.(*http.Transport).Clone()}
+	q := newKafkaRESTClient(QueueConfig{Addrs: []string{server.URL}, Group: "group1", Topic: "topic", VerifyTopicExists: true}, &http.Client{Transport: transport})
+	instance := consumerInstanceURI{BaseURI: server.URL + "/consumers/group1/instances/i1"}
+
+	calls := []func() error{
+		func() error { _, err := q.createConsumerInstance(); return err },
+		func() error { return q.subscribeConsumerInstance(instance) },
+		func() error { return q.seekOffsets(instance, map[int]int64{0: 1}) },
+		func() error { _, err := q.consumeMessages(instance); return err },
+		func() error { return q.keepAlive(instance) },
+		func() error { return q.commitOffsets(instance) },
+		func() error { return q.commitPartitionOffsets(instance, map[int]int64{0: 1}) },
+		func() error { _, err := q.topicExists(); return err },
+		func() error { return q.checkConnectivity() },
+		func() error { return q.destroyConsumerInstanceSubscription(instance) },
+		func() error { return q.destroyConsumerInstance(instance) },
+	}
+	for i := 0; i < 10; i++ {
+		for _, call := range calls {
+			//some of the calls tolerate the 404, e.g. deleting an instance that is already gone
+			_ = call()
+		}
+	}
+
+	assert.Equal(t, 0, transport.unclosed(), "every error response body should be closed")
+	assert.Equal(t, int32(1), atomic.LoadInt32(&conns), "the error responses should be drained for the connection to be reused")
+}
+
+func TestTokenProviderRotatesAuthorization(t *testing.T) {
+	var auths []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		auths = append(auths, req.Header.Get("Authorization"))
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	tokens := []string{"Bearer token-1", "Bearer token-2"}
+	calls := 0
+	c := httpClient{client: &http.Client{}, authorizationKey: "static-key", tokenProvider: func() (string, error) {
+		token := tokens[calls%len(tokens)]
+		calls++
+		return token, nil
+	}}
+
+	for i := 0; i < 3; i++ {
+		_, err := c.DoReq("GET", server.URL, nil, nil, http.StatusOK)
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, []string{"Bearer token-1", "Bearer token-2", "Bearer token-1"}, auths, "each request should get a fresh token instead of the static key")
+}
+
+func TestTokenProviderErrorFailsTheRequest(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		requests++
+	}))
+	defer server.Close()
+
+	providerErr := errors.New("token endpoint unavailable")
+	c := httpClient{client: &http.Client{}, tokenProvider: func() (string, error) { return "", providerErr }}
+	_, err := c.DoReq("GET", server.URL, nil, nil, http.StatusOK)
+
+	assert.True(t, errors.Is(err, providerErr))
+	assert.EqualError(t, err, "error getting authorization token from the token provider: token endpoint unavailable")
+	assert.Equal(t, 0, requests, "the request should not be sent without a token")
+}
@@ -0,0 +1,45 @@
+package consumer
+
+import "context"
+
+// NewInMemoryConsumer returns a MessageConsumer that feeds the given messages to the handler
+// through the same processing machinery as NewConsumer, without connecting to a proxy.
+// It is meant for testing handlers: config.ConcurrentProcessing and config.NoOfProcessors are honoured.
+func NewInMemoryConsumer(config QueueConfig, messages []Message, handler func(m Message)) MessageConsumer {
+	return newInMemoryConsumer(config, messages, splitMessageProcessor{handler})
+}
+
+// NewInMemoryBatchedConsumer is the batched counterpart of NewInMemoryConsumer
+func NewInMemoryBatchedConsumer(config QueueConfig, messages []Message, handler func(m []Message)) MessageConsumer {
+	return newInMemoryConsumer(config, messages, batchedMessageProcessor{handler})
+}
+
+func newInMemoryConsumer(config QueueConfig, messages []Message, processor messageProcessor) *inMemoryConsumer {
+	return &inMemoryConsumer{
+		instance: &consumerInstance{
+			config:    config,
+			processor: processor,
+			logger:    discardLogger(),
+		},
+		messages: messages,
+	}
+}
+
+// inMemoryConsumer processes a fixed set of messages
+type inMemoryConsumer struct {
+	instance *consumerInstance
+	messages []Message
+}
+
+// Start processes all the messages and returns once they have been handled
+func (c *inMemoryConsumer) Start() {
+	c.instance.processMessages(context.Background(), c.messages)
+}
+
+// Stop is a no-op as Start returns once the messages are processed
+func (c *inMemoryConsumer) Stop() {}
+
+// ConnectivityCheck always succeeds as there is no proxy involved
+func (c *inMemoryConsumer) ConnectivityCheck() (string, error) {
+	return "In-memory consumer has no proxy to connect to.", nil
+}
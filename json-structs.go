@@ -1,18 +1,96 @@
 package consumer
 
+import "time"
+
 //QueueConfig represents the configuration of the queue, consumer group and topic the consumer interested about.
 type QueueConfig struct {
-	Addrs                []string `json:"address"` //list of queue addresses.
-	Group                string   `json:"group"`
-	Topic                string   `json:"topic"`
-	Queue                string   `json:"queue"` //The name of the queue.
-	Offset               string   `json:"offset"`
-	BackoffPeriod        int      `json:"backoffPeriod"`
-	StreamCount          int      `json:"streamCount"`
-	ConcurrentProcessing bool     `json:"concurrentProcessing"`
-	AuthorizationKey     string   `json:"authorizationKey"`
-	AutoCommitEnable     bool     `json:"autoCommitEnable"`
-	NoOfProcessors       int      `json:"noOfProcessors"`
+	Addrs                   []string      `json:"address"`  //list of queue addresses.
+	BasePath                string        `json:"basePath"` //path prefix the proxy endpoints are served under, e.g. /kafka-proxy.
+	Group                   string        `json:"group"`
+	Topic                   string        `json:"topic"`
+	Queue                   string        `json:"queue"` //The name of the queue.
+	Offset                  string        `json:"offset"`
+	BackoffPeriod           int           `json:"backoffPeriod"`
+	StreamCount             int           `json:"streamCount"`
+	ConcurrentProcessing    bool          `json:"concurrentProcessing"`
+	AuthorizationKey        string        `json:"authorizationKey"`
+	UserAgent               string        `json:"userAgent"` //User-Agent of the proxy requests. Defaults to message-queue-gonsumer/<version>.
+	AutoCommitEnable        bool          `json:"autoCommitEnable"`
+	NoOfProcessors          int           `json:"noOfProcessors"`
+	ProcessorChannelBuffer  int           `json:"processorChannelBuffer"`  //buffer size of the channel feeding the concurrent processors. Defaults to 128.
+	MaxInFlight             int           `json:"maxInFlight"`             //maximum number of messages dispatched to the concurrent processors and not yet processed. 0 means no limit.
+	MaxMessagesPerSecond    int           `json:"maxMessagesPerSecond"`    //maximum rate at which each stream hands messages to the handler, dispatch slows down rather than dropping messages. 0 means no limit.
+	MaxIdleConnsPerHost     int           `json:"maxIdleConnsPerHost"`     //idle connections kept per proxy when no http.Client is given. Defaults to 2 per stream.
+	IdleConnTimeout         time.Duration `json:"idleConnTimeout"`         //how long idle connections are kept when no http.Client is given. Defaults to 90s.
+	SeekOffsets             map[int]int64 `json:"seekOffsets"`             //partition to offset the consumer instance is moved to after subscribing.
+	APIVersion              string        `json:"apiVersion"`              //kafka-rest-proxy API version, v1 or v2. Defaults to v2.
+	CommitRetries           int           `json:"commitRetries"`           //number of times a failed offset commit is retried before the consumer instance is torn down.
+	CommitRetryInterval     time.Duration `json:"commitRetryInterval"`     //wait before the first commit retry, doubled after each attempt. Defaults to 1s.
+	CommitProcessedOffsets  bool          `json:"commitProcessedOffsets"`  //only commit each partition up to the first message an error aware handler failed on, and redeliver from there. v2 API only.
+	DestroyRetries          int           `json:"destroyRetries"`          //number of times a failed delete of the consumer instance or its subscription is retried on shutdown. Defaults to 2.
+	RawBody                 bool          `json:"rawBody"`                 //skip FT message format parsing, only Message.Raw is populated with the decoded value.
+	TimestampHeader         string        `json:"timestampHeader"`         //header parsed into Message.Timestamp. Defaults to Message-Timestamp.
+	TransactionIDHeader     string        `json:"transactionIdHeader"`     //header returned by Message.TransactionID. Defaults to X-Request-Id.
+	Decompression           string        `json:"decompression"`           //none or gzip, how the message values are decompressed after base64 decoding. Defaults to none.
+	MaxMessageBytes         int           `json:"maxMessageBytes"`         //skip the messages whose decoded value, decompressed if need be, is larger than this. 0 means no limit.
+	AvroSchemaRegistryURL   string        `json:"avroSchemaRegistryUrl"`   //decode the values as Avro records in the Confluent wire format, with their schema fetched by id from this Schema Registry, into a JSON Message.Body.
+	LazyBody                bool          `json:"lazyBody"`                //leave Message.Body empty and read the body with Message.BodyReader, for large bodies not to be copied into a string.
+	BalancedJSONBody        bool          `json:"balancedJsonBody"`        //set Message.Body to the first complete JSON object of the body, leaving out anything after it.
+	HeaderBodySeparator     string        `json:"headerBodySeparator"`     //exact separator the headers and body are split on, e.g. "\r\n\r\n". Defaults to the first blank line with either line ending.
+	DebugRawResponses       bool          `json:"debugRawResponses"`       //log the status and the first 4KB of every consume response at debug level.
+	LogPerMessage           bool          `json:"logPerMessage"`           //log the partition and offset of every parsed or skipped message at debug level.
+	ReconnectWarnThreshold  int           `json:"reconnectWarnThreshold"`  //warn when the consumer instance is recreated more than this many times in a row. 0 disables the warning.
+	ReconnectWarnWindow     time.Duration `json:"reconnectWarnWindow"`     //an instance living longer than this resets the reconnect count. Defaults to 5m.
+	KeepAliveInterval       time.Duration `json:"keepAliveInterval"`       //ping the consumer instance at this interval while messages are processed. 0 disables keep-alive.
+	InstanceName            string        `json:"instanceName"`            //name of the consumer instance, suffixed with the stream number when StreamCount > 1. Generated by the proxy when empty.
+	GroupInstanceID         string        `json:"groupInstanceId"`         //group.instance.id of the consumer instance for static group membership, suffixed with the stream number when StreamCount > 1.
+	RequestTimeout          time.Duration `json:"requestTimeout"`          //request.timeout.ms of the consumer instance. Proxy default when 0.
+	SessionTimeout          time.Duration `json:"sessionTimeout"`          //session.timeout.ms of the consumer instance, between 6s and 5m. Proxy default when 0.
+	FetchMaxBytes           int           `json:"fetchMaxBytes"`           //fetch.max.bytes of the consumer instance. Proxy default when 0.
+	MaxPollRecords          int           `json:"maxPollRecords"`          //max.poll.records of the consumer instance. Proxy default when 0.
+	ConsumeMaxBytes         int           `json:"consumeMaxBytes"`         //max_bytes query parameter of each consume request. Proxy default when 0.
+	ConsumeTimeoutMs        int           `json:"consumeTimeoutMs"`        //timeout query parameter of each consume request, in milliseconds, for the proxy to hold empty polls. Empty polls are not backed off when set. Proxy default when 0.
+	VerifyTopicExists       bool          `json:"verifyTopicExists"`       //stop the consumer with ErrTopicNotFound if the topic is not in the proxy's topic listing.
+	DedupWindow             int           `json:"dedupWindow"`             //skip messages whose partition and offset are among the last DedupWindow consumed, e.g. redelivered after an instance expiry. 0 disables deduplication.
+	LargeBatchThreshold     int           `json:"largeBatchThreshold"`     //warn when a poll returns more messages than this, as the consumer may be falling behind. 0 disables the warning.
+	SlowHandlerThreshold    time.Duration `json:"slowHandlerThreshold"`    //warn when the handler takes longer than this to process a message, or a batch for the batched handlers. 0 disables the warning.
+	AsyncCommit             bool          `json:"asyncCommit"`             //coalesce the commits of the batches consumed within AsyncCommitInterval instead of committing after every batch. Pending offsets are flushed on Stop.
+	AsyncCommitInterval     time.Duration `json:"asyncCommitInterval"`     //how long consumed offsets may stay uncommitted with AsyncCommit. Defaults to 5s.
+	MaxDeliveryAttempts     int           `json:"maxDeliveryAttempts"`     //with CommitProcessedOffsets, times a message is redelivered to an error aware handler before being passed to DeadLetter and skipped. 0 redelivers indefinitely.
+	CircuitBreakerThreshold int           `json:"circuitBreakerThreshold"` //consecutive failed polls after which the proxy calls of the stream are skipped for CircuitBreakerCooldown. 0 disables the breaker.
+	CircuitBreakerCooldown  time.Duration `json:"circuitBreakerCooldown"`  //how long the proxy calls are skipped once the circuit breaker opens, before a poll is let through. Defaults to 1m.
+	FirstPollImmediate      *bool         `json:"firstPollImmediate"`      //poll as soon as the consume loop starts, only backing off after empty or failed polls. Defaults to true, false backs off for BackoffPeriod first, e.g. to stagger the start of many workers.
+
+	ProxyConsumerConfig map[string]string `json:"proxyConsumerConfig"` //extra properties of the consumer instance config, e.g. fetch.min.bytes. The ones set from the other fields take precedence.
+	ContentTypes        ContentTypes      `json:"contentTypes"`        //overrides the Content-Type or Accept header of each kind of proxy request, to adapt to proxy quirks.
+
+	TokenProvider               func() (string, error)          `json:"-"` //returns the Authorization header of each proxy request, taking precedence over AuthorizationKey, e.g. a refreshed OAuth bearer token.
+	OnSubscribe                 func(instanceURI string)        `json:"-"` //called after a consumer instance is created and subscribed to the topic.
+	OnUnsubscribe               func(instanceURI string)        `json:"-"` //called after a consumer instance is torn down.
+	OnLargeBatch                func(size int)                  `json:"-"` //called with the batch size when a poll exceeds LargeBatchThreshold.
+	BeforeCommit                func(offsets ...int)            `json:"-"` //called with the offsets of the batch right before they are committed, when AutoCommitEnable is false.
+	AfterCommit                 func(offsets ...int)            `json:"-"` //called with the offsets of the batch once they have been committed, when AutoCommitEnable is false.
+	OnCommit                    func(offsets map[int]int64)     `json:"-"` //called with the last offset committed per partition after every successful commit, including the explicit ones, when AutoCommitEnable is false.
+	Unmarshaler                 Unmarshaler                     `json:"-"` //decodes the records of the proxy response. Defaults to encoding/json.
+	OnRawResponse               func(data []byte)               `json:"-"` //called with the whole body of every successful consume response before it is parsed, when DebugRawResponses is set. data must not be modified.
+	ValidateMessage             func(m Message) error           `json:"-"` //called with each parsed message before it is handed to the handler, the ones it fails are passed to DeadLetter and committed instead.
+	DeadLetter                  func(m Message, err error)      `json:"-"` //called with a message that failed MaxDeliveryAttempts times or ValidateMessage and the last error, before its offset is committed.
+	OnCircuitBreakerStateChange func(state CircuitBreakerState) `json:"-"` //called from the stream goroutine whenever its circuit breaker changes state.
+	WorkerKeyFunc               func(m Message) string          `json:"-"` //with ConcurrentProcessing, returns the key routing each message to a processor, the messages with the same key being processed in order by the same one.
+}
+
+// ContentTypes are the Content-Type headers of the proxy requests with a body, and the Accept headers of the others.
+// The empty ones default to the content type of the APIVersion, application/vnd.kafka.v2+json, the v1 consume
+// requests accepting application/vnd.kafka.binary.v1+json.
+type ContentTypes struct {
+	Create    string `json:"create"`    //Content-Type of the consumer instance creation.
+	Subscribe string `json:"subscribe"` //Content-Type of the subscription, or of the partition assignment.
+	Seek      string `json:"seek"`      //Content-Type of the seeks to SeekOffsets or to the failed messages.
+	Consume   string `json:"consume"`   //Accept of the consume requests.
+	Commit    string `json:"commit"`    //Content-Type of the offset commits.
+	KeepAlive string `json:"keepAlive"` //Accept of the keep-alive pings.
+	Destroy   string `json:"destroy"`   //Accept of the deletion of the subscription and of the consumer instance.
+	Topics    string `json:"topics"`    //Accept of the topic listing of VerifyTopicExists and of the connectivity check.
 }
 
 type consumerInstanceURI struct {
@@ -1,9 +1,89 @@
 package consumer
 
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
 // Message defines the consumed messages
+//
+// FT-format messages have their Headers and Body populated.
+// Raw always holds the decoded message value as it was produced, e.g. for signature
+// verification, once decompressed with QueueConfig.Decompression. When QueueConfig.RawBody
+// is set, Headers and Body are left empty.
+// BodyReader reads the body, without it being copied into Body when QueueConfig.LazyBody is set.
+// Timestamp is parsed from the QueueConfig.TimestampHeader header and is
+// the zero time when the header is missing or not in RFC3339 format.
+// Partition and Offset locate the message in the topic.
+// IsTombstone is set for the records with a null value, e.g. the deletions of a compacted topic,
+// whose other fields are left empty.
 type Message struct {
+	Headers   map[string]string
+	Body      string
+	Raw       []byte
+	Timestamp time.Time
+	Partition int
+	Offset    int
+	//the record had a null value
+	IsTombstone bool
+	//body within Raw read by BodyReader with QueueConfig.LazyBody, nil otherwise
+	body []byte
+	//QueueConfig.TransactionIDHeader of the consumer, see TransactionID
+	transactionIDHeader string
+}
+
+const defaultTransactionIDHeader = "X-Request-Id"
+
+// TransactionID returns the transaction id of the message used for tracing, read case-insensitively from
+// the QueueConfig.TransactionIDHeader header, X-Request-Id by default. It is empty if the header is missing.
+func (m Message) TransactionID() string {
+	header := defaultTransactionIDHeader
+	if m.transactionIDHeader != "" {
+		header = m.transactionIDHeader
+	}
+	tid, _ := m.Header(header)
+	return tid
+}
+
+// BodyReader returns a reader over the body, e.g. to stream-decode it with json.NewDecoder.
+// With QueueConfig.LazyBody it reads the decoded bytes of the body, which are shared with Raw.
+func (m Message) BodyReader() io.Reader {
+	if m.body != nil {
+		return bytes.NewReader(m.body)
+	}
+	return strings.NewReader(m.Body)
+}
+
+// Header returns the value of the header with the given key, ignoring the case of the key.
+// An exact match is preferred when several headers only differ by case.
+func (m Message) Header(key string) (string, bool) {
+	if v, ok := m.Headers[key]; ok {
+		return v, true
+	}
+	for k, v := range m.Headers {
+		if strings.EqualFold(k, key) {
+			return v, true
+		}
+	}
+	return "", false
+}
+
+// StreamMessage is the variant of Message handed to streaming consumers,
+// its Body reads the decoded message body so that large payloads can be stream-parsed.
+// For QueueConfig.RawBody consumers Body reads the raw message value.
+type StreamMessage struct {
 	Headers map[string]string
-	Body    string
+	Body    io.Reader
+}
+
+// Header returns the value of the header with the given key, ignoring the case of the key
+func (m StreamMessage) Header(key string) (string, bool) {
+	return Message{Headers: m.Headers}.Header(key)
 }
 
 // splitMessageProcessor processes messages one by one
@@ -11,19 +91,102 @@ type splitMessageProcessor struct {
 	handler func(m Message)
 }
 
-func (p splitMessageProcessor) consume(msgs ...Message) {
+func (p splitMessageProcessor) consume(ctx context.Context, msgs ...Message) {
 	for _, msg := range msgs {
 		p.handler(msg)
 	}
 }
 
+// errorAwareMessageProcessor processes messages one by one, collecting the ones the handler failed on
+type errorAwareMessageProcessor struct {
+	handler  func(ctx context.Context, m Message) error
+	failures *failedMessages
+}
+
+func (p errorAwareMessageProcessor) consume(ctx context.Context, msgs ...Message) {
+	for _, msg := range msgs {
+		if err := p.handler(ctx, msg); err != nil {
+			p.failures.add(msg, err)
+		}
+	}
+}
+
+// failedMessages is safe for use by the concurrent processors
+type failedMessages struct {
+	sync.Mutex
+	msgs []Message
+	errs []error
+}
+
+func (f *failedMessages) add(m Message, err error) {
+	f.Lock()
+	defer f.Unlock()
+	f.msgs = append(f.msgs, m)
+	f.errs = append(f.errs, err)
+}
+
+// take returns the failed messages with the handler errors and resets the list
+func (f *failedMessages) take() ([]Message, []error) {
+	f.Lock()
+	defer f.Unlock()
+	msgs, errs := f.msgs, f.errs
+	f.msgs, f.errs = nil, nil
+	return msgs, errs
+}
+
 // batchedMessageProcessor process messages in batches
 type batchedMessageProcessor struct {
 	handler func(m []Message)
 }
 
-func (b batchedMessageProcessor) consume(msgs ...Message) {
+func (b batchedMessageProcessor) consume(ctx context.Context, msgs ...Message) {
 	if len(msgs) > 0 {
 		b.handler(msgs)
 	}
 }
+
+// errNotCommitted is the failure of the messages a batched error aware handler left uncommitted without an error
+var errNotCommitted = errors.New("message left uncommitted by the batch handler")
+
+// batchedErrorAwareMessageProcessor processes messages in batches, collecting the messages
+// after the first commitUpTo ones of each batch as failures
+type batchedErrorAwareMessageProcessor struct {
+	handler  func(msgs []Message) (commitUpTo int, err error)
+	failures *failedMessages
+}
+
+func (b batchedErrorAwareMessageProcessor) consume(ctx context.Context, msgs ...Message) {
+	if len(msgs) == 0 {
+		return
+	}
+	commitUpTo, err := b.handler(msgs)
+	if commitUpTo < 0 {
+		commitUpTo = 0
+	}
+	if commitUpTo > len(msgs) {
+		commitUpTo = len(msgs)
+	}
+	if err == nil {
+		err = errNotCommitted
+	}
+	for _, m := range msgs[commitUpTo:] {
+		b.failures.add(m, err)
+	}
+}
+
+// streamingMessageProcessor processes messages one by one as StreamMessages,
+// their body being the raw value with QueueConfig.RawBody
+type streamingMessageProcessor struct {
+	handler func(m StreamMessage)
+	rawBody bool
+}
+
+func (p streamingMessageProcessor) consume(ctx context.Context, msgs ...Message) {
+	for _, msg := range msgs {
+		body := msg.BodyReader()
+		if p.rawBody {
+			body = bytes.NewReader(msg.Raw)
+		}
+		p.handler(StreamMessage{Headers: msg.Headers, Body: body})
+	}
+}
@@ -0,0 +1,99 @@
+package consumer
+
+import (
+	"context"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMessageHeader(t *testing.T) {
+	m := Message{Headers: map[string]string{
+		"X-Request-ID": "tid_1",
+		"content-type": "application/json",
+		"Message-Id":   "id-upper",
+		"message-id":   "id-lower",
+	}}
+
+	var tests = []struct {
+		key      string
+		expected string
+		found    bool
+	}{
+		{key: "X-Request-ID", expected: "tid_1", found: true},
+		{key: "X-Request-Id", expected: "tid_1", found: true},
+		{key: "x-request-id", expected: "tid_1", found: true},
+		{key: "Content-Type", expected: "application/json", found: true},
+		{key: "Message-Id", expected: "id-upper", found: true},
+		{key: "message-id", expected: "id-lower", found: true},
+		{key: "Origin-System-Id", expected: "", found: false},
+	}
+
+	for _, test := range tests {
+		actual, found := m.Header(test.key)
+		assert.Equal(t, test.expected, actual, test.key)
+		assert.Equal(t, test.found, found, test.key)
+	}
+}
+
+func TestMessageHeaderWithoutHeaders(t *testing.T) {
+	_, found := Message{}.Header("X-Request-Id")
+	assert.False(t, found)
+}
+
+func TestMessageTransactionID(t *testing.T) {
+	var tests = []struct {
+		name     string
+		msg      Message
+		expected string
+	}{
+		{"present", Message{Headers: map[string]string{"X-Request-Id": "tid_1"}}, "tid_1"},
+		{"differently cased", Message{Headers: map[string]string{"x-request-id": "tid_2"}}, "tid_2"},
+		{"missing", Message{Headers: map[string]string{"Message-Id": "id"}}, ""},
+		{"no headers", Message{}, ""},
+		{"configured header", Message{Headers: map[string]string{"X-Request-Id": "tid_1", "transaction-id": "tid_3"}, transactionIDHeader: "Transaction-Id"}, "tid_3"},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.expected, test.msg.TransactionID(), test.name)
+	}
+}
+
+func TestStreamingMessageProcessorYieldsFullBody(t *testing.T) {
+	largeBody := strings.Repeat("0123456789abcdef", 4<<16)
+	msgs := []Message{
+		{Headers: map[string]string{"Message-Id": "0000-1111-0000-abcd"}, Body: largeBody},
+		{Raw: []byte("FTMSG/1.0\r\n\r\n")},
+		{Headers: map[string]string{}, Raw: []byte("\n\nlazy body"), body: []byte("lazy body")},
+	}
+
+	var bodies []string
+	var headers []map[string]string
+	handler := func(m StreamMessage) {
+		data, err := ioutil.ReadAll(m.Body)
+		assert.NoError(t, err)
+		bodies = append(bodies, string(data))
+		headers = append(headers, m.Headers)
+	}
+	streamingMessageProcessor{handler, false}.consume(context.Background(), msgs...)
+
+	assert.Equal(t, []string{largeBody, "", "lazy body"}, bodies, "an empty FT message should keep its empty body")
+	assert.Equal(t, map[string]string{"Message-Id": "0000-1111-0000-abcd"}, headers[0])
+
+	bodies = nil
+	streamingMessageProcessor{handler, true}.consume(context.Background(), Message{Raw: []byte("raw value")})
+	assert.Equal(t, []string{"raw value"}, bodies, "the body should be the raw value with RawBody")
+}
+
+func TestBatchedErrorAwareProcessorFailures(t *testing.T) {
+	failures := &failedMessages{}
+	p := batchedErrorAwareMessageProcessor{func(msgs []Message) (int, error) { return 1, nil }, failures}
+	p.consume(context.Background(), Message{Offset: 1}, Message{Offset: 2})
+	p.consume(context.Background())
+
+	failed, errs := failures.take()
+	assert.Equal(t, []Message{{Offset: 2}}, failed)
+	assert.Equal(t, []error{errNotCommitted}, errs, "the messages left uncommitted without an error should get one")
+}
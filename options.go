@@ -0,0 +1,87 @@
+package consumer
+
+import (
+	"net/http"
+	"time"
+
+	log "github.com/Financial-Times/go-logger/v2"
+)
+
+// Option customises a consumer created with NewConsumerWithOptions, or any other constructor
+type Option func(o *options)
+
+// Metrics is notified of the outcome of every poll of every stream, it must be safe for concurrent use
+type Metrics interface {
+	// Poll is called with the number of messages consumed, the time taken to consume, process and commit them,
+	// and the error the poll failed with, if any.
+	Poll(messages int, d time.Duration, err error)
+}
+
+// PollStage is a step of a poll timed for StageMetrics
+type PollStage string
+
+const (
+	StageCreate    PollStage = "create"    //creation of the consumer instance
+	StageSubscribe PollStage = "subscribe" //subscription of the consumer instance to the topic
+	StageConsume   PollStage = "consume"   //consume request, until the response headers are received
+	StageParse     PollStage = "parse"     //reading and parsing of the response body
+	StageProcess   PollStage = "process"   //handling of the consumed messages
+	StageCommit    PollStage = "commit"    //offset commit, when AutoCommitEnable is false
+)
+
+// StageMetrics can be implemented by the Metrics given to WithMetrics to also be notified of the time spent
+// in each stage of a poll, e.g. to record a histogram per stage. Only the stages a poll went through are reported,
+// create and subscribe being reported when the consumer instance is (re)created.
+type StageMetrics interface {
+	Stage(stage PollStage, d time.Duration)
+}
+
+type options struct {
+	client       *http.Client
+	logger       *log.UPPLogger
+	errorHandler func(err error)
+	metrics      Metrics
+	backoff      time.Duration
+}
+
+// WithHTTPClient sets the client used for the proxy requests, see NewConsumer for the default
+func WithHTTPClient(client *http.Client) Option {
+	return func(o *options) {
+		o.client = client
+	}
+}
+
+// WithLogger sets the logger, nothing is logged by default
+func WithLogger(logger *log.UPPLogger) Option {
+	return func(o *options) {
+		o.logger = logger
+	}
+}
+
+// WithErrorHandler sets a function called with the error of every failed poll, e.g. to report it.
+// It is called from the stream goroutines, so it must be safe for concurrent use.
+func WithErrorHandler(handler func(err error)) Option {
+	return func(o *options) {
+		o.errorHandler = handler
+	}
+}
+
+// WithMetrics sets the Metrics notified of every poll
+func WithMetrics(metrics Metrics) Option {
+	return func(o *options) {
+		o.metrics = metrics
+	}
+}
+
+// WithBackoff sets the wait after a failed or empty poll, taking precedence over QueueConfig.BackoffPeriod.
+// It allows waits shorter than a second.
+func WithBackoff(backoff time.Duration) Option {
+	return func(o *options) {
+		o.backoff = backoff
+	}
+}
+
+// NewConsumerWithOptions returns a new instance of a Consumer customised by the options
+func NewConsumerWithOptions(config QueueConfig, handler func(m Message), opts ...Option) MessageConsumer {
+	return NewConsumer(config, handler, nil, nil, opts...)
+}
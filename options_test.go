@@ -0,0 +1,128 @@
+package consumer
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	log "github.com/Financial-Times/go-logger/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+type recordingMetrics struct {
+	sync.Mutex
+	messages []int
+	errs     []error
+}
+
+func (m *recordingMetrics) Poll(messages int, d time.Duration, err error) {
+	m.Lock()
+	defer m.Unlock()
+	m.messages = append(m.messages, messages)
+	m.errs = append(m.errs, err)
+}
+
+type stageRecordingMetrics struct {
+	recordingMetrics
+	stages []PollStage
+	ds     []time.Duration
+}
+
+func (m *stageRecordingMetrics) Stage(stage PollStage, d time.Duration) {
+	m.Lock()
+	defer m.Unlock()
+	m.stages = append(m.stages, stage)
+	m.ds = append(m.ds, d)
+}
+
+func TestStageMetrics(t *testing.T) {
+	metrics := &stageRecordingMetrics{}
+	c := NewConsumerWithOptions(QueueConfig{}, func(m Message) { time.Sleep(time.Millisecond) }, WithMetrics(metrics)).(*Consumer)
+	instance := c.instanceHandlers[0].(*consumerInstance)
+	instance.queue = defaultTestQueueCaller{}
+
+	_, err := instance.poll()
+	assert.NoError(t, err)
+	assert.Equal(t, []PollStage{StageCreate, StageSubscribe, StageConsume, StageParse, StageProcess, StageCommit}, metrics.stages)
+	assert.True(t, metrics.ds[4] >= 2*time.Millisecond, "the process stage should include the handler calls")
+	assert.Equal(t, []int{2}, metrics.messages, "the poll should still be reported")
+
+	metrics.stages = nil
+	_, err = instance.poll()
+	assert.NoError(t, err)
+	assert.Equal(t, []PollStage{StageConsume, StageParse, StageProcess, StageCommit}, metrics.stages, "create and subscribe should only be timed for a new consumer instance")
+}
+
+func TestNewConsumerWithOptions(t *testing.T) {
+	client := &http.Client{}
+	logger := log.NewUPPLogger("Test", "FATAL")
+	metrics := &recordingMetrics{}
+	var errs []error
+
+	c := NewConsumerWithOptions(QueueConfig{StreamCount: 2, BackoffPeriod: 30}, func(m Message) {},
+		WithHTTPClient(client),
+		WithLogger(logger),
+		WithMetrics(metrics),
+		WithErrorHandler(func(err error) { errs = append(errs, err) }),
+		WithBackoff(100*time.Millisecond),
+	).(*Consumer)
+
+	assert.Len(t, c.instanceHandlers, 2)
+	for _, ih := range c.instanceHandlers {
+		instance := ih.(*consumerInstance)
+		assert.Equal(t, logger, instance.logger)
+		assert.Equal(t, client, instance.queue.(*kafkaRESTClient).caller.(httpClient).client)
+	}
+
+	clk := &fakeClock{}
+	instance := c.instanceHandlers[0].(*consumerInstance)
+	instance.queue = consumeMsgErrorQueueCaller{}
+	instance.clock = clk
+
+	assert.NoError(t, instance.consumeN(context.Background(), 2))
+	assert.Len(t, errs, 2)
+	assert.Equal(t, []int{0, 0}, metrics.messages)
+	assert.Equal(t, errs, metrics.errs)
+	assert.Equal(t, []time.Duration{100 * time.Millisecond}, clk.waits(), "WithBackoff should take precedence over BackoffPeriod")
+
+	instance.queue = defaultTestQueueCaller{}
+	assert.NoError(t, instance.consumeN(context.Background(), 1))
+	assert.Len(t, errs, 2)
+	assert.Equal(t, []int{0, 0, 2}, metrics.messages)
+	assert.Nil(t, metrics.errs[2])
+}
+
+func TestNewConsumerWithoutOptions(t *testing.T) {
+	c := NewConsumerWithOptions(QueueConfig{}, func(m Message) {}).(*Consumer)
+
+	instance := c.instanceHandlers[0].(*consumerInstance)
+	assert.NotNil(t, instance.logger)
+	assert.NotNil(t, instance.queue.(*kafkaRESTClient).caller.(httpClient).client)
+	assert.Equal(t, 8*time.Second, instance.backoffPeriod())
+}
+
+func TestOptionsApplyToEveryConsumerKind(t *testing.T) {
+	client := &http.Client{}
+	logger := log.NewUPPLogger("Test", "FATAL")
+	metrics := &recordingMetrics{}
+	opts := []Option{WithHTTPClient(client), WithLogger(logger), WithMetrics(metrics), WithBackoff(time.Second)}
+
+	consumers := map[string]MessageConsumer{
+		"split":               NewConsumer(QueueConfig{}, func(m Message) {}, nil, nil, opts...),
+		"batched":             NewBatchedConsumer(QueueConfig{}, func(m []Message) {}, nil, nil, opts...),
+		"streaming":           NewStreamingConsumer(QueueConfig{}, func(m StreamMessage) {}, nil, nil, opts...),
+		"error aware":         NewErrorAwareConsumer(QueueConfig{}, func(m Message) error { return nil }, nil, nil, opts...),
+		"batched error aware": NewBatchedErrorAwareConsumer(QueueConfig{}, func(m []Message) (int, error) { return len(m), nil }, nil, nil, opts...),
+		"context":             NewContextConsumer(QueueConfig{}, func(ctx context.Context, m Message) error { return nil }, nil, nil, opts...),
+		"options over client": NewConsumer(QueueConfig{}, func(m Message) {}, &http.Client{}, nil, opts...),
+	}
+	for name, c := range consumers {
+		instance := c.(*Consumer).instanceHandlers[0].(*consumerInstance)
+		assert.Equal(t, logger, instance.logger, name)
+		assert.True(t, client == instance.queue.(*kafkaRESTClient).caller.(httpClient).client, "%s: WithHTTPClient should take precedence over the client", name)
+		assert.Equal(t, metrics, instance.metrics, name)
+		assert.Equal(t, time.Second, instance.backoffPeriod(), name)
+	}
+}
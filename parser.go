@@ -1,84 +1,447 @@
 package consumer
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"regexp"
 	"strings"
+	"time"
 
 	log "github.com/Financial-Times/go-logger/v2"
 )
 
 //raw message
 type message struct {
-	Value     string `json:"value"` //base64 encoded
-	Partition int    `json:"partition"`
-	Offset    int    `json:"offset"`
+	Value     *string `json:"value"` //base64 encoded, nil for a tombstone
+	Partition int     `json:"partition"`
+	Offset    int     `json:"offset"`
 }
 
-func parseResponse(data []byte, logger *log.UPPLogger) ([]Message, error) {
-	var resp []message
-	err := json.Unmarshal(data, &resp)
+// Unmarshaler decodes a single JSON record of the proxy response.
+// It can be set on QueueConfig to replace encoding/json with a faster or more lenient decoder.
+type Unmarshaler interface {
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// UnmarshalerFunc adapts a function such as json.Unmarshal to the Unmarshaler interface
+type UnmarshalerFunc func(data []byte, v interface{}) error
+
+// Unmarshal calls f(data, v)
+func (f UnmarshalerFunc) Unmarshal(data []byte, v interface{}) error {
+	return f(data, v)
+}
+
+// ErrNonJSONResponse is returned when the proxy responds with something other than JSON, e.g. an HTML error page
+var ErrNonJSONResponse = errors.New("non-JSON response from proxy")
+
+const maxResponseSnippet = 256
+
+// errMessageTooLarge is returned for the messages whose decoded value exceeds QueueConfig.MaxMessageBytes
+var errMessageTooLarge = errors.New("message exceeds the maximum message size")
+
+const defaultTimestampHeader = "Message-Timestamp"
+
+const (
+	decompressionNone = "none"
+	decompressionGzip = "gzip"
+)
+
+// parseResponse decodes the consumed records one by one while streaming over the response body
+func parseResponse(r io.Reader, config QueueConfig, logger *log.UPPLogger) ([]Message, error) {
+	return parseResponseSkipping(r, config, logger, nil)
+}
+
+// parseResponseSkipping is parseResponse leaving out the records for which skip returns true.
+// Empty polls, answered with [] or an empty body, return early without setting up the decoder.
+func parseResponseSkipping(r io.Reader, config QueueConfig, logger *log.UPPLogger, skip func(partition, offset int) bool) ([]Message, error) {
+	br := bufio.NewReader(r)
+	first, err := peekNonSpace(br)
+	if err == io.EOF {
+		return nil, nil
+	}
 	if err != nil {
-		return nil, fmt.Errorf("error parsing json message %q: %w", data, err)
+		return nil, fmt.Errorf("error reading response: %w", err)
 	}
+
+	switch first {
+	case '[':
+		_, _ = br.ReadByte()
+		next, err := peekNonSpace(br)
+		if err != nil && err != io.EOF {
+			return nil, fmt.Errorf("error reading response: %w", err)
+		}
+		if next == ']' {
+			return nil, nil
+		}
+	case '{':
+		data, _ := ioutil.ReadAll(br)
+		if perr := parseProxyError(0, data); perr != nil {
+			return nil, perr
+		}
+		return nil, fmt.Errorf("error parsing json message %q: expected an array of messages", data)
+	default:
+		data, _ := ioutil.ReadAll(io.LimitReader(br, maxResponseSnippet))
+		return nil, fmt.Errorf("%w: %q", ErrNonJSONResponse, data)
+	}
+
+	//the opening bracket has been read by the empty array check
+	dec := json.NewDecoder(io.MultiReader(strings.NewReader("["), br))
+	if _, err = dec.Token(); err != nil {
+		return nil, fmt.Errorf("error parsing json message: %w", err)
+	}
+
 	var msgs []Message
-	for _, m := range resp {
-		msg, err := parseMessage(m.Value, logger)
+	for dec.More() {
+		var m message
+		if err = decodeRecord(dec, config.Unmarshaler, &m); err != nil {
+			return nil, fmt.Errorf("error parsing json message: %w", err)
+		}
+		if skip != nil && skip(m.Partition, m.Offset) {
+			if config.LogPerMessage {
+				logger.WithField("partition", m.Partition).WithField("offset", m.Offset).Debug("Skipping already consumed message")
+			}
+			continue
+		}
+		if config.LogPerMessage {
+			logger.WithField("partition", m.Partition).WithField("offset", m.Offset).Debug("Parsing message")
+		}
+
+		if m.Value == nil {
+			msgs = append(msgs, Message{IsTombstone: true, Partition: m.Partition, Offset: m.Offset, transactionIDHeader: config.TransactionIDHeader})
+			continue
+		}
+		msg, err := parseMessage(*m.Value, config, logger)
+		if errors.Is(err, errMessageTooLarge) {
+			logger.WithError(err).WithField("partition", m.Partition).WithField("offset", m.Offset).Warn("Skipping oversized message")
+			continue
+		}
 		if err != nil {
-			logger.WithError(err).Error("Error parsing message")
+			logger.WithError(err).WithField("partition", m.Partition).WithField("offset", m.Offset).Error("Error parsing message")
 			continue
 		}
+		msg.Partition = m.Partition
+		msg.Offset = m.Offset
 
 		msgs = append(msgs, msg)
 	}
+
+	if _, err = dec.Token(); err != nil {
+		return nil, fmt.Errorf("error parsing json message: %w", err)
+	}
 	return msgs, nil
 }
 
+func decodeRecord(dec *json.Decoder, unmarshaler Unmarshaler, m *message) error {
+	if unmarshaler == nil {
+		return dec.Decode(m)
+	}
+
+	var raw json.RawMessage
+	if err := dec.Decode(&raw); err != nil {
+		return err
+	}
+	return unmarshaler.Unmarshal(raw, m)
+}
+
+// peekNonSpace skips leading whitespace and returns the next byte without consuming it
+func peekNonSpace(br *bufio.Reader) (byte, error) {
+	for {
+		b, err := br.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		switch b {
+		case ' ', '\t', '\r', '\n':
+			continue
+		}
+		return b, br.UnreadByte()
+	}
+}
+
 // FT async msg format:
 //
 // message-version CRLF
 // *(message-header CRLF)
 // CRLF
 // message-body
-func parseMessage(raw string, logger *log.UPPLogger) (m Message, err error) {
+//
+// Message.Raw always holds the decoded value, decompressed first with config.Decompression.
+// When config.RawBody or config.AvroSchemaRegistryURL is set the value is not expected to be in this format
+// and only Message.Raw is populated.
+func parseMessage(raw string, config QueueConfig, logger *log.UPPLogger) (m Message, err error) {
+	//checked before decoding for the oversized values not to be allocated
+	if size := decodedLen(raw); config.MaxMessageBytes > 0 && size > config.MaxMessageBytes {
+		return Message{}, fmt.Errorf("%w: %d bytes, maximum %d", errMessageTooLarge, size, config.MaxMessageBytes)
+	}
 	decoded, err := base64.StdEncoding.DecodeString(raw)
 	if err != nil {
 		return Message{}, fmt.Errorf("error decoding base64 value: %w", err)
 	}
-	doubleNewLineStartIndex, err := getHeaderSectionEndingIndex(string(decoded[:]))
+	decoded, err = decompress(decoded, config.Decompression, config.MaxMessageBytes)
 	if err != nil {
-		doubleNewLineStartIndex = len(decoded)
-		logger.WithError(err).Warn("message with no message body")
+		return Message{}, err
+	}
+	m.Raw = decoded
+	if config.RawBody || config.AvroSchemaRegistryURL != "" {
+		return m, nil
 	}
+	section := decoded
+	if config.LazyBody {
+		section = headerSection(decoded, config.HeaderBodySeparator)
+	}
+	headersEnd, bodyStart := splitHeaders(string(section), config.HeaderBodySeparator, logger)
 
-	m.Headers = parseHeaders(string(decoded[:doubleNewLineStartIndex]))
-	m.Body = strings.TrimSpace(string(decoded[doubleNewLineStartIndex:]))
+	m.Headers = parseHeaders(string(decoded[:headersEnd]))
+	if config.LazyBody {
+		m.body = bytes.TrimSpace(decoded[bodyStart:])
+		if m.body == nil {
+			m.body = []byte{}
+		}
+	} else {
+		m.Body = strings.TrimSpace(string(decoded[bodyStart:]))
+	}
+	if config.BalancedJSONBody {
+		if config.LazyBody {
+			if obj, found := firstJSONObjectBytes(m.body); found {
+				m.body = obj
+			} else {
+				logger.Warn("message body without a complete JSON object")
+			}
+		} else if obj, found := firstJSONObject(m.Body); found {
+			m.Body = obj
+		} else {
+			logger.Warn("message body without a complete JSON object")
+		}
+	}
+	m.Timestamp = parseTimestamp(m, config, logger)
+	m.transactionIDHeader = config.TransactionIDHeader
 	return m, nil
 }
 
-func getHeaderSectionEndingIndex(msg string) (int, error) {
-	//FT msg format uses CRLF for line endings
-	i := strings.Index(msg, "\r\n\r\n")
-	if i != -1 {
-		return i, nil
+// headerSection returns the beginning of the decoded value holding the headers, up to the separator or the first
+// blank line, for LazyBody not to copy the body into a string when splitting the headers.
+// The whole value is returned when there is neither.
+func headerSection(decoded []byte, separator string) []byte {
+	end := -1
+	if separator != "" {
+		if i := bytes.Index(decoded, []byte(separator)); i != -1 {
+			end = i + len(separator)
+		}
+	} else {
+		for _, blankLine := range []string{"\n\n", "\n\r\n"} {
+			if i := bytes.Index(decoded, []byte(blankLine)); i != -1 && (end == -1 || i+len(blankLine) < end) {
+				end = i + len(blankLine)
+			}
+		}
+	}
+	if end == -1 {
+		return decoded
+	}
+	return decoded[:end]
+}
+
+// decodedLen returns the size of the base64 encoded value once decoded
+func decodedLen(raw string) int {
+	size := base64.StdEncoding.DecodedLen(len(raw))
+	if strings.HasSuffix(raw, "==") {
+		return size - 2
+	}
+	if strings.HasSuffix(raw, "=") {
+		return size - 1
+	}
+	return size
+}
+
+// decompress returns the value decompressed as configured by QueueConfig.Decompression.
+// Decompression stops once the value exceeds maxBytes, unless it is 0.
+func decompress(value []byte, decompression string, maxBytes int) ([]byte, error) {
+	switch decompression {
+	case "", decompressionNone:
+		return value, nil
+	case decompressionGzip:
+		r, err := gzip.NewReader(bytes.NewReader(value))
+		if err != nil {
+			return nil, fmt.Errorf("error decompressing gzip value, the message may not be compressed: %w", err)
+		}
+		defer r.Close()
+		var src io.Reader = r
+		if maxBytes > 0 {
+			src = io.LimitReader(r, int64(maxBytes)+1)
+		}
+		decompressed, err := ioutil.ReadAll(src)
+		if err != nil {
+			return nil, fmt.Errorf("error decompressing gzip value: %w", err)
+		}
+		if maxBytes > 0 && len(decompressed) > maxBytes {
+			return nil, fmt.Errorf("%w: more than %d bytes once decompressed", errMessageTooLarge, maxBytes)
+		}
+		return decompressed, nil
+	}
+	return nil, fmt.Errorf("unsupported decompression %q", decompression)
+}
+
+// firstJSONObject returns the first balanced JSON object of the body, starting at its first '{'.
+// Braces within string literals, escaped quotes included, are not counted.
+func firstJSONObject(body string) (string, bool) {
+	start := strings.IndexByte(body, '{')
+	if start == -1 {
+		return "", false
+	}
+
+	var s jsonObjectScanner
+	for i := start; i < len(body); i++ {
+		if s.closes(body[i]) {
+			return body[start : i+1], true
+		}
+	}
+	return "", false
+}
+
+// firstJSONObjectBytes is firstJSONObject for the LazyBody bodies, reslicing the body rather than copying it
+func firstJSONObjectBytes(body []byte) ([]byte, bool) {
+	start := bytes.IndexByte(body, '{')
+	if start == -1 {
+		return nil, false
+	}
+
+	var s jsonObjectScanner
+	for i := start; i < len(body); i++ {
+		if s.closes(body[i]) {
+			return body[start : i+1], true
+		}
+	}
+	return nil, false
+}
+
+// jsonObjectScanner follows the nesting of a JSON object byte by byte, ignoring the braces within strings
+type jsonObjectScanner struct {
+	depth             int
+	inString, escaped bool
+}
+
+// closes reports whether b is the closing brace of the object
+func (s *jsonObjectScanner) closes(b byte) bool {
+	if s.inString {
+		switch {
+		case s.escaped:
+			s.escaped = false
+		case b == '\\':
+			s.escaped = true
+		case b == '"':
+			s.inString = false
+		}
+		return false
+	}
+
+	switch b {
+	case '"':
+		s.inString = true
+	case '{':
+		s.depth++
+	case '}':
+		s.depth--
+		return s.depth == 0
+	}
+	return false
+}
+
+// parseTimestamp returns the RFC3339 time of the timestamp header, or the zero time if it is missing or invalid
+func parseTimestamp(m Message, config QueueConfig, logger *log.UPPLogger) time.Time {
+	header := defaultTimestampHeader
+	if config.TimestampHeader != "" {
+		header = config.TimestampHeader
 	}
-	//fallback to UNIX line endings
-	i = strings.Index(msg, "\n\n")
-	if i != -1 {
-		return i, nil
+	value, found := m.Header(header)
+	if !found {
+		return time.Time{}
+	}
+
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		logger.WithError(err).WithField("header", header).Warn("Invalid message timestamp")
+		return time.Time{}
+	}
+	return t
+}
+
+// getHeaderSectionEndingIndex returns the index of the first blank line, whether the lines end with CRLF or LF
+func getHeaderSectionEndingIndex(msg string) (int, error) {
+	for i := strings.IndexByte(msg, '\n'); i != -1; {
+		rest := msg[i+1:]
+		if strings.HasPrefix(rest, "\n") || strings.HasPrefix(rest, "\r\n") {
+			//FT msg format uses CRLF for line endings, keep the index at the start of the ending
+			if i > 0 && msg[i-1] == '\r' {
+				return i - 1, nil
+			}
+			return i, nil
+		}
+		next := strings.IndexByte(rest, '\n')
+		if next == -1 {
+			break
+		}
+		i += next + 1
 	}
 
 	return 0, errors.New("header section ending not found")
 }
 
+// splitHeaders returns where the header section ends and the body starts.
+// With a separator the message is split on its first occurrence, otherwise on the first blank line.
+func splitHeaders(msg string, separator string, logger *log.UPPLogger) (headersEnd, bodyStart int) {
+	if separator != "" {
+		i := strings.Index(msg, separator)
+		if i == -1 {
+			logger.WithField("separator", separator).Warn("message with no message body")
+			return len(msg), len(msg)
+		}
+		return i, i + len(separator)
+	}
+
+	i, err := getHeaderSectionEndingIndex(msg)
+	if err != nil {
+		i = headerLinesEndingIndex(msg)
+		if i == len(msg) {
+			logger.WithError(err).Warn("message with no message body")
+		} else {
+			logger.WithError(err).Warn("message with no blank line after the headers")
+		}
+	}
+	return i, i
+}
+
+var headerLineRe = regexp.MustCompile(`^[\w-]+:`)
+
+// headerLinesEndingIndex is the fallback for messages without a blank line after the headers.
+// The headers end at the first line, after the message version, that is not a header.
+func headerLinesEndingIndex(msg string) int {
+	i := strings.IndexByte(msg, '\n')
+	for i != -1 {
+		rest := msg[i+1:]
+		if !headerLineRe.MatchString(rest) {
+			return i
+		}
+		next := strings.IndexByte(rest, '\n')
+		if next == -1 {
+			break
+		}
+		i += next + 1
+	}
+	return len(msg)
+}
+
 var re = regexp.MustCompile(`[\w-]*:[\w\-:/.+;= ]*`)
 var kre = regexp.MustCompile(`[\w-]*:`)
 var vre = regexp.MustCompile(`:[\w-:/.+;= ]*`)
 
 func parseHeaders(msg string) map[string]string {
+	msg = strings.Replace(msg, "\r\n", "\n", -1)
 	headerLines := re.FindAllString(msg, -1)
 	if headerLines == nil {
 		return nil
@@ -1,17 +1,28 @@
 package consumer
 
 import (
+	"bytes"
+	"compress/gzip"
 	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
 
 	logger "github.com/Financial-Times/go-logger/v2"
+	"github.com/sirupsen/logrus"
+	logTest "github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
 )
 
 func TestParseResponse_ResponseContainsMultipleRawMessages_Success(t *testing.T) {
 	expected := []Message{
 		{
-			map[string]string{
+			Headers: map[string]string{
 				"Message-Id":        "c6653374-922c-4b78-927d-15c5125fcd8d",
 				"Message-Timestamp": "2015-10-21T14:22:06.270Z",
 				"Message-Type":      "cms-content-published",
@@ -19,11 +30,13 @@ func TestParseResponse_ResponseContainsMultipleRawMessages_Success(t *testing.T)
 				"Content-Type":      "application/json",
 				"X-Request-Id":      "SYNTHETIC-REQ-MON_A391MMaVMv",
 			},
-			`{"contentUri":"http://methode-image-model-transformer-pr-uk-int.svc.ft.com/image/model/c94a3a57-3c99-423c-a6bd-ed8c4c10a3c3",
+			Timestamp: time.Date(2015, 10, 21, 14, 22, 6, 270000000, time.UTC),
+			Offset:    24461,
+			Body: `{"contentUri":"http://methode-image-model-transformer-pr-uk-int.svc.ft.com/image/model/c94a3a57-3c99-423c-a6bd-ed8c4c10a3c3",
 "uuid":"c94a3a57-3c99-423c-a6bd-ed8c4c10a3c3", "destination":"methode-image-model-transformer", "relativeUrl":"/image/model/c94a3a57-3c99-423c-a6bd-ed8c4c10a3c3"}`,
 		},
 		{
-			map[string]string{
+			Headers: map[string]string{
 				"Message-Id":        "be8132e8-dc95-459f-808f-e6a89e2dc8f0",
 				"Message-Timestamp": "2015-10-21T14:22:06.270Z",
 				"Message-Type":      "cms-content-published",
@@ -31,13 +44,19 @@ func TestParseResponse_ResponseContainsMultipleRawMessages_Success(t *testing.T)
 				"Content-Type":      "application/json",
 				"X-Request-Id":      "SYNTHETIC-REQ-MON_A391MMaVMv",
 			},
-			`{"contentUri":"http://methode-image-model-transformer-pr-uk-int.svc.ft.com/image-set/model/c94a3a57-3c99-423c-38db-7a169664088a",
+			Timestamp: time.Date(2015, 10, 21, 14, 22, 6, 270000000, time.UTC),
+			Offset:    24462,
+			Body: `{"contentUri":"http://methode-image-model-transformer-pr-uk-int.svc.ft.com/image-set/model/c94a3a57-3c99-423c-38db-7a169664088a",
 "uuid":"c94a3a57-3c99-423c-38db-7a169664088a", "destination":"methode-image-model-transformer", "relativeUrl":"/image-set/model/c94a3a57-3c99-423c-38db-7a169664088a"}`,
 		},
 	}
 
+	for i, raw := range decodedValues(t, testRawResp) {
+		expected[i].Raw = raw
+	}
+
 	log := logger.NewUPPLogger("Test", "FATAL")
-	actual, err := parseResponse([]byte(testRawResp), log)
+	actual, err := parseResponse(strings.NewReader(testRawResp), QueueConfig{}, log)
 	if err != nil {
 		t.Fatalf("Error: [%v]", err)
 	}
@@ -46,20 +65,189 @@ func TestParseResponse_ResponseContainsMultipleRawMessages_Success(t *testing.T)
 	}
 }
 
+func TestParseResponse_ProxyErrorObject_ReturnsProxyError(t *testing.T) {
+	log := logger.NewUPPLogger("Test", "FATAL")
+	_, err := parseResponse(strings.NewReader(`{"error_code":40403,"message":"Consumer instance not found."}`), QueueConfig{}, log)
+
+	var perr *ProxyError
+	if !errors.As(err, &perr) {
+		t.Fatalf("Expected ProxyError. Actual: [%v]", err)
+	}
+	assert.Equal(t, 40403, perr.ErrorCode)
+	assert.Equal(t, "Consumer instance not found.", perr.Message)
+}
+
+func TestParseResponse_HTMLBody_ReturnsNonJSONError(t *testing.T) {
+	log := logger.NewUPPLogger("Test", "FATAL")
+	body := "<html><body><h1>502 Bad Gateway</h1>" + strings.Repeat("<p>nginx</p>", 100) + "</body></html>"
+	_, err := parseResponse(strings.NewReader(body), QueueConfig{}, log)
+
+	if !errors.Is(err, ErrNonJSONResponse) {
+		t.Fatalf("Expected ErrNonJSONResponse. Actual: [%v]", err)
+	}
+	assert.Contains(t, err.Error(), "502 Bad Gateway")
+	assert.NotContains(t, err.Error(), "</html>", "the response should be truncated")
+}
+
+func TestParseResponse_LogPerMessage(t *testing.T) {
+	data := `[{"value":"RlRNU0cvMS4wCgpib2R5Cg==","partition":0,"offset":0},{"value":"RlRNU0cvMS4wCgpib2R5Cg==","partition":1,"offset":7}]`
+	for _, enabled := range []bool{false, true} {
+		log := logger.NewUPPLogger("Test", "DEBUG")
+		log.Out = ioutil.Discard
+		hook := logTest.NewLocal(log.Logger)
+
+		msgs, err := parseResponseSkipping(strings.NewReader(data), QueueConfig{LogPerMessage: enabled}, log, func(partition, offset int) bool { return partition == 1 })
+		assert.NoError(t, err)
+		assert.Len(t, msgs, 1)
+
+		if !enabled {
+			assert.Empty(t, hook.AllEntries(), "nothing should be logged per message by default")
+			continue
+		}
+		entries := hook.AllEntries()
+		assert.Len(t, entries, 2)
+		assert.Equal(t, "Parsing message", entries[0].Message)
+		assert.Equal(t, 0, entries[0].Data["partition"])
+		assert.Equal(t, "Skipping already consumed message", entries[1].Message)
+		assert.Equal(t, 7, entries[1].Data["offset"])
+	}
+}
+
+func TestParseResponse_ParseErrorsLoggedThroughInjectedLogger(t *testing.T) {
+	log := logger.NewUPPLogger("Test", "INFO")
+	log.Out = ioutil.Discard
+	hook := logTest.NewLocal(log.Logger)
+
+	data := `[{"value":"not base64!","partition":0,"offset":0},{"value":"RlRNU0cvMS4wCgpib2R5Cg==","partition":0,"offset":1}]`
+	msgs, err := parseResponse(strings.NewReader(data), QueueConfig{}, log)
+	assert.NoError(t, err)
+	assert.Len(t, msgs, 1, "the invalid message should be skipped")
+
+	entries := hook.AllEntries()
+	assert.Len(t, entries, 1)
+	assert.Equal(t, "Error parsing message", entries[0].Message)
+	assert.Equal(t, logrus.ErrorLevel, entries[0].Level)
+	assert.Equal(t, 0, entries[0].Data["partition"])
+	assert.Equal(t, 0, entries[0].Data["offset"])
+	assert.Contains(t, entries[0].Data["error"].(error).Error(), "error decoding base64 value")
+}
+
+func TestParseResponse_EmptyArray_NoMessages(t *testing.T) {
+	log := logger.NewUPPLogger("Test", "FATAL")
+	for _, body := range []string{"[]", " [ ] ", "[\n]\n", "", " \n"} {
+		actual, err := parseResponse(strings.NewReader(body), QueueConfig{}, log)
+		assert.NoError(t, err, "body %q", body)
+		assert.Nil(t, actual, "body %q", body)
+	}
+
+	_, err := parseResponse(strings.NewReader("[ "), QueueConfig{}, log)
+	assert.Error(t, err, "an unterminated array should still fail")
+}
+
+func TestParseResponse_TruncatedArray_Error(t *testing.T) {
+	log := logger.NewUPPLogger("Test", "FATAL")
+	_, err := parseResponse(strings.NewReader(testRawResp[:len(testRawResp)-1]), QueueConfig{}, log)
+	assert.Error(t, err)
+}
+
+func TestParseResponse_CustomUnmarshaler_Invoked(t *testing.T) {
+	calls := 0
+	config := QueueConfig{Unmarshaler: UnmarshalerFunc(func(data []byte, v interface{}) error {
+		calls++
+		return json.Unmarshal(data, v)
+	})}
+
+	log := logger.NewUPPLogger("Test", "FATAL")
+	actual, err := parseResponse(strings.NewReader(testRawResp), config, log)
+	assert.NoError(t, err)
+	assert.Len(t, actual, 2)
+	assert.Equal(t, 2, calls)
+}
+
+func TestParseResponse_CustomUnmarshalerError_Fails(t *testing.T) {
+	config := QueueConfig{Unmarshaler: UnmarshalerFunc(func(data []byte, v interface{}) error {
+		return errors.New("unmarshal error")
+	})}
+
+	log := logger.NewUPPLogger("Test", "FATAL")
+	_, err := parseResponse(strings.NewReader(testRawResp), config, log)
+	assert.EqualError(t, err, "error parsing json message: unmarshal error")
+}
+
+func BenchmarkParseResponseCustomUnmarshaler(b *testing.B) {
+	log := logger.NewUPPLogger("Test", "FATAL")
+	config := QueueConfig{Unmarshaler: UnmarshalerFunc(json.Unmarshal)}
+	resp := largeTestResponse(1000)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, _ = parseResponse(strings.NewReader(resp), config, log)
+	}
+}
+
+func BenchmarkParseResponseEmpty(b *testing.B) {
+	log := logger.NewUPPLogger("Test", "FATAL")
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, _ = parseResponse(strings.NewReader("[]"), QueueConfig{}, log)
+	}
+}
+
+func BenchmarkParseResponse(b *testing.B) {
+	log := logger.NewUPPLogger("Test", "FATAL")
+	resp := largeTestResponse(1000)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, _ = parseResponse(strings.NewReader(resp), QueueConfig{}, log)
+	}
+}
+
+// BenchmarkParseResponseUnmarshalAll is the reference for the previous implementation,
+// which decoded the whole response at once before parsing the messages
+func BenchmarkParseResponseUnmarshalAll(b *testing.B) {
+	log := logger.NewUPPLogger("Test", "FATAL")
+	resp := []byte(largeTestResponse(1000))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var raw []message
+		_ = json.Unmarshal(resp, &raw)
+		var msgs []Message
+		for _, m := range raw {
+			msg, _ := parseMessage(*m.Value, QueueConfig{}, log)
+			msgs = append(msgs, msg)
+		}
+	}
+}
+
+func largeTestResponse(n int) string {
+	value := base64.StdEncoding.EncodeToString([]byte("FTMSG/1.0\r\nMessage-Id: c4b96810-03e8-4057-84c5-dcc3a8c61a26\r\n\r\n" + testBody4RawMsgValue))
+	records := make([]string, n)
+	for i := range records {
+		records[i] = fmt.Sprintf(`{"value":"%s","partition":0,"offset":%d}`, value, i)
+	}
+	return "[" + strings.Join(records, ",") + "]"
+}
+
 func TestParseMessage_RawMessage_Success(t *testing.T) {
 	expected := Message{
-		map[string]string{
+		Headers: map[string]string{
 			"Message-Id":        "c4b96810-03e8-4057-84c5-dcc3a8c61a26",
 			"Message-Timestamp": "2015-10-19T09:30:29.110Z",
 			"Message-Type":      "cms-content-published",
 			"Origin-System-Id":  "http://cmdb.ft.com/systems/methode-web-pub",
 			"Content-Type":      "application/json",
 			"X-Request-Id":      "SYNTHETIC-REQ-MON_Unv1K838lY"},
-		testBody4RawMsgValue,
+		Timestamp: time.Date(2015, 10, 19, 9, 30, 29, 110000000, time.UTC),
+		Body:      testBody4RawMsgValue,
 	}
 
+	expected.Raw, _ = base64.StdEncoding.DecodeString(testRawMsgValue)
+
 	log := logger.NewUPPLogger("Test", "FATAL")
-	actual, err := parseMessage(testRawMsgValue, log)
+	actual, err := parseMessage(testRawMsgValue, QueueConfig{}, log)
 	if err != nil {
 		t.Fatalf("Error: [%v]", err)
 	}
@@ -79,7 +267,7 @@ X-Request-Id: SYNTHETIC-REQ-MON_Unv1K838lY
 
 {"uuid":"e7a3b814-59ee-459e-8f60-517f3e80ed99", "value":"test","attributes":[]}`
 	expected := Message{
-		map[string]string{
+		Headers: map[string]string{
 			"Message-Id":        "c4b96810-03e8-4057-84c5-dcc3a8c61a26",
 			"Message-Timestamp": "2015-10-19T09:30:29.110Z",
 			"Message-Type":      "cms-content-published",
@@ -87,11 +275,14 @@ X-Request-Id: SYNTHETIC-REQ-MON_Unv1K838lY
 			"Content-Type":      "application/json",
 			"X-Request-Id":      "SYNTHETIC-REQ-MON_Unv1K838lY",
 		},
-		`{"uuid":"e7a3b814-59ee-459e-8f60-517f3e80ed99", "value":"test","attributes":[]}`,
+		Timestamp: time.Date(2015, 10, 19, 9, 30, 29, 110000000, time.UTC),
+		Body:      `{"uuid":"e7a3b814-59ee-459e-8f60-517f3e80ed99", "value":"test","attributes":[]}`,
 	}
 
+	expected.Raw = []byte(testMsg)
+
 	log := logger.NewUPPLogger("Test", "FATAL")
-	actual, _ := parseMessage(base64.StdEncoding.EncodeToString([]byte(testMsg)), log)
+	actual, _ := parseMessage(base64.StdEncoding.EncodeToString([]byte(testMsg)), QueueConfig{}, log)
 	if !reflect.DeepEqual(actual, expected) {
 		t.Errorf("Expected: [%v]\nActual: [%v]", expected, actual)
 	}
@@ -108,7 +299,7 @@ X-Request-Id: SYNTHETIC-REQ-MON_Unv1K838lY
 
 foobar`
 	expected := Message{
-		map[string]string{
+		Headers: map[string]string{
 			"Message-Id":        "c4b96810-03e8-4057-84c5-dcc3a8c61a26",
 			"Message-Timestamp": "2015-10-19T09:30:29.110Z",
 			"Message-Type":      "cms-content-published",
@@ -116,11 +307,14 @@ foobar`
 			"Content-Type":      "application/json",
 			"X-Request-Id":      "SYNTHETIC-REQ-MON_Unv1K838lY",
 		},
-		"foobar",
+		Timestamp: time.Date(2015, 10, 19, 9, 30, 29, 110000000, time.UTC),
+		Body:      "foobar",
 	}
 
+	expected.Raw = []byte(testMsg)
+
 	log := logger.NewUPPLogger("Test", "FATAL")
-	actual, _ := parseMessage(base64.StdEncoding.EncodeToString([]byte(testMsg)), log)
+	actual, _ := parseMessage(base64.StdEncoding.EncodeToString([]byte(testMsg)), QueueConfig{}, log)
 	if !reflect.DeepEqual(actual, expected) {
 		t.Errorf("Expected: [%v]\nActual: [%v]", expected, actual)
 	}
@@ -136,7 +330,7 @@ Content-Type: application/json
 X-Request-Id: SYNTHETIC-REQ-MON_Unv1K838lY
 `
 	expected := Message{
-		map[string]string{
+		Headers: map[string]string{
 			"Message-Id":        "c4b96810-03e8-4057-84c5-dcc3a8c61a26",
 			"Message-Timestamp": "2015-10-19T09:30:29.110Z",
 			"Message-Type":      "cms-content-published",
@@ -145,11 +339,14 @@ X-Request-Id: SYNTHETIC-REQ-MON_Unv1K838lY
 			"X-Request-Id":      "SYNTHETIC-REQ-MON_Unv1K838lY",
 		},
 
-		"",
+		Timestamp: time.Date(2015, 10, 19, 9, 30, 29, 110000000, time.UTC),
+		Body:      "",
 	}
 
+	expected.Raw = []byte(testMsg)
+
 	log := logger.NewUPPLogger("Test", "FATAL")
-	actual, _ := parseMessage(base64.StdEncoding.EncodeToString([]byte(testMsg)), log)
+	actual, _ := parseMessage(base64.StdEncoding.EncodeToString([]byte(testMsg)), QueueConfig{}, log)
 	if !reflect.DeepEqual(actual, expected) {
 		t.Errorf("Expected: [%v]\nActual: [%v]", expected, actual)
 	}
@@ -167,7 +364,7 @@ X-Request-Id: SYNTHETIC-REQ-MON_Unv1K838lY`
 	expected := ""
 
 	log := logger.NewUPPLogger("Test", "FATAL")
-	actual, err := parseMessage(base64.StdEncoding.EncodeToString([]byte(testMsg)), log)
+	actual, err := parseMessage(base64.StdEncoding.EncodeToString([]byte(testMsg)), QueueConfig{}, log)
 	if err != nil {
 		t.Fatalf("Error: [%v]", err)
 	}
@@ -176,6 +373,17 @@ X-Request-Id: SYNTHETIC-REQ-MON_Unv1K838lY`
 	}
 }
 
+func TestParseMessage_RawBody_OnlyRawPopulated(t *testing.T) {
+	value := []byte{0x08, 0x96, 0x01, 0xff, 0x00, '{', '\n', '\n'}
+
+	log := logger.NewUPPLogger("Test", "FATAL")
+	actual, err := parseMessage(base64.StdEncoding.EncodeToString(value), QueueConfig{RawBody: true}, log)
+	if err != nil {
+		t.Fatalf("Error: [%v]", err)
+	}
+	assert.Equal(t, Message{Raw: value}, actual)
+}
+
 func TestParseHeaders_Success(t *testing.T) {
 	testMsg := `FTMSG/1.0
 Message-Id: c4b96810-03e8-4057-84c5-dcc3a8c61a26
@@ -221,7 +429,411 @@ X-Request-Id: SYNTHETIC-REQ-MON_Unv1K838lY`
 	}
 }
 
+func TestParseMessage_CRLFLineEndings_Success(t *testing.T) {
+	tests := map[string]string{
+		"CRLF":     "FTMSG/1.0\r\nMessage-Id: c4b96810-03e8-4057-84c5-dcc3a8c61a26\r\nContent-Type: text/plain\r\n\r\nfoo\r\nbar\r\n",
+		"mixed":    "FTMSG/1.0\r\nMessage-Id: c4b96810-03e8-4057-84c5-dcc3a8c61a26\nContent-Type: text/plain\r\n\nfoo\r\nbar\r\n",
+		"LF first": "FTMSG/1.0\nMessage-Id: c4b96810-03e8-4057-84c5-dcc3a8c61a26\nContent-Type: text/plain\n\nfoo\r\n\r\nbar",
+	}
+	expectedHeaders := map[string]string{
+		"Message-Id":   "c4b96810-03e8-4057-84c5-dcc3a8c61a26",
+		"Content-Type": "text/plain",
+	}
+	expectedBodies := map[string]string{
+		"CRLF":     "foo\r\nbar",
+		"mixed":    "foo\r\nbar",
+		"LF first": "foo\r\n\r\nbar",
+	}
+
+	log := logger.NewUPPLogger("Test", "FATAL")
+	for name, testMsg := range tests {
+		actual, err := parseMessage(base64.StdEncoding.EncodeToString([]byte(testMsg)), QueueConfig{}, log)
+		assert.NoError(t, err, name)
+		assert.Equal(t, expectedHeaders, actual.Headers, name)
+		assert.Equal(t, expectedBodies[name], actual.Body, name)
+	}
+}
+
+func TestParseMessage_NonJSONBodies_Success(t *testing.T) {
+	tests := []struct {
+		name string
+		msg  string
+		body string
+	}{
+		{"XML", "FTMSG/1.0\nMessage-Id: c4b96810-03e8-4057-84c5-dcc3a8c61a26\nContent-Type: application/xml\n\n<?xml version=\"1.0\"?>\n<doc>\n\n<p>{not json}</p>\n</doc>", "<?xml version=\"1.0\"?>\n<doc>\n\n<p>{not json}</p>\n</doc>"},
+		{"plain text", "FTMSG/1.0\r\nMessage-Id: c4b96810-03e8-4057-84c5-dcc3a8c61a26\r\nContent-Type: text/plain\r\n\r\nsome {braces} and: colons\r\n", "some {braces} and: colons"},
+		{"CSV", "FTMSG/1.0\nMessage-Id: c4b96810-03e8-4057-84c5-dcc3a8c61a26\nContent-Type: text/csv\n\nid,name\n1,foo", "id,name\n1,foo"},
+		{"no blank line", "FTMSG/1.0\nMessage-Id: c4b96810-03e8-4057-84c5-dcc3a8c61a26\nContent-Type: text/csv\nid,name\n1,foo", "id,name\n1,foo"},
+	}
+
+	log := logger.NewUPPLogger("Test", "FATAL")
+	for _, test := range tests {
+		actual, err := parseMessage(base64.StdEncoding.EncodeToString([]byte(test.msg)), QueueConfig{}, log)
+		assert.NoError(t, err, test.name)
+		assert.Equal(t, "c4b96810-03e8-4057-84c5-dcc3a8c61a26", actual.Headers["Message-Id"], test.name)
+		assert.Len(t, actual.Headers, 2, test.name)
+		assert.Equal(t, test.body, actual.Body, test.name)
+	}
+}
+
+func TestParseMessage_HeaderBodySeparator(t *testing.T) {
+	testMsg := "FTMSG/1.0\r\nMessage-Id: c4b96810-03e8-4057-84c5-dcc3a8c61a26\r\nContent-Type: text/plain\r\n\r\nfirst paragraph\n\nsecond paragraph: with a colon\r\n"
+	tests := []struct {
+		separator string
+		headers   map[string]string
+		body      string
+	}{
+		{"", map[string]string{"Message-Id": "c4b96810-03e8-4057-84c5-dcc3a8c61a26", "Content-Type": "text/plain"}, "first paragraph\n\nsecond paragraph: with a colon"},
+		{"\r\n\r\n", map[string]string{"Message-Id": "c4b96810-03e8-4057-84c5-dcc3a8c61a26", "Content-Type": "text/plain"}, "first paragraph\n\nsecond paragraph: with a colon"},
+	}
+
+	log := logger.NewUPPLogger("Test", "FATAL")
+	for _, test := range tests {
+		actual, err := parseMessage(base64.StdEncoding.EncodeToString([]byte(testMsg)), QueueConfig{HeaderBodySeparator: test.separator}, log)
+		assert.NoError(t, err, "separator %q", test.separator)
+		assert.Equal(t, test.headers, actual.Headers, "separator %q", test.separator)
+		assert.Equal(t, test.body, actual.Body, "separator %q", test.separator)
+	}
+
+	// without the separator the whole message is the header section
+	actual, err := parseMessage(base64.StdEncoding.EncodeToString([]byte(testMsg)), QueueConfig{HeaderBodySeparator: "\n---\n"}, log)
+	assert.NoError(t, err)
+	assert.Equal(t, "c4b96810-03e8-4057-84c5-dcc3a8c61a26", actual.Headers["Message-Id"])
+	assert.Empty(t, actual.Body)
+
+	// the blank line of an LF message is not the configured separator
+	lfMsg := "FTMSG/1.0\nMessage-Id: c4b96810-03e8-4057-84c5-dcc3a8c61a26\n\nbody\r\n\r\nmore"
+	actual, err = parseMessage(base64.StdEncoding.EncodeToString([]byte(lfMsg)), QueueConfig{HeaderBodySeparator: "\r\n\r\n"}, log)
+	assert.NoError(t, err)
+	assert.Equal(t, "more", actual.Body)
+}
+
+func TestFirstJSONObject(t *testing.T) {
+	var tests = []struct {
+		name     string
+		body     string
+		expected string
+		found    bool
+	}{
+		{"single object", `{"uuid":"1"}`, `{"uuid":"1"}`, true},
+		{"nested objects", `{"a":{"b":{"c":1}},"d":[{"e":2}]}`, `{"a":{"b":{"c":1}},"d":[{"e":2}]}`, true},
+		{"closing brace in string", `{"title":"a } b","x":1}`, `{"title":"a } b","x":1}`, true},
+		{"escaped quote in string", `{"title":"say \"}\" twice","x":1} trailing`, `{"title":"say \"}\" twice","x":1}`, true},
+		{"escaped backslash before quote", `{"path":"c:\\"} {"next":1}`, `{"path":"c:\\"}`, true},
+		{"trailing headers", "{\"uuid\":\"1\"}\nX-Trailer: value", `{"uuid":"1"}`, true},
+		{"multiple objects", `{"a":1}{"b":2}`, `{"a":1}`, true},
+		{"leading text", `junk {"a":1}`, `{"a":1}`, true},
+		{"unbalanced", `{"a":{"b":1}`, "", false},
+		{"no object", `plain text`, "", false},
+	}
+
+	for _, test := range tests {
+		actual, found := firstJSONObject(test.body)
+		assert.Equal(t, test.expected, actual, test.name)
+		assert.Equal(t, test.found, found, test.name)
+
+		actualBytes, found := firstJSONObjectBytes([]byte(test.body))
+		assert.Equal(t, test.expected, string(actualBytes), test.name)
+		assert.Equal(t, test.found, found, test.name)
+	}
+}
+
+func TestParseMessage_BalancedJSONBody(t *testing.T) {
+	value := base64.StdEncoding.EncodeToString([]byte("FTMSG/1.0\nMessage-Id: id\n\n{\"uuid\":\"1\",\"body\":\"<p>}</p>\"}\n{\"uuid\":\"2\"}\n"))
+	log := logger.NewUPPLogger("Test", "FATAL")
+
+	actual, err := parseMessage(value, QueueConfig{BalancedJSONBody: true}, log)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"uuid":"1","body":"<p>}</p>"}`, actual.Body)
+
+	actual, err = parseMessage(value, QueueConfig{}, log)
+	assert.NoError(t, err)
+	assert.Equal(t, "{\"uuid\":\"1\",\"body\":\"<p>}</p>\"}\n{\"uuid\":\"2\"}", actual.Body, "the body should be kept whole by default")
+
+	unbalanced := base64.StdEncoding.EncodeToString([]byte("FTMSG/1.0\nMessage-Id: id\n\n{\"uuid\":"))
+	actual, err = parseMessage(unbalanced, QueueConfig{BalancedJSONBody: true}, log)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"uuid":`, actual.Body, "a body without a complete object should be kept as it is")
+}
+
+func TestParseMessage_LazyBody(t *testing.T) {
+	var tests = []struct {
+		value  string
+		config QueueConfig
+	}{
+		{"FTMSG/1.0\nMessage-Id: id\n\n{\"uuid\":\"1\"}\n", QueueConfig{}},
+		{"FTMSG/1.0\r\nMessage-Id: id\r\n\r\n  body  \r\n", QueueConfig{}},
+		{"FTMSG/1.0\nMessage-Id: id\n\n{\"uuid\":\"1\",\"body\":\"<p>}</p>\"}\n{\"uuid\":\"2\"}\n", QueueConfig{BalancedJSONBody: true}},
+		{"FTMSG/1.0\nMessage-Id: id\n---\nbody\n\nafter a blank line", QueueConfig{HeaderBodySeparator: "\n---\n"}},
+		{"FTMSG/1.0\nMessage-Id: id\n", QueueConfig{}},
+		{"FTMSG/1.0\nMessage-Id: id\nnot a header\n", QueueConfig{}},
+	}
+
+	log := logger.NewUPPLogger("Test", "FATAL")
+	for _, test := range tests {
+		value := base64.StdEncoding.EncodeToString([]byte(test.value))
+		eager, err := parseMessage(value, test.config, log)
+		assert.NoError(t, err)
+
+		test.config.LazyBody = true
+		lazy, err := parseMessage(value, test.config, log)
+		assert.NoError(t, err)
+		assert.Empty(t, lazy.Body, "%q", test.value)
+		assert.Equal(t, eager.Headers, lazy.Headers, "%q", test.value)
+		body, err := ioutil.ReadAll(lazy.BodyReader())
+		assert.NoError(t, err)
+		assert.Equal(t, eager.Body, string(body), "%q", test.value)
+
+		body, err = ioutil.ReadAll(eager.BodyReader())
+		assert.NoError(t, err)
+		assert.Equal(t, eager.Body, string(body), "the reader should read Body without LazyBody")
+	}
+}
+
+func BenchmarkParseLargeMessageBody(b *testing.B) {
+	log := logger.NewUPPLogger("Test", "FATAL")
+	payload := `{"items":[` + strings.TrimSuffix(strings.Repeat(testBody4RawMsgValue+",", 200), ",") + `]}`
+	value := base64.StdEncoding.EncodeToString([]byte("FTMSG/1.0\r\nMessage-Id: c4b96810-03e8-4057-84c5-dcc3a8c61a26\r\n\r\n" + payload))
+
+	b.Run("eager", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			m, _ := parseMessage(value, QueueConfig{}, log)
+			var v struct{ Items []struct{ UUID string } }
+			_ = json.NewDecoder(strings.NewReader(m.Body)).Decode(&v)
+		}
+	})
+	b.Run("lazy", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			m, _ := parseMessage(value, QueueConfig{LazyBody: true}, log)
+			var v struct{ Items []struct{ UUID string } }
+			_ = json.NewDecoder(m.BodyReader()).Decode(&v)
+		}
+	})
+	b.Run("eager balanced JSON", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			m, _ := parseMessage(value, QueueConfig{BalancedJSONBody: true}, log)
+			var v struct{ Items []struct{ UUID string } }
+			_ = json.NewDecoder(strings.NewReader(m.Body)).Decode(&v)
+		}
+	})
+	b.Run("lazy balanced JSON", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			m, _ := parseMessage(value, QueueConfig{LazyBody: true, BalancedJSONBody: true}, log)
+			var v struct{ Items []struct{ UUID string } }
+			_ = json.NewDecoder(m.BodyReader()).Decode(&v)
+		}
+	})
+}
+
+func TestParseHeaders_CRLFLineEndings_NoTrailingCR(t *testing.T) {
+	actual := parseHeaders("FTMSG/1.0\r\nMessage-Id: c4b96810-03e8-4057-84c5-dcc3a8c61a26\r\nX-Request-Id: tid_1\r\n")
+	assert.Equal(t, map[string]string{
+		"Message-Id":   "c4b96810-03e8-4057-84c5-dcc3a8c61a26",
+		"X-Request-Id": "tid_1",
+	}, actual)
+}
+
 const testRawResp = `[{"key":"Yzk0YTNhNTctM2M5OS00MjNjLWE2YmQtZWQ4YzRjMTBhM2Mz","value":"RlRNU0cvMS4wDQpNZXNzYWdlLUlkOiBjNjY1MzM3NC05MjJjLTRiNzgtOTI3ZC0xNWM1MTI1ZmNkOGQNCk1lc3NhZ2UtVGltZXN0YW1wOiAyMDE1LTEwLTIxVDE0OjIyOjA2LjI3MFoNCk1lc3NhZ2UtVHlwZTogY21zLWNvbnRlbnQtcHVibGlzaGVkDQpPcmlnaW4tU3lzdGVtLUlkOiBodHRwOi8vY21kYi5mdC5jb20vc3lzdGVtcy9tZXRob2RlLXdlYi1wdWINCkNvbnRlbnQtVHlwZTogYXBwbGljYXRpb24vanNvbg0KWC1SZXF1ZXN0LUlkOiBTWU5USEVUSUMtUkVRLU1PTl9BMzkxTU1hVk12DQoNCnsiY29udGVudFVyaSI6Imh0dHA6Ly9tZXRob2RlLWltYWdlLW1vZGVsLXRyYW5zZm9ybWVyLXByLXVrLWludC5zdmMuZnQuY29tL2ltYWdlL21vZGVsL2M5NGEzYTU3LTNjOTktNDIzYy1hNmJkLWVkOGM0YzEwYTNjMyIsCiJ1dWlkIjoiYzk0YTNhNTctM2M5OS00MjNjLWE2YmQtZWQ4YzRjMTBhM2MzIiwgImRlc3RpbmF0aW9uIjoibWV0aG9kZS1pbWFnZS1tb2RlbC10cmFuc2Zvcm1lciIsICJyZWxhdGl2ZVVybCI6Ii9pbWFnZS9tb2RlbC9jOTRhM2E1Ny0zYzk5LTQyM2MtYTZiZC1lZDhjNGMxMGEzYzMifQ==","partition":0,"offset":24461},{"key":"Yzk0YTNhNTctM2M5OS00MjNjLTM4ZGItN2ExNjk2NjQwODhh","value":"RlRNU0cvMS4wDQpNZXNzYWdlLUlkOiBiZTgxMzJlOC1kYzk1LTQ1OWYtODA4Zi1lNmE4OWUyZGM4ZjANCk1lc3NhZ2UtVGltZXN0YW1wOiAyMDE1LTEwLTIxVDE0OjIyOjA2LjI3MFoNCk1lc3NhZ2UtVHlwZTogY21zLWNvbnRlbnQtcHVibGlzaGVkDQpPcmlnaW4tU3lzdGVtLUlkOiBodHRwOi8vY21kYi5mdC5jb20vc3lzdGVtcy9tZXRob2RlLXdlYi1wdWINCkNvbnRlbnQtVHlwZTogYXBwbGljYXRpb24vanNvbg0KWC1SZXF1ZXN0LUlkOiBTWU5USEVUSUMtUkVRLU1PTl9BMzkxTU1hVk12DQoNCnsiY29udGVudFVyaSI6Imh0dHA6Ly9tZXRob2RlLWltYWdlLW1vZGVsLXRyYW5zZm9ybWVyLXByLXVrLWludC5zdmMuZnQuY29tL2ltYWdlLXNldC9tb2RlbC9jOTRhM2E1Ny0zYzk5LTQyM2MtMzhkYi03YTE2OTY2NDA4OGEiLAoidXVpZCI6ImM5NGEzYTU3LTNjOTktNDIzYy0zOGRiLTdhMTY5NjY0MDg4YSIsICJkZXN0aW5hdGlvbiI6Im1ldGhvZGUtaW1hZ2UtbW9kZWwtdHJhbnNmb3JtZXIiLCAicmVsYXRpdmVVcmwiOiIvaW1hZ2Utc2V0L21vZGVsL2M5NGEzYTU3LTNjOTktNDIzYy0zOGRiLTdhMTY5NjY0MDg4YSJ9","partition":0,"offset":24462}]`
 
 const testRawMsgValue = `RlRNU0cvMS4wDQpNZXNzYWdlLUlkOiBjNGI5NjgxMC0wM2U4LTQwNTctODRjNS1kY2MzYThjNjFhMjYNCk1lc3NhZ2UtVGltZXN0YW1wOiAyMDE1LTEwLTE5VDA5OjMwOjI5LjExMFoNCk1lc3NhZ2UtVHlwZTogY21zLWNvbnRlbnQtcHVibGlzaGVkDQpPcmlnaW4tU3lzdGVtLUlkOiBodHRwOi8vY21kYi5mdC5jb20vc3lzdGVtcy9tZXRob2RlLXdlYi1wdWINCkNvbnRlbnQtVHlwZTogYXBwbGljYXRpb24vanNvbg0KWC1SZXF1ZXN0LUlkOiBTWU5USEVUSUMtUkVRLU1PTl9VbnYxSzgzOGxZDQoNCnsidXVpZCI6ImU3YTNiODE0LTU5ZWUtNDU5ZS04ZjYwLTUxN2YzZTgwZWQ5OSIsInR5cGUiOiJJbWFnZSIsInZhbHVlIjoid2tLdDVBVEd1REpZR2Z2VGMyOFZVanM5ZzdTRCtsOGZxY3FkZ0N1cDJ1R2ZiTXlmRXhvSHBOZjI1VmQ5UU1vMEpWZ2pwL1loUWwrMVBnUGZjTGhwSkc0MVQrSzJQTDNKcFhGd1YwVGZBTG4wQnNyYzJwWXRDZzVGTGFsd3RRYlBnN2FIUzU1T1k2UThubDh0K2xoMVJ5amxtMmR2TTVCT2huZmlDVDY3STZYaFk4SU03RnhKSFJWMHlSNEFWWmVPVXdtYms4Ky9zblpIcmFUTGdXUnB2UmxWaDFsSFJ4TEJlK0xrSTFxNDRWUHljdXR6ck16Y0Jta2sza1lzSm5ObmdmWEpCVDNNZlBGeURJSVJoKzdnWlBTK0JDVWQ1UFNNS3JOU0dJUllhczQ4UWZxWnk4YnJ1MzljNHQyc05LRnJtWnJyd05SMDRIc3UxM0kyYnBkSUdXbFdQSTk4dWZvV2hWc1pJdmhMYXV1TS9KZU5zNndHRVNxclJCOEpCekNabWdWY1NIcFNqMWc3dTNKeGd2RDJSd3F0YkZhaGR1NUhZVkEzVEVRbksxaG03WUFNc0ROc0ZZK25MRjJMVFI4ZitBRlVLM0RmN3orWE1vVjA3K1FkVEVGaW9nMmgwTlJ2VXVzYXBhWjZza2I5b3VPMlYyMXRaYjdxdEdYelk1Rm5UdzNwRTVYOVZqVmtnV2xmWGR1bHR3WlhvK1JPY2pGcXhJSVJDbWFIMS9EbEtKaG10ZDB0VzRnc2FYamxGZkpxWXd6RDZXckEwdzRQQlMydjVWb0c0VWFkTE10c25aSFl4Y1dqeHFYbVBiUkhpMmw1MEJxbm9tMXFwZWZVZGh6eC9XcnNuUFp2R2o3ZzMvQXJ5RHNBVXREb0puN0VoSDVZMnB0ZEdjTThmb3FhYStZWWpvbHpFdXhtWjlyUlE2UFpETWcvN3FMZU9JNVMxWXJFRFFxcE5CN1czWlhlUFhKbjNTMlFEeW9yblJrc05MankxaUJEZGdYbm5PSVladFNJOWhPRDBIQnRhaWVla0hWRWtqQmRTeTNXWjB1S2RscWFlOThnZTJmNHVPSmhwdVpaOGlrUlNGbVRCdmprQkRaWmljVVdKUWdCNzM0NjhHeEdUNEJjVWJQSlFmYlFYeEpGWEtSQ01xYStsN2ZBY3JYZk5OZGNESFJuWWRvWHh3QVU3Vlk1V2lFTE85ZmNOTmxWNm1aQnkvYXdCSEw5NHVjN29MWFYyUzNyNUhZZzZsaGhOODVrRUsxdU1pY0lXNkl2eHVJRW0vLzg3QmhRcU0vaGdzbUxIaGNKbUZiVkdUZThGamFJcGp4ckJHLzdtZjY3VzZubFl1dUVxbkdRTWZnWnAxaENic1hXUmZrNnY3NjMwYVdQY1AyRjNwTGxhby9kTjh1dGt3QkZxaVRQMXMxOXV4N1FxcHZVNXhHeTdtK2U4eVA4K25yU3lad2JNRVVVYUpYNjJsb256WU81d3R6RDArakVTQmE2MG0waTR0TlhSVkhwbWY0UXgrUGMya3JHb1dsbTVBV0VqZC8xbFFFWXh0TGpSTjc1TTVrRitEbzg4NTJ5RUFBVW5kRmY1UTZRZUpoWkt6bXNZZTgzUnNkbS9oOGc0MjIvcG5PV2svQ0dXZEVYL2FSQWZtVVRvZTNzdEtIRTdDYzM1dmdXUVlLcU9SQkwwZ2xocWNnNUNMS0NMWm0rcGtMU1Vqb211MXQ3Vk44eTRSZ0VvYS9QcERNaSsySFVKb3Fad3ZFOHNQV2FtVll5VUE9PSIsImF0dHJpYnV0ZXMiOiJcdTAwM2M/eG1sIHZlcnNpb249XCIxLjBcIiBlbmNvZGluZz1cInV0Zi04XCI/XHUwMDNlXG5cdTAwM2MhRE9DVFlQRSBtZXRhIFNZU1RFTSBcIi9TeXNDb25maWcvQ2xhc3NpZnkvRlRJbWFnZXMvY2xhc3NpZnkuZHRkXCJcdTAwM2Vcblx1MDAzY21ldGFcdTAwM2VcbiAgICBcdTAwM2NwaWN0dXJlXHUwMDNlXG4gICAgICAgIFx1MDAzY2NhcHRpb24vXHUwMDNlXG4gICAgICAgIFx1MDAzY2NhdGVnb3J5L1x1MDAzZVxuICAgICAgICBcdTAwM2NrZXl3b3Jkcy9cdTAwM2VcbiAgICAgICAgXHUwMDNjYWRpbmZvL1x1MDAzZVxuICAgICAgICBcdTAwM2NwaG90b2dyYXBoZXIvXHUwMDNlXG4gICAgICAgIFx1MDAzY2NvcHlyaWdodF9pbmZvXHUwMDNlXG4gICAgICAgIFx1MDAzY2NvcHlyaWdodF9zdGF0ZW1lbnQvXHUwMDNlXG4gICAgICAgIFx1MDAzY2NvcHlyaWdodF9ncm91cC9cdTAwM2VcbiAgICAgICAgXHUwMDNjZGlzdHJpYnV0aW9uX3JpZ2h0cy9cdTAwM2VcbiAgICAgICAgXHUwMDNjbGVnYWxfc3RhdHVzL1x1MDAzZVxuICAgICAgICBcdTAwM2MvY29weXJpZ2h0X2luZm9cdTAwM2VcbiAgICAgICAgXHUwMDNjd2ViX2luZm9ybWF0aW9uXHUwMDNlXG4gICAgICAgICAgICBcdTAwM2NjYXB0aW9uL1x1MDAzZVxuICAgICAgICAgICAgXHUwMDNjYWx0X3RhZy9cdTAwM2VcbiAgICAgICAgICAgIFx1MDAzY29ubGluZS1zb3VyY2UvXHUwMDNlXG4gICAgICAgICAgICBcdTAwM2NtYW51YWwtc291cmNlL1x1MDAzZVxuICAgICAgICAgICAgXHUwMDNjRElGVGNvbVdlYlR5cGVcdTAwM2VncmFwaGljXHUwMDNjL0RJRlRjb21XZWJUeXBlXHUwMDNlXG4gICAgICAgIFx1MDAzYy93ZWJfaW5mb3JtYXRpb25cdTAwM2VcbiAgICAgICAgXHUwMDNjcHJvdmlkZXIvXHUwMDNlXG4gICAgICAgIFx1MDAzY2ZpbG1fdHlwZS9cdTAwM2VcbiAgICAgICAgXHUwMDNjZGF0ZV90YWtlbi9cdTAwM2VcbiAgICAgICAgXHUwMDNjZGF0ZV9yZWNlaXZlZC9cdTAwM2VcbiAgICAgICAgXHUwMDNjcmVmZXJlbmNlX251bS9cdTAwM2VcbiAgICAgICAgXHUwMDNjcm9sbF9udW0vXHUwMDNlXG4gICAgICAgIFx1MDAzY2ZyYW1lX251bS9cdTAwM2VcbiAgICAgICAgXHUwMDNjY2hlY2tib3hlcy9cdTAwM2VcbiAgICAgICAgXHUwMDNjd2FybmluZ3MvXHUwMDNlXG4gICAgICAgIFx1MDAzY3NlY3VyaXR5L1x1MDAzZVxuICAgICAgICBcdTAwM2NlbWJhcmdvX2RhdGUvXHUwMDNlXG4gICAgICAgIFx1MDAzY2pvYl9kZXNjcmlwdGlvblx1MDAzZVxuICAgICAgICAgICAgXHUwMDNjY2l0eS9cdTAwM2VcbiAgICAgICAgICAgIFx1MDAzY3Byb3ZpbmNlL1x1MDAzZVxuICAgICAgICAgICAgXHUwMDNjY291bnRyeS9cdTAwM2VcbiAgICAgICAgICAgIFx1MDAzY2luc3RydWN0aW9ucy9cdTAwM2VcbiAgICAgICAgXHUwMDNjL2pvYl9kZXNjcmlwdGlvblx1MDAzZVxuICAgICAgICBcdTAwM2NwcmljZS9cdTAwM2VcbiAgICAgICAgXHUwMDNjZmlsZW5hbWUvXHUwMDNlXG4gICAgICAgIFx1MDAzY2Jhc2tldC9cdTAwM2VcbiAgICAgICAgXHUwMDNjc291cmNlL1x1MDAzZVxuICAgICAgICBcdTAwM2NieWxpbmUvXHUwMDNlXG4gICAgICAgIFx1MDAzY2hlYWRsaW5lL1x1MDAzZVxuICAgICAgICBcdTAwM2N1dWlkXHUwMDNlZTdhM2I4MTQtNTllZS00NTllLThmNjAtNTE3ZjNlODBlZDk5XHUwMDNjL3V1aWRcdTAwM2VcbiAgICAgICAgXHUwMDNjcmF0aW9cdTAwM2UxLjBcdTAwM2MvcmF0aW9cdTAwM2VcbiAgICAgICAgXHUwMDNjaW1hZ2VUeXBlXHUwMDNlQ2hhcnRzXHUwMDNjL2ltYWdlVHlwZVx1MDAzZVxuICAgIFx1MDAzYy9waWN0dXJlXHUwMDNlXG4gICAgXHUwMDNjbWFya0RlbGV0ZWRcdTAwM2VGYWxzZVx1MDAzYy9tYXJrRGVsZXRlZFx1MDAzZVxuXHUwMDNjL21ldGFcdTAwM2VcbiIsIndvcmtmbG93U3RhdHVzIjoiIiwic3lzdGVtQXR0cmlidXRlcyI6Ilx1MDAzY3Byb3BzXHUwMDNlXG4gICAgXHUwMDNjcHJvZHVjdEluZm9cdTAwM2VcbiAgICAgICAgXHUwMDNjbmFtZVx1MDAzZUZpbmFuY2lhbCBUaW1lc1x1MDAzYy9uYW1lXHUwMDNlXG4gICAgICAgIFx1MDAzY2lzc3VlRGF0ZVx1MDAzZTIwMTUxMDE5XHUwMDNjL2lzc3VlRGF0ZVx1MDAzZVxuICAgIFx1MDAzYy9wcm9kdWN0SW5mb1x1MDAzZVxuICAgIFx1MDAzY3dvcmtGb2xkZXJcdTAwM2UvRlRcdTAwM2Mvd29ya0ZvbGRlclx1MDAzZVxuICAgIFx1MDAzY3N1bW1hcnkvXHUwMDNlXG4gICAgXHUwMDNjaW1hZ2VJbmZvXHUwMDNlXG4gICAgICAgIFx1MDAzY3dpZHRoXHUwMDNlMzAyXHUwMDNjL3dpZHRoXHUwMDNlXG4gICAgICAgIFx1MDAzY2hlaWdodFx1MDAzZTI4Mlx1MDAzYy9oZWlnaHRcdTAwM2VcbiAgICAgICAgXHUwMDNjcHRXaWR0aFx1MDAzZTMwMi4wXHUwMDNjL3B0V2lkdGhcdTAwM2VcbiAgICAgICAgXHUwMDNjcHRIZWlnaHRcdTAwM2UyODIuMFx1MDAzYy9wdEhlaWdodFx1MDAzZVxuICAgICAgICBcdTAwM2N4RGltXHUwMDNlMTA2LjU0XHUwMDNjL3hEaW1cdTAwM2VcbiAgICAgICAgXHUwMDNjeURpbVx1MDAzZTk5LjQ4XHUwMDNjL3lEaW1cdTAwM2VcbiAgICAgICAgXHUwMDNjZGltXHUwMDNlMTAuNjU0Y20geCA5Ljk0OGNtXHUwMDNjL2RpbVx1MDAzZVxuICAgICAgICBcdTAwM2N4cmVzXHUwMDNlNzIuMFx1MDAzYy94cmVzXHUwMDNlXG4gICAgICAgIFx1MDAzY3lyZXNcdTAwM2U3Mi4wXHUwMDNjL3lyZXNcdTAwM2VcbiAgICAgICAgXHUwMDNjY29sb3JUeXBlXHUwMDNlUkdCXHUwMDNjL2NvbG9yVHlwZVx1MDAzZVxuICAgICAgICBcdTAwM2NmaWxlVHlwZVx1MDAzZVBOR1x1MDAzYy9maWxlVHlwZVx1MDAzZVxuICAgICAgICBcdTAwM2NhbHBoYUNoYW5uZWxzXHUwMDNlMVx1MDAzYy9hbHBoYUNoYW5uZWxzXHUwMDNlXG4gICAgXHUwMDNjL2ltYWdlSW5mb1x1MDAzZVxuXHUwMDNjL3Byb3BzXHUwMDNlXG4iLCJ1c2FnZVRpY2tldHMiOiJcdTAwM2M/eG1sIHZlcnNpb249JzEuMCcgZW5jb2Rpbmc9J1VURi04Jz9cdTAwM2Vcblx1MDAzY3RsXHUwMDNlXG4gICAgXHUwMDNjdFx1MDAzZVxuICAgICAgICBcdTAwM2NpZFx1MDAzZTFcdTAwM2MvaWRcdTAwM2VcbiAgICAgICAgXHUwMDNjdHBcdTAwM2VQdWJsaXNoZXJcdTAwM2MvdHBcdTAwM2VcbiAgICAgICAgXHUwMDNjY1x1MDAzZXRhc3NlbGx0XHUwMDNjL2NcdTAwM2VcbiAgICAgICAgXHUwMDNjY2RcdTAwM2UyMDE1MTAxOTA5MzAyNVx1MDAzYy9jZFx1MDAzZVxuICAgICAgICBcdTAwM2NkdFx1MDAzZVxuICAgICAgICAgICAgXHUwMDNjcHVibGlzaGVkRGF0ZVx1MDAzZU1vbiBPY3QgMTkgMDk6MzA6MjUgVVRDIDIwMTVcdTAwM2MvcHVibGlzaGVkRGF0ZVx1MDAzZVxuICAgICAgICBcdTAwM2MvZHRcdTAwM2VcbiAgICBcdTAwM2MvdFx1MDAzZVxuICAgIFx1MDAzY3RcdTAwM2VcbiAgICAgICAgXHUwMDNjaWRcdTAwM2UyXHUwMDNjL2lkXHUwMDNlXG4gICAgICAgIFx1MDAzY3RwXHUwMDNld2ViX3B1YmxpY2F0aW9uXHUwMDNjL3RwXHUwMDNlXG4gICAgICAgIFx1MDAzY2NcdTAwM2V0YXNzZWxsdFx1MDAzYy9jXHUwMDNlXG4gICAgICAgIFx1MDAzY2NkXHUwMDNlMjAxNTEwMTkwOTMwMjVcdTAwM2MvY2RcdTAwM2VcbiAgICAgICAgXHUwMDNjZHRcdTAwM2VcbiAgICAgICAgICAgIFx1MDAzY3dlYnB1Ymxpc2hcdTAwM2VcbiAgICAgICAgICAgICAgICBcdTAwM2NzaXRlX3VybFx1MDAzZWh0dHA6Ly93d3cuZnQuY29tL2Ntcy9zL2U3YTNiODE0LTU5ZWUtNDU5ZS04ZjYwLTUxN2YzZTgwZWQ5OS5odG1sXHUwMDNjL3NpdGVfdXJsXHUwMDNlXG4gICAgICAgICAgICAgICAgXHUwMDNjc3luZF91cmxcdTAwM2VodHRwOi8vd3d3LmZ0LmNvbS9jbXMvcy9lN2EzYjgxNC01OWVlLTQ1OWUtOGY2MC01MTdmM2U4MGVkOTksczAxPTEuaHRtbFx1MDAzYy9zeW5kX3VybFx1MDAzZVxuICAgICAgICAgICAgXHUwMDNjL3dlYnB1Ymxpc2hcdTAwM2VcbiAgICAgICAgXHUwMDNjL2R0XHUwMDNlXG4gICAgXHUwMDNjL3RcdTAwM2VcbiAgICBcdTAwM2N0XHUwMDNlXG4gICAgICAgIFx1MDAzY2lkXHUwMDNlM1x1MDAzYy9pZFx1MDAzZVxuICAgICAgICBcdTAwM2N0cFx1MDAzZVdlYkNvcHlcdTAwM2MvdHBcdTAwM2VcbiAgICAgICAgXHUwMDNjY1x1MDAzZXRhc3NlbGx0XHUwMDNjL2NcdTAwM2VcbiAgICAgICAgXHUwMDNjY2RcdTAwM2UyMDE1MTAxOTA5MzAyNVx1MDAzYy9jZFx1MDAzZVxuICAgICAgICBcdTAwM2NkdFx1MDAzZVxuICAgICAgICAgICAgXHUwMDNjcmVwXHUwMDNlY21zQGZ0Y21yMDEtdXZwci11ay1wXHUwMDNjL3JlcFx1MDAzZVxuICAgICAgICAgICAgXHUwMDNjZmlyc3RcdTAwM2UyMDE1MTAxOTA5MzAyNVx1MDAzYy9maXJzdFx1MDAzZVxuICAgICAgICAgICAgXHUwMDNjbGFzdFx1MDAzZTIwMTUxMDE5MDkzMDI1XHUwMDNjL2xhc3RcdTAwM2VcbiAgICAgICAgICAgIFx1MDAzY2NvdW50XHUwMDNlMVx1MDAzYy9jb3VudFx1MDAzZVxuICAgICAgICAgICAgXHUwMDNjY2hhbm5lbFx1MDAzZUZUY29tXHUwMDNjL2NoYW5uZWxcdTAwM2VcbiAgICAgICAgXHUwMDNjL2R0XHUwMDNlXG4gICAgXHUwMDNjL3RcdTAwM2VcbiAgICBcdTAwM2N0XHUwMDNlXG4gICAgICAgIFx1MDAzY2lkXHUwMDNlNFx1MDAzYy9pZFx1MDAzZVxuICAgICAgICBcdTAwM2N0cFx1MDAzZW1tc1x1MDAzYy90cFx1MDAzZVxuICAgICAgICBcdTAwM2NjXHUwMDNlc2VydmxldC1tbXNcdTAwM2MvY1x1MDAzZVxuICAgICAgICBcdTAwM2NjZFx1MDAzZTIwMTUwNjE2MTMxNTAwXHUwMDNjL2NkXHUwMDNlXG4gICAgICAgIFx1MDAzY2R0XHUwMDNlXG4gICAgICAgICAgICBcdTAwM2NzcmNVVUlEXHUwMDNlZTdhM2I4MTQtNTllZS00NTllLThmNjAtNTE3ZjNlODBlZDk5XHUwMDNjL3NyY1VVSURcdTAwM2VcbiAgICAgICAgICAgIFx1MDAzY3RyZ1VVSURcdTAwM2VlN2EzYjgxNC01OWVlLTQ1OWUtOGY2MC01MTdmM2U4MGVkOTlcdTAwM2MvdHJnVVVJRFx1MDAzZVxuICAgICAgICAgICAgXHUwMDNjc3JjUmVwb1x1MDAzZVBST0QtY21zLXJlYWRcdTAwM2Mvc3JjUmVwb1x1MDAzZVxuICAgICAgICAgICAgXHUwMDNjdHJnUmVwb1x1MDAzZVBST0QtY21hLXdyaXRlXHUwMDNjL3RyZ1JlcG9cdTAwM2VcbiAgICAgICAgICAgIFx1MDAzY3RzXHUwMDNlMTIzNDU2Nzg5MFx1MDAzYy90c1x1MDAzZVxuICAgICAgICAgICAgXHUwMDNjY2xzXHUwMDNlY29tLmVpZG9zbWVkaWEubW1zLnRhc2suZXh0ZW5kZWRvYmplY3RtaWdyYXRpb250YXNrLm9iamVjdC5FeHRlbmRlZE9iamVjdEltcGxcdTAwM2MvY2xzXHUwMDNlXG4gICAgICAgICAgICBcdTAwM2NzZXFcdTAwM2VhcmNoaXZlX29uX3B1Ymxpc2hfb3B0aW1pc2VkXHUwMDNjL3NlcVx1MDAzZVxuICAgICAgICAgICAgXHUwMDNjam9iXHUwMDNlYXJjaGl2ZV9vbl9wdWJsaXNoX29wdGltaXNlZF9qb2JcdTAwM2Mvam9iXHUwMDNlXG4gICAgICAgIFx1MDAzYy9kdFx1MDAzZVxuICAgIFx1MDAzYy90XHUwMDNlXG5cdTAwM2MvdGxcdTAwM2VcbiIsImxpbmtlZE9iamVjdHMiOltdfQ==`
 const testBody4RawMsgValue = `{"uuid":"e7a3b814-59ee-459e-8f60-517f3e80ed99","type":"Image","value":"wkKt5ATGuDJYGfvTc28VUjs9g7SD+l8fqcqdgCup2uGfbMyfExoHpNf25Vd9QMo0JVgjp/YhQl+1PgPfcLhpJG41T+K2PL3JpXFwV0TfALn0Bsrc2pYtCg5FLalwtQbPg7aHS55OY6Q8nl8t+lh1Ryjlm2dvM5BOhnfiCT67I6XhY8IM7FxJHRV0yR4AVZeOUwmbk8+/snZHraTLgWRpvRlVh1lHRxLBe+LkI1q44VPycutzrMzcBmkk3kYsJnNngfXJBT3MfPFyDIIRh+7gZPS+BCUd5PSMKrNSGIRYas48QfqZy8bru39c4t2sNKFrmZrrwNR04Hsu13I2bpdIGWlWPI98ufoWhVsZIvhLauuM/JeNs6wGESqrRB8JBzCZmgVcSHpSj1g7u3JxgvD2RwqtbFahdu5HYVA3TEQnK1hm7YAMsDNsFY+nLF2LTR8f+AFUK3Df7z+XMoV07+QdTEFiog2h0NRvUusapaZ6skb9ouO2V21tZb7qtGXzY5FnTw3pE5X9VjVkgWlfXdultwZXo+ROcjFqxIIRCmaH1/DlKJhmtd0tW4gsaXjlFfJqYwzD6WrA0w4PBS2v5VoG4UadLMtsnZHYxcWjxqXmPbRHi2l50Bqnom1qpefUdhzx/WrsnPZvGj7g3/AryDsAUtDoJn7EhH5Y2ptdGcM8foqaa+YYjolzEuxmZ9rRQ6PZDMg/7qLeOI5S1YrEDQqpNB7W3ZXePXJn3S2QDyornRksNLjy1iBDdgXnnOIYZtSI9hOD0HBtaieekHVEkjBdSy3WZ0uKdlqae98ge2f4uOJhpuZZ8ikRSFmTBvjkBDZZicUWJQgB73468GxGT4BcUbPJQfbQXxJFXKRCMqa+l7fAcrXfNNdcDHRnYdoXxwAU7VY5WiELO9fcNNlV6mZBy/awBHL94uc7oLXV2S3r5HYg6lhhN85kEK1uMicIW6IvxuIEm//87BhQqM/hgsmLHhcJmFbVGTe8FjaIpjxrBG/7mf67W6nlYuuEqnGQMfgZp1hCbsXWRfk6v7630aWPcP2F3pLlao/dN8utkwBFqiTP1s19ux7QqpvU5xGy7m+e8yP8+nrSyZwbMEUUaJX62lonzYO5wtzD0+jESBa60m0i4tNXRVHpmf4Qx+Pc2krGoWlm5AWEjd/1lQEYxtLjRN75M5kF+Do8852yEAAUndFf5Q6QeJhZKzmsYe83Rsdm/h8g422/pnOWk/CGWdEX/aRAfmUToe3stKHE7Cc35vgWQYKqORBL0glhqcg5CLKCLZm+pkLSUjomu1t7VN8y4RgEoa/PpDMi+2HUJoqZwvE8sPWamVYyUA==","attributes":"\u003c?xml version=\"1.0\" encoding=\"utf-8\"?\u003e\n\u003c!DOCTYPE meta SYSTEM \"/SysConfig/Classify/FTImages/classify.dtd\"\u003e\n\u003cmeta\u003e\n    \u003cpicture\u003e\n        \u003ccaption/\u003e\n        \u003ccategory/\u003e\n        \u003ckeywords/\u003e\n        \u003cadinfo/\u003e\n        \u003cphotographer/\u003e\n        \u003ccopyright_info\u003e\n        \u003ccopyright_statement/\u003e\n        \u003ccopyright_group/\u003e\n        \u003cdistribution_rights/\u003e\n        \u003clegal_status/\u003e\n        \u003c/copyright_info\u003e\n        \u003cweb_information\u003e\n            \u003ccaption/\u003e\n            \u003calt_tag/\u003e\n            \u003conline-source/\u003e\n            \u003cmanual-source/\u003e\n            \u003cDIFTcomWebType\u003egraphic\u003c/DIFTcomWebType\u003e\n        \u003c/web_information\u003e\n        \u003cprovider/\u003e\n        \u003cfilm_type/\u003e\n        \u003cdate_taken/\u003e\n        \u003cdate_received/\u003e\n        \u003creference_num/\u003e\n        \u003croll_num/\u003e\n        \u003cframe_num/\u003e\n        \u003ccheckboxes/\u003e\n        \u003cwarnings/\u003e\n        \u003csecurity/\u003e\n        \u003cembargo_date/\u003e\n        \u003cjob_description\u003e\n            \u003ccity/\u003e\n            \u003cprovince/\u003e\n            \u003ccountry/\u003e\n            \u003cinstructions/\u003e\n        \u003c/job_description\u003e\n        \u003cprice/\u003e\n        \u003cfilename/\u003e\n        \u003cbasket/\u003e\n        \u003csource/\u003e\n        \u003cbyline/\u003e\n        \u003cheadline/\u003e\n        \u003cuuid\u003ee7a3b814-59ee-459e-8f60-517f3e80ed99\u003c/uuid\u003e\n        \u003cratio\u003e1.0\u003c/ratio\u003e\n        \u003cimageType\u003eCharts\u003c/imageType\u003e\n    \u003c/picture\u003e\n    \u003cmarkDeleted\u003eFalse\u003c/markDeleted\u003e\n\u003c/meta\u003e\n","workflowStatus":"","systemAttributes":"\u003cprops\u003e\n    \u003cproductInfo\u003e\n        \u003cname\u003eFinancial Times\u003c/name\u003e\n        \u003cissueDate\u003e20151019\u003c/issueDate\u003e\n    \u003c/productInfo\u003e\n    \u003cworkFolder\u003e/FT\u003c/workFolder\u003e\n    \u003csummary/\u003e\n    \u003cimageInfo\u003e\n        \u003cwidth\u003e302\u003c/width\u003e\n        \u003cheight\u003e282\u003c/height\u003e\n        \u003cptWidth\u003e302.0\u003c/ptWidth\u003e\n        \u003cptHeight\u003e282.0\u003c/ptHeight\u003e\n        \u003cxDim\u003e106.54\u003c/xDim\u003e\n        \u003cyDim\u003e99.48\u003c/yDim\u003e\n        \u003cdim\u003e10.654cm x 9.948cm\u003c/dim\u003e\n        \u003cxres\u003e72.0\u003c/xres\u003e\n        \u003cyres\u003e72.0\u003c/yres\u003e\n        \u003ccolorType\u003eRGB\u003c/colorType\u003e\n        \u003cfileType\u003ePNG\u003c/fileType\u003e\n        \u003calphaChannels\u003e1\u003c/alphaChannels\u003e\n    \u003c/imageInfo\u003e\n\u003c/props\u003e\n","usageTickets":"\u003c?xml version='1.0' encoding='UTF-8'?\u003e\n\u003ctl\u003e\n    \u003ct\u003e\n        \u003cid\u003e1\u003c/id\u003e\n        \u003ctp\u003ePublisher\u003c/tp\u003e\n        \u003cc\u003etassellt\u003c/c\u003e\n        \u003ccd\u003e20151019093025\u003c/cd\u003e\n        \u003cdt\u003e\n            \u003cpublishedDate\u003eMon Oct 19 09:30:25 UTC 2015\u003c/publishedDate\u003e\n        \u003c/dt\u003e\n    \u003c/t\u003e\n    \u003ct\u003e\n        \u003cid\u003e2\u003c/id\u003e\n        \u003ctp\u003eweb_publication\u003c/tp\u003e\n        \u003cc\u003etassellt\u003c/c\u003e\n        \u003ccd\u003e20151019093025\u003c/cd\u003e\n        \u003cdt\u003e\n            \u003cwebpublish\u003e\n                \u003csite_url\u003ehttp://www.ft.com/cms/s/e7a3b814-59ee-459e-8f60-517f3e80ed99.html\u003c/site_url\u003e\n                \u003csynd_url\u003ehttp://www.ft.com/cms/s/e7a3b814-59ee-459e-8f60-517f3e80ed99,s01=1.html\u003c/synd_url\u003e\n            \u003c/webpublish\u003e\n        \u003c/dt\u003e\n    \u003c/t\u003e\n    \u003ct\u003e\n        \u003cid\u003e3\u003c/id\u003e\n        \u003ctp\u003eWebCopy\u003c/tp\u003e\n        \u003cc\u003etassellt\u003c/c\u003e\n        \u003ccd\u003e20151019093025\u003c/cd\u003e\n        \u003cdt\u003e\n            \u003crep\u003ecms@ftcmr01-uvpr-uk-p\u003c/rep\u003e\n            \u003cfirst\u003e20151019093025\u003c/first\u003e\n            \u003clast\u003e20151019093025\u003c/last\u003e\n            \u003ccount\u003e1\u003c/count\u003e\n            \u003cchannel\u003eFTcom\u003c/channel\u003e\n        \u003c/dt\u003e\n    \u003c/t\u003e\n    \u003ct\u003e\n        \u003cid\u003e4\u003c/id\u003e\n        \u003ctp\u003emms\u003c/tp\u003e\n        \u003cc\u003eservlet-mms\u003c/c\u003e\n        \u003ccd\u003e20150616131500\u003c/cd\u003e\n        \u003cdt\u003e\n            \u003csrcUUID\u003ee7a3b814-59ee-459e-8f60-517f3e80ed99\u003c/srcUUID\u003e\n            \u003ctrgUUID\u003ee7a3b814-59ee-459e-8f60-517f3e80ed99\u003c/trgUUID\u003e\n            \u003csrcRepo\u003ePROD-cms-read\u003c/srcRepo\u003e\n            \u003ctrgRepo\u003ePROD-cma-write\u003c/trgRepo\u003e\n            \u003cts\u003e1234567890\u003c/ts\u003e\n            \u003ccls\u003ecom.eidosmedia.mms.task.extendedobjectmigrationtask.object.ExtendedObjectImpl\u003c/cls\u003e\n            \u003cseq\u003earchive_on_publish_optimised\u003c/seq\u003e\n            \u003cjob\u003earchive_on_publish_optimised_job\u003c/job\u003e\n        \u003c/dt\u003e\n    \u003c/t\u003e\n\u003c/tl\u003e\n","linkedObjects":[]}`
+
+func TestParseMessage_Timestamp(t *testing.T) {
+	var tests = []struct {
+		name     string
+		header   string
+		msg      string
+		expected time.Time
+	}{
+		{"valid", "", "FTMSG/1.0\nMessage-Timestamp: 2015-10-19T09:30:29.110Z\n\nbody", time.Date(2015, 10, 19, 9, 30, 29, 110000000, time.UTC)},
+		{"case-insensitive", "", "FTMSG/1.0\nmessage-timestamp: 2015-10-19T09:30:29Z\n\nbody", time.Date(2015, 10, 19, 9, 30, 29, 0, time.UTC)},
+		{"custom header", "Publish-Date", "FTMSG/1.0\nPublish-Date: 2015-10-19T09:30:29Z\nMessage-Timestamp: 2000-01-01T00:00:00Z\n\nbody", time.Date(2015, 10, 19, 9, 30, 29, 0, time.UTC)},
+		{"invalid", "", "FTMSG/1.0\nMessage-Timestamp: 19/10/2015 09:30\n\nbody", time.Time{}},
+		{"missing", "", "FTMSG/1.0\nMessage-Id: c4b96810-03e8-4057-84c5-dcc3a8c61a26\n\nbody", time.Time{}},
+	}
+
+	log := logger.NewUPPLogger("Test", "FATAL")
+	for _, test := range tests {
+		actual, err := parseMessage(base64.StdEncoding.EncodeToString([]byte(test.msg)), QueueConfig{TimestampHeader: test.header}, log)
+		assert.NoError(t, err, test.name)
+		assert.True(t, test.expected.Equal(actual.Timestamp), "%s: expected %v, actual %v", test.name, test.expected, actual.Timestamp)
+		assert.Equal(t, "body", actual.Body, test.name)
+	}
+}
+
+func TestParseMessage_MixedCaseHeaders(t *testing.T) {
+	value := base64.StdEncoding.EncodeToString([]byte("FTMSG/1.0\ncontent-type: application/json\nORIGIN-SYSTEM-ID: methode\nMessage-Id: id\n\nbody"))
+	actual, err := parseMessage(value, QueueConfig{}, logger.NewUPPLogger("Test", "FATAL"))
+	assert.NoError(t, err)
+
+	assert.Equal(t, map[string]string{"content-type": "application/json", "ORIGIN-SYSTEM-ID": "methode", "Message-Id": "id"}, actual.Headers, "the header keys should be kept as they were produced")
+	for key, expected := range map[string]string{"Content-Type": "application/json", "Origin-System-Id": "methode", "message-id": "id"} {
+		v, found := actual.Header(key)
+		assert.True(t, found, key)
+		assert.Equal(t, expected, v, key)
+	}
+}
+
+func TestParseMessage_TransactionIDHeader(t *testing.T) {
+	value := base64.StdEncoding.EncodeToString([]byte("FTMSG/1.0\nX-Request-Id: tid_default\nTransaction-Id: tid_custom\n\nbody"))
+	log := logger.NewUPPLogger("Test", "FATAL")
+
+	actual, err := parseMessage(value, QueueConfig{}, log)
+	assert.NoError(t, err)
+	assert.Equal(t, "tid_default", actual.TransactionID())
+
+	actual, err = parseMessage(value, QueueConfig{TransactionIDHeader: "transaction-id"}, log)
+	assert.NoError(t, err)
+	assert.Equal(t, "tid_custom", actual.TransactionID())
+}
+
+func gzipValue(t *testing.T, value string) string {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	_, err := w.Write([]byte(value))
+	assert.NoError(t, err)
+	assert.NoError(t, w.Close())
+	return base64.StdEncoding.EncodeToString(buf.Bytes())
+}
+
+func TestParseMessage_GzipDecompression(t *testing.T) {
+	value := "FTMSG/1.0\nMessage-Id: c4b96810-03e8-4057-84c5-dcc3a8c61a26\n\n{\"uuid\":\"1\"}"
+	log := logger.NewUPPLogger("Test", "FATAL")
+
+	actual, err := parseMessage(gzipValue(t, value), QueueConfig{Decompression: "gzip"}, log)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"Message-Id": "c4b96810-03e8-4057-84c5-dcc3a8c61a26"}, actual.Headers)
+	assert.Equal(t, `{"uuid":"1"}`, actual.Body)
+	assert.Equal(t, []byte(value), actual.Raw)
+
+	actual, err = parseMessage(gzipValue(t, "\x08\x96\x01"), QueueConfig{Decompression: "gzip", RawBody: true}, log)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("\x08\x96\x01"), actual.Raw)
+}
+
+func TestParseMessage_GzipDecompressionOfUncompressedValue_Fails(t *testing.T) {
+	value := base64.StdEncoding.EncodeToString([]byte("FTMSG/1.0\nMessage-Id: id\n\nbody"))
+	_, err := parseMessage(value, QueueConfig{Decompression: "gzip"}, logger.NewUPPLogger("Test", "FATAL"))
+	assert.True(t, errors.Is(err, gzip.ErrHeader), "unexpected error %v", err)
+	assert.Contains(t, err.Error(), "the message may not be compressed")
+}
+
+func TestParseMessage_UnsupportedDecompression_Fails(t *testing.T) {
+	value := base64.StdEncoding.EncodeToString([]byte("FTMSG/1.0\n\nbody"))
+	_, err := parseMessage(value, QueueConfig{Decompression: "zstd"}, logger.NewUPPLogger("Test", "FATAL"))
+	assert.EqualError(t, err, `unsupported decompression "zstd"`)
+
+	actual, err := parseMessage(value, QueueConfig{Decompression: "none"}, logger.NewUPPLogger("Test", "FATAL"))
+	assert.NoError(t, err)
+	assert.Equal(t, "body", actual.Body)
+}
+
+func TestParseMessage_RawRetained(t *testing.T) {
+	var tests = []struct {
+		value  string
+		config QueueConfig
+	}{
+		{"FTMSG/1.0\r\nMessage-Id: c4b96810-03e8-4057-84c5-dcc3a8c61a26\r\n\r\n{\"uuid\":\"1\"}\n", QueueConfig{}},
+		{"FTMSG/1.0\nMessage-Id: c4b96810-03e8-4057-84c5-dcc3a8c61a26\n", QueueConfig{}},
+		{"\x08\x96\x01", QueueConfig{RawBody: true}},
+	}
+
+	log := logger.NewUPPLogger("Test", "FATAL")
+	for _, test := range tests {
+		actual, err := parseMessage(base64.StdEncoding.EncodeToString([]byte(test.value)), test.config, log)
+		assert.NoError(t, err)
+		assert.Equal(t, []byte(test.value), actual.Raw, test.value)
+	}
+}
+
+// decodedValues returns the base64 decoded values of the records of a proxy response
+func decodedValues(t *testing.T, resp string) [][]byte {
+	var records []message
+	if err := json.Unmarshal([]byte(resp), &records); err != nil {
+		t.Fatalf("Error: [%v]", err)
+	}
+	values := make([][]byte, len(records))
+	for i, r := range records {
+		v, err := base64.StdEncoding.DecodeString(*r.Value)
+		if err != nil {
+			t.Fatalf("Error: [%v]", err)
+		}
+		values[i] = v
+	}
+	return values
+}
+
+func TestParseResponse_MaxMessageBytes(t *testing.T) {
+	log := logger.NewUPPLogger("Test", "WARN")
+	log.Out = ioutil.Discard
+	hook := logTest.NewLocal(log.Logger)
+
+	small := "FTMSG/1.0\n\nbody"
+	large := "FTMSG/1.0\n\n" + strings.Repeat("x", 100)
+	data := fmt.Sprintf(`[{"value":"%s","partition":0,"offset":1},{"value":"%s","partition":0,"offset":2}]`,
+		base64.StdEncoding.EncodeToString([]byte(small)), base64.StdEncoding.EncodeToString([]byte(large)))
+
+	msgs, err := parseResponse(strings.NewReader(data), QueueConfig{MaxMessageBytes: len(small)}, log)
+	assert.NoError(t, err)
+	assert.Len(t, msgs, 1, "the oversized message should be skipped")
+	assert.Equal(t, 1, msgs[0].Offset)
+
+	entries := hook.AllEntries()
+	assert.Len(t, entries, 1)
+	assert.Equal(t, logrus.WarnLevel, entries[0].Level)
+	assert.Equal(t, "Skipping oversized message", entries[0].Message)
+	assert.Equal(t, 2, entries[0].Data["offset"])
+
+	msgs, err = parseResponse(strings.NewReader(data), QueueConfig{}, log)
+	assert.NoError(t, err)
+	assert.Len(t, msgs, 2, "no limit should apply by default")
+}
+
+func TestParseResponse_Tombstone(t *testing.T) {
+	log := logger.NewUPPLogger("Test", "DEBUG")
+	log.Out = ioutil.Discard
+	hook := logTest.NewLocal(log.Logger)
+
+	data := fmt.Sprintf(`[{"value":"%s","partition":0,"offset":4},{"value":null,"partition":1,"offset":5}]`,
+		base64.StdEncoding.EncodeToString([]byte("FTMSG/1.0\nX-Request-Id: tid_1\n\nbody")))
+
+	msgs, err := parseResponse(strings.NewReader(data), QueueConfig{}, log)
+	assert.NoError(t, err)
+	assert.Len(t, msgs, 2)
+	assert.False(t, msgs[0].IsTombstone)
+	assert.Equal(t, "body", msgs[0].Body)
+	assert.True(t, msgs[1].IsTombstone)
+	assert.Equal(t, 1, msgs[1].Partition)
+	assert.Equal(t, 5, msgs[1].Offset)
+	assert.Empty(t, msgs[1].Body)
+	assert.Empty(t, msgs[1].Headers)
+	assert.Empty(t, hook.AllEntries(), "a tombstone is not a parse error")
+
+	config := QueueConfig{Unmarshaler: UnmarshalerFunc(json.Unmarshal)}
+	msgs, err = parseResponse(strings.NewReader(data), config, log)
+	assert.NoError(t, err)
+	assert.Len(t, msgs, 2)
+	assert.True(t, msgs[1].IsTombstone, "a custom unmarshaler should decode the null value too")
+}
+
+func TestParseMessage_MaxMessageBytes(t *testing.T) {
+	log := logger.NewUPPLogger("Test", "FATAL")
+	for _, size := range []int{2, 3, 4, 10, 11, 12} {
+		value := base64.StdEncoding.EncodeToString([]byte(strings.Repeat("x", size)))
+		_, err := parseMessage(value, QueueConfig{MaxMessageBytes: size, RawBody: true}, log)
+		assert.NoError(t, err, "a value of exactly %d bytes should be allowed", size)
+		_, err = parseMessage(value, QueueConfig{MaxMessageBytes: size - 1, RawBody: true}, log)
+		assert.True(t, errors.Is(err, errMessageTooLarge), "a value of %d bytes should be too large", size)
+	}
+
+	compressed := gzipValue(t, strings.Repeat("x", 10000))
+	_, err := parseMessage(compressed, QueueConfig{MaxMessageBytes: 1000, Decompression: "gzip", RawBody: true}, log)
+	assert.True(t, errors.Is(err, errMessageTooLarge), "the limit should apply to the decompressed value")
+	actual, err := parseMessage(compressed, QueueConfig{MaxMessageBytes: 10000, Decompression: "gzip", RawBody: true}, log)
+	assert.NoError(t, err)
+	assert.Len(t, actual.Raw, 10000)
+}
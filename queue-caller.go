@@ -7,40 +7,178 @@ import (
 	"io"
 	"net/http"
 	"net/url"
+	"sort"
 	"strconv"
 	"strings"
+	"sync/atomic"
+	"time"
 )
 
 var ErrNoQueueAddresses = errors.New("no kafka-rest-proxy addresses configured")
 
-const msgContentType = "application/vnd.kafka.v2+json"
+// Supported kafka-rest-proxy API versions.
+//
+// The v1 API differs from v2 in the following endpoints:
+//   - there is no subscription endpoint, the topic is part of the consume URL
+//     (GET /consumers/{group}/instances/{instance}/topics/{topic});
+//   - there is no positions endpoint, so seeking to offsets is not supported;
+//   - auto.offset.reset accepts smallest/largest instead of earliest/latest;
+//   - the content type is application/vnd.kafka.v1+json and records are
+//     consumed as application/vnd.kafka.binary.v1+json.
+const (
+	apiVersionV1      = "v1"
+	apiVersionV2      = "v2"
+	defaultAPIVersion = apiVersionV2
+)
+
+const defaultCommitRetryInterval = time.Second
+
+const (
+	defaultDestroyRetries       = 2
+	defaultDestroyRetryInterval = 500 * time.Millisecond
+)
+
+const (
+	msgContentType   = "application/vnd.kafka.v2+json"
+	msgContentTypeV1 = "application/vnd.kafka.v1+json"
+	// v1 consume responses have to be requested with the embedded format
+	binaryContentTypeV1 = "application/vnd.kafka.binary.v1+json"
+)
+
+// session.timeout.ms has to be within the broker's group.min.session.timeout.ms and group.max.session.timeout.ms,
+// these are the broker defaults
+const (
+	minSessionTimeout = 6 * time.Second
+	maxSessionTimeout = 5 * time.Minute
+)
+
+// ErrTopicNotFound is returned when QueueConfig.VerifyTopicExists is set and the proxy does not list the topic
+var ErrTopicNotFound = errors.New("topic not found")
+
+var errSeekNotSupported = errors.New("seeking to offsets is not supported by the v1 API")
+
+var errAssignNotSupported = errors.New("assigning partitions is not supported by the v1 API")
+
+var errPartitionCommitNotSupported = errors.New("committing partition offsets is not supported by the v1 API")
+
+var offsetResetV1 = map[string]string{
+	"earliest": "smallest",
+	"latest":   "largest",
+}
 
 type httpCaller interface {
 	DoReq(method, addr string, body io.Reader, headers map[string]string, expectedStatus int) ([]byte, error)
+	DoStreamReq(method, addr string, body io.Reader, headers map[string]string, expectedStatus int) (io.ReadCloser, error)
 }
 
 type kafkaRESTClient struct {
 	//pool of queue addresses
-	//the active address is changed in a round-robin fashion before each new consumer instance creation
+	//the active address is changed in a round-robin fashion before each new consumer instance creation,
+	//and on to the next one when the proxy can't be reached
+	//the instance requests then stick to the address the instance was created on
 	addrs []string
 	//used queue addr
 	//this gets 'incremented modulo' at each createConsumerInstance() call
-	addrInd          int
+	//accessed atomically, as the explicit commits build their URL while the poll loop may be reconnecting
+	addrInd int32
+	//path prefix the proxy endpoints are served under, normalized to either "" or "/prefix"
+	basePath         string
 	group            string
 	topic            string
 	offset           string
+	apiVersion       string
 	caller           httpCaller
 	autoCommitEnable bool
+	//number of times a failed commit is retried before giving up
+	commitRetries int
+	//wait before the first commit retry, doubled after each failed attempt
+	commitRetryInterval time.Duration
+	//consumer instance timeouts, omitted from the instance config when 0
+	requestTimeout time.Duration
+	sessionTimeout time.Duration
+	//name requested for the consumer instance, the proxy generates one when empty
+	instanceName string
+	//group.instance.id of the consumer instance for static group membership, omitted when empty
+	groupInstanceID string
+	//fetch sizes of the consumer instance and query parameters of the consume requests, omitted when 0
+	fetchMaxBytes    int
+	maxPollRecords   int
+	consumeMaxBytes  int
+	consumeTimeoutMs int
+	//extra properties of the consumer instance config
+	proxyConsumerConfig map[string]string
+	//number of times a failed delete is retried, and the wait between the attempts
+	destroyRetries       int
+	destroyRetryInterval time.Duration
+	//used for the retry waits, the real clock when nil
+	clock clock
+	//overridden request content types, the empty ones default to those of the API version
+	contentTypes ContentTypes
+}
+
+// setClock has the retries and the HTTP client of the queue use clk instead of the real clock
+func (q *kafkaRESTClient) setClock(clk clock) {
+	q.clock = clk
+	if caller, ok := q.caller.(httpClient); ok {
+		caller.clock = clk
+		q.caller = caller
+	}
 }
 
 func (q *kafkaRESTClient) createConsumerInstance() (c consumerInstanceURI, err error) {
-	q.addrInd = (q.addrInd + 1) % len(q.addrs)
-	addr := q.addrs[q.addrInd]
+	offset := q.offset
+	if q.apiVersion == apiVersionV1 {
+		if o, ok := offsetResetV1[offset]; ok {
+			offset = o
+		}
+	}
+	if q.sessionTimeout != 0 && (q.sessionTimeout < minSessionTimeout || q.sessionTimeout > maxSessionTimeout) {
+		return consumerInstanceURI{}, fmt.Errorf("session timeout %v is outside of the allowed range [%v, %v]", q.sessionTimeout, minSessionTimeout, maxSessionTimeout)
+	}
 
-	reqBody := strings.NewReader(`{"auto.offset.reset": "` + q.offset + `", "auto.commit.enable": "` + strconv.FormatBool(q.autoCommitEnable) + `"}`)
-	data, err := q.caller.DoReq("POST", addr+"/consumers/"+q.group, reqBody, map[string]string{"Content-Type": msgContentType}, http.StatusOK)
+	instanceConfig := `{"auto.offset.reset": "` + offset + `", "auto.commit.enable": "` + strconv.FormatBool(q.autoCommitEnable) + `"`
+	configured := map[string]bool{"auto.offset.reset": true, "auto.commit.enable": true}
+	add := func(key, value string) {
+		instanceConfig += `, "` + key + `": "` + value + `"`
+		configured[key] = true
+	}
+	if q.requestTimeout > 0 {
+		add("request.timeout.ms", formatMillis(q.requestTimeout))
+	}
+	if q.sessionTimeout > 0 {
+		add("session.timeout.ms", formatMillis(q.sessionTimeout))
+	}
+	if q.fetchMaxBytes > 0 {
+		add("fetch.max.bytes", strconv.Itoa(q.fetchMaxBytes))
+	}
+	if q.maxPollRecords > 0 {
+		add("max.poll.records", strconv.Itoa(q.maxPollRecords))
+	}
+	if q.instanceName != "" {
+		name, _ := json.Marshal(q.instanceName)
+		instanceConfig += `, "name": ` + string(name)
+		configured["name"] = true
+	}
+	if q.groupInstanceID != "" {
+		id, _ := json.Marshal(q.groupInstanceID)
+		instanceConfig += `, "group.instance.id": ` + string(id)
+		configured["group.instance.id"] = true
+	}
+	instanceConfig += q.extraConsumerConfig(configured) + "}"
+
+	var data []byte
+	//fail over to the next addresses while the proxies can't be reached
+	for range q.addrs {
+		ind := (int(atomic.LoadInt32(&q.addrInd)) + 1) % len(q.addrs)
+		atomic.StoreInt32(&q.addrInd, int32(ind))
+		addr := q.addrs[ind]
+		data, err = q.caller.DoReq("POST", addr+q.basePath+"/consumers/"+q.group, strings.NewReader(instanceConfig), map[string]string{"Content-Type": contentTypeOr(q.contentTypes.Create, q.contentType())}, http.StatusOK)
+		if !isConnectionError(err) {
+			break
+		}
+	}
 	if err != nil {
-		return consumerInstanceURI{}, err
+		return consumerInstanceURI{}, withOperation("create", err)
 	}
 	err = json.Unmarshal(data, &c)
 	if err != nil {
@@ -50,17 +188,49 @@ func (q *kafkaRESTClient) createConsumerInstance() (c consumerInstanceURI, err e
 	return
 }
 
+// extraConsumerConfig returns the ProxyConsumerConfig entries to append to the instance config, ordered by key.
+// The keys set from the other QueueConfig fields are left out.
+func (q *kafkaRESTClient) extraConsumerConfig(configured map[string]bool) string {
+	keys := make([]string, 0, len(q.proxyConsumerConfig))
+	for k := range q.proxyConsumerConfig {
+		if !configured[k] {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	var extra string
+	for _, k := range keys {
+		key, _ := json.Marshal(k)
+		value, _ := json.Marshal(q.proxyConsumerConfig[k])
+		extra += `, ` + string(key) + `: ` + string(value)
+	}
+	return extra
+}
+
+// isConnectionError is true for the errors of requests that did not get any response from the proxy
+func isConnectionError(err error) bool {
+	return err != nil && responseStatus(err) == 0 && !errors.Is(err, ErrRateLimited)
+}
+
 func (q *kafkaRESTClient) destroyConsumerInstance(c consumerInstanceURI) (err error) {
 	url, err := q.buildConsumerURL(c)
 	if err != nil {
 		return fmt.Errorf("error building consumer URL: %w", err)
 	}
 
-	_, err = q.caller.DoReq("DELETE", url.String(), nil, map[string]string{"Accept": msgContentType}, http.StatusNoContent)
-	return err
+	return q.retryDestroy(func() error {
+		_, err := q.caller.DoReq("DELETE", url.String(), nil, map[string]string{"Accept": contentTypeOr(q.contentTypes.Destroy, q.contentType())}, http.StatusNoContent)
+		return withOperation("destroy", err)
+	})
 }
 
 func (q *kafkaRESTClient) subscribeConsumerInstance(c consumerInstanceURI) (err error) {
+	if q.apiVersion == apiVersionV1 {
+		// v1 instances are not subscribed, the topic is passed when consuming
+		return nil
+	}
+
 	url, err := q.buildConsumerURL(c)
 	if err != nil {
 		return fmt.Errorf("error building consumer URL: %w", err)
@@ -68,40 +238,143 @@ func (q *kafkaRESTClient) subscribeConsumerInstance(c consumerInstanceURI) (err
 
 	url.Path = strings.TrimRight(url.Path, "/") + "/subscription"
 	reqBody := strings.NewReader(`{"topics": ["` + q.topic + `"]}`)
-	_, err = q.caller.DoReq("POST", url.String(), reqBody, map[string]string{"Content-Type": msgContentType}, http.StatusNoContent)
+	_, err = q.caller.DoReq("POST", url.String(), reqBody, map[string]string{"Content-Type": contentTypeOr(q.contentTypes.Subscribe, msgContentType)}, http.StatusNoContent)
 	if err != nil {
-		return err
+		return withOperation("subscribe", err)
 	}
 
 	return
 }
 
+// assignPartitions assigns the partitions of the topic to the consumer instance instead of subscribing it
+func (q *kafkaRESTClient) assignPartitions(c consumerInstanceURI, partitions []int) (err error) {
+	if q.apiVersion == apiVersionV1 {
+		return errAssignNotSupported
+	}
+
+	url, err := q.buildConsumerURL(c)
+	if err != nil {
+		return fmt.Errorf("error building consumer URL: %w", err)
+	}
+
+	url.Path = strings.TrimRight(url.Path, "/") + "/assignments"
+	assignments := make([]string, 0, len(partitions))
+	for _, p := range partitions {
+		assignments = append(assignments, `{"topic": "`+q.topic+`", "partition": `+strconv.Itoa(p)+`}`)
+	}
+	reqBody := strings.NewReader(`{"partitions": [` + strings.Join(assignments, ", ") + `]}`)
+	_, err = q.caller.DoReq("POST", url.String(), reqBody, map[string]string{"Content-Type": contentTypeOr(q.contentTypes.Subscribe, msgContentType)}, http.StatusNoContent)
+	return withOperation("assign", err)
+}
+
+func (q *kafkaRESTClient) seekOffsets(c consumerInstanceURI, offsets map[int]int64) (err error) {
+	if q.apiVersion == apiVersionV1 {
+		return errSeekNotSupported
+	}
+
+	url, err := q.buildConsumerURL(c)
+	if err != nil {
+		return fmt.Errorf("error building consumer URL: %w", err)
+	}
+
+	url.Path = strings.TrimRight(url.Path, "/") + "/positions"
+	_, err = q.caller.DoReq("POST", url.String(), q.offsetsBody(offsets), map[string]string{"Content-Type": contentTypeOr(q.contentTypes.Seek, msgContentType)}, http.StatusNoContent)
+	return withOperation("seek", err)
+}
+
+// offsetsBody returns the {"offsets": [...]} request body of the topic partitions, ordered by partition
+func (q *kafkaRESTClient) offsetsBody(offsets map[int]int64) io.Reader {
+	partitions := make([]int, 0, len(offsets))
+	for p := range offsets {
+		partitions = append(partitions, p)
+	}
+	sort.Ints(partitions)
+
+	positions := make([]string, 0, len(partitions))
+	for _, p := range partitions {
+		positions = append(positions, `{"topic": "`+q.topic+`", "partition": `+strconv.Itoa(p)+`, "offset": `+strconv.FormatInt(offsets[p], 10)+`}`)
+	}
+	return strings.NewReader(`{"offsets": [` + strings.Join(positions, ", ") + `]}`)
+}
+
 func (q *kafkaRESTClient) destroyConsumerInstanceSubscription(c consumerInstanceURI) (err error) {
+	if q.apiVersion == apiVersionV1 {
+		return nil
+	}
+
 	url, err := q.buildConsumerURL(c)
 	if err != nil {
 		return fmt.Errorf("error building consumer URL: %w", err)
 	}
 
 	url.Path = strings.TrimRight(url.Path, "/") + "/subscription"
-	_, err = q.caller.DoReq("DELETE", url.String(), nil, map[string]string{"Accept": msgContentType}, http.StatusNoContent)
-	return err
+	return q.retryDestroy(func() error {
+		_, err := q.caller.DoReq("DELETE", url.String(), nil, map[string]string{"Accept": contentTypeOr(q.contentTypes.Destroy, msgContentType)}, http.StatusNoContent)
+		return withOperation("unsubscribe", err)
+	})
+}
+
+// retryDestroy retries a failed delete up to destroyRetries times.
+// A 404 means the resource is already gone, e.g. expired by the proxy, and counts as a success.
+func (q *kafkaRESTClient) retryDestroy(destroy func() error) error {
+	for attempt := 0; ; attempt++ {
+		err := destroy()
+		if err == nil || responseStatus(err) == http.StatusNotFound {
+			return nil
+		}
+		if attempt >= q.destroyRetries {
+			return err
+		}
+		clockOrDefault(q.clock).Sleep(q.destroyRetryInterval)
+	}
 }
 
-func (q *kafkaRESTClient) consumeMessages(c consumerInstanceURI) ([]byte, error) {
+func (q *kafkaRESTClient) consumeMessages(c consumerInstanceURI) (io.ReadCloser, error) {
 	uri, err := q.buildConsumerURL(c)
 	if err != nil {
 		return nil, fmt.Errorf("error building consumer URL: %w", err)
 	}
 
-	uri.Path = strings.TrimRight(uri.Path, "/") + "/records"
-	data, err := q.caller.DoReq("GET", uri.String(), nil, map[string]string{"Accept": msgContentType}, http.StatusOK)
+	accept := msgContentType
+	if q.apiVersion == apiVersionV1 {
+		uri.Path = strings.TrimRight(uri.Path, "/") + "/topics/" + q.topic
+		accept = binaryContentTypeV1
+	} else {
+		uri.Path = strings.TrimRight(uri.Path, "/") + "/records"
+	}
+	query := uri.Query()
+	if q.consumeTimeoutMs > 0 {
+		query.Set("timeout", strconv.Itoa(q.consumeTimeoutMs))
+	}
+	if q.consumeMaxBytes > 0 {
+		query.Set("max_bytes", strconv.Itoa(q.consumeMaxBytes))
+	}
+	uri.RawQuery = query.Encode()
+	data, err := q.caller.DoStreamReq("GET", uri.String(), nil, map[string]string{"Accept": contentTypeOr(q.contentTypes.Consume, accept)}, http.StatusOK)
 	if err != nil {
-		return nil, err
+		return nil, withOperation("consume", err)
 	}
 
 	return data, nil
 }
 
+// keepAlive issues a lightweight request against the consumer instance so that the proxy doesn't expire it.
+// The v1 API has no side-effect free instance endpoint, so no request is made.
+func (q *kafkaRESTClient) keepAlive(c consumerInstanceURI) error {
+	if q.apiVersion == apiVersionV1 {
+		return nil
+	}
+
+	url, err := q.buildConsumerURL(c)
+	if err != nil {
+		return fmt.Errorf("error building consumer URL: %w", err)
+	}
+
+	url.Path = strings.TrimRight(url.Path, "/") + "/assignments"
+	_, err = q.caller.DoReq("GET", url.String(), nil, map[string]string{"Accept": contentTypeOr(q.contentTypes.KeepAlive, msgContentType)}, http.StatusOK)
+	return withOperation("keepAlive", err)
+}
+
 func (q *kafkaRESTClient) commitOffsets(c consumerInstanceURI) (err error) {
 	url, err := q.buildConsumerURL(c)
 	if err != nil {
@@ -109,9 +382,71 @@ func (q *kafkaRESTClient) commitOffsets(c consumerInstanceURI) (err error) {
 	}
 
 	url.Path = strings.TrimRight(url.Path, "/") + "/offsets"
-	_, err = q.caller.DoReq("POST", url.String(), nil, map[string]string{"Content-Type": msgContentType}, http.StatusOK)
+	return q.retryCommit(func() error {
+		_, err := q.caller.DoReq("POST", url.String(), nil, map[string]string{"Content-Type": contentTypeOr(q.contentTypes.Commit, q.contentType())}, http.StatusOK)
+		return withOperation("commit", err)
+	})
+}
+
+// commitPartitionOffsets commits the given offset of each partition instead of everything consumed so far.
+// It is only supported by the v2 API.
+func (q *kafkaRESTClient) commitPartitionOffsets(c consumerInstanceURI, offsets map[int]int64) error {
+	if q.apiVersion == apiVersionV1 {
+		return errPartitionCommitNotSupported
+	}
 
-	return err
+	url, err := q.buildConsumerURL(c)
+	if err != nil {
+		return fmt.Errorf("error building consumer URL: %w", err)
+	}
+
+	url.Path = strings.TrimRight(url.Path, "/") + "/offsets"
+	return q.retryCommit(func() error {
+		_, err := q.caller.DoReq("POST", url.String(), q.offsetsBody(offsets), map[string]string{"Content-Type": contentTypeOr(q.contentTypes.Commit, msgContentType)}, http.StatusOK)
+		return withOperation("commit", err)
+	})
+}
+
+// retryCommit retries a failed commit up to commitRetries times, doubling the wait after each attempt
+func (q *kafkaRESTClient) retryCommit(commit func() error) (err error) {
+	interval := q.commitRetryInterval
+	for attempt := 0; ; attempt++ {
+		err = commit()
+		if err == nil || attempt >= q.commitRetries {
+			return err
+		}
+		wait := interval
+		var rerr *rateLimitError
+		if errors.As(err, &rerr) && rerr.retryAfter > wait {
+			wait = rerr.retryAfter
+		}
+		clockOrDefault(q.clock).Sleep(wait)
+		interval *= 2
+	}
+}
+
+// normalizeBasePath returns the path with a single leading slash and no trailing slash, or "" for the root
+func normalizeBasePath(p string) string {
+	p = strings.Trim(p, "/")
+	if p == "" {
+		return ""
+	}
+	return "/" + p
+}
+
+// contentTypeOr returns the configured content type, or def when it is empty
+func contentTypeOr(configured, def string) string {
+	if configured != "" {
+		return configured
+	}
+	return def
+}
+
+func (q *kafkaRESTClient) contentType() string {
+	if q.apiVersion == apiVersionV1 {
+		return msgContentTypeV1
+	}
+	return msgContentType
 }
 
 func (q *kafkaRESTClient) buildConsumerURL(c consumerInstanceURI) (uri *url.URL, err error) {
@@ -126,11 +461,15 @@ func (q *kafkaRESTClient) buildConsumerURL(c consumerInstanceURI) (uri *url.URL,
 		return nil, fmt.Errorf("error parsing base URI: %w", err)
 	}
 
-	addr := q.addrs[q.addrInd]
+	addr := q.addrs[atomic.LoadInt32(&q.addrInd)]
 	addrURL, err := url.Parse(addr)
 	if err != nil {
 		return nil, fmt.Errorf("error parsing queue address: %w", err)
 	}
+	// the returned base URI may or may not include the base path, depending on the proxy setup
+	if !strings.HasPrefix(uri.Path, q.basePath+"/") {
+		uri.Path = q.basePath + uri.Path
+	}
 	addrURL.Path = addrURL.Path + uri.Path
 	return addrURL, nil
 }
@@ -152,11 +491,53 @@ func (q *kafkaRESTClient) checkConnectivity() error {
 	return nil
 }
 
+// topicExists looks the topic up in the GET /topics listing of the first proxy answering it.
+// An error is returned if no proxy returned a topic listing, e.g. when listing is disabled.
+func (q *kafkaRESTClient) topicExists() (bool, error) {
+	if len(q.addrs) == 0 {
+		return false, ErrNoQueueAddresses
+	}
+
+	var err error
+	for _, address := range q.addrs {
+		var data []byte
+		data, err = q.caller.DoReq("GET", address+q.basePath+"/topics", nil, map[string]string{"Accept": contentTypeOr(q.contentTypes.Topics, q.contentType())}, http.StatusOK)
+		if err != nil {
+			err = withOperation("listTopics", err)
+			continue
+		}
+
+		var topics []string
+		if err = json.Unmarshal(data, &topics); err != nil {
+			err = fmt.Errorf("error unmarshalling topics: %w", err)
+			continue
+		}
+		for _, t := range topics {
+			if t == q.topic {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+	return false, fmt.Errorf("could not list topics: %w", err)
+}
+
 func (q *kafkaRESTClient) checkMessageQueueProxyReachable(address string) error {
-	_, err := q.caller.DoReq("GET", address+"/topics", nil, map[string]string{"Accept": msgContentType}, http.StatusOK)
+	_, err := q.caller.DoReq("GET", address+q.basePath+"/topics", nil, map[string]string{"Accept": contentTypeOr(q.contentTypes.Topics, q.contentType())}, http.StatusOK)
 	if err != nil {
 		return fmt.Errorf("could not connect to proxy: %w", err)
 	}
 
 	return nil
 }
+
+func (q *kafkaRESTClient) closeIdleConnections() {
+	if c, ok := q.caller.(httpClient); ok && c.client != nil {
+		c.client.CloseIdleConnections()
+	}
+}
+
+// formatMillis formats d as the whole number of milliseconds expected by the kafka *.ms configs
+func formatMillis(d time.Duration) string {
+	return strconv.FormatInt(int64(d/time.Millisecond), 10)
+}
@@ -1,9 +1,18 @@
 package consumer
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
 	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"net/url"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -103,6 +112,583 @@ func TestCreateConsumerInstance_queueAddressesAreChangedInRoundRobinFashion(t *t
 
 }
 
+func TestCreateConsumerInstanceFailsOverToTheNextAddress(t *testing.T) {
+	caller := &unreachableHTTPCaller{unreachable: map[string]bool{"http://kafka-proxy-2.prod.ft.com": true}}
+	q := &kafkaRESTClient{
+		addrs:  []string{"http://kafka-proxy-1.prod.ft.com", "http://kafka-proxy-2.prod.ft.com", "http://kafka-proxy-3.prod.ft.com"},
+		group:  "group1",
+		caller: caller,
+	}
+
+	_, err := q.createConsumerInstance()
+	assert.NoError(t, err)
+	assert.Equal(t, int32(2), q.addrInd)
+	assert.Equal(t, []string{
+		"http://kafka-proxy-2.prod.ft.com/consumers/group1",
+		"http://kafka-proxy-3.prod.ft.com/consumers/group1",
+	}, caller.addrs)
+
+	caller.addrs = nil
+	_, err = q.consumeMessages(testConsumer)
+	assert.NoError(t, err)
+	assert.NoError(t, q.commitOffsets(testConsumer))
+	assert.Equal(t, []string{
+		"http://kafka-proxy-3.prod.ft.com/consumers/group1/instances/rest-consumer-1-45864/records",
+		"http://kafka-proxy-3.prod.ft.com/consumers/group1/instances/rest-consumer-1-45864/offsets",
+	}, caller.addrs, "the instance requests should stick to the address the instance was created on")
+}
+
+func TestCreateConsumerInstanceFailsWhenNoAddressIsReachable(t *testing.T) {
+	caller := &unreachableHTTPCaller{unreachable: map[string]bool{"http://kafka-proxy-1.prod.ft.com": true, "http://kafka-proxy-2.prod.ft.com": true}}
+	q := &kafkaRESTClient{
+		addrs:  []string{"http://kafka-proxy-1.prod.ft.com", "http://kafka-proxy-2.prod.ft.com"},
+		group:  "group1",
+		caller: caller,
+	}
+
+	_, err := q.createConsumerInstance()
+	assert.Error(t, err)
+	assert.Len(t, caller.addrs, 2, "each address should be tried once")
+}
+
+func TestCreateConsumerInstanceDoesNotFailOverOnErrorResponse(t *testing.T) {
+	caller := &failingCreateHTTPCaller{status: http.StatusInternalServerError}
+	q := &kafkaRESTClient{
+		addrs:  []string{"http://kafka-proxy-1.prod.ft.com", "http://kafka-proxy-2.prod.ft.com"},
+		group:  "group1",
+		caller: caller,
+	}
+
+	_, err := q.createConsumerInstance()
+	assert.Error(t, err)
+	assert.Equal(t, 1, caller.creates)
+}
+
+func TestSeekOffsetsIssuesPositionForEachPartition(t *testing.T) {
+	caller := &recordingHTTPCaller{}
+	queueCaller := &kafkaRESTClient{
+		addrs:  []string{"http://kafka-proxy-1.prod.ft.com"},
+		topic:  "methode-articles",
+		caller: caller,
+	}
+
+	err := queueCaller.seekOffsets(testConsumer, map[int]int64{2: 300, 0: 100, 1: 200})
+	assert.NoError(t, err)
+
+	assert.Len(t, caller.reqs, 1)
+	assert.Equal(t, "POST", caller.reqs[0].method)
+	assert.Equal(t, "http://kafka-proxy-1.prod.ft.com/consumers/group1/instances/rest-consumer-1-45864/positions", caller.reqs[0].addr)
+	assert.JSONEq(t, `{"offsets": [
+		{"topic": "methode-articles", "partition": 0, "offset": 100},
+		{"topic": "methode-articles", "partition": 1, "offset": 200},
+		{"topic": "methode-articles", "partition": 2, "offset": 300}
+	]}`, caller.reqs[0].body)
+}
+
+func TestAssignPartitionsIssuesAssignmentForEachPartition(t *testing.T) {
+	caller := &recordingHTTPCaller{}
+	queueCaller := &kafkaRESTClient{
+		addrs:  []string{"http://kafka-proxy-1.prod.ft.com"},
+		topic:  "methode-articles",
+		caller: caller,
+	}
+
+	err := queueCaller.assignPartitions(testConsumer, []int{3, 0})
+	assert.NoError(t, err)
+
+	assert.Len(t, caller.reqs, 1)
+	assert.Equal(t, "POST", caller.reqs[0].method)
+	assert.Equal(t, "http://kafka-proxy-1.prod.ft.com/consumers/group1/instances/rest-consumer-1-45864/assignments", caller.reqs[0].addr)
+	assert.Equal(t, map[string]string{"Content-Type": "application/vnd.kafka.v2+json"}, caller.reqs[0].headers)
+	assert.JSONEq(t, `{"partitions": [
+		{"topic": "methode-articles", "partition": 3},
+		{"topic": "methode-articles", "partition": 0}
+	]}`, caller.reqs[0].body)
+}
+
+func TestAPIVersionEndpoints(t *testing.T) {
+	var tests = []struct {
+		apiVersion string
+		expected   []recordedRequest
+	}{
+		{
+			apiVersion: apiVersionV2,
+			expected: []recordedRequest{
+				{method: "POST", addr: "http://kafka-proxy-1.prod.ft.com/consumers/group1", body: `{"auto.offset.reset": "earliest", "auto.commit.enable": "false"}`, headers: map[string]string{"Content-Type": "application/vnd.kafka.v2+json"}},
+				{method: "POST", addr: "http://kafka-proxy-1.prod.ft.com/consumers/group1/instances/rest-consumer-1-45864/subscription", body: `{"topics": ["methode-articles"]}`, headers: map[string]string{"Content-Type": "application/vnd.kafka.v2+json"}},
+				{method: "GET", addr: "http://kafka-proxy-1.prod.ft.com/consumers/group1/instances/rest-consumer-1-45864/records", headers: map[string]string{"Accept": "application/vnd.kafka.v2+json"}},
+				{method: "POST", addr: "http://kafka-proxy-1.prod.ft.com/consumers/group1/instances/rest-consumer-1-45864/offsets", headers: map[string]string{"Content-Type": "application/vnd.kafka.v2+json"}},
+				{method: "DELETE", addr: "http://kafka-proxy-1.prod.ft.com/consumers/group1/instances/rest-consumer-1-45864/subscription", headers: map[string]string{"Accept": "application/vnd.kafka.v2+json"}},
+				{method: "DELETE", addr: "http://kafka-proxy-1.prod.ft.com/consumers/group1/instances/rest-consumer-1-45864", headers: map[string]string{"Accept": "application/vnd.kafka.v2+json"}},
+			},
+		},
+		{
+			apiVersion: apiVersionV1,
+			expected: []recordedRequest{
+				{method: "POST", addr: "http://kafka-proxy-1.prod.ft.com/consumers/group1", body: `{"auto.offset.reset": "smallest", "auto.commit.enable": "false"}`, headers: map[string]string{"Content-Type": "application/vnd.kafka.v1+json"}},
+				{method: "GET", addr: "http://kafka-proxy-1.prod.ft.com/consumers/group1/instances/rest-consumer-1-45864/topics/methode-articles", headers: map[string]string{"Accept": "application/vnd.kafka.binary.v1+json"}},
+				{method: "POST", addr: "http://kafka-proxy-1.prod.ft.com/consumers/group1/instances/rest-consumer-1-45864/offsets", headers: map[string]string{"Content-Type": "application/vnd.kafka.v1+json"}},
+				{method: "DELETE", addr: "http://kafka-proxy-1.prod.ft.com/consumers/group1/instances/rest-consumer-1-45864", headers: map[string]string{"Accept": "application/vnd.kafka.v1+json"}},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		caller := &recordingHTTPCaller{}
+		q := &kafkaRESTClient{
+			addrs:      []string{"http://kafka-proxy-1.prod.ft.com"},
+			group:      "group1",
+			topic:      "methode-articles",
+			offset:     "earliest",
+			apiVersion: test.apiVersion,
+			caller:     caller,
+		}
+
+		_, err := q.createConsumerInstance()
+		assert.NoError(t, err)
+		assert.NoError(t, q.subscribeConsumerInstance(testConsumer))
+		_, err = q.consumeMessages(testConsumer)
+		assert.NoError(t, err)
+		assert.NoError(t, q.commitOffsets(testConsumer))
+		assert.NoError(t, q.destroyConsumerInstanceSubscription(testConsumer))
+		assert.NoError(t, q.destroyConsumerInstance(testConsumer))
+
+		assert.Equal(t, test.expected, caller.reqs, "API version %s", test.apiVersion)
+	}
+}
+
+func TestContentTypes(t *testing.T) {
+	caller := &recordingHTTPCaller{}
+	q := newKafkaRESTClient(QueueConfig{
+		Addrs: []string{"http://kafka-proxy-1.prod.ft.com"},
+		Group: "group1",
+		Topic: "methode-articles",
+		ContentTypes: ContentTypes{
+			Create:    "application/create",
+			Subscribe: "application/subscribe",
+			Seek:      "application/seek",
+			Consume:   "application/consume",
+			Commit:    "application/commit",
+			KeepAlive: "application/keepalive",
+			Destroy:   "application/destroy",
+			Topics:    "application/topics",
+		},
+	}, nil)
+	q.caller = caller
+
+	_, err := q.createConsumerInstance()
+	assert.NoError(t, err)
+	assert.NoError(t, q.subscribeConsumerInstance(testConsumer))
+	assert.NoError(t, q.assignPartitions(testConsumer, []int{0}))
+	assert.NoError(t, q.seekOffsets(testConsumer, map[int]int64{0: 1}))
+	_, err = q.consumeMessages(testConsumer)
+	assert.NoError(t, err)
+	assert.NoError(t, q.commitOffsets(testConsumer))
+	assert.NoError(t, q.commitPartitionOffsets(testConsumer, map[int]int64{0: 2}))
+	assert.NoError(t, q.keepAlive(testConsumer))
+	assert.NoError(t, q.checkConnectivity())
+	assert.NoError(t, q.destroyConsumerInstanceSubscription(testConsumer))
+	assert.NoError(t, q.destroyConsumerInstance(testConsumer))
+
+	var headers []map[string]string
+	for _, req := range caller.reqs {
+		headers = append(headers, req.headers)
+	}
+	assert.Equal(t, []map[string]string{
+		{"Content-Type": "application/create"},
+		{"Content-Type": "application/subscribe"},
+		{"Content-Type": "application/subscribe"},
+		{"Content-Type": "application/seek"},
+		{"Accept": "application/consume"},
+		{"Content-Type": "application/commit"},
+		{"Content-Type": "application/commit"},
+		{"Accept": "application/keepalive"},
+		{"Accept": "application/topics"},
+		{"Accept": "application/destroy"},
+		{"Accept": "application/destroy"},
+	}, headers)
+}
+
+func TestContentTypesDefaultWhenEmpty(t *testing.T) {
+	for _, apiVersion := range []string{apiVersionV2, apiVersionV1} {
+		caller := &recordingHTTPCaller{}
+		q := newKafkaRESTClient(QueueConfig{
+			Addrs:        []string{"http://kafka-proxy-1.prod.ft.com"},
+			Group:        "group1",
+			Topic:        "methode-articles",
+			APIVersion:   apiVersion,
+			ContentTypes: ContentTypes{Commit: "application/json"},
+		}, nil)
+		q.caller = caller
+
+		_, err := q.createConsumerInstance()
+		assert.NoError(t, err)
+		_, err = q.consumeMessages(testConsumer)
+		assert.NoError(t, err)
+		assert.NoError(t, q.commitOffsets(testConsumer))
+
+		expected := []map[string]string{
+			{"Content-Type": "application/vnd.kafka.v2+json"},
+			{"Accept": "application/vnd.kafka.v2+json"},
+			{"Content-Type": "application/json"},
+		}
+		if apiVersion == apiVersionV1 {
+			expected[0]["Content-Type"] = "application/vnd.kafka.v1+json"
+			expected[1]["Accept"] = "application/vnd.kafka.binary.v1+json"
+		}
+		assert.Len(t, caller.reqs, 3)
+		for i, req := range caller.reqs {
+			assert.Equal(t, expected[i], req.headers, "API version %s, request %d", apiVersion, i)
+		}
+	}
+}
+
+func TestCreateConsumerInstanceTimeouts(t *testing.T) {
+	var tests = []struct {
+		requestTimeout time.Duration
+		sessionTimeout time.Duration
+		expectedBody   string
+		expectedErr    bool
+	}{
+		{0, 0, `{"auto.offset.reset": "latest", "auto.commit.enable": "false"}`, false},
+		{40 * time.Second, 0, `{"auto.offset.reset": "latest", "auto.commit.enable": "false", "request.timeout.ms": "40000"}`, false},
+		{0, 15 * time.Second, `{"auto.offset.reset": "latest", "auto.commit.enable": "false", "session.timeout.ms": "15000"}`, false},
+		{40 * time.Second, 30 * time.Second, `{"auto.offset.reset": "latest", "auto.commit.enable": "false", "request.timeout.ms": "40000", "session.timeout.ms": "30000"}`, false},
+		{0, time.Second, "", true},
+		{0, time.Hour, "", true},
+	}
+
+	for _, test := range tests {
+		caller := &recordingHTTPCaller{}
+		q := newKafkaRESTClient(QueueConfig{
+			Addrs:          []string{"http://kafka-proxy-1.prod.ft.com"},
+			Group:          "group1",
+			RequestTimeout: test.requestTimeout,
+			SessionTimeout: test.sessionTimeout,
+		}, nil)
+		q.caller = caller
+
+		_, err := q.createConsumerInstance()
+		if test.expectedErr {
+			assert.Error(t, err, "session timeout %v", test.sessionTimeout)
+			assert.Empty(t, caller.reqs, "no consumer instance should be created")
+			continue
+		}
+		assert.NoError(t, err)
+		assert.Len(t, caller.reqs, 1)
+		assert.Equal(t, test.expectedBody, caller.reqs[0].body)
+	}
+}
+
+func TestCreateConsumerInstanceWithName(t *testing.T) {
+	caller := &recordingHTTPCaller{}
+	q := newKafkaRESTClient(QueueConfig{
+		Addrs:        []string{"http://kafka-proxy-1.prod.ft.com"},
+		Group:        "group1",
+		InstanceName: "annotations-writer",
+	}, nil)
+	q.caller = caller
+
+	_, err := q.createConsumerInstance()
+	assert.NoError(t, err)
+	assert.Len(t, caller.reqs, 1)
+	assert.JSONEq(t, `{"auto.offset.reset": "latest", "auto.commit.enable": "false", "name": "annotations-writer"}`, caller.reqs[0].body)
+}
+
+func TestCreateConsumerInstanceWithGroupInstanceID(t *testing.T) {
+	caller := &recordingHTTPCaller{}
+	q := newKafkaRESTClient(QueueConfig{
+		Addrs:           []string{"http://kafka-proxy-1.prod.ft.com"},
+		Group:           "group1",
+		GroupInstanceID: "annotations-writer-replica-0",
+		ProxyConsumerConfig: map[string]string{
+			"group.instance.id": "overridden",
+		},
+	}, nil)
+	q.caller = caller
+
+	_, err := q.createConsumerInstance()
+	assert.NoError(t, err)
+	assert.Len(t, caller.reqs, 1)
+	assert.JSONEq(t, `{"auto.offset.reset": "latest", "auto.commit.enable": "false", "group.instance.id": "annotations-writer-replica-0"}`, caller.reqs[0].body)
+
+	q.groupInstanceID = ""
+	_, err = q.createConsumerInstance()
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"auto.offset.reset": "latest", "auto.commit.enable": "false", "group.instance.id": "overridden"}`, caller.reqs[1].body, "ProxyConsumerConfig should apply when GroupInstanceID is not set")
+}
+
+func TestFetchSizes(t *testing.T) {
+	caller := &recordingHTTPCaller{}
+	q := newKafkaRESTClient(QueueConfig{
+		Addrs:            []string{"http://kafka-proxy-1.prod.ft.com"},
+		Group:            "group1",
+		Topic:            "methode-articles",
+		FetchMaxBytes:    1048576,
+		MaxPollRecords:   100,
+		ConsumeMaxBytes:  500000,
+		ConsumeTimeoutMs: 2000,
+	}, nil)
+	q.caller = caller
+
+	_, err := q.createConsumerInstance()
+	assert.NoError(t, err)
+	_, err = q.consumeMessages(testConsumer)
+	assert.NoError(t, err)
+
+	assert.Len(t, caller.reqs, 2)
+	assert.JSONEq(t, `{"auto.offset.reset": "latest", "auto.commit.enable": "false", "fetch.max.bytes": "1048576", "max.poll.records": "100"}`, caller.reqs[0].body)
+	assert.Equal(t, "http://kafka-proxy-1.prod.ft.com/consumers/group1/instances/rest-consumer-1-45864/records?max_bytes=500000&timeout=2000", caller.reqs[1].addr)
+
+	q.apiVersion = apiVersionV1
+	q.consumeTimeoutMs = 0
+	_, err = q.consumeMessages(testConsumer)
+	assert.NoError(t, err)
+	assert.Equal(t, "http://kafka-proxy-1.prod.ft.com/consumers/group1/instances/rest-consumer-1-45864/topics/methode-articles?max_bytes=500000", caller.reqs[2].addr)
+}
+
+func TestConsumeTimeoutQueryParameter(t *testing.T) {
+	for _, timeout := range []int{0, 500, 30000} {
+		caller := &recordingHTTPCaller{}
+		q := newKafkaRESTClient(QueueConfig{
+			Addrs:            []string{"http://kafka-proxy-1.prod.ft.com"},
+			Group:            "group1",
+			ConsumeTimeoutMs: timeout,
+		}, nil)
+		q.caller = caller
+
+		_, err := q.consumeMessages(testConsumer)
+		assert.NoError(t, err)
+		assert.Len(t, caller.reqs, 1)
+		uri, err := url.Parse(caller.reqs[0].addr)
+		assert.NoError(t, err)
+		if timeout == 0 {
+			assert.NotContains(t, uri.Query(), "timeout", "the proxy default should apply")
+			continue
+		}
+		assert.Equal(t, strconv.Itoa(timeout), uri.Query().Get("timeout"))
+	}
+}
+
+func TestProxyConsumerConfig(t *testing.T) {
+	caller := &recordingHTTPCaller{}
+	q := newKafkaRESTClient(QueueConfig{
+		Addrs:          []string{"http://kafka-proxy-1.prod.ft.com"},
+		Group:          "group1",
+		Topic:          "methode-articles",
+		Offset:         "earliest",
+		MaxPollRecords: 100,
+		ProxyConsumerConfig: map[string]string{
+			"fetch.min.bytes":         "1024",
+			"fetch.max.wait.ms":       "500",
+			"auto.commit.interval.ms": "1000",
+			"auto.offset.reset":       "latest",
+			"max.poll.records":        "10",
+		},
+	}, nil)
+	q.caller = caller
+
+	_, err := q.createConsumerInstance()
+	assert.NoError(t, err)
+	assert.Len(t, caller.reqs, 1)
+	assert.JSONEq(t, `{
+		"auto.offset.reset": "earliest",
+		"auto.commit.enable": "false",
+		"max.poll.records": "100",
+		"auto.commit.interval.ms": "1000",
+		"fetch.max.wait.ms": "500",
+		"fetch.min.bytes": "1024"
+	}`, caller.reqs[0].body, "the extra properties should be added without overriding the configured ones")
+}
+
+func TestBasePathIsPrependedToEndpoints(t *testing.T) {
+	for _, basePath := range []string{"kafka-proxy", "/kafka-proxy", "/kafka-proxy/"} {
+		caller := &recordingHTTPCaller{}
+		q := &kafkaRESTClient{
+			addrs:    []string{"http://kafka-proxy-1.prod.ft.com"},
+			basePath: normalizeBasePath(basePath),
+			group:    "group1",
+			topic:    "methode-articles",
+			caller:   caller,
+		}
+
+		_, err := q.createConsumerInstance()
+		assert.NoError(t, err)
+		assert.NoError(t, q.subscribeConsumerInstance(testConsumer))
+		assert.NoError(t, q.seekOffsets(testConsumer, map[int]int64{0: 1}))
+		_, err = q.consumeMessages(testConsumer)
+		assert.NoError(t, err)
+		assert.NoError(t, q.commitOffsets(testConsumer))
+		assert.NoError(t, q.destroyConsumerInstanceSubscription(testConsumer))
+		assert.NoError(t, q.destroyConsumerInstance(testConsumer))
+		assert.NoError(t, q.checkConnectivity())
+
+		var addrs []string
+		for _, req := range caller.reqs {
+			addrs = append(addrs, req.addr)
+		}
+		assert.Equal(t, []string{
+			"http://kafka-proxy-1.prod.ft.com/kafka-proxy/consumers/group1",
+			"http://kafka-proxy-1.prod.ft.com/kafka-proxy/consumers/group1/instances/rest-consumer-1-45864/subscription",
+			"http://kafka-proxy-1.prod.ft.com/kafka-proxy/consumers/group1/instances/rest-consumer-1-45864/positions",
+			"http://kafka-proxy-1.prod.ft.com/kafka-proxy/consumers/group1/instances/rest-consumer-1-45864/records",
+			"http://kafka-proxy-1.prod.ft.com/kafka-proxy/consumers/group1/instances/rest-consumer-1-45864/offsets",
+			"http://kafka-proxy-1.prod.ft.com/kafka-proxy/consumers/group1/instances/rest-consumer-1-45864/subscription",
+			"http://kafka-proxy-1.prod.ft.com/kafka-proxy/consumers/group1/instances/rest-consumer-1-45864",
+			"http://kafka-proxy-1.prod.ft.com/kafka-proxy/topics",
+		}, addrs, "base path %q", basePath)
+	}
+}
+
+func TestBasePathIsNotDuplicatedWhenPresentInBaseURI(t *testing.T) {
+	q := kafkaRESTClient{
+		addrs:    []string{"http://kafka-proxy-1.prod.ft.com"},
+		basePath: "/kafka-proxy",
+	}
+	actual, err := q.buildConsumerURL(consumerInstanceURI{BaseURI: "http://kafka/kafka-proxy/consumers/group1/instances/rest-consumer-1-45864"})
+	assert.NoError(t, err)
+	assert.Equal(t, "http://kafka-proxy-1.prod.ft.com/kafka-proxy/consumers/group1/instances/rest-consumer-1-45864", actual.String())
+}
+
+func TestBasePathAgainstPrefixedProxy(t *testing.T) {
+	var paths []string
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		paths = append(paths, req.Method+" "+req.URL.Path)
+		if !strings.HasPrefix(req.URL.Path, "/kafka-rest/") {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		switch req.Method {
+		case "POST":
+			if strings.HasSuffix(req.URL.Path, "/consumers/group1") {
+				// the gateway strips the prefix before the proxy builds the base URI
+				fmt.Fprintf(w, `{"instance_id":"inst-1","base_uri":"%s/consumers/group1/instances/inst-1"}`, server.URL)
+				return
+			}
+			if strings.HasSuffix(req.URL.Path, "/subscription") {
+				w.WriteHeader(http.StatusNoContent)
+			}
+		case "GET":
+			w.Write([]byte("[]"))
+		case "DELETE":
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	defer server.Close()
+
+	q := newKafkaRESTClient(QueueConfig{
+		Addrs:    []string{server.URL},
+		BasePath: "kafka-rest",
+		Group:    "group1",
+		Topic:    "methode-articles",
+	}, &http.Client{})
+
+	c, err := q.createConsumerInstance()
+	assert.NoError(t, err)
+	assert.NoError(t, q.subscribeConsumerInstance(c))
+	body, err := q.consumeMessages(c)
+	assert.NoError(t, err)
+	body.Close()
+	assert.NoError(t, q.commitOffsets(c))
+	assert.NoError(t, q.destroyConsumerInstanceSubscription(c))
+	assert.NoError(t, q.destroyConsumerInstance(c))
+
+	assert.Equal(t, []string{
+		"POST /kafka-rest/consumers/group1",
+		"POST /kafka-rest/consumers/group1/instances/inst-1/subscription",
+		"GET /kafka-rest/consumers/group1/instances/inst-1/records",
+		"POST /kafka-rest/consumers/group1/instances/inst-1/offsets",
+		"DELETE /kafka-rest/consumers/group1/instances/inst-1/subscription",
+		"DELETE /kafka-rest/consumers/group1/instances/inst-1",
+	}, paths)
+}
+
+func TestNormalizeBasePath(t *testing.T) {
+	assert.Equal(t, "", normalizeBasePath(""))
+	assert.Equal(t, "", normalizeBasePath("/"))
+	assert.Equal(t, "/kafka-proxy", normalizeBasePath("kafka-proxy/"))
+	assert.Equal(t, "/gw/kafka-proxy", normalizeBasePath("/gw/kafka-proxy/"))
+}
+
+func TestKeepAlive(t *testing.T) {
+	caller := &recordingHTTPCaller{}
+	q := &kafkaRESTClient{
+		addrs:  []string{"http://kafka-proxy-1.prod.ft.com"},
+		caller: caller,
+	}
+
+	assert.NoError(t, q.keepAlive(testConsumer))
+	assert.Equal(t, []recordedRequest{
+		{method: "GET", addr: "http://kafka-proxy-1.prod.ft.com/consumers/group1/instances/rest-consumer-1-45864/assignments", headers: map[string]string{"Accept": "application/vnd.kafka.v2+json"}},
+	}, caller.reqs)
+
+	q.apiVersion = apiVersionV1
+	assert.NoError(t, q.keepAlive(testConsumer))
+	assert.Len(t, caller.reqs, 1, "no keep-alive request should be made with the v1 API")
+}
+
+func TestAssignPartitionsNotSupportedByV1(t *testing.T) {
+	caller := &recordingHTTPCaller{}
+	q := &kafkaRESTClient{
+		addrs:      []string{"http://kafka-proxy-1.prod.ft.com"},
+		apiVersion: apiVersionV1,
+		caller:     caller,
+	}
+
+	err := q.assignPartitions(testConsumer, []int{0})
+	assert.Equal(t, errAssignNotSupported, err)
+	assert.Empty(t, caller.reqs)
+}
+
+func TestSeekOffsetsNotSupportedByV1(t *testing.T) {
+	caller := &recordingHTTPCaller{}
+	q := &kafkaRESTClient{
+		addrs:      []string{"http://kafka-proxy-1.prod.ft.com"},
+		apiVersion: apiVersionV1,
+		caller:     caller,
+	}
+
+	err := q.seekOffsets(testConsumer, map[int]int64{0: 1})
+	assert.Equal(t, errSeekNotSupported, err)
+	assert.Empty(t, caller.reqs)
+}
+
+func TestNewKafkaRESTClientDefaultsAPIVersion(t *testing.T) {
+	assert.Equal(t, apiVersionV2, newKafkaRESTClient(QueueConfig{}, nil).apiVersion)
+	assert.Equal(t, apiVersionV2, newKafkaRESTClient(QueueConfig{APIVersion: "v3"}, nil).apiVersion)
+	assert.Equal(t, apiVersionV1, newKafkaRESTClient(QueueConfig{APIVersion: "v1"}, nil).apiVersion)
+}
+
+func TestCommitOffsetsRetriesWithBackoff(t *testing.T) {
+	caller := &failingCommitHTTPCaller{commitFailures: 2}
+	clk := &fakeClock{}
+	q := &kafkaRESTClient{
+		addrs:               []string{"http://kafka-proxy-1.prod.ft.com"},
+		caller:              caller,
+		commitRetries:       3,
+		commitRetryInterval: 10 * time.Millisecond,
+		clock:               clk,
+	}
+
+	err := q.commitOffsets(testConsumer)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, caller.commits)
+	assert.Equal(t, []time.Duration{10 * time.Millisecond, 20 * time.Millisecond}, clk.waits(), "the retry interval should be doubled after each failed attempt")
+}
+
+func TestCommitOffsetsWithoutRetries(t *testing.T) {
+	caller := &failingCommitHTTPCaller{commitFailures: 1}
+	q := &kafkaRESTClient{
+		addrs:  []string{"http://kafka-proxy-1.prod.ft.com"},
+		caller: caller,
+	}
+
+	err := q.commitOffsets(testConsumer)
+	assert.Error(t, err)
+	assert.Equal(t, 1, caller.commits)
+}
+
 var testConsumer = consumerInstanceURI{
 	BaseURI: "http://kafka/consumers/group1/instances/rest-consumer-1-45864",
 }
@@ -115,9 +701,176 @@ func (t testHTTPCaller) DoReq(method, addr string, body io.Reader, headers map[s
 	return []byte("{}"), err
 }
 
+type recordedRequest struct {
+	method  string
+	addr    string
+	body    string
+	headers map[string]string
+}
+
+// records every request and replies with an empty JSON object
+type recordingHTTPCaller struct {
+	reqs []recordedRequest
+}
+
+func (t testHTTPCaller) DoStreamReq(method, addr string, body io.Reader, headers map[string]string, expectedStatus int) (io.ReadCloser, error) {
+	data, err := t.DoReq(method, addr, body, headers, expectedStatus)
+	return ioutil.NopCloser(bytes.NewReader(data)), err
+}
+
+func (t *recordingHTTPCaller) DoStreamReq(method, addr string, body io.Reader, headers map[string]string, expectedStatus int) (io.ReadCloser, error) {
+	data, err := t.DoReq(method, addr, body, headers, expectedStatus)
+	return ioutil.NopCloser(bytes.NewReader(data)), err
+}
+
+func (t *recordingHTTPCaller) DoReq(method, addr string, body io.Reader, headers map[string]string, expectedStatus int) ([]byte, error) {
+	req := recordedRequest{method: method, addr: addr, headers: headers}
+	if body != nil {
+		b, err := ioutil.ReadAll(body)
+		if err != nil {
+			return nil, err
+		}
+		req.body = string(b)
+	}
+	t.reqs = append(t.reqs, req)
+	return []byte("{}"), nil
+}
+
+// fails the requests to the unreachable addresses as if there was no proxy listening
+type unreachableHTTPCaller struct {
+	unreachable map[string]bool
+	addrs       []string
+}
+
+func (t *unreachableHTTPCaller) DoReq(method, addr string, body io.Reader, headers map[string]string, expectedStatus int) ([]byte, error) {
+	t.addrs = append(t.addrs, addr)
+	u, _ := url.Parse(addr)
+	if t.unreachable[u.Scheme+"://"+u.Host] {
+		return nil, fmt.Errorf("error executing request: %w", errors.New("connection refused"))
+	}
+	return testHTTPCaller{}.DoReq(method, addr, body, headers, expectedStatus)
+}
+
+func (t *unreachableHTTPCaller) DoStreamReq(method, addr string, body io.Reader, headers map[string]string, expectedStatus int) (io.ReadCloser, error) {
+	data, err := t.DoReq(method, addr, body, headers, expectedStatus)
+	return ioutil.NopCloser(bytes.NewReader(data)), err
+}
+
+// fails every consumer instance creation with the given status
+type failingCreateHTTPCaller struct {
+	status  int
+	creates int
+}
+
+func (t *failingCreateHTTPCaller) DoReq(method, addr string, body io.Reader, headers map[string]string, expectedStatus int) ([]byte, error) {
+	t.creates++
+	return nil, &ProxyError{StatusCode: t.status, expected: expectedStatus}
+}
+
+func (t *failingCreateHTTPCaller) DoStreamReq(method, addr string, body io.Reader, headers map[string]string, expectedStatus int) (io.ReadCloser, error) {
+	data, err := t.DoReq(method, addr, body, headers, expectedStatus)
+	return ioutil.NopCloser(bytes.NewReader(data)), err
+}
+
+func TestDestroyRetriesFailedDelete(t *testing.T) {
+	caller := &failingDestroyHTTPCaller{failures: 1, status: http.StatusServiceUnavailable}
+	q := &kafkaRESTClient{
+		addrs:                []string{"http://kafka-proxy-1.prod.ft.com"},
+		caller:               caller,
+		destroyRetries:       2,
+		destroyRetryInterval: time.Millisecond,
+	}
+
+	assert.NoError(t, q.destroyConsumerInstanceSubscription(testConsumer))
+	assert.Equal(t, 2, caller.deletes)
+
+	caller.deletes, caller.failures = 0, 1
+	assert.NoError(t, q.destroyConsumerInstance(testConsumer))
+	assert.Equal(t, 2, caller.deletes)
+}
+
+func TestDestroyFailsAfterRetriesAreExhausted(t *testing.T) {
+	caller := &failingDestroyHTTPCaller{failures: 5, status: http.StatusServiceUnavailable}
+	q := &kafkaRESTClient{
+		addrs:                []string{"http://kafka-proxy-1.prod.ft.com"},
+		caller:               caller,
+		destroyRetries:       2,
+		destroyRetryInterval: time.Millisecond,
+	}
+
+	assert.Error(t, q.destroyConsumerInstance(testConsumer))
+	assert.Equal(t, 3, caller.deletes)
+}
+
+func TestDestroyTreatsNotFoundAsSuccess(t *testing.T) {
+	caller := &failingDestroyHTTPCaller{failures: 5, status: http.StatusNotFound}
+	q := &kafkaRESTClient{
+		addrs:                []string{"http://kafka-proxy-1.prod.ft.com"},
+		caller:               caller,
+		destroyRetries:       2,
+		destroyRetryInterval: time.Millisecond,
+	}
+
+	assert.NoError(t, q.destroyConsumerInstanceSubscription(testConsumer))
+	assert.NoError(t, q.destroyConsumerInstance(testConsumer))
+	assert.Equal(t, 2, caller.deletes, "a 404 should not be retried")
+}
+
+func TestCommitPartitionOffsets(t *testing.T) {
+	caller := &recordingHTTPCaller{}
+	q := &kafkaRESTClient{
+		addrs:  []string{"http://kafka-proxy-1.prod.ft.com"},
+		topic:  "methode-articles",
+		caller: caller,
+	}
+
+	assert.NoError(t, q.commitPartitionOffsets(testConsumer, map[int]int64{1: 21, 0: 10}))
+	assert.Len(t, caller.reqs, 1)
+	assert.Equal(t, "POST", caller.reqs[0].method)
+	assert.Equal(t, "http://kafka-proxy-1.prod.ft.com/consumers/group1/instances/rest-consumer-1-45864/offsets", caller.reqs[0].addr)
+	assert.JSONEq(t, `{"offsets": [
+		{"topic": "methode-articles", "partition": 0, "offset": 10},
+		{"topic": "methode-articles", "partition": 1, "offset": 21}
+	]}`, caller.reqs[0].body)
+}
+
+func TestCommitPartitionOffsetsNotSupportedByV1(t *testing.T) {
+	caller := &recordingHTTPCaller{}
+	q := &kafkaRESTClient{addrs: []string{"http://kafka-proxy-1.prod.ft.com"}, apiVersion: apiVersionV1, caller: caller}
+
+	assert.Equal(t, errPartitionCommitNotSupported, q.commitPartitionOffsets(testConsumer, map[int]int64{0: 1}))
+	assert.Empty(t, caller.reqs)
+}
+
 func TestNoQueueAddressesFails(t *testing.T) {
 	q := kafkaRESTClient{}
 	err := q.checkConnectivity()
 
 	assert.EqualError(t, err, ErrNoQueueAddresses.Error())
 }
+
+// fails the first deletes with the given status, with a proxy error object for 404s
+type failingDestroyHTTPCaller struct {
+	failures int
+	status   int
+	deletes  int
+}
+
+func (t *failingDestroyHTTPCaller) DoReq(method, addr string, body io.Reader, headers map[string]string, expectedStatus int) ([]byte, error) {
+	if method != "DELETE" {
+		return []byte("{}"), nil
+	}
+	t.deletes++
+	if t.deletes > t.failures {
+		return nil, nil
+	}
+	if t.status == http.StatusNotFound {
+		return nil, &ProxyError{StatusCode: t.status, ErrorCode: 40403, Message: "Consumer instance not found."}
+	}
+	return nil, &ProxyError{StatusCode: t.status, expected: expectedStatus}
+}
+
+func (t *failingDestroyHTTPCaller) DoStreamReq(method, addr string, body io.Reader, headers map[string]string, expectedStatus int) (io.ReadCloser, error) {
+	data, err := t.DoReq(method, addr, body, headers, expectedStatus)
+	return ioutil.NopCloser(bytes.NewReader(data)), err
+}
@@ -0,0 +1,41 @@
+package consumer
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// rateLimiter is a token bucket holding a single token, refilled at the rate of QueueConfig.MaxMessagesPerSecond.
+// It is shared by the goroutines dispatching the messages of a stream.
+type rateLimiter struct {
+	sync.Mutex
+	interval time.Duration
+	clock    clock
+	//when the tokens taken so far will have been refilled
+	next time.Time
+}
+
+func newRateLimiter(messagesPerSecond int, c clock) *rateLimiter {
+	return &rateLimiter{interval: time.Second / time.Duration(messagesPerSecond), clock: clockOrDefault(c)}
+}
+
+// wait takes n tokens, blocking until they are available or ctx is done
+func (l *rateLimiter) wait(ctx context.Context, n int) {
+	l.Lock()
+	now := l.clock.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	delay := l.next.Sub(now)
+	l.next = l.next.Add(time.Duration(n) * l.interval)
+	l.Unlock()
+
+	if delay <= 0 {
+		return
+	}
+	select {
+	case <-ctx.Done():
+	case <-l.clock.After(delay):
+	}
+}
@@ -0,0 +1,34 @@
+package consumer
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// RunUntilSignal starts the consumer and blocks until one of the given signals is received,
+// then stops the consumer and returns once it has shut down.
+// It also returns when Start does by itself, e.g. with VerifyTopicExists for a missing topic.
+// If no signals are given it waits for SIGINT or SIGTERM.
+func RunUntilSignal(c MessageConsumer, signals ...os.Signal) {
+	if len(signals) == 0 {
+		signals = []os.Signal{syscall.SIGINT, syscall.SIGTERM}
+	}
+
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, signals...)
+	defer signal.Stop(ch)
+
+	returned := make(chan struct{})
+	go func() {
+		defer close(returned)
+		c.Start()
+	}()
+
+	select {
+	case <-ch:
+		c.Stop()
+		<-returned
+	case <-returned:
+	}
+}